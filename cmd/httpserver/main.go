@@ -1,7 +1,281 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/account"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"github.com/huangjiahua/tempdesk/internal/certs"
+	"github.com/huangjiahua/tempdesk/internal/config"
+	"github.com/huangjiahua/tempdesk/internal/event"
+	"github.com/huangjiahua/tempdesk/internal/files"
+	"github.com/huangjiahua/tempdesk/internal/groups"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/http/handler"
+	"github.com/huangjiahua/tempdesk/internal/instrument"
+	"github.com/huangjiahua/tempdesk/internal/mail"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/internal/ratelimit"
+	"github.com/huangjiahua/tempdesk/internal/session"
+	"github.com/huangjiahua/tempdesk/internal/share"
+	"github.com/huangjiahua/tempdesk/internal/signup"
+	"github.com/huangjiahua/tempdesk/internal/totp"
+	"github.com/huangjiahua/tempdesk/internal/users"
+	"github.com/huangjiahua/tempdesk/internal/webhook"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
 
 func main() {
-	fmt.Println("Hello, TempDesk")
+	loader := &config.Loader{Args: os.Args[1:], Getenv: os.Getenv, Output: os.Stderr}
+	cfg, err := loader.Load()
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if err := tlog.Setup(cfg.LogConfig()); err != nil {
+		tlog.Fatal("error setting up logging", tlog.Err(err))
+	}
+
+	var store storage.PutterGetter = mock.NewStorage()
+	var userService td.UserService = mock.NewUserService()
+	if cfg.Storage.Backend == config.BackendDir {
+		dir, err := storage.NewDir(cfg.Storage.Dir)
+		if err != nil {
+			tlog.Fatal("error opening data directory", tlog.Err(err))
+		}
+		store = dir
+		if userService, err = users.NewService(dir); err != nil {
+			tlog.Fatal("error loading users", tlog.Err(err))
+		}
+	}
+
+	var tlsConfig *tls.Config
+	var plain http.Handler
+	var reloadCerts func()
+	if cfg.TLSEnabled() {
+		if tlsConfig, plain, reloadCerts, err = setupTLS(context.Background(), cfg, store); err != nil {
+			tlog.Fatal("error setting up tls", tlog.Err(err))
+		}
+	}
+
+	groupService, err := groups.NewService(store)
+	if err != nil {
+		tlog.Fatal("error loading groups", tlog.Err(err))
+	}
+	memFiles := mock.NewFileService()
+	var fileService td.FileService = memFiles
+	if cfg.Storage.Backend == config.BackendDir {
+		stored, err := files.NewService(store)
+		if err != nil {
+			tlog.Fatal("error loading files", tlog.Err(err))
+		}
+		memFiles, fileService = stored.FileService, stored
+	}
+	memFiles.SetGroups(groupService)
+
+	auditLog, err := audit.NewLog(store)
+	if err != nil {
+		tlog.Fatal("error loading audit log", tlog.Err(err))
+	}
+
+	totps, err := totp.NewService(store)
+	if err != nil {
+		tlog.Fatal("error loading totp enrollments", tlog.Err(err))
+	}
+	totps.Issuer = cfg.Auth.TOTPIssuer
+	guard := totp.NewGuard(totps, cfg.Auth.TOTPSkip)
+	sessions := session.NewStore(cfg.Auth.SessionTTL)
+
+	auther := auth.NewHMACAuther()
+	auther.SetMaxSkew(cfg.Auth.ClockSkew)
+	userAuther := auth.Chain{guard.Auther(auther, totp.ScopeHMAC), sessions.Auther()}
+	if cfg.Auth.ClientCAFile != "" {
+		certAuther, reloadCRL, err := setupCertAuth(cfg)
+		if err != nil {
+			tlog.Fatal("error setting up client certificates", tlog.Err(err))
+		}
+		tlsConfig.ClientCAs = certAuther.Pool()
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		userAuther = auth.Chain{guard.Auther(auther, totp.ScopeHMAC), guard.Auther(certAuther, totp.ScopeCert), sessions.Auther()}
+		if reloadCRL != nil {
+			reloadCerts = chain(reloadCerts, reloadCRL)
+		}
+	}
+
+	limiter := ratelimit.New(ratelimit.NewMemoryStore(), cfg.RateLimitPolicy())
+
+	bus := event.NewBus()
+	state := &thttp.State{
+		Users:    event.NewUserService(userService, bus),
+		Groups:   groupService,
+		Files:    event.NewFileService(fileService, bus),
+		Auther:   limiter.Auther(userAuther),
+		Login:    limiter.Auther(guard.Auther(auth.NewPasswordAuther(), totp.ScopePassword)),
+		Events:   bus,
+		Store:    store,
+		Audit:    auditLog,
+		TOTP:     totps,
+		Sessions: sessions,
+	}
+	m := instrument.NewMetrics()
+	m.State(state)
+
+	hooks, err := webhook.NewService(store, state.Users)
+	if err != nil {
+		tlog.Fatal("error loading webhooks", tlog.Err(err))
+	}
+	state.Webhooks = hooks
+	if state.Shares, err = share.NewService(store); err != nil {
+		tlog.Fatal("error loading shares", tlog.Err(err))
+	}
+	if state.Signup, err = signup.NewService(store); err != nil {
+		tlog.Fatal("error loading invites", tlog.Err(err))
+	}
+	if err = state.Signup.SetMode(cfg.Signup.Mode); err != nil {
+		tlog.Fatal("error setting signup mode", tlog.Err(err))
+	}
+	state.Signup.SetPolicy(cfg.SignupPolicy())
+	if cfg.MailEnabled() {
+		if state.Account, err = setupAccount(cfg, store); err != nil {
+			tlog.Fatal("error setting up mail", tlog.Err(err))
+		}
+	}
+	go hooks.Run(context.Background(), bus, func(err error) {
+		tlog.Warn("error delivering webhooks", tlog.Err(err))
+	})
+
+	addr, tlsSettings := cfg.Server.Addr, cfg.TLS
+	var mu sync.Mutex
+	current := func() *config.Config {
+		mu.Lock()
+		defer mu.Unlock()
+		return cfg
+	}
+	go reload(loader, func(next *config.Config) {
+		if reloadCerts != nil {
+			reloadCerts()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		reloadable, static := cfg.Changed(next)
+		for _, key := range reloadable {
+			switch key {
+			case "log.level":
+				_ = tlog.SetLevel(next.Log.Level)
+			case "auth.clock_skew":
+				auther.SetMaxSkew(next.Auth.ClockSkew)
+			case "auth.session_ttl":
+				sessions.SetTTL(next.Auth.SessionTTL)
+			case "auth.totp_skip":
+				guard.SetSkip(next.Auth.TOTPSkip)
+			}
+			tlog.Info("config reloaded", tlog.String("key", key), tlog.String("value", next.Public()[key]))
+		}
+		limiter.SetPolicy(next.RateLimitPolicy())
+		if err := state.Signup.SetMode(next.Signup.Mode); err != nil {
+			tlog.Error("error setting signup mode", tlog.Err(err))
+		}
+		state.Signup.SetPolicy(next.SignupPolicy())
+		if state.Account != nil {
+			state.Account.SetResetTTL(next.Mail.ResetTTL)
+		}
+		for _, key := range static {
+			tlog.Warn("config change needs a restart", tlog.String("key", key))
+			// keep reporting what is in effect
+			_ = next.Set(key, cfg.Values()[key])
+		}
+		cfg = next
+	})
+
+	limit := limiter.Middleware
+	mux := http.NewServeMux()
+	mux.Handle("/user/", m.Route("user", limit(handler.NewUser(state))))
+	mux.Handle("/file/", m.Route("file", limit(handler.NewFile(state, "/file"))))
+	mux.Handle("/watch/", m.Route("watch", limit(handler.NewWatch(state, "/watch"))))
+	mux.Handle("/webhook/", m.Route("webhook", limit(handler.NewWebhook(state, "/webhook"))))
+	mux.Handle("/group/", m.Route("group", limit(handler.NewGroup(state, "/group"))))
+	mux.Handle("/perm/", m.Route("perm", limit(handler.NewPerm(state, "/perm"))))
+	mux.Handle("/archive/", m.Route("archive", limit(handler.NewArchive(state, "/archive"))))
+	mux.Handle("/share/", m.Route("share", limit(handler.NewShare(state, "/share"))))
+	mux.Handle("/account/", m.Route("account", limit(handler.NewAccount(state, "/account"))))
+	mux.Handle("/session/", m.Route("session", limit(handler.NewSession(state, "/session"))))
+	mux.Handle("/totp/", m.Route("totp", limit(handler.NewTOTP(state, "/totp"))))
+	mux.Handle("/admin/", m.Route("admin", limit(handler.NewAdmin(state, "/admin"))))
+	mux.Handle("/debug/", handler.NewDebug(state, "/debug", func() interface{} {
+		return current().Public()
+	}))
+	mux.Handle("/metrics", m.Registry)
+	health := handler.NewHealth(state)
+	mux.HandleFunc("/healthz", health.ServeLive)
+	mux.HandleFunc("/readyz", health.ServeReady)
+
+	if tlsConfig == nil {
+		tlog.Info("Hello, TempDesk", tlog.String("addr", addr))
+		if err := http.ListenAndServe(addr, tlog.AccessLog(mux)); err != nil {
+			tlog.Fatal("error serving http", tlog.Err(err))
+		}
+		return
+	}
+
+	if httpAddr := tlsSettings.HTTPAddr; httpAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(httpAddr, tlog.AccessLog(plain)); err != nil {
+				tlog.Fatal("error serving http", tlog.Err(err))
+			}
+		}()
+	}
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   tlog.AccessLog(certs.HSTS(tlsSettings.HSTS, mux)),
+		TLSConfig: tlsConfig,
+	}
+	tlog.Info("Hello, TempDesk", tlog.String("addr", addr), tlog.String("http_addr", tlsSettings.HTTPAddr))
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		tlog.Fatal("error serving https", tlog.Err(err))
+	}
+}
+
+// setupAccount sends the mails of users through the SMTP server of cfg.
+func setupAccount(cfg *config.Config, store storage.PutterGetter) (*account.Service, error) {
+	templates, err := mail.LoadTemplates(cfg.Mail.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+	transport := mail.NewSMTP(cfg.Mail.SMTPAddr, cfg.Mail.Username, cfg.Mail.Password)
+	s, err := account.NewService(store, transport, cfg.Mail.From, cfg.Mail.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	s.Templates = templates
+	s.SetResetTTL(cfg.Mail.ResetTTL)
+	return s, nil
+}
+
+// reload loads the config again on every SIGHUP and hands it to apply. A
+// config that does not load is logged and changes nothing.
+func reload(loader *config.Loader, apply func(*config.Config)) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		next, err := loader.Load()
+		if err != nil {
+			tlog.Error("error reloading config", tlog.Err(err))
+			continue
+		}
+		apply(next)
+	}
 }
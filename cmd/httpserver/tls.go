@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"github.com/huangjiahua/tempdesk/internal/certs"
+	"github.com/huangjiahua/tempdesk/internal/config"
+	"github.com/huangjiahua/tempdesk/pkg/acme"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// setupTLS sets up where the certificate of the server comes from. It
+// returns the TLS config, the handler of plain HTTP requests and a function
+// looking for a new certificate right away, for SIGHUP.
+func setupTLS(ctx context.Context, cfg *config.Config, store storage.PutterGetter) (*tls.Config, http.Handler, func(), error) {
+	plain := certs.Redirect(cfg.Server.Addr)
+
+	if cfg.TLS.CertFile != "" {
+		r, err := certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		logExpiry := func() {
+			tlog.Info("certificate loaded", tlog.String("file", cfg.TLS.CertFile), tlog.String("expires", r.Expiry().Format(time.RFC3339)))
+		}
+		logExpiry()
+		onError := func(err error) {
+			tlog.Error("error reloading certificate", tlog.Err(err))
+		}
+		go r.Watch(ctx, certs.DefaultInterval, logExpiry, onError)
+		return certs.Config(r.GetCertificate), plain, func() {
+			if reloaded, err := r.Reload(); err != nil {
+				onError(err)
+			} else if reloaded {
+				logExpiry()
+			}
+		}, nil
+	}
+
+	client := http.DefaultClient
+	if cfg.ACME.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.ACME.CAFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, nil, nil, errors.New("no certificate in " + cfg.ACME.CAFile)
+		}
+		client = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+	m := &acme.Manager{
+		DirectoryURL: cfg.ACME.Directory,
+		Email:        cfg.ACME.Email,
+		Domains:      cfg.ACME.Domains,
+		Store:        store,
+		HTTPClient:   client,
+	}
+	go m.Run(ctx, acme.DefaultCheckInterval, func(err error) {
+		tlog.Error("error obtaining certificate", tlog.String("directory", cfg.ACME.Directory), tlog.Err(err))
+	})
+	return certs.Config(m.GetCertificate), m.HTTPHandler(plain), nil, nil
+}
+
+// setupCertAuth sets up authentication by client certificates. It returns
+// the auther and a function loading the CRL file again, if there is one.
+func setupCertAuth(cfg *config.Config) (*auth.CertAuther, func(), error) {
+	b, err := ioutil.ReadFile(cfg.Auth.ClientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	a, err := auth.NewCertAuther(b, cfg.Auth.ClientCertMatch)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", cfg.Auth.ClientCAFile, err)
+	}
+	path := cfg.Auth.ClientCRLFile
+	if path == "" {
+		return a, nil, nil
+	}
+	if err = a.LoadCRLFile(path); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return a, func() {
+		if err := a.LoadCRLFile(path); err != nil {
+			tlog.Error("error reloading CRL", tlog.String("file", path), tlog.Err(err))
+			return
+		}
+		tlog.Info("CRL loaded", tlog.String("file", path))
+	}, nil
+}
+
+// chain returns a function calling the non-nil ones of fns in order.
+func chain(fns ...func()) func() {
+	return func() {
+		for _, fn := range fns {
+			if fn != nil {
+				fn()
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	"github.com/huangjiahua/tempdesk/internal/share"
+	"github.com/huangjiahua/tempdesk/internal/webhook"
+)
+
+// check verifies that everything the server keeps in the storage can be
+// read and is consistent, and reports each problem it finds.
+func (a *app) check(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	problems := 0
+	report := func(part string, err error) {
+		if err != nil {
+			problems++
+			fmt.Fprintf(a.stdout, "FAIL %-8s %v\n", part, err)
+			return
+		}
+		fmt.Fprintf(a.stdout, "ok   %s\n", part)
+	}
+
+	report("storage", td.CheckHealth(a.store))
+
+	list, err := a.users.Users()
+	if err == nil {
+		for _, msg := range checkUsers(list) {
+			problems++
+			fmt.Fprintf(a.stdout, "FAIL %-8s %s\n", "users", msg)
+		}
+	}
+	report("users", err)
+
+	log, err := audit.NewLog(a.store)
+	if err == nil {
+		err = log.Verify()
+	}
+	report("audit", err)
+
+	_, err = webhook.NewService(a.store, a.users)
+	report("webhooks", err)
+
+	_, err = share.NewService(a.store)
+	report("shares", err)
+
+	if problems > 0 {
+		fmt.Fprintf(a.stdout, "%d problems found\n", problems)
+		return errProblems
+	}
+	return nil
+}
+
+// checkUsers describes what is wrong with the users in list.
+func checkUsers(list []td.User) []string {
+	var msgs []string
+	ids := make(map[int]string)
+	for _, u := range list {
+		if u.Name == "" {
+			msgs = append(msgs, fmt.Sprintf("user %d has no name", u.ID))
+		}
+		if u.Key == "" {
+			msgs = append(msgs, u.Name+" has no key")
+		}
+		if other, ok := ids[u.ID]; ok {
+			msgs = append(msgs, fmt.Sprintf("%s has the id %d of %s", u.Name, u.ID, other))
+		}
+		ids[u.ID] = u.Name
+		if role := u.Meta[td.MetaRole]; role != "" && role != td.RoleAdmin && role != td.RoleUser {
+			msgs = append(msgs, u.Name+" has the unknown role "+role)
+		}
+		if q, ok := u.Meta[td.MetaQuota]; ok {
+			if _, valid := u.Quota(); !valid {
+				msgs = append(msgs, u.Name+" has the invalid quota "+q)
+			}
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// exportVersion is written into exports, so the format can change later.
+const exportVersion = 1
+
+type exportUser struct {
+	ID   int               `json:"id"`
+	Name string            `json:"name"`
+	Key  string            `json:"key"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+type export struct {
+	Version int          `json:"version"`
+	Users   []exportUser `json:"users"`
+}
+
+// export writes every user, keys included, as JSON.
+func (a *app) export(args []string) (err error) {
+	fs := a.flags("export")
+	out := fs.String("o", "", "write to FILE instead of stdout")
+	if err = fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	list, err := a.users.Users()
+	if err != nil {
+		return err
+	}
+	e := export{Version: exportVersion, Users: []exportUser{}}
+	for _, u := range list {
+		e.Users = append(e.Users, exportUser{ID: u.ID, Name: u.Name, Key: u.Key, Meta: u.Meta})
+	}
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if *out == "" {
+		_, err = a.stdout.Write(b)
+		return err
+	}
+	// the export holds keys, so only its owner may read it
+	return ioutil.WriteFile(*out, b, 0600)
+}
+
+// importUsers creates the users of an export and updates those that exist.
+// With -replace, users missing from the export are deleted.
+func (a *app) importUsers(args []string) error {
+	fs := a.flags("import")
+	replace := fs.Bool("replace", false, "delete users missing from FILE")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+
+	var r io.Reader = a.stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var e export
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return err
+	}
+	if e.Version != exportVersion {
+		return fmt.Errorf("unknown export version %d", e.Version)
+	}
+	list := make([]td.User, 0, len(e.Users))
+	for _, u := range e.Users {
+		list = append(list, td.User{ID: u.ID, Name: u.Name, Key: u.Key, Meta: u.Meta})
+	}
+	if msgs := checkUsers(list); len(msgs) > 0 {
+		return errors.New(msgs[0])
+	}
+
+	keep := make(map[string]bool, len(list))
+	created, updated, deleted := 0, 0, 0
+	for _, u := range list {
+		keep[u.Name] = true
+		if _, ok := a.users.User(u.Name); ok {
+			if err := a.users.UpdateUser(u); err != nil {
+				return err
+			}
+			updated++
+			continue
+		}
+		if err := a.users.CreateUser(u); err != nil {
+			return err
+		}
+		created++
+	}
+	if *replace {
+		current, err := a.users.Users()
+		if err != nil {
+			return err
+		}
+		for _, u := range current {
+			if keep[u.Name] {
+				continue
+			}
+			if err = a.users.DeleteUser(u); err != nil {
+				return err
+			}
+			deleted++
+		}
+	}
+	fmt.Fprintf(a.stdout, "created %d, updated %d, deleted %d users\n", created, updated, deleted)
+	return nil
+}
@@ -0,0 +1,140 @@
+// Command tempdesk-admin manages the users and the storage of a TempDesk
+// server directly, while the server is not running.
+//
+//	tempdesk-admin -data DIR add [-admin] [-quota SIZE] [-key KEY] NAME
+//	tempdesk-admin -data DIR list
+//	tempdesk-admin -data DIR update [-key KEY] [-meta KEY=VALUE]... NAME
+//	tempdesk-admin -data DIR disable|enable|delete NAME
+//	tempdesk-admin -data DIR approve NAME
+//	tempdesk-admin -data DIR invite [-uses N] [-ttl DURATION]
+//	tempdesk-admin -data DIR rotate NAME
+//	tempdesk-admin -data DIR reset-totp NAME
+//	tempdesk-admin -data DIR quota NAME SIZE|none
+//	tempdesk-admin -data DIR role NAME admin|user
+//	tempdesk-admin -data DIR check
+//	tempdesk-admin -data DIR export [-o FILE]
+//	tempdesk-admin -data DIR import [-replace] FILE
+//
+// SIZE is a number of bytes with an optional K, M, G or T suffix.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/huangjiahua/tempdesk/internal/users"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// errUsage is returned by a command that was called wrongly, its usage is
+// printed instead of the error.
+var errUsage = errors.New("usage")
+
+// errProblems is returned by check when it found problems, which it has
+// already reported.
+var errProblems = errors.New("problems found")
+
+type command struct {
+	usage string
+	run   func(a *app, args []string) error
+}
+
+var commands = map[string]command{
+	"add":        {"add [-admin] [-quota SIZE] [-key KEY] NAME", (*app).add},
+	"list":       {"list", (*app).list},
+	"update":     {"update [-key KEY] [-meta KEY=VALUE]... NAME", (*app).update},
+	"disable":    {"disable NAME", (*app).disable},
+	"enable":     {"enable NAME", (*app).enable},
+	"delete":     {"delete NAME", (*app).delete},
+	"approve":    {"approve NAME", (*app).approve},
+	"invite":     {"invite [-uses N] [-ttl DURATION]", (*app).invite},
+	"rotate":     {"rotate NAME", (*app).rotate},
+	"reset-totp": {"reset-totp NAME", (*app).resetTOTP},
+	"quota":      {"quota NAME SIZE|none", (*app).quota},
+	"role":       {"role NAME admin|user", (*app).role},
+	"check":      {"check", (*app).check},
+	"export":     {"export [-o FILE]", (*app).export},
+	"import":     {"import [-replace] FILE", (*app).importUsers},
+}
+
+type app struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	store *storage.Dir
+	users *users.Service
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	a := &app{stdin: stdin, stdout: stdout, stderr: stderr}
+
+	fs := flag.NewFlagSet("tempdesk-admin", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	data := fs.String("data", os.Getenv("TEMPDESK_DATA"), "data directory of the server")
+	fs.Usage = func() { a.usage() }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 || *data == "" {
+		a.usage()
+		return 2
+	}
+
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "tempdesk-admin: unknown command %q\n", name)
+		a.usage()
+		return 2
+	}
+
+	var err error
+	if a.store, err = storage.NewDir(*data); err == nil {
+		a.users, err = users.NewService(a.store)
+	}
+	if err == nil {
+		err = cmd.run(a, fs.Args()[1:])
+	}
+	switch {
+	case err == errUsage:
+		fmt.Fprintln(stderr, "usage: tempdesk-admin -data DIR "+cmd.usage)
+		return 2
+	case err == errProblems:
+		return 1
+	case err != nil:
+		fmt.Fprintln(stderr, "tempdesk-admin "+name+": "+err.Error())
+		return 1
+	}
+	return 0
+}
+
+func (a *app) usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString("usage: tempdesk-admin -data DIR COMMAND [ARGS]\n\ncommands:\n")
+	for _, name := range names {
+		sb.WriteString("  tempdesk-admin " + commands[name].usage + "\n")
+	}
+	fmt.Fprint(a.stderr, sb.String())
+}
+
+// flags returns a flag set for a command that reports errors on stderr.
+func (a *app) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.Usage = func() {}
+	return fs
+}
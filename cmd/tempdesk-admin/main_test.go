@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	"github.com/huangjiahua/tempdesk/internal/testutil"
+	"github.com/huangjiahua/tempdesk/internal/totp"
+	"github.com/huangjiahua/tempdesk/internal/users"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type cli struct {
+	t    *testing.T
+	data string
+}
+
+func (c cli) run(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"-data", c.data}, args...), strings.NewReader(""), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func (c cli) ok(args ...string) string {
+	code, stdout, stderr := c.run(args...)
+	if code != 0 {
+		c.t.Fatalf("tempdesk-admin %v: exit %d: %s%s", args, code, stdout, stderr)
+	}
+	return stdout
+}
+
+// user reads the user name straight from the data directory.
+func (c cli) user(name string) td.User {
+	store, _ := storage.NewDir(c.data)
+	us, err := users.NewService(store)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	u, _ := us.User(name)
+	return u
+}
+
+func TestUsers(t *testing.T) {
+	dir := testutil.TempDir(t)
+	c := cli{t: t, data: filepath.Join(dir, "data")}
+
+	out := c.ok("add", "-admin", "root")
+	assert.Contains(t, out, "key: ")
+	key := strings.TrimSpace(out[strings.Index(out, "key: ")+5:])
+	assert.Equal(t, key, c.user("root").Key)
+	assert.True(t, c.user("root").IsAdmin())
+
+	c.ok("add", "-quota", "2M", "-key", "secret", "sam")
+	q, ok := c.user("sam").Quota()
+	assert.True(t, ok)
+	assert.Equal(t, int64(2<<20), q)
+
+	code, _, stderr := c.run("add", "sam")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, td.NameAlreadyExists)
+
+	c.ok("disable", "sam")
+	assert.True(t, c.user("sam").IsDisabled())
+	assert.Contains(t, c.ok("list"), "disabled")
+	c.ok("enable", "sam")
+	assert.False(t, c.user("sam").IsDisabled())
+
+	out = c.ok("rotate", "sam")
+	assert.NotEqual(t, "secret", c.user("sam").Key)
+	assert.Contains(t, out, c.user("sam").Key)
+
+	c.ok("quota", "sam", "none")
+	_, ok = c.user("sam").Quota()
+	assert.False(t, ok)
+	c.ok("role", "sam", "admin")
+	assert.True(t, c.user("sam").IsAdmin())
+	c.ok("update", "-meta", "team=ops", "-meta", "role=", "sam")
+	assert.Equal(t, map[string]string{"team": "ops"}, c.user("sam").Meta)
+
+	code, _, stderr = c.run("role", "sam", "god")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "usage:")
+
+	// export, wipe and import again
+	export := filepath.Join(dir, "users.json")
+	c.ok("export", "-o", export)
+	info, _ := os.Stat(export)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	c.ok("delete", "sam")
+	c.ok("add", "tom")
+	assert.Equal(t, "created 1, updated 1, deleted 1 users\n", c.ok("import", "-replace", export))
+	assert.Equal(t, "ops", c.user("sam").Meta["team"])
+	assert.Equal(t, "", c.user("tom").Name)
+}
+
+func TestSignup(t *testing.T) {
+	dir := testutil.TempDir(t)
+	c := cli{t: t, data: filepath.Join(dir, "data")}
+
+	c.ok("add", "-key", "secret", "sam")
+	c.ok("update", "-meta", "pending=true", "sam")
+	assert.Contains(t, c.ok("list"), "pending")
+	c.ok("approve", "sam")
+	assert.False(t, c.user("sam").IsPending())
+	code, _, stderr := c.run("approve", "sam")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "sam is not pending")
+
+	out := c.ok("invite", "-uses", "3", "-ttl", "24h")
+	assert.Regexp(t, `^invite: [a-z0-9]{16}\nexpires: `, out)
+	code, _, _ = c.run("invite", "-ttl", "-1h")
+	assert.Equal(t, 1, code)
+}
+
+func TestResetTOTP(t *testing.T) {
+	c := cli{t: t, data: testutil.TempDir(t)}
+	c.ok("add", "sam")
+	store, _ := storage.NewDir(c.data)
+	s, _ := totp.NewService(store)
+	secret, _, _ := s.Enroll("sam")
+	otp, _ := totp.Code(secret, time.Now())
+	_, err := s.Confirm("sam", otp)
+	assert.Nil(t, err)
+
+	c.ok("reset-totp", "sam")
+	s, _ = totp.NewService(store)
+	assert.False(t, s.Enabled("sam"))
+	code, _, stderr := c.run("reset-totp", "sam")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, totp.NotEnrolled)
+	code, _, _ = c.run("reset-totp", "tom")
+	assert.Equal(t, 1, code)
+}
+
+func TestCheck(t *testing.T) {
+	c := cli{t: t, data: testutil.TempDir(t)}
+	c.ok("add", "root")
+	store, _ := storage.NewDir(c.data)
+	log, _ := audit.NewLog(store)
+	_, _ = log.Append(audit.Record{Actor: "root", Action: audit.ActionUserCreate})
+	_, _ = log.Append(audit.Record{Actor: "root", Action: audit.ActionUserDelete})
+
+	out := c.ok("check")
+	assert.Contains(t, out, "ok   audit")
+	assert.Contains(t, out, "ok   users")
+
+	// tamper with the first audit record
+	records, _ := filepath.Glob(filepath.Join(c.data, "audit", "record", "*"))
+	if assert.Len(t, records, 2) {
+		b, _ := ioutil.ReadFile(records[0])
+		assert.Nil(t, ioutil.WriteFile(records[0], bytes.Replace(b, []byte("root"), []byte("toor"), 1), 0600))
+	}
+	code, out, _ := c.run("check")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, out, "FAIL audit")
+	assert.Contains(t, out, "1 problems found")
+}
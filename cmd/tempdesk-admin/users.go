@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/signup"
+	"github.com/huangjiahua/tempdesk/internal/totp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metaFlags collects repeated -meta KEY=VALUE flags.
+type metaFlags map[string]string
+
+func (m metaFlags) String() string {
+	return fmt.Sprint(map[string]string(m))
+}
+
+func (m metaFlags) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return errors.New("expected KEY=VALUE")
+	}
+	m[s[:i]] = s[i+1:]
+	return nil
+}
+
+// newKey returns a random key for a user.
+func newKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// parseSize reads a number of bytes with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]&^0x20); i >= 0 {
+			mult = int64(1) << (10 * uint(i+1))
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size " + s)
+	}
+	return n * mult, nil
+}
+
+func (a *app) add(args []string) error {
+	fs := a.flags("add")
+	admin := fs.Bool("admin", false, "make the user an admin")
+	quota := fs.String("quota", "", "bytes the user may store")
+	key := fs.String("key", "", "key of the user, generated if empty")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+
+	user := td.User{Name: fs.Arg(0), Key: *key, Meta: map[string]string{td.MetaRole: td.RoleUser}}
+	if *admin {
+		user.Meta[td.MetaRole] = td.RoleAdmin
+	}
+	if *quota != "" {
+		q, err := parseSize(*quota)
+		if err != nil {
+			return err
+		}
+		user.Meta[td.MetaQuota] = strconv.FormatInt(q, 10)
+	}
+	generated := user.Key == ""
+	if generated {
+		var err error
+		if user.Key, err = newKey(); err != nil {
+			return err
+		}
+	}
+	if err := a.users.CreateUser(user); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "created %s\n", user.Name)
+	if generated {
+		fmt.Fprintf(a.stdout, "key: %s\n", user.Key)
+	}
+	return nil
+}
+
+func (a *app) list(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	list, err := a.users.Users()
+	if err != nil {
+		return err
+	}
+	for _, u := range list {
+		role := u.Meta[td.MetaRole]
+		if role == "" {
+			role = td.RoleUser
+		}
+		quota := "-"
+		if q, ok := u.Quota(); ok {
+			quota = strconv.FormatInt(q, 10)
+		}
+		status := "active"
+		if u.IsDisabled() {
+			status = "disabled"
+		} else if u.IsPending() {
+			status = "pending"
+		}
+		fmt.Fprintf(a.stdout, "%-4d %-20s %-6s %-9s %s\n", u.ID, u.Name, role, status, quota)
+	}
+	return nil
+}
+
+// change applies fn to the user name and saves the result.
+func (a *app) change(name string, fn func(u *td.User) error) error {
+	u, ok := a.users.User(name)
+	if !ok {
+		return &td.UserServiceError{Kind: td.NameNotExists}
+	}
+	if u.Meta == nil {
+		u.Meta = make(map[string]string)
+	}
+	if err := fn(&u); err != nil {
+		return err
+	}
+	return a.users.UpdateUser(u)
+}
+
+func (a *app) update(args []string) error {
+	fs := a.flags("update")
+	key := fs.String("key", "", "new key of the user")
+	meta := metaFlags{}
+	fs.Var(meta, "meta", "set a meta value, an empty value removes it")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	return a.change(fs.Arg(0), func(u *td.User) error {
+		if *key != "" {
+			u.Key = *key
+		}
+		for k, v := range meta {
+			if v == "" {
+				delete(u.Meta, k)
+			} else {
+				u.Meta[k] = v
+			}
+		}
+		return nil
+	})
+}
+
+// oneName parses the arguments of commands taking nothing but a user name.
+func oneName(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return "", errUsage
+	}
+	return fs.Arg(0), nil
+}
+
+func (a *app) disable(args []string) error {
+	name, err := oneName(a.flags("disable"), args)
+	if err != nil {
+		return err
+	}
+	return a.change(name, func(u *td.User) error {
+		u.Meta[td.MetaDisabled] = "true"
+		return nil
+	})
+}
+
+func (a *app) enable(args []string) error {
+	name, err := oneName(a.flags("enable"), args)
+	if err != nil {
+		return err
+	}
+	return a.change(name, func(u *td.User) error {
+		delete(u.Meta, td.MetaDisabled)
+		return nil
+	})
+}
+
+// approve lets a user who signed up in the approval mode log in.
+func (a *app) approve(args []string) error {
+	name, err := oneName(a.flags("approve"), args)
+	if err != nil {
+		return err
+	}
+	return a.change(name, func(u *td.User) error {
+		if !u.IsPending() {
+			return fmt.Errorf("%s is not pending", name)
+		}
+		delete(u.Meta, td.MetaPending)
+		return nil
+	})
+}
+
+// invite creates an invite code for the invite mode.
+func (a *app) invite(args []string) error {
+	fs := a.flags("invite")
+	uses := fs.Int("uses", 1, "how many users may sign up with the code, 0 for any number")
+	ttl := fs.Duration("ttl", signup.DefaultInviteTTL, "how long the code may be used")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	s, err := signup.NewService(a.store)
+	if err != nil {
+		return err
+	}
+	invite, err := s.CreateInvite("tempdesk-admin", *uses, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "invite: %s\nexpires: %s\n", invite.Code, invite.Expires.Format(time.RFC3339))
+	return nil
+}
+
+func (a *app) delete(args []string) error {
+	name, err := oneName(a.flags("delete"), args)
+	if err != nil {
+		return err
+	}
+	if err = a.users.DeleteUser(td.User{Name: name}); err != nil {
+		return err
+	}
+	s, err := totp.NewService(a.store)
+	if err != nil {
+		return err
+	}
+	if err = s.Disable(name); err != nil && !totp.IsKind(err, totp.NotEnrolled) {
+		return err
+	}
+	return nil
+}
+
+// resetTOTP removes the second factor of a user who lost it, who logs in
+// with the key alone until enrolling again.
+func (a *app) resetTOTP(args []string) error {
+	name, err := oneName(a.flags("reset-totp"), args)
+	if err != nil {
+		return err
+	}
+	if _, ok := a.users.User(name); !ok {
+		return &td.UserServiceError{Kind: td.NameNotExists}
+	}
+	s, err := totp.NewService(a.store)
+	if err != nil {
+		return err
+	}
+	return s.Disable(name)
+}
+
+func (a *app) rotate(args []string) error {
+	name, err := oneName(a.flags("rotate"), args)
+	if err != nil {
+		return err
+	}
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	if err = a.change(name, func(u *td.User) error {
+		u.Key = key
+		return nil
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "key: %s\n", key)
+	return nil
+}
+
+func (a *app) quota(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return a.change(args[0], func(u *td.User) error {
+		if args[1] == "none" {
+			delete(u.Meta, td.MetaQuota)
+			return nil
+		}
+		q, err := parseSize(args[1])
+		if err != nil {
+			return err
+		}
+		u.Meta[td.MetaQuota] = strconv.FormatInt(q, 10)
+		return nil
+	})
+}
+
+func (a *app) role(args []string) error {
+	if len(args) != 2 || (args[1] != td.RoleAdmin && args[1] != td.RoleUser) {
+		return errUsage
+	}
+	return a.change(args[0], func(u *td.User) error {
+		u.Meta[td.MetaRole] = args[1]
+		return nil
+	})
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/huangjiahua/tempdesk/pkg/client"
+	"github.com/huangjiahua/tempdesk/pkg/syncdir"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func (a *app) login(args []string) error {
+	cfg, err := a.loadConfig()
+	if err != nil && err != errNotLoggedIn {
+		return err
+	}
+	fs := a.flags("login")
+	fs.StringVar(&cfg.Server, "server", cfg.Server, "address of the server, like http://localhost:8080")
+	fs.StringVar(&cfg.Name, "name", cfg.Name, "user name")
+	key := fs.String("key", "", "key of the user")
+	if err = fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	in := bufio.NewReader(a.stdin)
+	for _, v := range []struct {
+		prompt string
+		value  *string
+	}{{"server", &cfg.Server}, {"name", &cfg.Name}, {"key", key}} {
+		if *v.value != "" {
+			continue
+		}
+		fmt.Fprintf(a.stderr, "%s: ", v.prompt)
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			return errors.New("no " + v.prompt + " given")
+		}
+		*v.value = strings.TrimSpace(line)
+	}
+	cfg.Key = *key
+
+	name, err := client.New(cfg.Server, cfg.Name, cfg.Key).WhoAmI(a.ctx)
+	if err != nil {
+		return err
+	}
+	if err = a.saveConfig(cfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "logged in to %s as %s\n", cfg.Server, name)
+	return nil
+}
+
+// reset mails the user a reset token, or with -token sets a new key.
+func (a *app) reset(args []string) error {
+	cfg, err := a.loadConfig()
+	if err != nil && err != errNotLoggedIn {
+		return err
+	}
+	fs := a.flags("reset")
+	fs.StringVar(&cfg.Server, "server", cfg.Server, "address of the server, like http://localhost:8080")
+	fs.StringVar(&cfg.Name, "name", cfg.Name, "user name to mail a reset token")
+	token := fs.String("token", "", "reset token from the mail")
+	key := fs.String("key", "", "new key of the user")
+	if err = fs.Parse(args); err != nil || fs.NArg() != 0 || cfg.Server == "" {
+		return errUsage
+	}
+	c := client.New(cfg.Server, "", "")
+
+	if *token == "" {
+		if cfg.Name == "" {
+			return errUsage
+		}
+		if err = c.RequestReset(a.ctx, cfg.Name); err != nil {
+			return err
+		}
+		fmt.Fprintf(a.stdout, "if %s has a verified email address, a reset token is on its way\n", cfg.Name)
+		return nil
+	}
+	if *key == "" {
+		fmt.Fprint(a.stderr, "new key: ")
+		line, err := bufio.NewReader(a.stdin).ReadString('\n')
+		if *key = strings.TrimSpace(line); err != nil && *key == "" {
+			return errors.New("no key given")
+		}
+	}
+	if err = c.ResetKey(a.ctx, *token, *key); err != nil {
+		return err
+	}
+	fmt.Fprintln(a.stdout, "key reset, run tempdesk login with the new key")
+	return nil
+}
+
+func (a *app) whoami(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	name, err := c.WhoAmI(a.ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "%s on %s\n", name, c.BaseURL)
+	return nil
+}
+
+func (a *app) put(args []string) error {
+	fs := a.flags("put")
+	quiet := fs.Bool("q", false, "do not show progress")
+	resume := fs.Bool("resume", false, "continue interrupted uploads")
+	diff := fs.Bool("delta", false, "send only what changed in files the server has")
+	if err := fs.Parse(args); err != nil || fs.NArg() < 2 || (*resume && *diff) {
+		return errUsage
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	remote := fs.Arg(fs.NArg() - 1)
+	var sources []string
+	for _, pattern := range fs.Args()[:fs.NArg()-1] {
+		matches, err := expandLocal(pattern)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, matches...)
+	}
+	toDir := len(sources) > 1 || strings.HasSuffix(remote, "/")
+
+	for _, src := range sources {
+		dest := remote
+		if toDir {
+			dest = path.Join(remote, filepath.Base(src))
+		}
+		if err := a.upload(c, src, dest, *quiet, *resume, *diff); err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+	}
+	return nil
+}
+
+func (a *app) upload(c *client.Client, src, dest string, quiet, resume, diff bool) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("is a directory")
+	}
+
+	var progress client.Progress
+	if !quiet {
+		bar := newProgressBar(a.stderr, filepath.Base(src))
+		defer bar.finish()
+		progress = bar.update
+	}
+	if resume {
+		return c.ResumeUpload(a.ctx, dest, f, info.Size(), progress)
+	}
+	if diff {
+		return c.UploadDelta(a.ctx, dest, f, info.Size(), progress)
+	}
+	return c.Upload(a.ctx, dest, f, info.Size(), progress)
+}
+
+func (a *app) get(args []string) error {
+	fs := a.flags("get")
+	quiet := fs.Bool("q", false, "do not show progress")
+	if err := fs.Parse(args); err != nil || fs.NArg() < 2 {
+		return errUsage
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	local := fs.Arg(fs.NArg() - 1)
+	var sources []string
+	for _, pattern := range fs.Args()[:fs.NArg()-1] {
+		matches, err := a.expandRemote(c, pattern)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, matches...)
+	}
+	info, err := os.Stat(local)
+	toDir := len(sources) > 1 || strings.HasSuffix(local, string(filepath.Separator)) || (err == nil && info.IsDir())
+	if local == "-" {
+		toDir = false
+	}
+
+	for _, src := range sources {
+		dest := local
+		if toDir {
+			dest = filepath.Join(local, path.Base(src))
+		}
+		if err := a.download(c, src, dest, *quiet); err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+	}
+	return nil
+}
+
+// download writes the file at src to the local file dest, or to stdout if
+// dest is "-". A failed download leaves no file behind.
+func (a *app) download(c *client.Client, src, dest string, quiet bool) (err error) {
+	var progress client.Progress
+	if !quiet && dest != "-" {
+		bar := newProgressBar(a.stderr, path.Base(src))
+		defer bar.finish()
+		progress = bar.update
+	}
+	if dest == "-" {
+		_, err = c.Download(a.ctx, src, a.stdout, progress)
+		return err
+	}
+
+	tmp := dest + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = c.Download(a.ctx, src, f, progress)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+func (a *app) ls(args []string) error {
+	fs := a.flags("ls")
+	recursive := fs.Bool("r", false, "list every file below DIR")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	dir := "/"
+	if fs.NArg() == 1 {
+		dir = fs.Arg(0)
+	}
+
+	files, err := c.List(a.ctx, dir, *recursive)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name
+		if f.Dir {
+			fmt.Fprintf(a.stdout, "%10s  %s/\n", "-", name)
+			continue
+		}
+		fmt.Fprintf(a.stdout, "%10s  %s\n", formatBytes(f.Size), name)
+	}
+	return nil
+}
+
+func (a *app) rm(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	for _, pattern := range args {
+		matches, err := a.expandRemote(c, pattern)
+		if err != nil {
+			return err
+		}
+		for _, p := range matches {
+			if err := c.Remove(a.ctx, p); err != nil {
+				return fmt.Errorf("%s: %v", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *app) mv(args []string) error {
+	fs := a.flags("mv")
+	force := fs.Bool("f", false, "replace DEST if it exists")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 {
+		return errUsage
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	return c.Move(a.ctx, fs.Arg(0), fs.Arg(1), *force)
+}
+
+func (a *app) share(args []string) error {
+	fs := a.flags("share")
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the share lives")
+	link := fs.Bool("link", false, "make a presigned link instead of a share code")
+	list := fs.Bool("list", false, "list your share codes")
+	revoke := fs.String("revoke", "", "revoke a share code")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *list && fs.NArg() == 0:
+		shares, err := c.Shares(a.ctx)
+		if err != nil {
+			return err
+		}
+		for _, sh := range shares {
+			fmt.Fprintf(a.stdout, "%s  %s  until %s\n", sh.Code, sh.Path, sh.Expires.Local().Format(time.RFC3339))
+		}
+		return nil
+	case *revoke != "" && fs.NArg() == 0:
+		return c.Revoke(a.ctx, *revoke)
+	case fs.NArg() != 1 || *list:
+		return errUsage
+	case *link:
+		u, err := c.PresignURL(fs.Arg(0), *ttl)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(a.stdout, u)
+		return nil
+	}
+
+	sh, err := c.Share(a.ctx, fs.Arg(0), *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "%s\ncode %s, until %s\n", c.ShareURL(sh.Code), sh.Code, sh.Expires.Local().Format(time.RFC3339))
+	return nil
+}
+
+// sync keeps the folder LOCAL and the path REMOTE in sync, once or until
+// interrupted with -watch.
+func (a *app) sync(args []string) error {
+	fs := a.flags("sync")
+	watch := fs.Bool("watch", false, "keep syncing until interrupted")
+	interval := fs.Duration("interval", 30*time.Second, "how often -watch looks for local changes")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 || *interval <= 0 {
+		return errUsage
+	}
+	if info, err := os.Stat(fs.Arg(0)); err != nil || !info.IsDir() {
+		return errors.New(fs.Arg(0) + " is not a folder")
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	s := syncdir.New(c, fs.Arg(0), fs.Arg(1))
+	s.Report = func(action, name string) {
+		fmt.Fprintf(a.stdout, "%-13s  %s\n", action, name)
+	}
+	if !*watch {
+		return s.Sync(a.ctx)
+	}
+	s.OnError = func(err error) {
+		fmt.Fprintln(a.stderr, "tempdesk: sync:", err)
+	}
+	if err = s.Watch(a.ctx, *interval); err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[`)
+}
+
+// expandLocal returns the local files matching pattern, which must match at
+// least one.
+func expandLocal(pattern string) ([]string, error) {
+	if !hasMeta(pattern) {
+		return []string{pattern}, nil
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, errors.New("no match for " + pattern)
+	}
+	return matches, nil
+}
+
+// expandRemote returns the files on the server matching pattern. Only the
+// last element of pattern may hold wildcards.
+func (a *app) expandRemote(c *client.Client, pattern string) ([]string, error) {
+	if !hasMeta(pattern) {
+		return []string{pattern}, nil
+	}
+	pattern = path.Clean("/" + pattern)
+	dir := path.Dir(pattern)
+	if hasMeta(dir) {
+		return nil, errors.New("wildcards are only allowed in the last element of " + pattern)
+	}
+
+	files, err := c.List(a.ctx, dir, false)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, f := range files {
+		ok, err := path.Match(pattern, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if ok && !f.Dir {
+			matches = append(matches, f.Path)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, errors.New("no match for " + pattern)
+	}
+	return matches, nil
+}
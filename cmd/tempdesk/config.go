@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/huangjiahua/tempdesk/pkg/client"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var errNotLoggedIn = errors.New("not logged in, run tempdesk login first")
+
+// config is what login stores, the key is kept in plain text so the file is
+// only readable by its owner.
+type config struct {
+	Server string `json:"server"`
+	Name   string `json:"name"`
+	Key    string `json:"key"`
+}
+
+func (a *app) path() (string, error) {
+	if a.configPath != "" {
+		return a.configPath, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tempdesk", "config.json"), nil
+}
+
+func (a *app) loadConfig() (config, error) {
+	var cfg config
+	p, err := a.path()
+	if err != nil {
+		return cfg, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return cfg, errNotLoggedIn
+	}
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(b, &cfg)
+	return cfg, err
+}
+
+func (a *app) saveConfig(cfg config) error {
+	p, err := a.path()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, append(b, '\n'), 0600)
+}
+
+// client returns a client for the server and user of the config.
+func (a *app) client() (*client.Client, error) {
+	cfg, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Server == "" || cfg.Name == "" {
+		return nil, errNotLoggedIn
+	}
+	return client.New(cfg.Server, cfg.Name, cfg.Key), nil
+}
@@ -0,0 +1,129 @@
+// Command tempdesk is the command line client of a TempDesk server.
+//
+//	tempdesk login [-server URL] [-name NAME] [-key KEY]
+//	tempdesk reset [-server URL] [-name NAME]
+//	tempdesk reset [-server URL] -token TOKEN [-key KEY]
+//	tempdesk whoami
+//	tempdesk put [-q] [-resume | -delta] LOCAL... REMOTE
+//	tempdesk get [-q] REMOTE... LOCAL
+//	tempdesk ls [-r] [DIR]
+//	tempdesk rm REMOTE...
+//	tempdesk mv [-f] SRC DEST
+//	tempdesk share [-ttl 24h] [-link] PATH
+//	tempdesk share -list | -revoke CODE
+//	tempdesk sync [-watch] [-interval 30s] LOCAL REMOTE
+//
+// Local and remote paths may be glob patterns. The credentials written by
+// login are kept in a config file, which -config or TEMPDESK_CONFIG may
+// point elsewhere.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+)
+
+// errUsage is returned by a command that was called wrongly, its usage is
+// printed instead of the error.
+var errUsage = errors.New("usage")
+
+type command struct {
+	usage string
+	run   func(a *app, args []string) error
+}
+
+var commands = map[string]command{
+	"login":  {"login [-server URL] [-name NAME] [-key KEY]", (*app).login},
+	"reset":  {"reset [-server URL] [-name NAME] | -token TOKEN [-key KEY]", (*app).reset},
+	"whoami": {"whoami", (*app).whoami},
+	"put":    {"put [-q] [-resume | -delta] LOCAL... REMOTE", (*app).put},
+	"get":    {"get [-q] REMOTE... LOCAL", (*app).get},
+	"ls":     {"ls [-r] [DIR]", (*app).ls},
+	"rm":     {"rm REMOTE...", (*app).rm},
+	"mv":     {"mv [-f] SRC DEST", (*app).mv},
+	"share":  {"share [-ttl 24h] [-link] PATH | -list | -revoke CODE", (*app).share},
+	"sync":   {"sync [-watch] [-interval 30s] LOCAL REMOTE", (*app).sync},
+}
+
+type app struct {
+	ctx    context.Context
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	configPath string
+}
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	a := &app{ctx: ctx, stdin: stdin, stdout: stdout, stderr: stderr}
+
+	fs := flag.NewFlagSet("tempdesk", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&a.configPath, "config", os.Getenv("TEMPDESK_CONFIG"), "config file, written by login")
+	fs.Usage = func() { a.usage() }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		a.usage()
+		return 2
+	}
+
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "tempdesk: unknown command %q\n", name)
+		a.usage()
+		return 2
+	}
+	err := cmd.run(a, fs.Args()[1:])
+	if err == errUsage || err == flag.ErrHelp {
+		fmt.Fprintln(stderr, "usage: tempdesk "+cmd.usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "tempdesk "+name+": "+err.Error())
+		return 1
+	}
+	return 0
+}
+
+func (a *app) usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString("usage: tempdesk [-config FILE] COMMAND [ARGS]\n\ncommands:\n")
+	for _, name := range names {
+		sb.WriteString("  tempdesk " + commands[name].usage + "\n")
+	}
+	fmt.Fprint(a.stderr, sb.String())
+}
+
+// flags returns a flag set for a command that reports errors on stderr.
+func (a *app) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.Usage = func() {}
+	return fs
+}
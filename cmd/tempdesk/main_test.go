@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/http/handler"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/internal/share"
+	"github.com/huangjiahua/tempdesk/internal/testutil"
+	"github.com/huangjiahua/tempdesk/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	state := &thttp.State{
+		Users:  mock.NewUserService(),
+		Files:  mock.NewFileService(),
+		Auther: auth.NewHMACAuther(),
+	}
+	state.Shares, _ = share.NewService(mock.NewStorage())
+	mux := http.NewServeMux()
+	mux.Handle("/user/", handler.NewUser(state))
+	mux.Handle("/file/", handler.NewFile(state, "/file"))
+	mux.Handle("/share/", handler.NewShare(state, "/share"))
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	if err := client.New(ts.URL, "", "").CreateUser(context.Background(), "sam", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+type cli struct {
+	t      *testing.T
+	config string
+}
+
+// run runs tempdesk with args and returns its exit code and output.
+func (c cli) run(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), append([]string{"-config", c.config}, args...),
+		strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func (c cli) ok(args ...string) string {
+	code, stdout, stderr := c.run("", args...)
+	if code != 0 {
+		c.t.Fatalf("tempdesk %v: exit %d: %s", args, code, stderr)
+	}
+	return stdout
+}
+
+func TestCommands(t *testing.T) {
+	ts := newServer(t)
+	dir := testutil.TempDir(t)
+	c := cli{t: t, config: filepath.Join(dir, "config", "config.json")}
+
+	code, _, stderr := c.run("", "whoami")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "not logged in")
+
+	code, _, _ = c.run(ts.URL+"\nsam\nwrong\n", "login")
+	assert.Equal(t, 1, code, "a wrong key should not log in")
+
+	code, stdout, _ := c.run("key\n", "login", "-server", ts.URL, "-name", "sam")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "as sam")
+	info, err := os.Stat(c.config)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	assert.Contains(t, c.ok("whoami"), "sam on "+ts.URL)
+
+	for name, content := range map[string]string{"a.txt": "alpha", "b.txt": "bravo", "c.log": "charlie"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	c.ok("put", "-q", filepath.Join(dir, "*.txt"), "/docs/")
+	c.ok("put", filepath.Join(dir, "c.log"), "/docs/logs/c.log")
+
+	assert.Equal(t, "        5B  a.txt\n        5B  b.txt\n         -  logs/\n", c.ok("ls", "/docs"))
+	assert.Contains(t, c.ok("ls", "-r", "/docs"), "logs/c.log")
+
+	out := filepath.Join(dir, "out")
+	assert.Nil(t, os.Mkdir(out, 0755))
+	c.ok("get", "-q", "/docs/*.txt", out)
+	b, _ := ioutil.ReadFile(filepath.Join(out, "b.txt"))
+	assert.Equal(t, "bravo", string(b))
+	assert.Equal(t, "alpha", c.ok("get", "/docs/a.txt", "-"))
+
+	c.ok("mv", "/docs/a.txt", "/docs/z.txt")
+	code, _, stderr = c.run("", "mv", "/docs/b.txt", "/docs/z.txt")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "destination exists")
+	c.ok("mv", "-f", "/docs/b.txt", "/docs/z.txt")
+	assert.Equal(t, "bravo", c.ok("get", "/docs/z.txt", "-"))
+
+	lines := strings.Split(c.ok("share", "-ttl", "1h", "/docs/z.txt"), "\n")
+	res, err := http.Get(lines[0])
+	if assert.Nil(t, err) {
+		b, _ = ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		assert.Equal(t, "bravo", string(b))
+	}
+	assert.Contains(t, c.ok("share", "-list"), "/docs/z.txt")
+
+	res, err = http.Get(strings.TrimSpace(c.ok("share", "-link", "/docs/logs/c.log")))
+	if assert.Nil(t, err) {
+		b, _ = ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		assert.Equal(t, "charlie", string(b))
+	}
+
+	c.ok("rm", "/docs/*.txt")
+	assert.Equal(t, "         -  logs/\n", c.ok("ls", "/docs"))
+	code, _, stderr = c.run("", "rm", "/docs/*.txt")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "no match")
+
+	folder := filepath.Join(dir, "folder")
+	assert.Nil(t, os.Mkdir(folder, 0755))
+	assert.Equal(t, "download       logs/c.log\n", c.ok("sync", folder, "/docs"))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(folder, "new.txt"), []byte("delta"), 0644))
+	assert.Equal(t, "upload         new.txt\n", c.ok("sync", folder, "/docs"))
+	assert.Equal(t, "delta", c.ok("get", "/docs/new.txt", "-"))
+
+	code, _, stderr = c.run("", "mv", "/docs/logs/c.log")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "usage: tempdesk mv")
+}
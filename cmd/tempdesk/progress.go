@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const barWidth = 30
+
+// progressBar draws the progress of one transfer on a terminal line.
+type progressBar struct {
+	w     io.Writer
+	name  string
+	last  time.Time
+	drawn bool
+}
+
+func newProgressBar(w io.Writer, name string) *progressBar {
+	return &progressBar{w: w, name: name}
+}
+
+// update is a client.Progress, it redraws at most ten times a second.
+func (b *progressBar) update(done, total int64) {
+	now := time.Now()
+	if b.drawn && done != total && now.Sub(b.last) < 100*time.Millisecond {
+		return
+	}
+	b.last = now
+	b.drawn = true
+
+	if total <= 0 {
+		fmt.Fprintf(b.w, "\r%s %s", b.name, formatBytes(done))
+		return
+	}
+	filled := int(done * barWidth / total)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	fmt.Fprintf(b.w, "\r%s [%s%s] %3d%% %s/%s", b.name,
+		strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled),
+		done*100/total, formatBytes(done), formatBytes(total))
+}
+
+// finish ends the line of the bar.
+func (b *progressBar) finish() {
+	if b.drawn {
+		fmt.Fprintln(b.w)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,16 +1,131 @@
 package tempdesk
 
-import "io"
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	FileNotExist      = "file not exists"
+	FileAlreadyExists = "file already exists"
+	FileLocked        = "file locked"
+	LockNotExist      = "lock not exists"
+)
+
+// DefaultLockLease is used when a lock is requested without a lease.
+const DefaultLockLease = 10 * time.Minute
+
+type LockScope int
 
 const (
-	FileNotExist = "file not exists"
+	// LockShared locks are advisory, any number of them may be held at once.
+	LockShared LockScope = iota
+	// LockExclusive locks reject writes that do not present the lock token.
+	LockExclusive
+)
+
+func (s LockScope) String() string {
+	if s == LockExclusive {
+		return "exclusive"
+	}
+	return "shared"
+}
+
+type Lock struct {
+	Token   string
+	Path    string
+	Owner   string
+	Scope   LockScope
+	Expires time.Time
+}
+
+// Verb is a set of things a user or a share code may do with a file.
+type Verb uint8
+
+const (
+	VerbRead Verb = 1 << iota
+	VerbWrite
+	VerbDelete
+	VerbShare
+	// VerbChangePerm lets a user change the permission of a file.
+	VerbChangePerm
+
+	// VerbNone grants nothing, it blocks a user or group.
+	VerbNone Verb = 0
+	VerbAll       = VerbRead | VerbWrite | VerbDelete | VerbShare | VerbChangePerm
 )
 
+var verbNames = []struct {
+	verb Verb
+	name string
+}{{VerbRead, "read"}, {VerbWrite, "write"}, {VerbDelete, "delete"}, {VerbShare, "share"}, {VerbChangePerm, "change_perm"}}
+
+// Has reports whether v holds every verb of o.
+func (v Verb) Has(o Verb) bool {
+	return v&o == o
+}
+
+// String lists the verbs of v like "read,write", "none" if there are none.
+func (v Verb) String() string {
+	var names []string
+	for _, n := range verbNames {
+		if v.Has(n.verb) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseVerb parses verbs listed like String lists them, "all" is every verb.
+func ParseVerb(s string) (Verb, error) {
+	var v Verb
+	for _, name := range strings.Split(s, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "none", "":
+			continue
+		case "all":
+			v |= VerbAll
+			continue
+		}
+		found := false
+		for _, n := range verbNames {
+			if n.name == name {
+				v, found = v|n.verb, true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown verb %q", name)
+		}
+	}
+	return v, nil
+}
+
+// MarshalText writes v as String does, so verbs read well in JSON.
+func (v Verb) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+func (v *Verb) UnmarshalText(text []byte) (err error) {
+	*v, err = ParseVerb(string(text))
+	return
+}
+
+// FilePermission allows or blocks users as a whole. A VerbPermission grants
+// single verbs instead, see Verbs.
 type FilePermission interface {
 	AllowUser(name string)
 	BlockUser(name string)
 	AllowUserMeta(key, value string)
 	BlockUserMeta(key, value string)
+	// AllowGroup and BlockGroup are like AllowUser and BlockUser for every
+	// member of the group name.
+	AllowGroup(name string)
+	BlockGroup(name string)
 	AllowAllUser()
 	BlockAllUser()
 	AllowPublic(code string)
@@ -22,7 +137,102 @@ type FilePermission interface {
 	TestCode(code string) bool
 }
 
+// VerbPermission grants users, groups and share codes separate verbs. The
+// verbs of the most specific rule apply to a user: its own, else the union
+// of those of its groups, else the verbs granted to every user. A user of a
+// public file may read it in any case.
+//
+// Of the FilePermission methods, allowing grants VerbAll, blocking grants
+// VerbNone, and TestUser and TestCode test VerbRead.
+type VerbPermission interface {
+	FilePermission
+
+	GrantUser(name string, verbs Verb)
+	GrantGroup(name string, verbs Verb)
+	// GrantAllUser sets the verbs of users without a rule of their own or
+	// of a group, dropping the rules of users and groups.
+	GrantAllUser(verbs Verb)
+	// GrantCode lets a share code do verbs, none revokes it.
+	GrantCode(code string, verbs Verb)
+
+	// UserVerbs returns the verbs user may do.
+	UserVerbs(user User) Verb
+	CodeVerbs(code string) Verb
+}
+
+// Verbs returns p as a VerbPermission. A FilePermission that is not one is
+// adapted: a user it allows may do everything, a code it allows may read,
+// and granting some verbs allows while granting none blocks.
+func Verbs(p FilePermission) VerbPermission {
+	if v, ok := p.(VerbPermission); ok {
+		return v
+	}
+	return verbAdapter{p}
+}
+
+// Can reports whether user may do every verb of verb with a file of
+// permission p.
+func Can(p FilePermission, user User, verb Verb) bool {
+	return Verbs(p).UserVerbs(user).Has(verb)
+}
+
+type verbAdapter struct {
+	FilePermission
+}
+
+func (a verbAdapter) GrantUser(name string, verbs Verb) {
+	if verbs == VerbNone {
+		a.BlockUser(name)
+	} else {
+		a.AllowUser(name)
+	}
+}
+
+func (a verbAdapter) GrantGroup(name string, verbs Verb) {
+	if verbs == VerbNone {
+		a.BlockGroup(name)
+	} else {
+		a.AllowGroup(name)
+	}
+}
+
+func (a verbAdapter) GrantAllUser(verbs Verb) {
+	if verbs == VerbNone {
+		a.BlockAllUser()
+	} else {
+		a.AllowAllUser()
+	}
+}
+
+func (a verbAdapter) GrantCode(code string, verbs Verb) {
+	if verbs == VerbNone {
+		a.BlockCode(code)
+	} else {
+		a.AllowCode(code)
+	}
+}
+
+func (a verbAdapter) UserVerbs(user User) Verb {
+	if a.TestUser(user) {
+		return VerbAll
+	}
+	return VerbNone
+}
+
+func (a verbAdapter) CodeVerbs(code string) Verb {
+	if a.TestCode(code) {
+		return VerbRead
+	}
+	return VerbNone
+}
+
+// MetaModTime is the FileMeta key of the time a file was last modified
+// where it came from, a time.Time or an RFC 3339 string. Archives keep it
+// instead of the time the file was stored.
+const MetaModTime = "mtime"
+
 type File interface {
+	io.Closer
 	io.Reader
 	io.Writer
 	io.Seeker
@@ -36,14 +246,72 @@ type File interface {
 	FileMeta(key string) (value interface{}, ok bool)
 	WriteFileMeta(key string, value interface{}) (err error)
 
+	// Truncate cuts or grows the file to pos and writes data there, as one
+	// change: readers see the file before or after it, never in between.
 	Truncate(pos int64, data []byte) (err error)
+
+	// SetLockToken makes following writes through this File present token,
+	// so they are accepted while the matching exclusive lock is held.
+	SetLockToken(token string)
+}
+
+// FileInfo describes a file found by FileService.List.
+type FileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
 }
 
 type FileService interface {
 	File(path string) (err error)
 	Open(path string, flags int, perm FilePermission) (file File, err error)
-	Rename(dest string, src string) (err error)
-	Remove(path string) (err error)
+	// Rename and Remove present token like File.SetLockToken, they fail
+	// with FileLocked while a file they change has an exclusive lock with
+	// another token.
+	Rename(dest string, src string, token string) (err error)
+	Remove(path string, token string) (err error)
+	// List returns the files below the directory dir at any depth, ordered
+	// by path.
+	List(dir string) (files []FileInfo, err error)
+
+	// Lock grants a lock on an existing file to owner for lease. Expired
+	// locks are released automatically.
+	Lock(path string, owner User, scope LockScope, lease time.Duration) (lock Lock, err error)
+	RefreshLock(path string, token string, lease time.Duration) (lock Lock, err error)
+	Unlock(path string, token string) (err error)
+	Locks(path string) (locks []Lock, err error)
+}
+
+// UsageReporter is implemented by a FileService that can tell how much it
+// stores.
+type UsageReporter interface {
+	Usage() (files int64, bytes int64, err error)
+}
+
+// MetaOwner is the Meta key naming the user who created a file, whose
+// quota the file counts against.
+const MetaOwner = "owner"
+
+// OwnerUsageReporter is implemented by a FileService that keeps a running
+// count of the bytes of the files of each MetaOwner, so checking a quota
+// does not look at every file.
+type OwnerUsageReporter interface {
+	OwnerUsage(owner string) (bytes int64, err error)
+}
+
+// OwnerUsage looks through wrappers of fs, which have an Unwrap method, for
+// a FileService that counts the usage of owners.
+func OwnerUsage(fs FileService) (OwnerUsageReporter, bool) {
+	for {
+		if r, ok := fs.(OwnerUsageReporter); ok {
+			return r, true
+		}
+		u, ok := fs.(interface{ Unwrap() FileService })
+		if !ok {
+			return nil, false
+		}
+		fs = u.Unwrap()
+	}
 }
 
 type FileServiceError struct {
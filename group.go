@@ -0,0 +1,62 @@
+package tempdesk
+
+const (
+	GroupAlreadyExists string = "group already exists"
+	GroupNotExists     string = "group not exists"
+	// GroupCycle is the kind of an error nesting a group in itself,
+	// directly or through other groups.
+	GroupCycle string = "group nesting cycle"
+)
+
+// Group is a named set of users, which a FilePermission may allow or block
+// as a whole. Its members are the users in Members and, at any depth, the
+// members of the groups in Groups. Owners may change the group besides
+// admins, they need not be members.
+type Group struct {
+	Name    string
+	Owners  []string
+	Members []string
+	Groups  []string
+}
+
+// IsOwner reports whether the user name owns g.
+func (g Group) IsOwner(name string) bool {
+	for _, o := range g.Owners {
+		if o == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupResolver tells which groups a user belongs to, as a FilePermission
+// needs to test its group rules.
+type GroupResolver interface {
+	// IsMember reports whether the user name is a member of group,
+	// directly or through a nested group.
+	IsMember(name, group string) bool
+}
+
+type GroupService interface {
+	GroupResolver
+	Group(name string) (group Group, ok bool)
+	// Groups lists every group ordered by name.
+	Groups() (groups []Group, err error)
+	CreateGroup(group Group) (err error)
+	UpdateGroup(group Group) (err error)
+	// DeleteGroup deletes a group and takes it out of the groups it is
+	// nested in.
+	DeleteGroup(group Group) (err error)
+}
+
+type GroupServiceError struct {
+	Kind string
+	Err  error
+}
+
+func (g *GroupServiceError) Error() string {
+	if g.Err != nil {
+		return g.Kind + ": " + g.Err.Error()
+	}
+	return g.Kind
+}
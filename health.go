@@ -0,0 +1,26 @@
+package tempdesk
+
+// HealthChecker is implemented by backends that can tell whether they are
+// reachable and writable.
+type HealthChecker interface {
+	Health() error
+}
+
+// CheckHealth checks service with the first HealthChecker found by
+// unwrapping it. Services that cannot check themselves are assumed healthy.
+func CheckHealth(service interface{}) error {
+	for service != nil {
+		if c, ok := service.(HealthChecker); ok {
+			return c.Health()
+		}
+		switch s := service.(type) {
+		case interface{ Unwrap() FileService }:
+			service = s.Unwrap()
+		case interface{ Unwrap() UserService }:
+			service = s.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+// Package account verifies the email addresses of users and lets them reset
+// their keys. Both send a mail with a token signed by a secret of the
+// server: a verify token names the user and the address, a reset token also
+// a stamp of the current key, so it works only until the key changes.
+package account
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mail"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	InvalidToken = "invalid token"
+	TokenExpired = "token expired"
+	NoEmail      = "no email address"
+
+	PurposeVerify = "verify"
+	PurposeReset  = "reset"
+
+	DefaultVerifyTTL = 48 * time.Hour
+	DefaultResetTTL  = time.Hour
+
+	// VerifyPath is where the link of a verify mail points, relative to
+	// the base URL.
+	VerifyPath = "/account/verify"
+	// ResetPath is where the link of a reset mail points, relative to the
+	// base URL.
+	ResetPath = "/account/reset"
+
+	secretKey = "account/secret"
+	// secretSize is the number of random bytes of the secret.
+	secretSize = 32
+)
+
+type AccountError struct {
+	Kind string
+	Err  error
+}
+
+func (a *AccountError) Error() string {
+	if a.Err != nil {
+		return a.Kind + ": " + a.Err.Error()
+	}
+	return a.Kind
+}
+
+// IsKind reports whether err is an AccountError of kind.
+func IsKind(err error, kind string) bool {
+	e, ok := err.(*AccountError)
+	return ok && e.Kind == kind
+}
+
+// Token is what a signed token says.
+type Token struct {
+	Purpose string    `json:"p"`
+	Name    string    `json:"n"`
+	Email   string    `json:"e"`
+	Stamp   string    `json:"s,omitempty"`
+	Expires time.Time `json:"x"`
+}
+
+// Matches reports whether t is still meant for user: the user has the
+// address of t, and for a reset, the address is verified and the key has
+// not changed since t was made.
+func (t Token) Matches(user td.User) bool {
+	if user.Name != t.Name || !strings.EqualFold(user.Email(), t.Email) {
+		return false
+	}
+	if t.Purpose == PurposeReset {
+		return user.IsEmailVerified() && hmac.Equal([]byte(stamp(user.Key)), []byte(t.Stamp))
+	}
+	return true
+}
+
+// stamp identifies key without giving it away.
+func stamp(key string) string {
+	sum := sha256.Sum256([]byte("tempdesk reset\n" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+type Service struct {
+	Transport mail.Transport
+	Templates *mail.Templates
+	// From is the sender of the mails.
+	From string
+	// BaseURL is the address of the server the mails point to, like
+	// "https://example.com".
+	BaseURL string
+
+	VerifyTTL time.Duration
+
+	Now func() time.Time
+
+	secret   []byte
+	mu       sync.Mutex
+	resetTTL time.Duration
+}
+
+// NewService loads the secret signing the tokens from store, or creates it
+// when there is none yet, and sends mails through t.
+func NewService(store storage.PutterGetter, t mail.Transport, from, baseURL string) (*Service, error) {
+	s := &Service{
+		Transport: t,
+		Templates: mail.DefaultTemplates(),
+		From:      from,
+		BaseURL:   strings.TrimRight(baseURL, "/"),
+		VerifyTTL: DefaultVerifyTTL,
+		Now:       time.Now,
+		resetTTL:  DefaultResetTTL,
+	}
+	value, err := store.Get(secretKey)
+	if storage.IsNotFound(err) {
+		secret := make([]byte, secretSize)
+		if _, err = rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if err = store.Put(secretKey, secret); err != nil {
+			return nil, err
+		}
+		s.secret = secret
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.([]byte)
+	if !ok || len(b) < secretSize {
+		return nil, &AccountError{Kind: "unexpected value stored under " + secretKey}
+	}
+	s.secret = b
+	return s, nil
+}
+
+// SetResetTTL changes how long reset tokens work, it is safe to call while
+// requests are served. Tokens already sent keep their expiry.
+func (s *Service) SetResetTTL(ttl time.Duration) {
+	s.mu.Lock()
+	s.resetTTL = ttl
+	s.mu.Unlock()
+}
+
+// sign returns t as a token: its JSON and the HMAC of the JSON, both in
+// URL safe base64 and joined by a dot.
+func (s *Service) sign(t Token) (string, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(payload)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// ParseToken checks the signature and expiry of token, which must be made
+// for purpose, and returns what it says.
+func (s *Service) ParseToken(token, purpose string) (Token, error) {
+	enc := base64.RawURLEncoding
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return Token{}, &AccountError{Kind: InvalidToken}
+	}
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return Token{}, &AccountError{Kind: InvalidToken, Err: err}
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return Token{}, &AccountError{Kind: InvalidToken, Err: err}
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return Token{}, &AccountError{Kind: InvalidToken}
+	}
+	var t Token
+	if err = json.Unmarshal(payload, &t); err != nil {
+		return Token{}, &AccountError{Kind: InvalidToken, Err: err}
+	}
+	if t.Purpose != purpose {
+		return Token{}, &AccountError{Kind: InvalidToken, Err: errors.New("token is for " + t.Purpose)}
+	}
+	if !s.Now().Before(t.Expires) {
+		return Token{}, &AccountError{Kind: TokenExpired}
+	}
+	return t, nil
+}
+
+// SendVerify mails user a link to verify their email address.
+func (s *Service) SendVerify(ctx context.Context, user td.User) error {
+	return s.send(ctx, mail.TemplateVerify, Token{Purpose: PurposeVerify}, s.VerifyTTL, user)
+}
+
+// SendReset mails user a link and a token to reset their key with, which needs a
+// verified email address.
+func (s *Service) SendReset(ctx context.Context, user td.User) error {
+	if !user.IsEmailVerified() {
+		return &AccountError{Kind: NoEmail, Err: errors.New("address is not verified")}
+	}
+	s.mu.Lock()
+	ttl := s.resetTTL
+	s.mu.Unlock()
+	return s.send(ctx, mail.TemplateReset, Token{Purpose: PurposeReset, Stamp: stamp(user.Key)}, ttl, user)
+}
+
+func (s *Service) send(ctx context.Context, template string, t Token, ttl time.Duration, user td.User) error {
+	if user.Email() == "" {
+		return &AccountError{Kind: NoEmail}
+	}
+	t.Name, t.Email, t.Expires = user.Name, user.Email(), s.Now().Add(ttl).UTC().Truncate(time.Second)
+	token, err := s.sign(t)
+	if err != nil {
+		return err
+	}
+	data := mail.TemplateData{
+		Name:    user.Name,
+		Email:   t.Email,
+		Server:  s.BaseURL,
+		Token:   token,
+		Expires: t.Expires,
+	}
+	path := VerifyPath
+	if t.Purpose == PurposeReset {
+		path = ResetPath
+	}
+	data.URL = s.BaseURL + path + "?" + url.Values{"token": {token}}.Encode()
+	subject, body, err := s.Templates.Render(template, data)
+	if err != nil {
+		return err
+	}
+	return s.Transport.Send(ctx, mail.Message{From: s.From, To: []string{user.Email()}, Subject: subject, Body: body})
+}
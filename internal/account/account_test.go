@@ -0,0 +1,109 @@
+package account
+
+import (
+	"context"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mail"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// outbox keeps the messages sent through it.
+type outbox []mail.Message
+
+func (o *outbox) Send(ctx context.Context, m mail.Message) error {
+	*o = append(*o, m)
+	return nil
+}
+
+var tokenPattern = regexp.MustCompile(`token[= ]([A-Za-z0-9_-]+\.[A-Za-z0-9_-]+)`)
+
+// lastToken returns the token in the last message of o.
+func (o outbox) lastToken(t *testing.T) string {
+	if len(o) == 0 {
+		t.Fatal("no message sent")
+	}
+	m := tokenPattern.FindStringSubmatch(o[len(o)-1].Body)
+	if m == nil {
+		t.Fatalf("no token in %q", o[len(o)-1].Body)
+	}
+	return m[1]
+}
+
+func TestService_Verify(t *testing.T) {
+	store := mock.NewStorage()
+	var out outbox
+	s, err := NewService(store, &out, "noreply@example.com", "https://example.com/")
+	assert.Nil(t, err)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+
+	sam := td.User{Name: "sam", Key: "sam key", Meta: map[string]string{td.MetaEmail: "sam@example.com"}}
+	assert.True(t, IsKind(s.SendVerify(context.Background(), td.User{Name: "tom"}), NoEmail))
+	assert.Nil(t, s.SendVerify(context.Background(), sam))
+	if assert.Len(t, out, 1) {
+		assert.Equal(t, []string{"sam@example.com"}, out[0].To)
+		assert.Equal(t, "noreply@example.com", out[0].From)
+		assert.Contains(t, out[0].Body, "https://example.com"+VerifyPath+"?token=")
+	}
+	token := out.lastToken(t)
+
+	tok, err := s.ParseToken(token, PurposeVerify)
+	assert.Nil(t, err)
+	assert.Equal(t, "sam", tok.Name)
+	assert.Equal(t, now.Add(DefaultVerifyTTL), tok.Expires)
+	assert.True(t, tok.Matches(sam))
+	moved := sam
+	moved.Meta = map[string]string{td.MetaEmail: "sam@example.org"}
+	assert.False(t, tok.Matches(moved), "the address changed since")
+
+	_, err = s.ParseToken(token, PurposeReset)
+	assert.True(t, IsKind(err, InvalidToken))
+	for _, bad := range []string{"", "abc", token + "x", strings.Replace(token, ".", "x.", 1)} {
+		_, err = s.ParseToken(bad, PurposeVerify)
+		assert.True(t, IsKind(err, InvalidToken), bad)
+	}
+
+	// the secret survives a restart
+	s, err = NewService(store, &out, "noreply@example.com", "https://example.com")
+	assert.Nil(t, err)
+	s.Now = func() time.Time { return now.Add(DefaultVerifyTTL - time.Second) }
+	_, err = s.ParseToken(token, PurposeVerify)
+	assert.Nil(t, err)
+	s.Now = func() time.Time { return now.Add(DefaultVerifyTTL) }
+	_, err = s.ParseToken(token, PurposeVerify)
+	assert.True(t, IsKind(err, TokenExpired))
+
+	other, _ := NewService(mock.NewStorage(), &out, "noreply@example.com", "https://example.com")
+	_, err = other.ParseToken(token, PurposeVerify)
+	assert.True(t, IsKind(err, InvalidToken), "another server has another secret")
+}
+
+func TestService_Reset(t *testing.T) {
+	var out outbox
+	s, _ := NewService(mock.NewStorage(), &out, "noreply@example.com", "https://example.com")
+	s.SetResetTTL(10 * time.Minute)
+
+	sam := td.User{Name: "sam", Key: "sam key", Meta: map[string]string{td.MetaEmail: "sam@example.com"}}
+	assert.True(t, IsKind(s.SendReset(context.Background(), sam), NoEmail), "the address is not verified")
+	assert.Empty(t, out)
+
+	sam.Meta[td.MetaEmailVerified] = "true"
+	assert.Nil(t, s.SendReset(context.Background(), sam))
+	if assert.Len(t, out, 1) {
+		assert.Contains(t, out[0].Body, "https://example.com/account/reset?token=")
+		assert.Contains(t, out[0].Body, "tempdesk reset -server https://example.com -token ")
+	}
+	tok, err := s.ParseToken(out.lastToken(t), PurposeReset)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), tok.Expires, time.Minute)
+	assert.True(t, tok.Matches(sam))
+	assert.NotContains(t, tok.Stamp, "sam key")
+
+	sam.Key = "new key"
+	assert.False(t, tok.Matches(sam), "the token is used up once the key changed")
+}
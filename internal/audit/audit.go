@@ -0,0 +1,239 @@
+// Package audit keeps an append-only log of security relevant actions. Every
+// record carries the hash of its predecessor, so changing or removing a
+// stored record breaks the chain and is found by Verify.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ActionUserCreate   = "user.create"
+	ActionUserUpdate   = "user.update"
+	ActionUserDelete   = "user.delete"
+	ActionUserApprove  = "user.approve"
+	ActionEmailVerify  = "user.verify_email"
+	ActionKeyReset     = "user.reset_key"
+	ActionAuthFail     = "auth.fail"
+	ActionLogin        = "auth.login"
+	ActionTOTPEnable   = "totp.enable"
+	ActionTOTPDisable  = "totp.disable"
+	ActionTOTPReset    = "totp.reset"
+	ActionPermChange   = "file.perm"
+	ActionGroupCreate  = "group.create"
+	ActionGroupUpdate  = "group.update"
+	ActionGroupDelete  = "group.delete"
+	ActionInviteCreate = "invite.create"
+	ActionInviteRevoke = "invite.revoke"
+
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+
+	ChainBroken    = "audit chain broken"
+	RecordNotExist = "audit record not exists"
+
+	headKey   = "audit/head"
+	recordKey = "audit/record/"
+)
+
+type Record struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target"`
+	Outcome  string    `json:"outcome"`
+	ClientIP string    `json:"client_ip"`
+	Detail   string    `json:"detail,omitempty"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// ComputeHash hashes every field of r but Hash itself.
+func (r Record) ComputeHash() string {
+	h := sha256.New()
+	for _, f := range []string{
+		strconv.FormatUint(r.Seq, 10),
+		r.Time.UTC().Format(time.RFC3339Nano),
+		r.Actor,
+		r.Action,
+		r.Target,
+		r.Outcome,
+		r.ClientIP,
+		r.Detail,
+		r.PrevHash,
+	} {
+		// length prefixes keep field boundaries unambiguous
+		fmt.Fprintf(h, "%d:%s\n", len(f), f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type AuditError struct {
+	Kind string
+	Seq  uint64
+}
+
+func (a *AuditError) Error() string {
+	if a.Seq != 0 {
+		return fmt.Sprintf("%v at record %d", a.Kind, a.Seq)
+	}
+	return a.Kind
+}
+
+type head struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+type Log struct {
+	store storage.PutterGetter
+
+	// Now is the clock stamped on records, it defaults to time.Now.
+	Now func() time.Time
+
+	mu   sync.Mutex
+	head head
+}
+
+func NewLog(store storage.PutterGetter) (*Log, error) {
+	l := &Log{store: store, Now: time.Now}
+	if err := l.load(headKey, &l.head); err != nil && !storage.IsNotFound(err) {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) load(name string, v interface{}) error {
+	value, err := l.store.Get(name)
+	if err != nil {
+		return err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected value stored under %v", name)
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (l *Log) save(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return l.store.Put(name, b)
+}
+
+func key(seq uint64) string {
+	return fmt.Sprintf("%s%020d", recordKey, seq)
+}
+
+// Append chains r to the log. Seq, Time, PrevHash and Hash are filled in.
+func (l *Log) Append(r Record) (Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Seq = l.head.Seq + 1
+	r.Time = l.Now().UTC()
+	r.PrevHash = l.head.Hash
+	r.Hash = r.ComputeHash()
+
+	if err := l.save(key(r.Seq), r); err != nil {
+		return Record{}, err
+	}
+	h := head{Seq: r.Seq, Hash: r.Hash}
+	if err := l.save(headKey, h); err != nil {
+		return Record{}, err
+	}
+	l.head = h
+	return r, nil
+}
+
+// Len returns the number of records.
+func (l *Log) Len() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head.Seq
+}
+
+func (l *Log) Record(seq uint64) (Record, error) {
+	var r Record
+	err := l.load(key(seq), &r)
+	if storage.IsNotFound(err) {
+		return Record{}, &AuditError{Kind: RecordNotExist, Seq: seq}
+	}
+	return r, err
+}
+
+type Filter struct {
+	// User matches records with the user as actor or as target.
+	User   string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	// Limit caps the number of records returned, 0 means no limit.
+	Limit int
+}
+
+func (f Filter) match(r Record) bool {
+	return (f.User == "" || r.Actor == f.User || r.Target == f.User) &&
+		(f.Action == "" || r.Action == f.Action) &&
+		(f.Since.IsZero() || !r.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || r.Time.Before(f.Until))
+}
+
+// Query returns the records that match f, newest first.
+func (l *Log) Query(f Filter) ([]Record, error) {
+	ret := []Record{}
+	for seq := l.Len(); seq > 0; seq-- {
+		r, err := l.Record(seq)
+		if err != nil {
+			return nil, err
+		}
+		if !f.Since.IsZero() && r.Time.Before(f.Since) {
+			// records are appended in time order
+			break
+		}
+		if f.match(r) {
+			ret = append(ret, r)
+			if f.Limit > 0 && len(ret) >= f.Limit {
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Verify walks the whole chain and reports the first record that does not
+// fit, as an *AuditError of kind ChainBroken.
+func (l *Log) Verify() error {
+	l.mu.Lock()
+	h := l.head
+	l.mu.Unlock()
+
+	prev := ""
+	for seq := uint64(1); seq <= h.Seq; seq++ {
+		r, err := l.Record(seq)
+		if e, ok := err.(*AuditError); ok && e.Kind == RecordNotExist {
+			return &AuditError{Kind: ChainBroken, Seq: seq}
+		}
+		if err != nil {
+			return err
+		}
+		if r.Seq != seq || r.PrevHash != prev || r.ComputeHash() != r.Hash {
+			return &AuditError{Kind: ChainBroken, Seq: seq}
+		}
+		prev = r.Hash
+	}
+	if prev != h.Hash {
+		return &AuditError{Kind: ChainBroken, Seq: h.Seq}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"encoding/json"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newLog(t *testing.T) (*Log, *mock.Storage, *time.Time) {
+	store := mock.NewStorage()
+	l, err := NewLog(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.Now = func() time.Time { return now }
+	return l, store, &now
+}
+
+func TestLog_Append(t *testing.T) {
+	l, store, now := newLog(t)
+	assert.NoError(t, l.Verify(), "empty log should verify")
+
+	r1, err := l.Append(Record{Actor: "sam", Action: ActionUserCreate, Target: "sam", Outcome: OutcomeSuccess, ClientIP: "127.0.0.1"})
+	assert.NoError(t, err)
+	*now = now.Add(time.Minute)
+	r2, err := l.Append(Record{Actor: "tom", Action: ActionAuthFail, Target: "/file/a", Outcome: OutcomeFailure, Detail: "Not Authed"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(1), r1.Seq)
+	assert.Equal(t, "", r1.PrevHash)
+	assert.Equal(t, r1.Hash, r2.PrevHash)
+	assert.Equal(t, r2.ComputeHash(), r2.Hash)
+	assert.NoError(t, l.Verify())
+
+	// a restarted log continues the chain
+	l, err = NewLog(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r3, err := l.Append(Record{Actor: "sam", Action: ActionUserDelete, Target: "tom", Outcome: OutcomeSuccess})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), r3.Seq)
+	assert.Equal(t, r2.Hash, r3.PrevHash)
+	assert.NoError(t, l.Verify())
+}
+
+func TestLog_Verify(t *testing.T) {
+	l, store, _ := newLog(t)
+	for _, actor := range []string{"a", "b", "c"} {
+		_, _ = l.Append(Record{Actor: actor, Action: ActionUserUpdate, Outcome: OutcomeSuccess})
+	}
+
+	tampered, _ := l.Record(2)
+	original, _ := store.Get(key(2))
+	tampered.Outcome = OutcomeFailure
+	b, _ := json.Marshal(tampered)
+	_ = store.Put(key(2), b)
+
+	err := l.Verify()
+	if e, ok := err.(*AuditError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, ChainBroken, e.Kind)
+		assert.Equal(t, uint64(2), e.Seq)
+	}
+
+	// rehashing the changed record moves the break to its successor
+	tampered.Hash = tampered.ComputeHash()
+	b, _ = json.Marshal(tampered)
+	_ = store.Put(key(2), b)
+	err = l.Verify()
+	if e, ok := err.(*AuditError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, uint64(3), e.Seq)
+	}
+
+	_ = store.Put(key(2), original)
+	assert.NoError(t, l.Verify())
+
+	// dropping the newest record is caught through the head
+	_ = store.Put(headKey, []byte(`{"seq":2,"hash":"x"}`))
+	l, _ = NewLog(store)
+	assert.Error(t, l.Verify())
+}
+
+func TestLog_Query(t *testing.T) {
+	l, _, now := newLog(t)
+	start := *now
+	for _, r := range []Record{
+		{Actor: "sam", Action: ActionUserCreate, Target: "sam"},
+		{Actor: "tom", Action: ActionAuthFail, Target: "/file/a"},
+		{Actor: "sam", Action: ActionUserUpdate, Target: "tom"},
+		{Actor: "sam", Action: ActionPermChange, Target: "/file/b"},
+	} {
+		_, _ = l.Append(r)
+		*now = now.Add(time.Hour)
+	}
+
+	rs, err := l.Query(Filter{})
+	assert.NoError(t, err)
+	if assert.Len(t, rs, 4) {
+		assert.Equal(t, uint64(4), rs[0].Seq, "newest should come first")
+	}
+
+	rs, _ = l.Query(Filter{User: "tom"})
+	assert.Len(t, rs, 2, "user should match actor and target")
+
+	rs, _ = l.Query(Filter{Action: ActionAuthFail})
+	assert.Len(t, rs, 1)
+
+	rs, _ = l.Query(Filter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)})
+	if assert.Len(t, rs, 2) {
+		assert.Equal(t, uint64(3), rs[0].Seq)
+		assert.Equal(t, uint64(2), rs[1].Seq)
+	}
+
+	rs, _ = l.Query(Filter{User: "sam", Limit: 2})
+	assert.Len(t, rs, 2)
+}
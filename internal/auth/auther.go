@@ -11,6 +11,11 @@ const (
 	WrongFormat    string = "Wrong Format"
 	Outdated       string = "Message Outdated"
 	AutherInternal string = "Auther Internal Error"
+	Disabled       string = "User Disabled"
+	Pending        string = "User Pending Approval"
+	// SecondFactor is reported when the user has a second factor but the
+	// request carries no code of it.
+	SecondFactor string = "Second Factor Required"
 )
 
 type UserAuther interface {
@@ -25,3 +30,15 @@ type AutherError struct {
 func (a *AutherError) Error() string {
 	return a.Kind + ": " + a.Detail
 }
+
+// CheckActive fails for a user who may not log in: one disabled or still
+// waiting for approval.
+func CheckActive(user td.User) error {
+	if user.IsDisabled() {
+		return &AutherError{Disabled, "User Is Disabled"}
+	}
+	if user.IsPending() {
+		return &AutherError{Pending, "User Is Not Approved Yet"}
+	}
+	return nil
+}
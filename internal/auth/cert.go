@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How CertAuther finds the user of a client certificate.
+	MatchCN          = "cn"
+	MatchSAN         = "san"
+	MatchFingerprint = "fingerprint"
+
+	// MetaCertFingerprint is the User.Meta key holding the SHA-256
+	// fingerprints of the client certificates of a user, in hex and
+	// separated by commas, which MatchFingerprint looks for. Only admins
+	// may set it, as signup.Reserved tells, or users could claim the
+	// certificates of others.
+	MetaCertFingerprint = "cert_sha256"
+
+	Revoked string = "Certificate Revoked"
+)
+
+// CertAuther authenticates a request by the client certificate of its TLS
+// connection. The certificate must chain up to one of the CAs and not be
+// revoked by a CRL loaded with LoadCRL. Match tells how its user is found:
+// by the subject common name, by a subject alternative name, a DNS name,
+// email address or URI, or by its fingerprint in the Meta of a user.
+type CertAuther struct {
+	Match string
+	// Now is used to check validity, it is replaceable for tests.
+	Now func() time.Time
+
+	roots *x509.CertPool
+	cas   []*x509.Certificate
+
+	mu   sync.RWMutex
+	crls []*pkix.CertificateList
+}
+
+// NewCertAuther creates a CertAuther trusting the CA certificates in caPEM.
+func NewCertAuther(caPEM []byte, match string) (*CertAuther, error) {
+	switch match {
+	case MatchCN, MatchSAN, MatchFingerprint:
+	default:
+		return nil, fmt.Errorf("unknown match %q, want %q, %q or %q", match, MatchCN, MatchSAN, MatchFingerprint)
+	}
+	c := &CertAuther{Match: match, roots: x509.NewCertPool()}
+	for {
+		var block *pem.Block
+		block, caPEM = pem.Decode(caPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		c.roots.AddCert(ca)
+		c.cas = append(c.cas, ca)
+	}
+	if len(c.cas) == 0 {
+		return nil, errors.New("no CA certificate")
+	}
+	return c, nil
+}
+
+// Pool returns the CAs, for tls.Config.ClientCAs.
+func (c *CertAuther) Pool() *x509.CertPool {
+	return c.roots
+}
+
+func (c *CertAuther) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// LoadCRL replaces the revocation lists by the ones in b, PEM or DER, each
+// signed by one of the CAs.
+func (c *CertAuther) LoadCRL(b []byte) error {
+	var ders [][]byte
+	if !strings.Contains(string(b), "-----BEGIN") {
+		ders = append(ders, b)
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		return errors.New("no CRL")
+	}
+
+	var crls []*pkix.CertificateList
+	for _, der := range ders {
+		crl, err := x509.ParseDERCRL(der)
+		if err != nil {
+			return err
+		}
+		if c.issuerOf(crl) == nil {
+			return fmt.Errorf("CRL of %s is not signed by a CA", crl.TBSCertList.Issuer)
+		}
+		crls = append(crls, crl)
+	}
+	c.mu.Lock()
+	c.crls = crls
+	c.mu.Unlock()
+	return nil
+}
+
+// LoadCRLFile replaces the revocation lists by the ones in the file path.
+func (c *CertAuther) LoadCRLFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return c.LoadCRL(b)
+}
+
+func (c *CertAuther) issuerOf(crl *pkix.CertificateList) *x509.Certificate {
+	for _, ca := range c.cas {
+		if ca.Subject.String() == crl.TBSCertList.Issuer.String() && ca.CheckCRLSignature(crl) == nil {
+			return ca
+		}
+	}
+	return nil
+}
+
+// revoked checks the certificates of chain but the root against the CRLs
+// of their issuers. A CRL past its next update no longer tells, so it
+// revokes every certificate of its issuer.
+func (c *CertAuther) revoked(chain []*x509.Certificate) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := c.now()
+	for _, cert := range chain[:len(chain)-1] {
+		for _, crl := range c.crls {
+			if crl.TBSCertList.Issuer.String() != cert.Issuer.String() {
+				continue
+			}
+			if crl.HasExpired(now) {
+				return &AutherError{AutherInternal, "CRL Outdated"}
+			}
+			for _, r := range crl.TBSCertList.RevokedCertificates {
+				if r.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return &AutherError{Revoked, "Certificate Is Revoked"}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Presented reports whether req comes with a client certificate.
+func (c *CertAuther) Presented(req *http.Request) bool {
+	return req.TLS != nil && len(req.TLS.PeerCertificates) > 0
+}
+
+func (c *CertAuther) AuthUser(req *http.Request, us td.UserService) (td.User, error) {
+	if !c.Presented(req) {
+		return td.User{}, &AutherError{WrongFormat, "Missing Client Certificate"}
+	}
+	certs := req.TLS.PeerCertificates
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         c.roots,
+		Intermediates: intermediates,
+		CurrentTime:   c.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return td.User{}, &AutherError{NotAuthed, "Certificate Not Trusted"}
+	}
+	if err = c.revoked(chains[0]); err != nil {
+		return td.User{}, err
+	}
+
+	user, ok := c.user(certs[0], us)
+	if !ok {
+		return td.User{}, &AutherError{NoUser, "Cannot Find User"}
+	}
+	if err = CheckActive(user); err != nil {
+		return td.User{}, err
+	}
+	return user, nil
+}
+
+func (c *CertAuther) user(cert *x509.Certificate, us td.UserService) (td.User, bool) {
+	switch c.Match {
+	case MatchCN:
+		if cert.Subject.CommonName == "" {
+			return td.User{}, false
+		}
+		return us.User(cert.Subject.CommonName)
+	case MatchSAN:
+		for _, name := range SANs(cert) {
+			if user, ok := us.User(name); ok {
+				return user, true
+			}
+		}
+		return td.User{}, false
+	}
+
+	fp := Fingerprint(cert)
+	list, ok := td.Lister(us)
+	if !ok {
+		return td.User{}, false
+	}
+	users, err := list.Users()
+	if err != nil {
+		return td.User{}, false
+	}
+	// a fingerprint claimed by two users matches neither, it does not
+	// tell who holds the certificate
+	var found []td.User
+	for _, u := range users {
+		for _, f := range strings.Split(u.Meta[MetaCertFingerprint], ",") {
+			if strings.EqualFold(strings.TrimSpace(f), fp) {
+				found = append(found, u)
+				break
+			}
+		}
+	}
+	if len(found) != 1 {
+		return td.User{}, false
+	}
+	return found[0], true
+}
+
+// SANs returns the subject alternative names of cert MatchSAN tries: DNS
+// names, email addresses and URIs.
+func SANs(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// Fingerprint returns the SHA-256 of cert in hex, as MetaCertFingerprint
+// holds it.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a client certificate with the serial for the CN and email.
+func (ca *testCA) issue(t *testing.T, serial int64, cn, email string) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if email != "" {
+		tmpl.EmailAddresses = []string{email}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// crl returns a PEM CRL of ca revoking serials, valid until next.
+func (ca *testCA) crl(t *testing.T, next time.Time, serials ...int64) []byte {
+	var revoked []pkix.RevokedCertificate
+	for _, s := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, revoked, time.Now().Add(-time.Hour), next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func certRequest(certs ...*x509.Certificate) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/file/", nil)
+	if len(certs) > 0 {
+		req.TLS = &tls.ConnectionState{PeerCertificates: certs}
+	}
+	return req
+}
+
+func kindOf(err error) string {
+	if e, ok := err.(*AutherError); ok {
+		return e.Kind
+	}
+	return ""
+}
+
+func TestCertAuther_AuthUser(t *testing.T) {
+	ca := newTestCA(t, "Tempdesk CA")
+	us := mock.NewUserService()
+	_ = us.CreateUser(td.User{Name: "sam", Key: "password"})
+	_ = us.CreateUser(td.User{Name: "sam@example.com", Key: "password"})
+
+	_, err := NewCertAuther(ca.pem, "serial")
+	assert.NotNil(t, err, "unknown match")
+	_, err = NewCertAuther([]byte("no pem"), MatchCN)
+	assert.NotNil(t, err, "no CA")
+
+	a, err := NewCertAuther(ca.pem, MatchCN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.AuthUser(certRequest(), us)
+	assert.Equal(t, WrongFormat, kindOf(err))
+
+	user, err := a.AuthUser(certRequest(ca.issue(t, 2, "sam", "")), us)
+	assert.Nil(t, err)
+	assert.Equal(t, "sam", user.Name)
+
+	_, err = a.AuthUser(certRequest(ca.issue(t, 3, "tom", "")), us)
+	assert.Equal(t, NoUser, kindOf(err))
+
+	other := newTestCA(t, "Other CA")
+	_, err = a.AuthUser(certRequest(other.issue(t, 2, "sam", "")), us)
+	assert.Equal(t, NotAuthed, kindOf(err), "certificates of other CAs are not trusted")
+
+	a.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = a.AuthUser(certRequest(ca.issue(t, 4, "sam", "")), us)
+	assert.Equal(t, NotAuthed, kindOf(err), "expired certificates are not trusted")
+	a.Now = nil
+
+	_ = us.UpdateUser(td.User{Name: "sam", Key: "password", Meta: map[string]string{td.MetaDisabled: "true"}})
+	_, err = a.AuthUser(certRequest(ca.issue(t, 5, "sam", "")), us)
+	assert.Equal(t, Disabled, kindOf(err))
+
+	a.Match = MatchSAN
+	user, err = a.AuthUser(certRequest(ca.issue(t, 6, "nobody", "sam@example.com")), us)
+	assert.Nil(t, err)
+	assert.Equal(t, "sam@example.com", user.Name)
+}
+
+func TestCertAuther_Fingerprint(t *testing.T) {
+	ca := newTestCA(t, "Tempdesk CA")
+	a, _ := NewCertAuther(ca.pem, MatchFingerprint)
+	cert1, cert2 := ca.issue(t, 2, "laptop", ""), ca.issue(t, 3, "laptop", "")
+
+	us := mock.NewUserService()
+	_ = us.CreateUser(td.User{Name: "sam", Key: "password", Meta: map[string]string{
+		MetaCertFingerprint: "00ff, " + Fingerprint(cert1),
+	}})
+
+	user, err := a.AuthUser(certRequest(cert1), us)
+	assert.Nil(t, err)
+	assert.Equal(t, "sam", user.Name)
+	_, err = a.AuthUser(certRequest(cert2), us)
+	assert.Equal(t, NoUser, kindOf(err), "the CN alone does not tell the user")
+
+	_ = us.CreateUser(td.User{Name: "tom", Key: "password", Meta: map[string]string{
+		MetaCertFingerprint: Fingerprint(cert1),
+	}})
+	_, err = a.AuthUser(certRequest(cert1), us)
+	assert.Equal(t, NoUser, kindOf(err), "a fingerprint of two users matches neither")
+}
+
+func TestCertAuther_LoadCRL(t *testing.T) {
+	ca := newTestCA(t, "Tempdesk CA")
+	a, _ := NewCertAuther(ca.pem, MatchCN)
+	us := mock.NewUserService()
+	_ = us.CreateUser(td.User{Name: "sam", Key: "password"})
+	good, bad := ca.issue(t, 2, "sam", ""), ca.issue(t, 3, "sam", "")
+
+	other := newTestCA(t, "Tempdesk CA")
+	assert.NotNil(t, a.LoadCRL(other.crl(t, time.Now().Add(time.Hour), 2)), "the CRL must be signed by a CA")
+	assert.NotNil(t, a.LoadCRL([]byte("no crl")))
+
+	assert.Nil(t, a.LoadCRL(ca.crl(t, time.Now().Add(time.Hour), 3)))
+	_, err := a.AuthUser(certRequest(good), us)
+	assert.Nil(t, err)
+	_, err = a.AuthUser(certRequest(bad), us)
+	assert.Equal(t, Revoked, kindOf(err))
+
+	block, _ := pem.Decode(ca.crl(t, time.Now().Add(-time.Minute)))
+	assert.Nil(t, a.LoadCRL(block.Bytes), "DER is fine too")
+	_, err = a.AuthUser(certRequest(good), us)
+	assert.Equal(t, AutherInternal, kindOf(err), "an outdated CRL revokes everything")
+}
+
+func TestChain_AuthUser(t *testing.T) {
+	ca := newTestCA(t, "Tempdesk CA")
+	certAuther, _ := NewCertAuther(ca.pem, MatchCN)
+	us := mock.NewUserService()
+	_ = us.CreateUser(td.User{Name: "sam", Key: "password"})
+	c := Chain{NewHMACAuther(), certAuther}
+
+	_, err := Chain{}.AuthUser(certRequest(), us)
+	assert.Equal(t, AutherInternal, kindOf(err))
+
+	user, err := c.AuthUser(certRequest(ca.issue(t, 2, "sam", "")), us)
+	assert.Nil(t, err)
+	assert.Equal(t, "sam", user.Name)
+
+	req := certRequest(ca.issue(t, 3, "sam", ""))
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Authorization", "HMAC sam xxx")
+	_, err = c.AuthUser(req, us)
+	assert.Equal(t, NotAuthed, kindOf(err), "a request signed with HMAC is checked by HMACAuther")
+
+	_, err = c.AuthUser(certRequest(), us)
+	assert.Equal(t, WrongFormat, kindOf(err), "no credentials at all")
+
+	assert.Equal(t, "sam", ClaimedUser(certRequest(ca.issue(t, 4, "sam", ""))))
+}
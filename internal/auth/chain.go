@@ -0,0 +1,32 @@
+package auth
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"net/http"
+)
+
+// Presenter is implemented by a UserAuther that can tell whether a request
+// presents its kind of credentials at all.
+type Presenter interface {
+	Presented(req *http.Request) bool
+}
+
+// Chain lets several authers serve one server, like HMACAuther for people
+// and CertAuther for machines. A request is authenticated by the first
+// auther it presents credentials to, an auther that is no Presenter takes
+// every request that reaches it. A request presenting none is handed to
+// the first auther, which reports what it misses.
+type Chain []UserAuther
+
+func (c Chain) AuthUser(req *http.Request, us td.UserService) (td.User, error) {
+	if len(c) == 0 {
+		return td.User{}, &AutherError{AutherInternal, "No Auther"}
+	}
+	for _, a := range c {
+		if p, ok := a.(Presenter); ok && !p.Presented(req) {
+			continue
+		}
+		return a.AuthUser(req, us)
+	}
+	return c[0].AuthUser(req, us)
+}
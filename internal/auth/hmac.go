@@ -6,19 +6,57 @@ import (
 	"encoding/base64"
 	td "github.com/huangjiahua/tempdesk"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// Query parameters of a presigned link.
+	PresignUser      = "td-user"
+	PresignExpires   = "td-expires"
+	PresignSignature = "td-signature"
+
+	// MaxPresignTTL bounds how far in the future a presigned link may
+	// expire.
+	MaxPresignTTL = 7 * 24 * time.Hour
+
+	// DefaultMaxSkew is how far the Date of a signed request may be off
+	// unless SetMaxSkew says otherwise.
+	DefaultMaxSkew = 10 * time.Minute
+)
+
 type HMACAuther struct {
+	// maxSkew is shared by the copies of the auther, so that SetMaxSkew
+	// reaches the one a State holds.
+	maxSkew *int64
 }
 
 func NewHMACAuther() HMACAuther {
-	return HMACAuther{}
+	skew := int64(DefaultMaxSkew)
+	return HMACAuther{maxSkew: &skew}
+}
+
+// SetMaxSkew changes how far the Date of a signed request may be off, it is
+// safe to call while requests are served. The auther must come from
+// NewHMACAuther.
+func (j HMACAuther) SetMaxSkew(d time.Duration) {
+	atomic.StoreInt64(j.maxSkew, int64(d))
+}
+
+func (j HMACAuther) MaxSkew() time.Duration {
+	if j.maxSkew == nil {
+		return DefaultMaxSkew
+	}
+	return time.Duration(atomic.LoadInt64(j.maxSkew))
 }
 
 func (j HMACAuther) AuthUser(req *http.Request, us td.UserService) (td.User, error) {
 	a := req.Header.Get("Authorization")
+	if len(a) == 0 && req.URL.Query().Get(PresignSignature) != "" {
+		return j.authPresigned(req, us)
+	}
 	d := req.Header.Get("Date")
 	if len(a) == 0 || len(d) == 0 {
 		return td.User{}, &AutherError{WrongFormat, "Missing Header"}
@@ -30,7 +68,8 @@ func (j HMACAuther) AuthUser(req *http.Request, us td.UserService) (td.User, err
 	}
 
 	now := time.Now().UTC()
-	if now.Sub(t) > 10*time.Minute || t.Sub(now) > 10*time.Minute {
+	skew := j.MaxSkew()
+	if now.Sub(t) > skew || t.Sub(now) > skew {
 		return td.User{}, &AutherError{Outdated, "Message Is Not Valid"}
 	}
 
@@ -42,21 +81,99 @@ func (j HMACAuther) AuthUser(req *http.Request, us td.UserService) (td.User, err
 	username := fields[1]
 
 	user, ok := us.User(username)
+	msg := req.Method + "\n" + req.URL.Path + "\n" + username + "\n" + d
+	// the digest is checked for a missing user too, so that it takes as
+	// long as a wrong key
+	valid := ValidDigest([]byte(msg), fields[2], []byte(user.Key))
 	if !ok {
-		return user, &AutherError{NoUser, "Cannot Find User"}
+		return td.User{}, &AutherError{NoUser, "Cannot Find User"}
 	}
-
-	msg := req.Method + "\n" + req.URL.Path + "\n" + username + "\n" + d
-	if !ValidDigest([]byte(msg), fields[2], []byte(user.Key)) {
+	if !valid {
 		return td.User{}, &AutherError{NotAuthed, "Not Authed"}
 	}
+	if err := CheckActive(user); err != nil {
+		return td.User{}, err
+	}
 
 	return user, nil
 }
 
+// Presented reports whether req carries an HMAC Authorization header or is
+// a presigned link.
+func (j HMACAuther) Presented(req *http.Request) bool {
+	if a := req.Header.Get("Authorization"); a != "" {
+		return strings.HasPrefix(a, "HMAC ")
+	}
+	return req.URL.Query().Get(PresignSignature) != ""
+}
+
+// authPresigned authenticates a GET or HEAD request by a link a user signed
+// with its key. The signature covers the method GET, the path, the user name
+// and the expiry in Unix seconds, like the Authorization header does.
+func (j HMACAuther) authPresigned(req *http.Request, us td.UserService) (td.User, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return td.User{}, &AutherError{WrongFormat, "Presigned Link Only Allows GET"}
+	}
+
+	q := req.URL.Query()
+	expires := q.Get(PresignExpires)
+	sec, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return td.User{}, &AutherError{WrongFormat, "Wrong Expiry Format"}
+	}
+	now := time.Now()
+	exp := time.Unix(sec, 0)
+	if !now.Before(exp) {
+		return td.User{}, &AutherError{Outdated, "Link Expired"}
+	}
+	if exp.Sub(now) > MaxPresignTTL {
+		return td.User{}, &AutherError{WrongFormat, "Link Expires Too Late"}
+	}
+
+	username := q.Get(PresignUser)
+	user, ok := us.User(username)
+	msg := http.MethodGet + "\n" + req.URL.Path + "\n" + username + "\n" + expires
+	// the digest is checked for a missing user too, so that it takes as
+	// long as a wrong key
+	valid := ValidDigest([]byte(msg), q.Get(PresignSignature), []byte(user.Key))
+	if !ok {
+		return td.User{}, &AutherError{NoUser, "Cannot Find User"}
+	}
+	if !valid {
+		return td.User{}, &AutherError{NotAuthed, "Not Authed"}
+	}
+	if err := CheckActive(user); err != nil {
+		return td.User{}, err
+	}
+	return user, nil
+}
+
+// ClaimedUser returns the user name an HMAC or Basic Authorization header,
+// a presigned link or else the common name of a client certificate claims,
+// whether or not it authenticates.
+func ClaimedUser(req *http.Request) string {
+	if req.Header.Get("Authorization") == "" {
+		if name := req.URL.Query().Get(PresignUser); name != "" {
+			return name
+		}
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			return req.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		return ""
+	}
+	if name, _, ok := req.BasicAuth(); ok {
+		return name
+	}
+	fields := strings.Fields(req.Header.Get("Authorization"))
+	if len(fields) != 3 || fields[0] != "HMAC" {
+		return ""
+	}
+	return fields[1]
+}
+
 func ValidDigest(message []byte, digest string, key []byte) bool {
 	mac := hmac.New(sha256.New, key)
 	mac.Write(message)
 	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
-	return expected == digest
+	return hmac.Equal([]byte(expected), []byte(digest))
 }
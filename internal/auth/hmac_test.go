@@ -8,6 +8,7 @@ import (
 	td "github.com/huangjiahua/tempdesk"
 	"github.com/huangjiahua/tempdesk/internal/mock"
 	"net/http"
+	"net/url"
 	"testing"
 	"time"
 )
@@ -55,7 +56,107 @@ func TestHMACAuther_AuthUser(t *testing.T) {
 		t.Errorf("Should authed here: %v", err)
 	}
 
+	user1.Meta = map[string]string{td.MetaDisabled: "true"}
+	_ = us.UpdateUser(user1)
+	_, err = a.AuthUser(req, us)
+	errIsKind(t, err, Disabled)
+
+	user1.Meta = map[string]string{td.MetaPending: "true"}
+	_ = us.UpdateUser(user1)
+	_, err = a.AuthUser(req, us)
+	errIsKind(t, err, Pending)
+
 	req.Header.Set("Date", time.Now().UTC().Add(-10*time.Minute-1*time.Second).Format(http.TimeFormat))
 	_, err = a.AuthUser(req, us)
 	errIsKind(t, err, Outdated)
 }
+
+func TestHMACAuther_AuthUser_Presigned(t *testing.T) {
+	a := NewHMACAuther()
+	us := mock.NewUserService()
+	_ = us.CreateUser(td.User{Name: "Sam", Key: "password"})
+
+	presign := func(method, path string, expires time.Time) *http.Request {
+		exp := fmt.Sprint(expires.Unix())
+		mac := hmac.New(sha256.New, []byte("password"))
+		mac.Write([]byte("GET\n" + path + "\nSam\n" + exp))
+		q := url.Values{
+			PresignUser:      {"Sam"},
+			PresignExpires:   {exp},
+			PresignSignature: {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+		}
+		req, _ := http.NewRequest(method, "http://example.com"+path+"?"+q.Encode(), nil)
+		return req
+	}
+
+	user, err := a.AuthUser(presign(http.MethodGet, "/file/a.txt", time.Now().Add(time.Hour)), us)
+	if err != nil || user.Name != "Sam" {
+		t.Errorf("Should authed here: %v", err)
+	}
+	if _, err = a.AuthUser(presign(http.MethodHead, "/file/a.txt", time.Now().Add(time.Hour)), us); err != nil {
+		t.Errorf("Should authed a HEAD request: %v", err)
+	}
+
+	req := presign(http.MethodGet, "/file/a.txt", time.Now().Add(time.Hour))
+	if ClaimedUser(req) != "Sam" {
+		t.Errorf("Should claim Sam: %v", ClaimedUser(req))
+	}
+	req.URL.Path = "/file/b.txt"
+	_, err = a.AuthUser(req, us)
+	if err == nil || err.(*AutherError).Kind != NotAuthed {
+		t.Errorf("Should not auth another path: %v", err)
+	}
+
+	_, err = a.AuthUser(presign(http.MethodPut, "/file/a.txt", time.Now().Add(time.Hour)), us)
+	if err == nil || err.(*AutherError).Kind != WrongFormat {
+		t.Errorf("Should not auth a PUT: %v", err)
+	}
+	_, err = a.AuthUser(presign(http.MethodGet, "/file/a.txt", time.Now().Add(-time.Second)), us)
+	if err == nil || err.(*AutherError).Kind != Outdated {
+		t.Errorf("Should not auth an expired link: %v", err)
+	}
+	_, err = a.AuthUser(presign(http.MethodGet, "/file/a.txt", time.Now().Add(MaxPresignTTL+time.Hour)), us)
+	if err == nil || err.(*AutherError).Kind != WrongFormat {
+		t.Errorf("Should not auth a link living too long: %v", err)
+	}
+}
+
+func TestHMACAuther_SetMaxSkew(t *testing.T) {
+	a := NewHMACAuther()
+	us := mock.NewUserService()
+	_ = us.CreateUser(td.User{Name: "Sam", Key: "password"})
+
+	signed := func(date time.Time) *http.Request {
+		d := date.UTC().Format(http.TimeFormat)
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/path/", nil)
+		mac := hmac.New(sha256.New, []byte("password"))
+		mac.Write([]byte(req.Method + "\n" + req.URL.Path + "\nSam\n" + d))
+		req.Header.Set("Date", d)
+		req.Header.Set("Authorization", "HMAC Sam "+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+		return req
+	}
+
+	if a.MaxSkew() != DefaultMaxSkew {
+		t.Errorf("Should start with the default skew: %v", a.MaxSkew())
+	}
+	if _, err := a.AuthUser(signed(time.Now().Add(-20*time.Minute)), us); err == nil || err.(*AutherError).Kind != Outdated {
+		t.Errorf("Should not auth a request 20 minutes old: %v", err)
+	}
+
+	// a copy, like the one a State holds, sees the change
+	held := a
+	a.SetMaxSkew(30 * time.Minute)
+	if _, err := held.AuthUser(signed(time.Now().Add(-20*time.Minute)), us); err != nil {
+		t.Errorf("Should auth a request 20 minutes old: %v", err)
+	}
+
+	a.SetMaxSkew(time.Minute)
+	if _, err := held.AuthUser(signed(time.Now().Add(2*time.Minute)), us); err == nil || err.(*AutherError).Kind != Outdated {
+		t.Errorf("Should not auth a request 2 minutes ahead: %v", err)
+	}
+
+	var zero HMACAuther
+	if zero.MaxSkew() != DefaultMaxSkew {
+		t.Errorf("A zero auther should use the default skew: %v", zero.MaxSkew())
+	}
+}
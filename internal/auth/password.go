@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"crypto/hmac"
+	td "github.com/huangjiahua/tempdesk"
+	"net/http"
+	"strings"
+)
+
+// PasswordAuther authenticates a request by the name and key of a user in
+// Basic Authorization. It is meant for logging in to a session only: the
+// key itself crosses the wire, so it needs TLS.
+type PasswordAuther struct{}
+
+func NewPasswordAuther() PasswordAuther {
+	return PasswordAuther{}
+}
+
+// Presented reports whether req carries a Basic Authorization header.
+func (PasswordAuther) Presented(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Authorization"), "Basic ")
+}
+
+func (PasswordAuther) AuthUser(req *http.Request, us td.UserService) (td.User, error) {
+	name, key, ok := req.BasicAuth()
+	if !ok {
+		return td.User{}, &AutherError{WrongFormat, "Missing Basic Authorization"}
+	}
+	user, ok := us.User(name)
+	// compared for a missing user too, so that it takes as long as a
+	// wrong key
+	valid := hmac.Equal([]byte(key), []byte(user.Key))
+	if !ok {
+		return td.User{}, &AutherError{NoUser, "Cannot Find User"}
+	}
+	if !valid || key == "" {
+		return td.User{}, &AutherError{NotAuthed, "Not Authed"}
+	}
+	if err := CheckActive(user); err != nil {
+		return td.User{}, err
+	}
+	return user, nil
+}
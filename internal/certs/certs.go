@@ -0,0 +1,151 @@
+// Package certs serves the server over TLS: it sets up crypto/tls with
+// modern defaults, keeps a certificate from files fresh when they change on
+// disk, sends plain HTTP requests over to HTTPS and asks browsers to stay
+// there.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how often Watch looks at the certificate files.
+const DefaultInterval = time.Minute
+
+// Config returns a server TLS config taking its certificate from get. It
+// allows TLS 1.2 and 1.3 only, and under TLS 1.2 only forward secret AEAD
+// cipher suites, which every current client supports.
+func Config(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
+		PreferServerCipherSuites: true,
+		GetCertificate:           get,
+	}
+}
+
+// stamp tells whether a file changed.
+type stamp struct {
+	mod  time.Time
+	size int64
+}
+
+func stat(path string) (stamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return stamp{}, err
+	}
+	return stamp{mod: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// Reloader serves the certificate of a PEM certificate chain file and key
+// file, loading them again when they change. A pair that does not load,
+// like one caught half written, leaves the current certificate in place.
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	cs   stamp
+	ks   stamp
+}
+
+// NewReloader loads the certificate of certFile and keyFile.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{CertFile: certFile, KeyFile: keyFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate hands the certificate to crypto/tls as the
+// tls.Config.GetCertificate callback.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, errors.New("certs: no certificate loaded")
+	}
+	return r.cert, nil
+}
+
+// Expiry returns when the current certificate expires.
+func (r *Reloader) Expiry() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil || r.cert.Leaf == nil {
+		return time.Time{}
+	}
+	return r.cert.Leaf.NotAfter
+}
+
+// Reload loads the files again if either changed since they were loaded,
+// and reports whether it did.
+func (r *Reloader) Reload() (bool, error) {
+	cs, err := stat(r.CertFile)
+	if err != nil {
+		return false, err
+	}
+	ks, err := stat(r.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	same := r.cert != nil && cs == r.cs && ks == r.ks
+	r.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.cert, r.cs, r.ks = &cert, cs, ks
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Watch reloads the files every interval until ctx is done. onReload is
+// called after a new certificate is loaded and onError when loading fails,
+// either may be nil.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, onReload func(), onError func(error)) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		reloaded, err := r.Reload()
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		if reloaded && onReload != nil {
+			onReload()
+		}
+	}
+}
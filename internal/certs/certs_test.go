@@ -0,0 +1,160 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/huangjiahua/tempdesk/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate for name and its key, serial
+// tells the certificates apart and is the days until it expires.
+func writePair(t *testing.T, certFile, keyFile, name string, serial int64) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Duration(serial) * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serial(t *testing.T, r *Reloader) int64 {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestReloader(t *testing.T) {
+	dir := testutil.TempDir(t)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	_, err := NewReloader(certFile, keyFile)
+	assert.NotNil(t, err, "the files must exist")
+
+	writePair(t, certFile, keyFile, "example.com", 10)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(10), serial(t, r))
+	reloaded, err := r.Reload()
+	assert.False(t, reloaded, "unchanged files are not loaded again")
+	assert.Nil(t, err)
+
+	// a certificate written without its key yet keeps the old one
+	writePair(t, certFile, filepath.Join(dir, "other.pem"), "example.com", 20)
+	reloaded, err = r.Reload()
+	assert.False(t, reloaded)
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(10), serial(t, r))
+
+	writePair(t, certFile, keyFile, "example.com", 30)
+	reloaded, err = r.Reload()
+	assert.True(t, reloaded)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(30), serial(t, r))
+	assert.True(t, r.Expiry().After(time.Now().Add(29*24*time.Hour)))
+
+	// Watch picks up the next change
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{}, 1)
+	go r.Watch(ctx, 10*time.Millisecond, func() { done <- struct{}{} }, nil)
+	writePair(t, certFile, keyFile, "example.com", 40)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not reload")
+	}
+	assert.Equal(t, int64(40), serial(t, r))
+}
+
+func TestConfig(t *testing.T) {
+	dir := testutil.TempDir(t)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePair(t, certFile, keyFile, "example.com", 1)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	srv.TLS = Config(r.GetCertificate)
+	srv.StartTLS()
+	defer srv.Close()
+
+	cert, _ := r.GetCertificate(nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	dial := func(max uint16) error {
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+			ServerName: "example.com",
+			RootCAs:    roots,
+			MaxVersion: max,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	assert.Nil(t, dial(tls.VersionTLS13))
+	assert.Nil(t, dial(tls.VersionTLS12))
+	assert.NotNil(t, dial(tls.VersionTLS11), "TLS 1.1 is refused")
+}
+
+func TestRedirect(t *testing.T) {
+	cases := []struct {
+		httpsAddr, method, url, want string
+		status                       int
+	}{
+		{":443", http.MethodGet, "http://example.com/file/a.txt?x=1", "https://example.com/file/a.txt?x=1", http.StatusMovedPermanently},
+		{":8443", http.MethodGet, "http://example.com:8080/file/", "https://example.com:8443/file/", http.StatusMovedPermanently},
+		{"127.0.0.1:8443", http.MethodPut, "http://[::1]/file/a", "https://[::1]:8443/file/a", http.StatusPermanentRedirect},
+		{":443", http.MethodHead, "http://[::1]:80/", "https://[::1]/", http.StatusMovedPermanently},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		Redirect(c.httpsAddr).ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+		assert.Equal(t, c.status, w.Code, c.url)
+		assert.Equal(t, c.want, w.Header().Get("Location"), c.url)
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	w := httptest.NewRecorder()
+	HSTS(365*24*time.Hour, next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "max-age=31536000", w.Header().Get("Strict-Transport-Security"))
+
+	w = httptest.NewRecorder()
+	HSTS(0, next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "", w.Header().Get("Strict-Transport-Security"))
+}
@@ -0,0 +1,56 @@
+package certs
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redirect answers every plain HTTP request with a permanent redirect to
+// the same URL over HTTPS, on the port of httpsAddr. GET and HEAD requests
+// get a 301, others a 308, which keeps the method.
+func Redirect(httpsAddr string) http.Handler {
+	port := ""
+	if _, p, err := net.SplitHostPort(httpsAddr); err == nil && p != "443" && p != "" {
+		port = p
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if host == "" {
+			http.Error(w, "Missing Host", http.StatusBadRequest)
+			return
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u := *req.URL
+		u.Scheme, u.Host = "https", host
+		status := http.StatusPermanentRedirect
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, req, u.String(), status)
+	})
+}
+
+// HSTS sets the Strict-Transport-Security header on every response of next,
+// telling browsers to reach the server only over HTTPS for maxAge. A maxAge
+// of 0 leaves next as it is.
+func HSTS(maxAge time.Duration, next http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return next
+	}
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,735 @@
+// Package config holds the settings of the server. They start from their
+// defaults and are read from a config file in YAML, TOML or JSON, then from
+// TEMPDESK_* environment variables and then from command line flags, each
+// overriding the ones before.
+//
+// Every setting has a key like "auth.clock_skew", which names it in the
+// config file as a nested table, in the environment as
+// TEMPDESK_AUTH_CLOCK_SKEW and in error messages.
+package config
+
+import (
+	"fmt"
+	"github.com/huangjiahua/tempdesk/internal/account"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"github.com/huangjiahua/tempdesk/internal/ratelimit"
+	"github.com/huangjiahua/tempdesk/internal/session"
+	"github.com/huangjiahua/tempdesk/internal/signup"
+	"github.com/huangjiahua/tempdesk/internal/totp"
+	"github.com/huangjiahua/tempdesk/pkg/acme"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BackendMemory = "memory"
+	BackendDir    = "dir"
+
+	DefaultAddr      = ":8080"
+	DefaultClockSkew = 10 * time.Minute
+	// MaxClockSkew bounds auth.clock_skew, a longer one would let signed
+	// requests be replayed for too long.
+	MaxClockSkew = 24 * time.Hour
+
+	// MaxSessionTTL bounds auth.session_ttl.
+	MaxSessionTTL = 30 * 24 * time.Hour
+
+	// MaxResetTTL bounds mail.reset_ttl.
+	MaxResetTTL = 24 * time.Hour
+
+	DefaultLockoutAfter = 10
+	// DefaultNameLockoutAfter is the failures of a user name from all
+	// addresses together locking it out for everyone.
+	DefaultNameLockoutAfter = 100
+	DefaultLockout          = time.Minute
+	DefaultLockoutMax       = time.Hour
+
+	// EnvPrefix starts the environment variables of the settings.
+	EnvPrefix = "TEMPDESK_"
+)
+
+type Config struct {
+	Server  Server
+	TLS     TLS
+	ACME    ACME
+	Storage Storage
+	Auth    Auth
+	Limit   Limit
+	Signup  Signup
+	Mail    Mail
+	Log     Log
+}
+
+type Server struct {
+	// Addr is the address to listen on.
+	Addr string
+}
+
+// TLS serves the server over HTTPS when a certificate comes from CertFile
+// and KeyFile or from ACME.
+type TLS struct {
+	// CertFile and KeyFile are PEM files, loaded again when they change.
+	CertFile string
+	KeyFile  string
+	// HTTPAddr is where plain HTTP requests are redirected to HTTPS and
+	// ACME challenges are answered, none if empty.
+	HTTPAddr string
+	// HSTS is the max-age of the Strict-Transport-Security header, which is
+	// not sent while it is 0.
+	HSTS time.Duration
+}
+
+// ACME obtains the certificate from the CA of Directory, which is off while
+// it is empty.
+type ACME struct {
+	Directory string
+	Email     string
+	Domains   []string
+	// CAFile is a PEM file of the CAs trusted to serve Directory besides the
+	// system ones, like the one of a test CA.
+	CAFile string
+}
+
+type Storage struct {
+	// Backend is BackendMemory or BackendDir, which keeps files, users,
+	// the audit log, webhooks and shares in Dir.
+	Backend string
+	Dir     string
+}
+
+type Auth struct {
+	// ClockSkew is how far the Date of a signed request may be off.
+	ClockSkew time.Duration
+	// ClientCAFile is a PEM file of the CAs whose client certificates
+	// authenticate users besides HMAC signatures, none if empty.
+	ClientCAFile string
+	// ClientCRLFile is a PEM or DER file of revocation lists of the client
+	// CAs, loaded again on SIGHUP.
+	ClientCRLFile string
+	// ClientCertMatch tells how the user of a client certificate is found:
+	// "cn", "san" or "fingerprint".
+	ClientCertMatch string
+	// UniformErrors reports an unknown user like a wrong key, and counts it
+	// toward a lockout, so neither tells which users exist.
+	UniformErrors bool
+	// SessionTTL is how long a browser login lasts.
+	SessionTTL time.Duration
+	// TOTPIssuer names the server in authenticator apps.
+	TOTPIssuer string
+	// TOTPSkip are the scopes, "hmac", "cert" or "password", whose requests
+	// need no TOTP code from users who enrolled.
+	TOTPSkip []string
+}
+
+// Limit rate limits the requests of every client IP and user name, which is
+// off while the rate is 0. It locks a client IP out of a user name after
+// LockoutAfter failed authentications in a row, and every client after
+// NameLockoutAfter failures from any addresses, for Lockout and twice as
+// long for each further failure up to LockoutMax.
+type Limit struct {
+	IPPerMinute      int
+	IPBurst          int
+	UserPerMinute    int
+	UserBurst        int
+	LockoutAfter     int
+	NameLockoutAfter int
+	Lockout          time.Duration
+	LockoutMax       time.Duration
+}
+
+// Signup controls who may sign up and the names and keys they may choose.
+type Signup struct {
+	// Mode is "open", "invite", "approval" or "closed".
+	Mode    string
+	NameMin int
+	NameMax int
+	KeyMin  int
+}
+
+// Mail sends users mails to verify their addresses and reset their keys
+// through the SMTP server at SMTPAddr, which is off while it is empty.
+type Mail struct {
+	SMTPAddr string
+	// Username and Password log in to the SMTP server, which needs TLS
+	// unless it is on localhost.
+	Username string
+	Password string
+	// From is the sender of the mails.
+	From string
+	// BaseURL is the address of the server the mails point to, like
+	// "https://tempdesk.example.com".
+	BaseURL string
+	// TemplateDir holds verify.tmpl and reset.tmpl replacing the default
+	// templates, none if empty.
+	TemplateDir string
+	// ResetTTL is how long a reset token works.
+	ResetTTL time.Duration
+}
+
+type Log struct {
+	Level    string
+	Encoding string
+	Output   string
+	// MaxSize, MaxAge and MaxBackups rotate a log file.
+	MaxSize    int
+	MaxAge     time.Duration
+	MaxBackups int
+	// SampleInitial and SampleThereafter sample repeated messages, which
+	// is off while both are 0.
+	SampleInitial    int
+	SampleThereafter int
+}
+
+// Default returns the settings used where nothing else is given.
+func Default() *Config {
+	return &Config{
+		Server:  Server{Addr: DefaultAddr},
+		Storage: Storage{Backend: BackendMemory},
+		Auth:    Auth{ClockSkew: DefaultClockSkew, ClientCertMatch: auth.MatchCN, SessionTTL: session.DefaultTTL, TOTPIssuer: totp.DefaultIssuer, TOTPSkip: []string{totp.ScopeHMAC, totp.ScopeCert}},
+		Limit: Limit{LockoutAfter: DefaultLockoutAfter, NameLockoutAfter: DefaultNameLockoutAfter,
+			Lockout: DefaultLockout, LockoutMax: DefaultLockoutMax},
+		Signup: Signup{Mode: signup.ModeOpen, NameMin: signup.DefaultNameMin, NameMax: signup.DefaultNameMax, KeyMin: signup.DefaultKeyMin},
+		Mail:   Mail{ResetTTL: account.DefaultResetTTL},
+		Log:    Log{Level: "info", Encoding: tlog.EncodingJSON, Output: tlog.OutputStdout},
+	}
+}
+
+// MailEnabled reports whether the server sends mails.
+func (c *Config) MailEnabled() bool {
+	return c.Mail.SMTPAddr != ""
+}
+
+// TLSEnabled reports whether the server is served over HTTPS.
+func (c *Config) TLSEnabled() bool {
+	return c.TLS.CertFile != "" || c.ACME.Directory != ""
+}
+
+// LogConfig returns the log settings as the log package takes them.
+func (c *Config) LogConfig() tlog.Config {
+	cfg := tlog.Config{
+		Level:    c.Log.Level,
+		Encoding: c.Log.Encoding,
+		Output:   c.Log.Output,
+		Rotation: tlog.RotationConfig{MaxSize: c.Log.MaxSize, MaxAge: c.Log.MaxAge, MaxBackups: c.Log.MaxBackups},
+	}
+	if c.Log.SampleInitial > 0 {
+		cfg.Sampling = &tlog.SamplingConfig{Initial: c.Log.SampleInitial, Thereafter: c.Log.SampleThereafter}
+	}
+	return cfg
+}
+
+// RateLimitPolicy returns the limit settings as the ratelimit package takes
+// them.
+func (c *Config) RateLimitPolicy() ratelimit.Policy {
+	return ratelimit.Policy{
+		IP:          ratelimit.Rate{PerMinute: c.Limit.IPPerMinute, Burst: c.Limit.IPBurst},
+		User:        ratelimit.Rate{PerMinute: c.Limit.UserPerMinute, Burst: c.Limit.UserBurst},
+		Lockout:     ratelimit.Lockout{After: c.Limit.LockoutAfter, Duration: c.Limit.Lockout, Max: c.Limit.LockoutMax},
+		NameLockout: ratelimit.Lockout{After: c.Limit.NameLockoutAfter, Duration: c.Limit.Lockout, Max: c.Limit.LockoutMax},
+		Uniform:     c.Auth.UniformErrors,
+	}
+}
+
+// SignupPolicy returns the name and key settings as the signup package takes
+// them.
+func (c *Config) SignupPolicy() signup.Policy {
+	return signup.Policy{NameMin: c.Signup.NameMin, NameMax: c.Signup.NameMax, KeyMin: c.Signup.KeyMin}
+}
+
+// setting describes one setting: how it is parsed, shown and checked.
+type setting struct {
+	key   string
+	flag  string
+	usage string
+	// reload tells that a change takes effect without a restart.
+	reload bool
+	// list settings may be written as a list in a config file.
+	list bool
+	// boolean settings are flags without a value.
+	boolean bool
+	// secret settings are not shown by Public.
+	secret bool
+	set    func(c *Config, v string) error
+	get    func(c *Config) string
+}
+
+var settings = []setting{
+	stringSetting("server.addr", "addr", "address to listen on", false,
+		func(c *Config) *string { return &c.Server.Addr }),
+	stringSetting("tls.cert_file", "tls-cert", "PEM certificate chain file to serve HTTPS with", false,
+		func(c *Config) *string { return &c.TLS.CertFile }),
+	stringSetting("tls.key_file", "tls-key", "PEM key file of tls.cert_file", false,
+		func(c *Config) *string { return &c.TLS.KeyFile }),
+	stringSetting("tls.http_addr", "http-addr", "address redirecting plain HTTP to HTTPS and answering ACME challenges", false,
+		func(c *Config) *string { return &c.TLS.HTTPAddr }),
+	durationSetting("tls.hsts", "hsts", "max-age of the Strict-Transport-Security header, 0 for none", false,
+		func(c *Config) *time.Duration { return &c.TLS.HSTS }),
+	stringSetting("acme.directory", "acme-directory", "ACME directory URL to obtain the certificate from, like "+acme.LetsEncryptURL, false,
+		func(c *Config) *string { return &c.ACME.Directory }),
+	stringSetting("acme.email", "acme-email", "contact of the ACME account", false,
+		func(c *Config) *string { return &c.ACME.Email }),
+	listSetting("acme.domains", "acme-domains", "comma separated domains of the ACME certificate", false,
+		func(c *Config) *[]string { return &c.ACME.Domains }),
+	stringSetting("acme.ca_file", "acme-ca", "PEM file of further CAs trusted to serve acme.directory", false,
+		func(c *Config) *string { return &c.ACME.CAFile }),
+	stringSetting("storage.backend", "storage-backend", "where users and other records are kept: memory or dir", false,
+		func(c *Config) *string { return &c.Storage.Backend }),
+	stringSetting("storage.dir", "storage-dir", "directory of the dir backend", false,
+		func(c *Config) *string { return &c.Storage.Dir }),
+	durationSetting("auth.clock_skew", "clock-skew", "how far the Date of a signed request may be off", true,
+		func(c *Config) *time.Duration { return &c.Auth.ClockSkew }),
+	stringSetting("auth.client_ca_file", "client-ca", "PEM file of the CAs of client certificates authenticating users", false,
+		func(c *Config) *string { return &c.Auth.ClientCAFile }),
+	stringSetting("auth.client_crl_file", "client-crl", "PEM or DER revocation lists of the client CAs, loaded again on SIGHUP", false,
+		func(c *Config) *string { return &c.Auth.ClientCRLFile }),
+	stringSetting("auth.client_cert_match", "client-cert-match", "how a client certificate names its user: cn, san or fingerprint", false,
+		func(c *Config) *string { return &c.Auth.ClientCertMatch }),
+	boolSetting("auth.uniform_errors", "uniform-auth-errors", "report an unknown user like a wrong key, so neither tells which users exist", true,
+		func(c *Config) *bool { return &c.Auth.UniformErrors }),
+	durationSetting("auth.session_ttl", "session-ttl", "how long a browser login lasts", true,
+		func(c *Config) *time.Duration { return &c.Auth.SessionTTL }),
+	stringSetting("auth.totp_issuer", "totp-issuer", "name of the server in authenticator apps", false,
+		func(c *Config) *string { return &c.Auth.TOTPIssuer }),
+	listSetting("auth.totp_skip", "totp-skip", "comma separated scopes needing no TOTP code: hmac, cert or password", true,
+		func(c *Config) *[]string { return &c.Auth.TOTPSkip }),
+	intSetting("limit.ip_per_minute", "limit-ip", "requests each client IP may make a minute, 0 for no limit", true,
+		func(c *Config) *int { return &c.Limit.IPPerMinute }),
+	intSetting("limit.ip_burst", "limit-ip-burst", "requests a client IP may make at once, limit.ip_per_minute if 0", true,
+		func(c *Config) *int { return &c.Limit.IPBurst }),
+	intSetting("limit.user_per_minute", "limit-user", "requests claiming each user name may be made a minute, 0 for no limit", true,
+		func(c *Config) *int { return &c.Limit.UserPerMinute }),
+	intSetting("limit.user_burst", "limit-user-burst", "requests claiming a user name may be made at once, limit.user_per_minute if 0", true,
+		func(c *Config) *int { return &c.Limit.UserBurst }),
+	intSetting("limit.lockout_after", "lockout-after", "failed authentications in a row locking a client IP out of a user name, 0 for never", true,
+		func(c *Config) *int { return &c.Limit.LockoutAfter }),
+	intSetting("limit.name_lockout_after", "name-lockout-after", "failed authentications of a user name from any IPs locking every client out of it, 0 for never", true,
+		func(c *Config) *int { return &c.Limit.NameLockoutAfter }),
+	durationSetting("limit.lockout", "lockout", "how long the first lockout of a user name lasts, doubling with each further failure", true,
+		func(c *Config) *time.Duration { return &c.Limit.Lockout }),
+	durationSetting("limit.lockout_max", "lockout-max", "the longest lockout, after which failures are also forgotten", true,
+		func(c *Config) *time.Duration { return &c.Limit.LockoutMax }),
+	stringSetting("signup.mode", "signup", "who may sign up: open, invite, approval or closed", true,
+		func(c *Config) *string { return &c.Signup.Mode }),
+	intSetting("signup.name_min", "signup-name-min", "fewest characters of a new user name", true,
+		func(c *Config) *int { return &c.Signup.NameMin }),
+	intSetting("signup.name_max", "signup-name-max", "most characters of a new user name", true,
+		func(c *Config) *int { return &c.Signup.NameMax }),
+	intSetting("signup.key_min", "signup-key-min", "fewest characters of a new key", true,
+		func(c *Config) *int { return &c.Signup.KeyMin }),
+	stringSetting("mail.smtp_addr", "smtp-addr", "host:port of the SMTP server mails are sent through, no mails if empty", false,
+		func(c *Config) *string { return &c.Mail.SMTPAddr }),
+	stringSetting("mail.username", "smtp-user", "user name to log in to the SMTP server", false,
+		func(c *Config) *string { return &c.Mail.Username }),
+	secretSetting("mail.password", "smtp-password", "password to log in to the SMTP server, better given as "+envName("mail.password"), false,
+		func(c *Config) *string { return &c.Mail.Password }),
+	stringSetting("mail.from", "mail-from", "sender address of the mails", false,
+		func(c *Config) *string { return &c.Mail.From }),
+	stringSetting("mail.base_url", "base-url", "address of the server the mails link to, like https://tempdesk.example.com", false,
+		func(c *Config) *string { return &c.Mail.BaseURL }),
+	stringSetting("mail.template_dir", "mail-templates", "directory of verify.tmpl and reset.tmpl replacing the default mail templates", false,
+		func(c *Config) *string { return &c.Mail.TemplateDir }),
+	durationSetting("mail.reset_ttl", "reset-ttl", "how long a key reset token works", true,
+		func(c *Config) *time.Duration { return &c.Mail.ResetTTL }),
+	stringSetting("log.level", "log-level", "log level: debug, info, warn or error", true,
+		func(c *Config) *string { return &c.Log.Level }),
+	stringSetting("log.encoding", "log-encoding", "log encoding: json or console", false,
+		func(c *Config) *string { return &c.Log.Encoding }),
+	stringSetting("log.output", "log-output", "log output: stdout, stderr or a file path", false,
+		func(c *Config) *string { return &c.Log.Output }),
+	intSetting("log.max_size", "log-max-size", "megabytes at which the log file is rotated, 0 for never", false,
+		func(c *Config) *int { return &c.Log.MaxSize }),
+	durationSetting("log.max_age", "log-max-age", "age at which the log file is rotated, 0 for never", false,
+		func(c *Config) *time.Duration { return &c.Log.MaxAge }),
+	intSetting("log.max_backups", "log-max-backups", "how many rotated log files are kept, 0 for all", false,
+		func(c *Config) *int { return &c.Log.MaxBackups }),
+	intSetting("log.sample_initial", "log-sample-initial", "messages logged each second before sampling starts", false,
+		func(c *Config) *int { return &c.Log.SampleInitial }),
+	intSetting("log.sample_thereafter", "log-sample-thereafter", "every how many messages one is logged when sampling", false,
+		func(c *Config) *int { return &c.Log.SampleThereafter }),
+}
+
+func stringSetting(key, flag, usage string, reload bool, field func(c *Config) *string) setting {
+	return setting{
+		key: key, flag: flag, usage: usage, reload: reload,
+		set: func(c *Config, v string) error { *field(c) = v; return nil },
+		get: func(c *Config) string { return *field(c) },
+	}
+}
+
+// secretSetting is a stringSetting whose value Public hides.
+func secretSetting(key, flag, usage string, reload bool, field func(c *Config) *string) setting {
+	s := stringSetting(key, flag, usage, reload, field)
+	s.secret = true
+	return s
+}
+
+// listSetting reads a comma separated list, a list in a config file is
+// written the same way.
+func listSetting(key, flag, usage string, reload bool, field func(c *Config) *[]string) setting {
+	return setting{
+		key: key, flag: flag, usage: usage, reload: reload, list: true,
+		set: func(c *Config, v string) error {
+			var list []string
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			*field(c) = list
+			return nil
+		},
+		get: func(c *Config) string { return strings.Join(*field(c), ",") },
+	}
+}
+
+func boolSetting(key, flag, usage string, reload bool, field func(c *Config) *bool) setting {
+	return setting{
+		key: key, flag: flag, usage: usage, reload: reload, boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid boolean %q, want true or false", v)
+			}
+			*field(c) = b
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatBool(*field(c)) },
+	}
+}
+
+func durationSetting(key, flag, usage string, reload bool, field func(c *Config) *time.Duration) setting {
+	return setting{
+		key: key, flag: flag, usage: usage, reload: reload,
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q, want one like 90s or 10m", v)
+			}
+			*field(c) = d
+			return nil
+		},
+		get: func(c *Config) string { return field(c).String() },
+	}
+}
+
+func intSetting(key, flag, usage string, reload bool, field func(c *Config) *int) setting {
+	return setting{
+		key: key, flag: flag, usage: usage, reload: reload,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid integer %q", v)
+			}
+			*field(c) = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+	}
+}
+
+func lookup(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// envName returns the environment variable of the setting key.
+func envName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// Set changes the setting key to the text v.
+func (c *Config) Set(key, v string) error {
+	s, ok := lookup(key)
+	if !ok {
+		return fmt.Errorf("unknown setting %s", key)
+	}
+	if err := s.set(c, v); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	return nil
+}
+
+// Values returns every setting as text by its key.
+func (c *Config) Values() map[string]string {
+	ret := make(map[string]string, len(settings))
+	for _, s := range settings {
+		ret[s.key] = s.get(c)
+	}
+	return ret
+}
+
+// Redacted is shown by Public for a secret setting that is set.
+const Redacted = "REDACTED"
+
+// Public returns every setting as text by its key like Values, but with
+// secrets hidden, to be logged or shown.
+func (c *Config) Public() map[string]string {
+	ret := c.Values()
+	for _, s := range settings {
+		if s.secret && ret[s.key] != "" {
+			ret[s.key] = Redacted
+		}
+	}
+	return ret
+}
+
+// Changed compares c with next and returns the keys of the settings that
+// differ, split by whether the change can be applied without a restart.
+func (c *Config) Changed(next *Config) (reloadable, static []string) {
+	for _, s := range settings {
+		if s.get(c) == s.get(next) {
+			continue
+		}
+		if s.reload {
+			reloadable = append(reloadable, s.key)
+		} else {
+			static = append(static, s.key)
+		}
+	}
+	return reloadable, static
+}
+
+// ValidationError lists every problem Validate found.
+type ValidationError struct {
+	Problems []string
+}
+
+func (v *ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(v.Problems, "\n  ")
+}
+
+// Validate checks the settings together and reports all that are wrong,
+// each with its key.
+func (c *Config) Validate() error {
+	var problems []string
+	bad := func(key, format string, args ...interface{}) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+	}
+
+	if host, port, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		bad("server.addr", "%q is not host:port, like :8080 or 127.0.0.1:8080", c.Server.Addr)
+	} else if n, err := strconv.Atoi(port); (err != nil && port != "") || n < 0 || n > 65535 {
+		bad("server.addr", "port %q of %q is not a number from 0 to 65535", port, c.Server.Addr)
+	} else if strings.ContainsAny(host, " /") {
+		bad("server.addr", "host %q is not a host name or address", host)
+	}
+
+	c.validateTLS(bad)
+
+	switch c.Storage.Backend {
+	case BackendMemory:
+		if c.Storage.Dir != "" {
+			bad("storage.dir", "is only used by the %q backend, but storage.backend is %q", BackendDir, BackendMemory)
+		}
+	case BackendDir:
+		if c.Storage.Dir == "" {
+			bad("storage.dir", "must be set for the %q backend", BackendDir)
+		}
+	default:
+		bad("storage.backend", "unknown backend %q, want %q or %q", c.Storage.Backend, BackendMemory, BackendDir)
+	}
+
+	if c.Auth.ClockSkew <= 0 || c.Auth.ClockSkew > MaxClockSkew {
+		bad("auth.clock_skew", "%v is not between 0 and %v", c.Auth.ClockSkew, MaxClockSkew)
+	}
+
+	switch c.Auth.ClientCertMatch {
+	case auth.MatchCN, auth.MatchSAN, auth.MatchFingerprint:
+	default:
+		bad("auth.client_cert_match", "unknown match %q, want %q, %q or %q", c.Auth.ClientCertMatch, auth.MatchCN, auth.MatchSAN, auth.MatchFingerprint)
+	}
+	if c.Auth.ClientCAFile != "" && !c.TLSEnabled() {
+		bad("auth.client_ca_file", "needs tls.cert_file or acme.directory")
+	}
+	if c.Auth.ClientCRLFile != "" && c.Auth.ClientCAFile == "" {
+		bad("auth.client_crl_file", "needs auth.client_ca_file")
+	}
+	if c.Auth.SessionTTL < time.Minute || c.Auth.SessionTTL > MaxSessionTTL {
+		bad("auth.session_ttl", "%v is not between %v and %v", c.Auth.SessionTTL, time.Minute, MaxSessionTTL)
+	}
+	if c.Auth.TOTPIssuer == "" || strings.Contains(c.Auth.TOTPIssuer, ":") {
+		bad("auth.totp_issuer", "%q is empty or has a colon", c.Auth.TOTPIssuer)
+	}
+	for _, scope := range c.Auth.TOTPSkip {
+		switch scope {
+		case totp.ScopeHMAC, totp.ScopeCert, totp.ScopePassword:
+		default:
+			bad("auth.totp_skip", "unknown scope %q, want %q, %q or %q", scope, totp.ScopeHMAC, totp.ScopeCert, totp.ScopePassword)
+		}
+	}
+
+	for _, v := range []struct {
+		key string
+		n   int
+	}{{"limit.ip_per_minute", c.Limit.IPPerMinute}, {"limit.ip_burst", c.Limit.IPBurst}, {"limit.user_per_minute", c.Limit.UserPerMinute}, {"limit.user_burst", c.Limit.UserBurst}, {"limit.lockout_after", c.Limit.LockoutAfter}, {"limit.name_lockout_after", c.Limit.NameLockoutAfter}} {
+		if v.n < 0 {
+			bad(v.key, "%d is negative", v.n)
+		}
+	}
+	if c.Limit.IPBurst > 0 && c.Limit.IPPerMinute <= 0 {
+		bad("limit.ip_burst", "needs limit.ip_per_minute")
+	}
+	if c.Limit.UserBurst > 0 && c.Limit.UserPerMinute <= 0 {
+		bad("limit.user_burst", "needs limit.user_per_minute")
+	}
+	if c.Limit.LockoutAfter > 0 || c.Limit.NameLockoutAfter > 0 {
+		if c.Limit.Lockout <= 0 {
+			bad("limit.lockout", "must be positive with limit.lockout_after")
+		} else if c.Limit.LockoutMax < c.Limit.Lockout {
+			bad("limit.lockout_max", "%v is shorter than limit.lockout %v", c.Limit.LockoutMax, c.Limit.Lockout)
+		}
+	}
+
+	if !signup.ValidMode(c.Signup.Mode) {
+		bad("signup.mode", "unknown mode %q, want %q, %q, %q or %q", c.Signup.Mode, signup.ModeOpen, signup.ModeInvite, signup.ModeApproval, signup.ModeClosed)
+	}
+	if c.Signup.NameMin < 1 {
+		bad("signup.name_min", "%d is less than 1", c.Signup.NameMin)
+	} else if c.Signup.NameMax < c.Signup.NameMin {
+		bad("signup.name_max", "%d is less than signup.name_min %d", c.Signup.NameMax, c.Signup.NameMin)
+	}
+	if c.Signup.KeyMin < 1 || c.Signup.KeyMin > signup.MaxKeyLength {
+		bad("signup.key_min", "%d is not between 1 and %d", c.Signup.KeyMin, signup.MaxKeyLength)
+	}
+
+	c.validateMail(bad)
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		bad("log.level", "unknown level %q, want debug, info, warn or error", c.Log.Level)
+	}
+	switch c.Log.Encoding {
+	case tlog.EncodingJSON, tlog.EncodingConsole:
+	default:
+		bad("log.encoding", "unknown encoding %q, want %q or %q", c.Log.Encoding, tlog.EncodingJSON, tlog.EncodingConsole)
+	}
+	if c.Log.Output == "" {
+		bad("log.output", "must be %q, %q or a file path", tlog.OutputStdout, tlog.OutputStderr)
+	}
+	for _, v := range []struct {
+		key string
+		n   int
+	}{{"log.max_size", c.Log.MaxSize}, {"log.max_backups", c.Log.MaxBackups}, {"log.sample_initial", c.Log.SampleInitial}, {"log.sample_thereafter", c.Log.SampleThereafter}} {
+		if v.n < 0 {
+			bad(v.key, "%d is negative", v.n)
+		}
+	}
+	if c.Log.MaxAge < 0 {
+		bad("log.max_age", "%v is negative", c.Log.MaxAge)
+	}
+	if (c.Log.SampleInitial > 0) != (c.Log.SampleThereafter > 0) {
+		bad("log.sample_initial", "sampling needs both log.sample_initial and log.sample_thereafter")
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (c *Config) validateTLS(bad func(key, format string, args ...interface{})) {
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		bad("tls.key_file", "tls.cert_file and tls.key_file must be set together")
+	}
+	if !c.TLSEnabled() {
+		if c.TLS.HTTPAddr != "" {
+			bad("tls.http_addr", "needs tls.cert_file or acme.directory")
+		}
+		if c.TLS.HSTS != 0 {
+			bad("tls.hsts", "needs tls.cert_file or acme.directory")
+		}
+	}
+	if c.TLS.HTTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.TLS.HTTPAddr); err != nil {
+			bad("tls.http_addr", "%q is not host:port, like :80", c.TLS.HTTPAddr)
+		} else if c.TLS.HTTPAddr == c.Server.Addr {
+			bad("tls.http_addr", "is the same as server.addr")
+		}
+	}
+	if c.TLS.HSTS < 0 {
+		bad("tls.hsts", "%v is negative", c.TLS.HSTS)
+	}
+
+	if c.ACME.Directory == "" {
+		for key, set := range map[string]bool{"acme.email": c.ACME.Email != "", "acme.domains": len(c.ACME.Domains) > 0, "acme.ca_file": c.ACME.CAFile != ""} {
+			if set {
+				bad(key, "needs acme.directory")
+			}
+		}
+		return
+	}
+	if u, err := url.Parse(c.ACME.Directory); err != nil || u.Scheme != "https" || u.Host == "" {
+		bad("acme.directory", "%q is not an https URL", c.ACME.Directory)
+	}
+	if c.TLS.CertFile != "" {
+		bad("acme.directory", "cannot be used with tls.cert_file")
+	}
+	if len(c.ACME.Domains) == 0 {
+		bad("acme.domains", "must be set with acme.directory")
+	}
+	for _, d := range c.ACME.Domains {
+		if !validDomain(d) {
+			bad("acme.domains", "%q is not a domain name, wildcards are not supported", d)
+		}
+	}
+	if c.TLS.HTTPAddr == "" {
+		bad("tls.http_addr", "must be set with acme.directory to answer http-01 challenges, like :80")
+	}
+	if c.Storage.Backend != BackendDir {
+		bad("acme.directory", "needs storage.backend %q to keep the account and certificate", BackendDir)
+	}
+}
+
+func validDomain(d string) bool {
+	if len(d) > 253 || !strings.Contains(d, ".") && d != "localhost" {
+		return false
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *Config) validateMail(bad func(key, format string, args ...interface{})) {
+	if !c.MailEnabled() {
+		for key, set := range map[string]bool{"mail.username": c.Mail.Username != "", "mail.password": c.Mail.Password != "", "mail.from": c.Mail.From != "", "mail.base_url": c.Mail.BaseURL != "", "mail.template_dir": c.Mail.TemplateDir != ""} {
+			if set {
+				bad(key, "needs mail.smtp_addr")
+			}
+		}
+	} else {
+		if _, _, err := net.SplitHostPort(c.Mail.SMTPAddr); err != nil {
+			bad("mail.smtp_addr", "%q is not host:port, like smtp.example.com:587", c.Mail.SMTPAddr)
+		}
+		if !signup.ValidEmail(c.Mail.From) {
+			bad("mail.from", "%q is not an email address", c.Mail.From)
+		}
+		if u, err := url.Parse(c.Mail.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			bad("mail.base_url", "%q is not an http or https URL", c.Mail.BaseURL)
+		}
+	}
+	if c.Mail.Password != "" && c.Mail.Username == "" {
+		bad("mail.password", "needs mail.username")
+	}
+	if c.Mail.ResetTTL <= 0 || c.Mail.ResetTTL > MaxResetTTL {
+		bad("mail.reset_ttl", "%v is not between 0 and %v", c.Mail.ResetTTL, MaxResetTTL)
+	}
+}
@@ -0,0 +1,421 @@
+package config
+
+import (
+	"flag"
+	"github.com/huangjiahua/tempdesk/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestLoader_Load(t *testing.T) {
+	dir := testutil.TempDir(t)
+	files := map[string]string{
+		"config.yaml": `
+server:
+  addr: 127.0.0.1:9000
+storage:
+  backend: dir
+  dir: /var/lib/tempdesk
+auth:
+  clock_skew: 5m
+log:
+  level: warn
+  max_size: 100
+`,
+		"config.toml": `
+# the server
+[server]
+addr = "127.0.0.1:9000"
+
+[storage]
+backend = 'dir'
+dir = "/var/lib/tempdesk" # kept here
+
+[auth]
+clock_skew = "5m"
+
+[log]
+level = "warn"
+max_size = 1_00
+`,
+		"config.json": `{
+  "server": {"addr": "127.0.0.1:9000"},
+  "storage": {"backend": "dir", "dir": "/var/lib/tempdesk"},
+  "auth": {"clock_skew": "5m"},
+  "log": {"level": "warn", "max_size": 100}
+}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			l := &Loader{Args: []string{"-config", writeFile(t, dir, name, content)}}
+			c, err := l.Load()
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, "127.0.0.1:9000", c.Server.Addr)
+			assert.Equal(t, Storage{Backend: BackendDir, Dir: "/var/lib/tempdesk"}, c.Storage)
+			assert.Equal(t, 5*time.Minute, c.Auth.ClockSkew)
+			assert.Equal(t, "warn", c.Log.Level)
+			assert.Equal(t, 100, c.Log.MaxSize)
+			assert.Equal(t, "json", c.Log.Encoding, "unset settings keep their default")
+		})
+	}
+
+	t.Run("precedence", func(t *testing.T) {
+		path := writeFile(t, dir, "config.yaml", files["config.yaml"])
+		l := &Loader{
+			Args: []string{"-log-level", "debug"},
+			Getenv: env(map[string]string{
+				EnvConfig:                  path,
+				"TEMPDESK_LOG_LEVEL":       "error",
+				"TEMPDESK_AUTH_CLOCK_SKEW": "90s",
+			}),
+		}
+		c, err := l.Load()
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, "127.0.0.1:9000", c.Server.Addr, "from the file")
+		assert.Equal(t, 90*time.Second, c.Auth.ClockSkew, "the environment overrides the file")
+		assert.Equal(t, "debug", c.Log.Level, "flags override the environment")
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		c, err := (&Loader{}).Load()
+		assert.Nil(t, err)
+		assert.Equal(t, Default(), c)
+	})
+
+	t.Run("data", func(t *testing.T) {
+		c, err := (&Loader{Args: []string{"-data", "/srv/td"}}).Load()
+		assert.Nil(t, err)
+		assert.Equal(t, Storage{Backend: BackendDir, Dir: "/srv/td"}, c.Storage)
+	})
+
+	t.Run("lists", func(t *testing.T) {
+		for name, content := range map[string]string{
+			"acme.yaml": "acme:\n  domains:\n    - example.com\n    - www.example.com\n",
+			"acme.toml": "[acme]\ndomains = [\"example.com\", 'www.example.com'] # both\n",
+			"acme.json": `{"acme": {"domains": ["example.com", "www.example.com"]}}`,
+		} {
+			values, err := readFile(writeFile(t, dir, name, content))
+			c := Default()
+			if assert.Nil(t, err, name) && assert.Nil(t, c.apply(values), name) {
+				assert.Equal(t, []string{"example.com", "www.example.com"}, c.ACME.Domains, name)
+			}
+		}
+		c, err := (&Loader{Args: []string{"-acme-domains", "example.com, www.example.com"}}).Load()
+		if assert.NotNil(t, err, "acme.domains needs acme.directory") {
+			assert.Nil(t, c)
+		}
+	})
+
+	t.Run("help", func(t *testing.T) {
+		_, err := (&Loader{Args: []string{"-h"}}).Load()
+		assert.Equal(t, flag.ErrHelp, err)
+	})
+}
+
+func TestLoader_Load_Errors(t *testing.T) {
+	dir := testutil.TempDir(t)
+	cases := []struct {
+		name string
+		l    *Loader
+		want string
+	}{
+		{
+			"unknown yaml key",
+			&Loader{Args: []string{"-config", writeFile(t, dir, "a.yaml", "server:\n  addr: :80\n  port: 80\n")}},
+			"a.yaml:3: unknown setting server.port",
+		},
+		{
+			"bad toml value",
+			&Loader{Args: []string{"-config", writeFile(t, dir, "b.toml", "[auth]\n\nclock_skew = \"ten minutes\"\n")}},
+			`b.toml:3: auth.clock_skew: invalid duration "ten minutes"`,
+		},
+		{
+			"toml array",
+			&Loader{Args: []string{"-config", writeFile(t, dir, "c.toml", "[server]\naddr = [\":80\"]\n")}},
+			"c.toml:2: server.addr: takes a single value, not a list",
+		},
+		{
+			"toml inline table",
+			&Loader{Args: []string{"-config", writeFile(t, dir, "c2.toml", "server = {addr = \":80\"}\n")}},
+			"c2.toml:1: server: inline tables are not supported",
+		},
+		{
+			"bad json",
+			&Loader{Args: []string{"-config", writeFile(t, dir, "d.json", `{"log": {"max_size": "big"}}`)}},
+			`d.json: log.max_size: invalid integer "big"`,
+		},
+		{
+			"unknown format",
+			&Loader{Args: []string{"-config", writeFile(t, dir, "e.ini", "")}},
+			"unknown config format",
+		},
+		{
+			"environment",
+			&Loader{Getenv: env(map[string]string{"TEMPDESK_LOG_MAX_BACKUPS": "many"})},
+			`environment variable TEMPDESK_LOG_MAX_BACKUPS: log.max_backups: invalid integer "many"`,
+		},
+		{
+			"flag",
+			&Loader{Args: []string{"-clock-skew", "10"}},
+			`flag -clock-skew: auth.clock_skew: invalid duration "10"`,
+		},
+		{
+			"argument",
+			&Loader{Args: []string{"extra"}},
+			`unexpected argument "extra"`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := c.l.Load()
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), c.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c := Default()
+	assert.Nil(t, c.Validate())
+
+	c.Server.Addr = "localhost"
+	c.Storage.Backend = BackendDir
+	c.Auth.ClockSkew = 48 * time.Hour
+	c.Log.Level = "loud"
+	c.Log.MaxBackups = -1
+	c.Log.SampleInitial = 100
+	err := c.Validate()
+	v, ok := err.(*ValidationError)
+	if !assert.True(t, ok, "%v", err) {
+		return
+	}
+	assert.Equal(t, []string{
+		"auth.clock_skew: 48h0m0s is not between 0 and 24h0m0s",
+		"log.level: unknown level \"loud\", want debug, info, warn or error",
+		"log.max_backups: -1 is negative",
+		"log.sample_initial: sampling needs both log.sample_initial and log.sample_thereafter",
+		"server.addr: \"localhost\" is not host:port, like :8080 or 127.0.0.1:8080",
+		"storage.dir: must be set for the \"dir\" backend",
+	}, v.Problems)
+	assert.True(t, strings.HasPrefix(err.Error(), "invalid config:\n"))
+
+	c = Default()
+	c.Server.Addr = ":99999"
+	c.Storage.Backend = "s3"
+	assert.Equal(t, []string{
+		"server.addr: port \"99999\" of \":99999\" is not a number from 0 to 65535",
+		"storage.backend: unknown backend \"s3\", want \"memory\" or \"dir\"",
+	}, c.Validate().(*ValidationError).Problems)
+}
+
+func TestConfig_Validate_TLS(t *testing.T) {
+	c := Default()
+	c.TLS.CertFile = "cert.pem"
+	c.TLS.HTTPAddr = ":80"
+	c.TLS.HSTS = 365 * 24 * time.Hour
+	assert.Equal(t, []string{
+		"tls.key_file: tls.cert_file and tls.key_file must be set together",
+	}, c.Validate().(*ValidationError).Problems)
+	c.TLS.KeyFile = "key.pem"
+	assert.Nil(t, c.Validate())
+	assert.True(t, c.TLSEnabled())
+
+	c = Default()
+	c.TLS.HTTPAddr = ":80"
+	c.ACME.Email = "admin@example.com"
+	assert.Equal(t, []string{
+		"acme.email: needs acme.directory",
+		"tls.http_addr: needs tls.cert_file or acme.directory",
+	}, c.Validate().(*ValidationError).Problems)
+
+	c = Default()
+	c.ACME.Directory = "http://ca.example.com/dir"
+	c.ACME.Domains = []string{"example.com", "*.example.com"}
+	assert.Equal(t, []string{
+		"acme.directory: \"http://ca.example.com/dir\" is not an https URL",
+		"acme.directory: needs storage.backend \"dir\" to keep the account and certificate",
+		"acme.domains: \"*.example.com\" is not a domain name, wildcards are not supported",
+		"tls.http_addr: must be set with acme.directory to answer http-01 challenges, like :80",
+	}, c.Validate().(*ValidationError).Problems)
+
+	c.ACME.Directory = "https://ca.example.com/dir"
+	c.ACME.Domains = []string{"example.com", "www.example.com"}
+	c.TLS.HTTPAddr = ":80"
+	c.Storage = Storage{Backend: BackendDir, Dir: "/var/lib/tempdesk"}
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, "example.com,www.example.com", c.Values()["acme.domains"])
+}
+
+func TestConfig_Validate_ClientCerts(t *testing.T) {
+	c := Default()
+	c.Auth.ClientCRLFile = "crl.pem"
+	c.Auth.ClientCertMatch = "serial"
+	assert.Equal(t, []string{
+		"auth.client_cert_match: unknown match \"serial\", want \"cn\", \"san\" or \"fingerprint\"",
+		"auth.client_crl_file: needs auth.client_ca_file",
+	}, c.Validate().(*ValidationError).Problems)
+
+	c.Auth.ClientCAFile = "ca.pem"
+	c.Auth.ClientCertMatch = "san"
+	assert.Equal(t, []string{
+		"auth.client_ca_file: needs tls.cert_file or acme.directory",
+	}, c.Validate().(*ValidationError).Problems)
+
+	c.TLS.CertFile, c.TLS.KeyFile = "cert.pem", "key.pem"
+	assert.Nil(t, c.Validate())
+}
+
+func TestConfig_Validate_Limit(t *testing.T) {
+	c := Default()
+	c.Limit.IPBurst = 10
+	c.Limit.UserPerMinute = -1
+	c.Limit.LockoutMax = 30 * time.Second
+	assert.Equal(t, []string{
+		"limit.ip_burst: needs limit.ip_per_minute",
+		"limit.lockout_max: 30s is shorter than limit.lockout 1m0s",
+		"limit.user_per_minute: -1 is negative",
+	}, c.Validate().(*ValidationError).Problems)
+
+	c = Default()
+	c.Limit.Lockout = 0
+	assert.Equal(t, []string{
+		"limit.lockout: must be positive with limit.lockout_after",
+	}, c.Validate().(*ValidationError).Problems)
+	c.Limit.LockoutAfter = 0
+	assert.Len(t, c.Validate().(*ValidationError).Problems, 1, "the name lockout needs it as well")
+	c.Limit.NameLockoutAfter = 0
+	assert.Nil(t, c.Validate())
+
+	c, err := (&Loader{Args: []string{"-uniform-auth-errors", "-limit-ip", "120"}}).Load()
+	if assert.Nil(t, err) {
+		p := c.RateLimitPolicy()
+		assert.True(t, p.Uniform)
+		assert.Equal(t, 120, p.IP.PerMinute)
+		assert.Equal(t, DefaultLockoutAfter, p.Lockout.After)
+		assert.Equal(t, DefaultNameLockoutAfter, p.NameLockout.After)
+	}
+	_, err = (&Loader{Getenv: env(map[string]string{"TEMPDESK_AUTH_UNIFORM_ERRORS": "yes"})}).Load()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `auth.uniform_errors: invalid boolean "yes"`)
+	}
+}
+
+func TestConfig_Validate_Signup(t *testing.T) {
+	c := Default()
+	c.Signup.Mode = "members"
+	c.Signup.NameMin = 0
+	c.Signup.KeyMin = 2048
+	assert.Equal(t, []string{
+		`signup.key_min: 2048 is not between 1 and 1024`,
+		`signup.mode: unknown mode "members", want "open", "invite", "approval" or "closed"`,
+		`signup.name_min: 0 is less than 1`,
+	}, c.Validate().(*ValidationError).Problems)
+
+	c = Default()
+	c.Signup.NameMax = 1
+	assert.Equal(t, []string{
+		"signup.name_max: 1 is less than signup.name_min 2",
+	}, c.Validate().(*ValidationError).Problems)
+
+	c, err := (&Loader{Args: []string{"-signup", "invite"}, Getenv: env(map[string]string{"TEMPDESK_SIGNUP_KEY_MIN": "12"})}).Load()
+	if assert.Nil(t, err) {
+		assert.Equal(t, "invite", c.Signup.Mode)
+		assert.Equal(t, 12, c.SignupPolicy().KeyMin)
+		assert.Equal(t, 64, c.SignupPolicy().NameMax)
+	}
+}
+
+func TestConfig_Validate_TOTP(t *testing.T) {
+	c := Default()
+	c.Auth.SessionTTL = time.Second
+	c.Auth.TOTPIssuer = "Temp:Desk"
+	c.Auth.TOTPSkip = []string{"hmac", "token"}
+	assert.Equal(t, []string{
+		`auth.session_ttl: 1s is not between 1m0s and 720h0m0s`,
+		`auth.totp_issuer: "Temp:Desk" is empty or has a colon`,
+		`auth.totp_skip: unknown scope "token", want "hmac", "cert" or "password"`,
+	}, c.Validate().(*ValidationError).Problems)
+
+	c, err := (&Loader{Args: []string{"-totp-skip", "cert"}, Getenv: env(nil)}).Load()
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"cert"}, c.Auth.TOTPSkip)
+		assert.Equal(t, 12*time.Hour, c.Auth.SessionTTL)
+	}
+	reloadable, _ := Default().Changed(c)
+	assert.Equal(t, []string{"auth.totp_skip"}, reloadable)
+}
+
+func TestConfig_Validate_Mail(t *testing.T) {
+	c := Default()
+	c.Mail.From = "noreply@example.com"
+	c.Mail.Password = "secret"
+	c.Mail.ResetTTL = 0
+	assert.Equal(t, []string{
+		"mail.from: needs mail.smtp_addr",
+		"mail.password: needs mail.smtp_addr",
+		"mail.password: needs mail.username",
+		"mail.reset_ttl: 0s is not between 0 and 24h0m0s",
+	}, c.Validate().(*ValidationError).Problems)
+
+	c = Default()
+	c.Mail.SMTPAddr = "smtp.example.com"
+	c.Mail.From = "TempDesk <noreply@example.com>"
+	c.Mail.BaseURL = "example.com"
+	assert.Equal(t, []string{
+		`mail.base_url: "example.com" is not an http or https URL`,
+		`mail.from: "TempDesk <noreply@example.com>" is not an email address`,
+		`mail.smtp_addr: "smtp.example.com" is not host:port, like smtp.example.com:587`,
+	}, c.Validate().(*ValidationError).Problems)
+
+	c, err := (&Loader{
+		Args:   []string{"-smtp-addr", "smtp.example.com:587", "-smtp-user", "tempdesk", "-mail-from", "noreply@example.com", "-base-url", "https://example.com"},
+		Getenv: env(map[string]string{"TEMPDESK_MAIL_PASSWORD": "secret"}),
+	}).Load()
+	if assert.Nil(t, err) {
+		assert.True(t, c.MailEnabled())
+		assert.Equal(t, "secret", c.Mail.Password)
+		assert.Equal(t, "secret", c.Values()["mail.password"])
+		assert.Equal(t, Redacted, c.Public()["mail.password"])
+		assert.Equal(t, "tempdesk", c.Public()["mail.username"])
+	}
+	assert.Equal(t, "", Default().Public()["mail.password"], "an empty secret is shown as empty")
+}
+
+func TestConfig_Changed(t *testing.T) {
+	c := Default()
+	next := Default()
+	reloadable, static := c.Changed(next)
+	assert.Empty(t, reloadable)
+	assert.Empty(t, static)
+
+	_ = next.Set("log.level", "debug")
+	_ = next.Set("auth.clock_skew", "1m")
+	_ = next.Set("server.addr", ":9090")
+	reloadable, static = c.Changed(next)
+	assert.Equal(t, []string{"auth.clock_skew", "log.level"}, reloadable)
+	assert.Equal(t, []string{"server.addr"}, static)
+
+	assert.Equal(t, "1m0s", next.Values()["auth.clock_skew"])
+	assert.Equal(t, ":9090", next.Values()["server.addr"])
+}
@@ -0,0 +1,372 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvConfig names the config file when the -config flag does not.
+const EnvConfig = EnvPrefix + "CONFIG"
+
+// Loader builds the config from a file, the environment and flags. It can
+// be asked again to reload the file, the flags stay what they were.
+type Loader struct {
+	// Args are the command line arguments without the program name.
+	Args []string
+	// Getenv reads the environment, like os.Getenv.
+	Getenv func(string) string
+	// Output receives the usage and flag errors.
+	Output io.Writer
+}
+
+// value is a setting as a source gives it, pos tells where it comes from
+// for error messages. A list from a config file is joined by commas.
+type value struct {
+	key  string
+	v    string
+	pos  string
+	list bool
+}
+
+// Load returns the validated config. It returns flag.ErrHelp when the flags
+// ask for help, which has then been printed.
+func (l *Loader) Load() (*Config, error) {
+	flags, path, err := l.parseFlags()
+	if err != nil {
+		return nil, err
+	}
+	if path == "" && l.Getenv != nil {
+		path = l.Getenv(EnvConfig)
+	}
+
+	c := Default()
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.apply(values); err != nil {
+			return nil, err
+		}
+	}
+	if err = c.apply(l.env()); err != nil {
+		return nil, err
+	}
+	if err = c.apply(flags); err != nil {
+		return nil, err
+	}
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) apply(values []value) error {
+	for _, v := range values {
+		if s, ok := lookup(v.key); ok && v.list && !s.list {
+			return fmt.Errorf("%s: %s: takes a single value, not a list", v.pos, v.key)
+		}
+		if err := c.Set(v.key, v.v); err != nil {
+			return fmt.Errorf("%s: %v", v.pos, err)
+		}
+	}
+	return nil
+}
+
+func (l *Loader) env() []value {
+	if l.Getenv == nil {
+		return nil
+	}
+	var values []value
+	for _, s := range settings {
+		name := envName(s.key)
+		if v := l.Getenv(name); v != "" {
+			values = append(values, value{key: s.key, v: v, pos: "environment variable " + name})
+		}
+	}
+	return values
+}
+
+// flagValue records the settings a flag on the command line gives.
+type flagValue struct {
+	name    string
+	expand  func(v string) map[string]string
+	values  *[]value
+	boolean bool
+}
+
+func (f *flagValue) String() string { return "" }
+
+// IsBoolFlag lets a boolean setting be given as -flag, meaning -flag=true.
+func (f *flagValue) IsBoolFlag() bool { return f.boolean }
+
+func (f *flagValue) Set(v string) error {
+	settings := f.expand(v)
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		*f.values = append(*f.values, value{key: key, v: settings[key], pos: "flag -" + f.name})
+	}
+	return nil
+}
+
+// parseFlags returns the settings given as flags, in order, and the config
+// file named by -config.
+func (l *Loader) parseFlags() ([]value, string, error) {
+	fs := flag.NewFlagSet("httpserver", flag.ContinueOnError)
+	if l.Output != nil {
+		fs.SetOutput(l.Output)
+	} else {
+		fs.SetOutput(ioutil.Discard)
+	}
+	path := fs.String("config", "", "config file in YAML, TOML or JSON, or $"+EnvConfig)
+	var values []value
+	for _, s := range settings {
+		key := s.key
+		fs.Var(&flagValue{name: s.flag, values: &values, boolean: s.boolean, expand: func(v string) map[string]string {
+			return map[string]string{key: v}
+		}}, s.flag, s.usage)
+	}
+	// -data is short for the dir backend in a directory
+	fs.Var(&flagValue{name: "data", values: &values, expand: func(v string) map[string]string {
+		return map[string]string{"storage.backend": BackendDir, "storage.dir": v}
+	}}, "data", "directory keeping users, audit log, webhooks and shares, short for -storage-backend dir -storage-dir DIR")
+	if err := fs.Parse(l.Args); err != nil {
+		return nil, "", err
+	}
+	if fs.NArg() > 0 {
+		return nil, "", fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return values, *path, nil
+}
+
+// readFile reads the settings of a config file, its extension tells the
+// format.
+func readFile(path string) ([]value, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return readYAML(path, data)
+	case ".toml":
+		return readTOML(path, data)
+	case ".json":
+		return readJSON(path, data)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format, want .yaml, .yml, .toml or .json", path)
+	}
+}
+
+func readJSON(path string, data []byte) ([]value, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var root map[string]interface{}
+	if err := d.Decode(&root); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var values []value
+	var walk func(prefix string, m map[string]interface{}) error
+	walk = func(prefix string, m map[string]interface{}) error {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			key := prefix + k
+			switch v := m[k].(type) {
+			case map[string]interface{}:
+				if err := walk(key+".", v); err != nil {
+					return err
+				}
+			case string:
+				values = append(values, value{key: key, v: v, pos: path})
+			case json.Number:
+				values = append(values, value{key: key, v: v.String(), pos: path})
+			case bool:
+				values = append(values, value{key: key, v: strconv.FormatBool(v), pos: path})
+			case []interface{}:
+				items := make([]string, len(v))
+				for i, item := range v {
+					s, ok := item.(string)
+					if !ok {
+						return fmt.Errorf("%s: %s: a list may only hold strings", path, key)
+					}
+					items[i] = s
+				}
+				values = append(values, value{key: key, v: strings.Join(items, ","), pos: path, list: true})
+			default:
+				return fmt.Errorf("%s: %s: unsupported value %v", path, key, v)
+			}
+		}
+		return nil
+	}
+	return values, walk("", root)
+}
+
+func readYAML(path string, data []byte) ([]value, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	var values []value
+	var walk func(prefix string, n *yaml.Node) error
+	walk = func(prefix string, n *yaml.Node) error {
+		pos := path + ":" + strconv.Itoa(n.Line)
+		if n.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s: %s: want a mapping of settings", pos, strings.TrimSuffix(prefix, "."))
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			key := prefix + k.Value
+			switch v.Kind {
+			case yaml.MappingNode:
+				if err := walk(key+".", v); err != nil {
+					return err
+				}
+			case yaml.ScalarNode:
+				values = append(values, value{key: key, v: v.Value, pos: path + ":" + strconv.Itoa(v.Line)})
+			case yaml.SequenceNode:
+				items := make([]string, len(v.Content))
+				for i, item := range v.Content {
+					if item.Kind != yaml.ScalarNode {
+						return fmt.Errorf("%s:%d: %s: a list may only hold strings", path, item.Line, key)
+					}
+					items[i] = item.Value
+				}
+				values = append(values, value{key: key, v: strings.Join(items, ","), pos: path + ":" + strconv.Itoa(v.Line), list: true})
+			default:
+				return fmt.Errorf("%s:%d: %s: unsupported value", path, v.Line, key)
+			}
+		}
+		return nil
+	}
+	return values, walk("", doc.Content[0])
+}
+
+// readTOML reads the part of TOML a config file needs: tables, comments and
+// keys with string, integer, float and boolean values and lists of strings.
+func readTOML(path string, data []byte) ([]value, error) {
+	var values []value
+	prefix := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		pos := path + ":" + strconv.Itoa(i+1)
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || strings.HasPrefix(line, "[[") || !tomlComment(line[end+1:]) {
+				return nil, fmt.Errorf("%s: malformed table header", pos)
+			}
+			prefix = strings.TrimSpace(line[1:end]) + "."
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%s: want key = value", pos)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), `"`)
+		v, list, err := tomlValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", pos, prefix+key, err)
+		}
+		values = append(values, value{key: prefix + key, v: v, pos: pos, list: list})
+	}
+	return values, nil
+}
+
+func tomlComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || rest[0] == '#'
+}
+
+// tomlValue reads a value and whether it is a list, which holds strings on
+// a single line.
+func tomlValue(s string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		var items []string
+		rest := strings.TrimSpace(s[1:])
+		for !strings.HasPrefix(rest, "]") {
+			item, n, err := tomlString(rest)
+			if err != nil {
+				return "", false, errors.New("malformed list, only strings on one line are supported")
+			}
+			items = append(items, item)
+			rest = strings.TrimSpace(rest[n:])
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", false, errors.New("malformed list, only strings on one line are supported")
+			}
+		}
+		if !tomlComment(rest[1:]) {
+			return "", false, errors.New("malformed list")
+		}
+		return strings.Join(items, ","), true, nil
+	case strings.HasPrefix(s, "{"):
+		return "", false, errors.New("inline tables are not supported")
+	case strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'"):
+		v, n, err := tomlString(s)
+		if err != nil || !tomlComment(s[n:]) {
+			return "", false, errors.New("malformed string")
+		}
+		return v, false, nil
+	}
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if s == "true" || s == "false" {
+		return s, false, nil
+	}
+	if _, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64); err != nil {
+		return "", false, fmt.Errorf("unsupported value %q", s)
+	}
+	return strings.Replace(s, "_", "", -1), false, nil
+}
+
+// tomlString reads the basic or literal string s starts with and returns it
+// and its length in s.
+func tomlString(s string) (string, int, error) {
+	if strings.HasPrefix(s, "'") {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", 0, errors.New("malformed string")
+		}
+		return s[1 : end+1], end + 2, nil
+	}
+	if !strings.HasPrefix(s, `"`) {
+		return "", 0, errors.New("not a string")
+	}
+	end := 1
+	for ; end < len(s) && s[end] != '"'; end++ {
+		if s[end] == '\\' {
+			end++
+		}
+	}
+	if end >= len(s) {
+		return "", 0, errors.New("malformed string")
+	}
+	v, err := strconv.Unquote(s[:end+1])
+	return v, end + 1, err
+}
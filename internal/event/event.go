@@ -0,0 +1,205 @@
+// Package event distributes change notifications of the file service to
+// subscribers such as watchers and webhooks.
+package event
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Op string
+
+const (
+	OpCreate Op = "create"
+	OpWrite  Op = "write"
+	OpRename Op = "rename"
+	OpRemove Op = "remove"
+	OpPerm   Op = "perm"
+
+	OpUserCreate Op = "user.create"
+)
+
+// DefaultBuffer is the number of events a subscriber may fall behind before
+// further events are dropped for it.
+const DefaultBuffer = 64
+
+type Event struct {
+	ID      uint64    `json:"id"`
+	Op      Op        `json:"op"`
+	Path    string    `json:"path"`
+	OldPath string    `json:"old_path,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Time    time.Time `json:"time"`
+	// Granted tells of an OpPerm event whether the change granted anything
+	// the permission did not before, rather than only revoking.
+	Granted bool `json:"granted,omitempty"`
+
+	// Perm is the permission of the file when the event happened, a
+	// td.Snapshot that later changes do not reach. It decides who may see
+	// the event.
+	Perm td.FilePermission `json:"-"`
+}
+
+// Visible reports whether user may read the file of event e. Events that do
+// not concern a file are never visible.
+func (e Event) Visible(user td.User) bool {
+	return e.Perm != nil && td.Can(e.Perm, user, td.VerbRead)
+}
+
+// Under reports whether e concerns prefix or a path below it.
+func (e Event) Under(prefix string) bool {
+	return under(e.Path, prefix) || (e.OldPath != "" && under(e.OldPath, prefix))
+}
+
+func under(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+type Bus struct {
+	mu   sync.Mutex
+	last uint64
+	// delivered is the ID of the last event handed out. Events are handed
+	// out in the order of their IDs, turn tells a Publish that it is next.
+	delivered uint64
+	turn      *sync.Cond
+	subs      map[*Subscription]struct{}
+	handlers  map[*handler]struct{}
+}
+
+// handler is a func given to Handle, a pointer so it can be removed again.
+type handler struct {
+	fn func(Event)
+}
+
+func NewBus() *Bus {
+	b := &Bus{subs: make(map[*Subscription]struct{}), handlers: make(map[*handler]struct{})}
+	b.turn = sync.NewCond(&b.mu)
+	return b
+}
+
+// Publish numbers e and hands it to every matching subscriber. It never
+// blocks on subscribers, one that is too slow misses the event. Handlers
+// are called before it returns. Events are handed out in the order of
+// their IDs, so concurrent calls wait for each other and filters and
+// handlers may not publish themselves.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	b.mu.Lock()
+	b.last++
+	e.ID = b.last
+	for b.delivered != e.ID-1 {
+		b.turn.Wait()
+	}
+	defer func() {
+		b.mu.Lock()
+		b.delivered = e.ID
+		b.turn.Broadcast()
+		b.mu.Unlock()
+	}()
+	var subs []*Subscription
+	for s := range b.subs {
+		if e.Under(s.prefix) {
+			subs = append(subs, s)
+		}
+	}
+	handlers := make([]*handler, 0, len(b.handlers))
+	for h := range b.handlers {
+		handlers = append(handlers, h)
+	}
+	b.mu.Unlock()
+
+	// filters may take their time, the bus is not held meanwhile
+	for _, s := range subs {
+		if s.filter == nil || s.filter(e) {
+			s.send(e)
+		}
+	}
+	for _, h := range handlers {
+		h.fn(e)
+	}
+}
+
+// Handle calls fn with every event published until the returned func is
+// called. Unlike a subscriber, fn never misses an event: Publish waits for
+// it, so it should be quick.
+func (b *Bus) Handle(fn func(Event)) (remove func()) {
+	h := &handler{fn: fn}
+	b.mu.Lock()
+	b.handlers[h] = struct{}{}
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.handlers, h)
+		b.mu.Unlock()
+	}
+}
+
+// Subscribe returns a subscription to the events under prefix that pass
+// filter. A nil filter passes everything.
+func (b *Bus) Subscribe(prefix string, filter func(Event) bool) *Subscription {
+	c := make(chan Event, DefaultBuffer)
+	s := &Subscription{C: c, c: c, bus: b, prefix: prefix, filter: filter}
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+type Subscription struct {
+	C <-chan Event
+
+	c      chan Event
+	bus    *Bus
+	prefix string
+	filter func(Event) bool
+
+	mu      sync.Mutex
+	dropped uint64
+	closed  bool
+}
+
+// send hands e to C unless it is full or closed.
+func (s *Subscription) send(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.c <- e:
+	default:
+		s.dropped++
+	}
+}
+
+// Dropped returns how many events were skipped because C was full.
+func (s *Subscription) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close stops the subscription and closes C.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(s.bus.subs, s)
+	close(s.c)
+}
@@ -0,0 +1,194 @@
+package event
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+)
+
+func next(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case e := <-sub.C:
+		return e
+	default:
+		t.Fatal("no event published")
+	}
+	return Event{}
+}
+
+func none(t *testing.T, sub *Subscription) {
+	t.Helper()
+	select {
+	case e := <-sub.C:
+		t.Fatalf("unexpected event %v %v", e.Op, e.Path)
+	default:
+	}
+}
+
+func TestBus_Subscribe(t *testing.T) {
+	bus := NewBus()
+	all := bus.Subscribe("/", nil)
+	docs := bus.Subscribe("/docs/", nil)
+	defer all.Close()
+
+	bus.Publish(Event{Op: OpWrite, Path: "/docs/a"})
+	bus.Publish(Event{Op: OpWrite, Path: "/docsx"})
+	bus.Publish(Event{Op: OpRename, Path: "/tmp/b", OldPath: "/docs/b"})
+
+	assert.Equal(t, "/docs/a", next(t, all).Path)
+	assert.Equal(t, "/docsx", next(t, all).Path)
+	e := next(t, all)
+	assert.Equal(t, uint64(3), e.ID)
+	assert.False(t, e.Time.IsZero())
+
+	assert.Equal(t, "/docs/a", next(t, docs).Path)
+	assert.Equal(t, "/tmp/b", next(t, docs).Path, "renames out of the prefix should be seen")
+	none(t, docs)
+
+	docs.Close()
+	docs.Close()
+	bus.Publish(Event{Op: OpWrite, Path: "/docs/a"})
+	_, ok := <-docs.C
+	assert.False(t, ok, "closed subscription should not receive events")
+
+	// one event is still buffered from above
+	for i := 0; i < DefaultBuffer+2; i++ {
+		bus.Publish(Event{Op: OpWrite, Path: "/a"})
+	}
+	assert.Equal(t, uint64(3), all.Dropped())
+}
+
+func TestFileService(t *testing.T) {
+	bus := NewBus()
+	fs := NewFileService(mock.NewFileService(), bus)
+	sam := td.User{Name: "sam"}
+	tom := td.User{Name: "tom"}
+	sub := bus.Subscribe("/", func(e Event) bool { return e.Visible(tom) })
+	defer sub.Close()
+
+	f, err := fs.Open("/a", os.O_RDWR|os.O_CREATE, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Perm().BlockAllUser()
+	f.Perm().AllowUser(sam.Name)
+	_, _ = f.Write([]byte("secret"))
+	_ = f.Close()
+	none(t, sub)
+
+	f, _ = fs.Open("/b", os.O_RDWR|os.O_CREATE, nil)
+	_, _ = f.Write([]byte("hello"))
+	none(t, sub)
+	_ = f.Close()
+	assert.Equal(t, OpCreate, next(t, sub).Op)
+	assert.Equal(t, OpWrite, next(t, sub).Op)
+
+	f, _ = fs.Open("/b", os.O_RDONLY, nil)
+	_ = f.Close()
+	none(t, sub)
+
+	f, _ = fs.Open("/a", os.O_RDWR, nil)
+	f.Perm().AllowUser(tom.Name)
+	e := next(t, sub)
+	assert.Equal(t, OpPerm, e.Op)
+	assert.Equal(t, "/a", e.Path)
+	assert.True(t, e.Granted)
+	f.Perm().BlockUser(tom.Name)
+	assert.True(t, e.Visible(tom), "an event keeps the permission it was published with")
+	none(t, sub)
+	f.Perm().AllowUser(tom.Name)
+	next(t, sub)
+	doc, err := f.Perm().(td.DocumentPermission).Document()
+	assert.NoError(t, err)
+	doc.Users[tom.Name] = td.VerbRead
+	assert.NoError(t, f.Perm().(td.DocumentPermission).SetDocument(doc))
+	e = next(t, sub)
+	assert.Equal(t, OpPerm, e.Op)
+	assert.False(t, e.Granted, "read is less than tom had")
+	assert.Error(t, f.Perm().(td.DocumentPermission).SetDocument(td.PermissionDocument{}))
+	none(t, sub)
+	_ = f.Close()
+
+	assert.NoError(t, fs.Rename("/c", "/b", ""))
+	e = next(t, sub)
+	assert.Equal(t, OpRename, e.Op)
+	assert.Equal(t, "/c", e.Path)
+	assert.Equal(t, "/b", e.OldPath)
+
+	assert.NoError(t, fs.Remove("/c", ""))
+	assert.Equal(t, OpRemove, next(t, sub).Op)
+	assert.Error(t, fs.Remove("/c", ""))
+	none(t, sub)
+}
+
+func TestBus_Handle(t *testing.T) {
+	bus := NewBus()
+	var got []uint64
+	remove := bus.Handle(func(e Event) { got = append(got, e.ID) })
+	for i := 0; i < DefaultBuffer+2; i++ {
+		bus.Publish(Event{Op: OpWrite, Path: "/a"})
+	}
+	assert.Len(t, got, DefaultBuffer+2, "a handler misses no event")
+
+	remove()
+	bus.Publish(Event{Op: OpWrite, Path: "/a"})
+	assert.Len(t, got, DefaultBuffer+2)
+}
+
+func TestBus_FilterUnlocked(t *testing.T) {
+	bus := NewBus()
+	// a filter that uses the bus would deadlock if it ran while the bus is
+	// held
+	sub := bus.Subscribe("/", func(e Event) bool {
+		bus.Subscribe("/", nil).Close()
+		return true
+	})
+	defer sub.Close()
+	bus.Publish(Event{Op: OpWrite, Path: "/a"})
+	assert.Equal(t, "/a", next(t, sub).Path)
+}
+
+func TestBus_Order(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe("/", nil)
+	defer sub.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < DefaultBuffer/8; j++ {
+				bus.Publish(Event{Op: OpWrite, Path: "/a"})
+			}
+		}()
+	}
+	wg.Wait()
+	for id := uint64(1); id <= DefaultBuffer; id++ {
+		assert.Equal(t, id, next(t, sub).ID, "events arrive in the order of their IDs")
+	}
+}
+
+func TestFileService_CreateRace(t *testing.T) {
+	bus := NewBus()
+	fs := NewFileService(mock.NewFileService(), bus)
+	sub := bus.Subscribe("/", nil)
+	defer sub.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if f, err := fs.Open("/a", os.O_RDWR|os.O_CREATE, nil); assert.NoError(t, err) {
+				_ = f.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, OpCreate, next(t, sub).Op)
+	assert.Equal(t, OpWrite, next(t, sub).Op)
+	none(t, sub)
+}
@@ -0,0 +1,322 @@
+package event
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"os"
+	"sync"
+)
+
+// FileService wraps a td.FileService and publishes an event for every change
+// made through it.
+//
+// A file created through Open is announced when it is closed, together with
+// its first write, so that subscribers only ever see a new file with the
+// permission its creator settled on.
+type FileService struct {
+	td.FileService
+	bus *Bus
+}
+
+func NewFileService(fs td.FileService, bus *Bus) *FileService {
+	return &FileService{FileService: fs, bus: bus}
+}
+
+// Unwrap returns the wrapped FileService.
+func (fs *FileService) Unwrap() td.FileService {
+	return fs.FileService
+}
+
+func (fs *FileService) Open(path string, flags int, perm td.FilePermission) (td.File, error) {
+	file, created, err := fs.open(path, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: file, fs: fs, path: path, created: created}, nil
+}
+
+// open also tells whether it created the file. With os.O_CREATE but not
+// os.O_EXCL it opens an existing file or creates one exclusively, so of
+// callers racing to create a file only one announces it.
+func (fs *FileService) open(path string, flags int, perm td.FilePermission) (td.File, bool, error) {
+	if flags&os.O_CREATE == 0 || flags&os.O_EXCL != 0 {
+		file, err := fs.FileService.Open(path, flags, perm)
+		return file, err == nil && flags&os.O_CREATE != 0, err
+	}
+	for {
+		file, err := fs.FileService.Open(path, flags&^os.O_CREATE, perm)
+		if !isKind(err, td.FileNotExist) {
+			return file, false, err
+		}
+		file, err = fs.FileService.Open(path, flags|os.O_EXCL, perm)
+		if !isKind(err, td.FileAlreadyExists) {
+			return file, err == nil, err
+		}
+	}
+}
+
+func isKind(err error, kind string) bool {
+	e, ok := err.(*td.FileServiceError)
+	return ok && e.Kind == kind
+}
+
+func (fs *FileService) Rename(dest string, src string, token string) error {
+	perm := fs.perm(src)
+	if err := fs.FileService.Rename(dest, src, token); err != nil {
+		return err
+	}
+	fs.bus.Publish(Event{Op: OpRename, Path: dest, OldPath: src, Perm: perm})
+	return nil
+}
+
+func (fs *FileService) Remove(path string, token string) error {
+	perm := fs.perm(path)
+	if err := fs.FileService.Remove(path, token); err != nil {
+		return err
+	}
+	fs.bus.Publish(Event{Op: OpRemove, Path: path, Perm: perm})
+	return nil
+}
+
+// perm returns a snapshot of the permission of the file at path, nil if
+// there is none.
+func (fs *FileService) perm(path string) td.FilePermission {
+	file, err := fs.FileService.Open(path, os.O_RDONLY, nil)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	return td.Snapshot(file.Perm())
+}
+
+type File struct {
+	td.File
+	fs   *FileService
+	path string
+
+	mu      sync.Mutex
+	created bool
+	written bool
+}
+
+func (f *File) Write(p []byte) (n int, err error) {
+	n, err = f.File.Write(p)
+	f.touch(n > 0)
+	return
+}
+
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	n, err = f.File.WriteAt(p, off)
+	f.touch(n > 0)
+	return
+}
+
+func (f *File) Truncate(pos int64, data []byte) (err error) {
+	err = f.File.Truncate(pos, data)
+	f.touch(err == nil)
+	return
+}
+
+func (f *File) touch(ok bool) {
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	f.written = true
+	f.mu.Unlock()
+}
+
+func (f *File) Perm() td.FilePermission {
+	return &permission{FilePermission: f.File.Perm(), file: f}
+}
+
+// Close publishes the create and write-complete events of this File.
+func (f *File) Close() error {
+	err := f.File.Close()
+
+	f.mu.Lock()
+	created, written := f.created, f.written
+	f.created, f.written = false, false
+	f.mu.Unlock()
+
+	perm := td.Snapshot(f.File.Perm())
+	if created {
+		f.fs.bus.Publish(Event{Op: OpCreate, Path: f.path, Perm: perm})
+	}
+	if written || created {
+		f.fs.bus.Publish(Event{Op: OpWrite, Path: f.path, Perm: perm})
+	}
+	return err
+}
+
+func (f *File) changedPerm(granted bool) {
+	f.mu.Lock()
+	created := f.created
+	f.mu.Unlock()
+	if !created {
+		f.fs.bus.Publish(Event{Op: OpPerm, Path: f.path, Perm: td.Snapshot(f.File.Perm()), Granted: granted})
+	}
+}
+
+// permission publishes an OpPerm event for every change. Changes to a file
+// that is not announced yet are not published.
+type permission struct {
+	td.FilePermission
+	file *File
+}
+
+// document returns the rules of the permission before a change, nil if it
+// has no document.
+func (p *permission) document() *td.PermissionDocument {
+	d, ok := p.FilePermission.(td.DocumentPermission)
+	if !ok {
+		return nil
+	}
+	doc, err := d.Document()
+	if err != nil {
+		return nil
+	}
+	return &doc
+}
+
+// grants tells whether the permission grants anything now that it did not
+// before, which is assumed when either document is missing.
+func (p *permission) grants(before *td.PermissionDocument) bool {
+	after := p.document()
+	return before == nil || after == nil || after.Grants(*before)
+}
+
+func (p *permission) GrantUser(name string, verbs td.Verb) {
+	before := p.document()
+	td.Verbs(p.FilePermission).GrantUser(name, verbs)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) GrantGroup(name string, verbs td.Verb) {
+	before := p.document()
+	td.Verbs(p.FilePermission).GrantGroup(name, verbs)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) GrantAllUser(verbs td.Verb) {
+	before := p.document()
+	td.Verbs(p.FilePermission).GrantAllUser(verbs)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) GrantCode(code string, verbs td.Verb) {
+	before := p.document()
+	td.Verbs(p.FilePermission).GrantCode(code, verbs)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) UserVerbs(user td.User) td.Verb {
+	return td.Verbs(p.FilePermission).UserVerbs(user)
+}
+
+func (p *permission) CodeVerbs(code string) td.Verb {
+	return td.Verbs(p.FilePermission).CodeVerbs(code)
+}
+
+func (p *permission) Document() (doc td.PermissionDocument, err error) {
+	d, ok := p.FilePermission.(td.DocumentPermission)
+	if !ok {
+		return doc, &td.PermissionError{Kind: td.PermissionNotDocumented}
+	}
+	return d.Document()
+}
+
+func (p *permission) SetDocument(doc td.PermissionDocument) (err error) {
+	d, ok := p.FilePermission.(td.DocumentPermission)
+	if !ok {
+		return &td.PermissionError{Kind: td.PermissionNotDocumented}
+	}
+	before := p.document()
+	if err = d.SetDocument(doc); err == nil {
+		p.file.changedPerm(p.grants(before))
+	}
+	return
+}
+
+func (p *permission) SetDocumentIf(old, doc td.PermissionDocument) (err error) {
+	d, ok := p.FilePermission.(td.DocumentPermission)
+	if !ok {
+		return &td.PermissionError{Kind: td.PermissionNotDocumented}
+	}
+	before := p.document()
+	if err = d.SetDocumentIf(old, doc); err == nil {
+		p.file.changedPerm(p.grants(before))
+	}
+	return
+}
+
+func (p *permission) AllowUser(name string) {
+	before := p.document()
+	p.FilePermission.AllowUser(name)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) BlockUser(name string) {
+	before := p.document()
+	p.FilePermission.BlockUser(name)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) AllowGroup(name string) {
+	before := p.document()
+	p.FilePermission.AllowGroup(name)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) BlockGroup(name string) {
+	before := p.document()
+	p.FilePermission.BlockGroup(name)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) AllowUserMeta(key, value string) {
+	before := p.document()
+	p.FilePermission.AllowUserMeta(key, value)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) BlockUserMeta(key, value string) {
+	before := p.document()
+	p.FilePermission.BlockUserMeta(key, value)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) AllowAllUser() {
+	before := p.document()
+	p.FilePermission.AllowAllUser()
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) BlockAllUser() {
+	before := p.document()
+	p.FilePermission.BlockAllUser()
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) AllowPublic(code string) {
+	before := p.document()
+	p.FilePermission.AllowPublic(code)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) AllowCode(code string) {
+	before := p.document()
+	p.FilePermission.AllowCode(code)
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) BlockPublic() {
+	before := p.document()
+	p.FilePermission.BlockPublic()
+	p.file.changedPerm(p.grants(before))
+}
+
+func (p *permission) BlockCode(code string) {
+	before := p.document()
+	p.FilePermission.BlockCode(code)
+	p.file.changedPerm(p.grants(before))
+}
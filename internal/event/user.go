@@ -0,0 +1,27 @@
+package event
+
+import td "github.com/huangjiahua/tempdesk"
+
+// UserService wraps a td.UserService and publishes an OpUserCreate event for
+// every user created through it.
+type UserService struct {
+	td.UserService
+	bus *Bus
+}
+
+func NewUserService(us td.UserService, bus *Bus) *UserService {
+	return &UserService{UserService: us, bus: bus}
+}
+
+// Unwrap returns the wrapped UserService.
+func (us *UserService) Unwrap() td.UserService {
+	return us.UserService
+}
+
+func (us *UserService) CreateUser(user td.User) error {
+	if err := us.UserService.CreateUser(user); err != nil {
+		return err
+	}
+	us.bus.Publish(Event{Op: OpUserCreate, User: user.Name})
+	return nil
+}
@@ -0,0 +1,322 @@
+// Package files keeps the files of TempDesk in a storage.PutterGetter, so
+// they survive a restart when the storage does. Files are served from
+// memory like a mock.FileService; a file is saved when a File that changed
+// it is closed, and an index of the paths when files are created, renamed
+// or removed. Locks are not kept.
+package files
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// indexKey names the JSON document mapping the path of every file to
+	// the id its record and data are stored under.
+	indexKey  = "files/index"
+	recordKey = "files/record/"
+	dataKey   = "files/data/"
+)
+
+// record is what is stored of a file besides its data.
+type record struct {
+	Meta     map[string]interface{} `json:"meta"`
+	Perm     td.PermissionDocument  `json:"perm"`
+	Modified time.Time              `json:"modified"`
+}
+
+// Service is a td.FileService. It reads the storage once when it is
+// created, so two services should not share a storage.
+type Service struct {
+	*mock.FileService
+	store storage.PutterGetter
+
+	mu      sync.Mutex
+	index   map[string]string
+	paths   map[string]string
+	records map[string][]byte
+}
+
+// NewService loads the files from store.
+func NewService(store storage.PutterGetter) (*Service, error) {
+	s := &Service{
+		FileService: mock.NewFileService(),
+		store:       store,
+		index:       make(map[string]string),
+		paths:       make(map[string]string),
+		records:     make(map[string][]byte),
+	}
+	var index map[string]string
+	if err := s.load(indexKey, &index); err != nil {
+		return nil, err
+	}
+	for p, id := range index {
+		if err := s.restore(p, id); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// restore loads the file p from the record and data stored as id. A file
+// whose record is missing was never closed and is left out.
+func (s *Service) restore(p, id string) error {
+	b, err := s.get(recordKey + id)
+	if storage.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rec record
+	if err = json.Unmarshal(b, &rec); err != nil {
+		return &td.FileServiceError{Kind: "error reading file " + p, Err: err}
+	}
+	data, err := s.get(dataKey + id)
+	if err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+
+	perm := mock.NewFilePermission()
+	if err = perm.SetDocument(rec.Perm); err != nil {
+		return err
+	}
+	f, err := s.FileService.Open(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	for key, value := range rec.Meta {
+		if err = f.WriteFileMeta(key, value); err != nil {
+			return err
+		}
+	}
+	f.(*mock.File).SetModTime(rec.Modified)
+	s.index[p], s.paths[id], s.records[id] = id, p, b
+	return nil
+}
+
+func (s *Service) get(name string) ([]byte, error) {
+	value, err := s.store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return nil, &td.FileServiceError{Kind: "unexpected value stored under " + name}
+	}
+	return b, nil
+}
+
+func (s *Service) load(name string, v interface{}) error {
+	b, err := s.get(name)
+	if storage.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveIndex stores the paths of the files, s.mu must be held.
+func (s *Service) saveIndex() error {
+	b, err := json.Marshal(s.index)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(indexKey, b)
+}
+
+// drop forgets the file stored as id and empties its data, which storage
+// cannot delete. s.mu must be held.
+func (s *Service) drop(id string) error {
+	delete(s.paths, id)
+	delete(s.records, id)
+	return s.store.Put(dataKey+id, []byte{})
+}
+
+// Open supports the flags of mock.FileService.Open. A file created by it is
+// saved when the returned File is closed.
+func (s *Service) Open(path string, flags int, perm td.FilePermission) (td.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.FileService.Open(path, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := s.index[path]
+	if !ok {
+		if id, err = newID(); err != nil {
+			return nil, err
+		}
+		s.index[path], s.paths[id] = id, path
+		if err = s.saveIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return &File{File: f, s: s, id: id, written: !ok || flags&os.O_TRUNC != 0}, nil
+}
+
+func (s *Service) Rename(dest string, src string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.FileService.Rename(dest, src, token); err != nil {
+		return err
+	}
+	id := s.index[src]
+	old, replaced := s.index[dest]
+	delete(s.index, src)
+	s.index[dest], s.paths[id] = id, dest
+	if err := s.saveIndex(); err != nil {
+		return err
+	}
+	if replaced && old != id {
+		return s.drop(old)
+	}
+	return nil
+}
+
+func (s *Service) Remove(path string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.FileService.Remove(path, token); err != nil {
+		return err
+	}
+	id := s.index[path]
+	delete(s.index, path)
+	if err := s.saveIndex(); err != nil {
+		return err
+	}
+	return s.drop(id)
+}
+
+// Health checks the storage when it can check itself.
+func (s *Service) Health() error {
+	return td.CheckHealth(s.store)
+}
+
+// save stores what f changed of its file, nothing once the file is removed
+// or replaced.
+func (s *Service) save(f *File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.paths[f.id]; !ok {
+		return nil
+	}
+
+	var rec record
+	if old, ok := s.records[f.id]; ok {
+		if err := json.Unmarshal(old, &rec); err != nil {
+			return err
+		}
+	}
+	if rec.Meta == nil {
+		rec.Meta = make(map[string]interface{})
+	}
+	for key, value := range f.meta {
+		rec.Meta[key] = value
+	}
+	if d, ok := f.File.Perm().(td.DocumentPermission); ok {
+		doc, err := d.Document()
+		if err != nil {
+			return err
+		}
+		rec.Perm = doc
+	}
+	rec.Modified = f.File.(*mock.File).ModTime()
+
+	if f.written {
+		size, err := f.File.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(io.NewSectionReader(f.File, 0, size))
+		if err != nil {
+			return err
+		}
+		if err = s.store.Put(dataKey+f.id, data); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, s.records[f.id]) {
+		if err = s.store.Put(recordKey+f.id, b); err != nil {
+			return err
+		}
+		s.records[f.id] = b
+	}
+	f.written, f.meta = false, nil
+	return nil
+}
+
+// File saves what was changed through it when it is closed.
+type File struct {
+	td.File
+	s       *Service
+	id      string
+	written bool
+	meta    map[string]interface{}
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.written = true
+	return f.File.Write(p)
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.written = true
+	return f.File.WriteAt(p, off)
+}
+
+func (f *File) Truncate(pos int64, data []byte) error {
+	f.written = true
+	return f.File.Truncate(pos, data)
+}
+
+func (f *File) WriteMeta(key string, value string) error {
+	return f.WriteFileMeta(key, value)
+}
+
+func (f *File) WriteFileMeta(key string, value interface{}) error {
+	if err := f.File.WriteFileMeta(key, value); err != nil {
+		return err
+	}
+	if f.meta == nil {
+		f.meta = make(map[string]interface{})
+	}
+	f.meta[key] = value
+	return nil
+}
+
+// Close saves the file, also when only its permission changed.
+func (f *File) Close() error {
+	err := f.File.Close()
+	if serr := f.s.save(f); err == nil {
+		err = serr
+	}
+	return err
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
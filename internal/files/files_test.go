@@ -0,0 +1,83 @@
+package files
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func read(t *testing.T, s *Service, p string) string {
+	f, err := s.Open(p, os.O_RDONLY, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestService_Persist(t *testing.T) {
+	store := mock.NewStorage()
+	s, err := NewService(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return modified }
+
+	f, _ := s.Open("/a", os.O_RDWR|os.O_CREATE, nil)
+	_, _ = f.Write([]byte("hello"))
+	_ = f.WriteMeta(td.MetaOwner, "sam")
+	f.Perm().BlockAllUser()
+	f.Perm().AllowUser("sam")
+	assert.Nil(t, f.Close())
+
+	for _, p := range []string{"/b", "/c", "/d"} {
+		f, _ = s.Open(p, os.O_RDWR|os.O_CREATE, nil)
+		_, _ = f.Write([]byte(p))
+		_ = f.Close()
+	}
+	assert.Nil(t, s.Rename("/e", "/b", ""))
+	assert.Nil(t, s.Rename("/d", "/c", ""), "replaces /d")
+	assert.Nil(t, s.Remove("/e", ""))
+
+	f, _ = s.Open("/d", os.O_RDONLY, nil)
+	f.Perm().AllowUser("tom")
+	_ = f.Close()
+	f, _ = s.Open("/f", os.O_RDWR|os.O_CREATE, nil)
+	_, _ = f.Write([]byte("never closed"))
+
+	s, err = NewService(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := s.List("/")
+	assert.Nil(t, err)
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, td.FileInfo{Path: "/a", Size: 5, ModTime: modified}, files[0])
+		assert.Equal(t, "/d", files[1].Path)
+	}
+	assert.Equal(t, "hello", read(t, s, "/a"))
+	assert.Equal(t, "/c", read(t, s, "/d"))
+
+	f, _ = s.Open("/a", os.O_RDONLY, nil)
+	owner, _ := f.Meta(td.MetaOwner)
+	assert.Equal(t, "sam", owner)
+	assert.True(t, td.Can(f.Perm(), td.User{Name: "sam"}, td.VerbRead))
+	assert.False(t, td.Can(f.Perm(), td.User{Name: "tom"}, td.VerbRead))
+	_ = f.Close()
+	usage, _ := s.OwnerUsage("sam")
+	assert.Equal(t, int64(5), usage)
+	f, _ = s.Open("/d", os.O_RDONLY, nil)
+	assert.True(t, td.Can(f.Perm(), td.User{Name: "tom"}, td.VerbRead))
+	_ = f.Close()
+
+	_ = store.Put(indexKey, []byte("{"))
+	_, err = NewService(store)
+	assert.NotNil(t, err)
+}
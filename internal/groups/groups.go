@@ -0,0 +1,316 @@
+// Package groups keeps the groups of TempDesk in a storage.PutterGetter, so
+// they survive a restart when the storage does.
+package groups
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// groupsKey names the JSON document holding every group.
+	groupsKey = "groups/db"
+
+	// MaxNameLength is the longest name of a group.
+	MaxNameLength = 64
+)
+
+// ValidName reports whether name may name a group: up to MaxNameLength
+// letters, digits and td.NameSymbols, starting with a letter or digit.
+func ValidName(name string) bool {
+	if name == "" || utf8.RuneCountInString(name) > MaxNameLength {
+		return false
+	}
+	for i, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && (i == 0 || !strings.ContainsRune(td.NameSymbols, r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Service is a td.GroupService. Like users.Service it reads the storage once
+// when it is created.
+//
+// The groups a user belongs to are resolved once and cached until a group
+// changes, so testing the group rules of a permission is a map lookup.
+type Service struct {
+	store storage.PutterGetter
+
+	rw     sync.RWMutex
+	groups map[string]td.Group
+
+	// cacheMu guards the resolved groups of every user asked about, which
+	// are dropped whenever gen moves on.
+	cacheMu sync.Mutex
+	cache   map[string]map[string]bool
+	gen     int
+}
+
+// NewService loads the groups from store.
+func NewService(store storage.PutterGetter) (*Service, error) {
+	s := &Service{store: store, groups: make(map[string]td.Group), cache: make(map[string]map[string]bool)}
+	value, err := store.Get(groupsKey)
+	if storage.IsNotFound(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return nil, &td.GroupServiceError{Kind: "unexpected value stored under " + groupsKey}
+	}
+	var list []td.Group
+	if err = json.Unmarshal(b, &list); err != nil {
+		return nil, &td.GroupServiceError{Kind: "error reading groups", Err: err}
+	}
+	for _, g := range list {
+		s.groups[g.Name] = g
+	}
+	return s, nil
+}
+
+// change copies the groups, lets fn change the copy and saves it unless it
+// nests a group in itself.
+func (s *Service) change(fn func(groups map[string]td.Group) error) error {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	groups := make(map[string]td.Group, len(s.groups)+1)
+	for name, g := range s.groups {
+		groups[name] = g
+	}
+	if err := fn(groups); err != nil {
+		return err
+	}
+	if name, ok := findCycle(groups); ok {
+		return &td.GroupServiceError{Kind: td.GroupCycle, Err: &cycleError{name}}
+	}
+	b, err := json.Marshal(sortedGroups(groups))
+	if err != nil {
+		return err
+	}
+	if err = s.store.Put(groupsKey, b); err != nil {
+		return err
+	}
+	s.groups = groups
+	s.cacheMu.Lock()
+	s.cache = make(map[string]map[string]bool)
+	s.gen++
+	s.cacheMu.Unlock()
+	return nil
+}
+
+type cycleError struct {
+	group string
+}
+
+func (c *cycleError) Error() string {
+	return c.group + " is nested in itself"
+}
+
+// findCycle returns a group nested in itself.
+func findCycle(groups map[string]td.Group) (string, bool) {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(groups))
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visiting:
+			return true
+		case done:
+			return false
+		}
+		state[name] = visiting
+		for _, sub := range groups[name].Groups {
+			if visit(sub) {
+				return true
+			}
+		}
+		state[name] = done
+		return false
+	}
+	for _, g := range sortedGroups(groups) {
+		if visit(g.Name) {
+			return g.Name, true
+		}
+	}
+	return "", false
+}
+
+// checkNested makes sure the groups nested in g exist.
+func checkNested(groups map[string]td.Group, g td.Group) error {
+	for _, sub := range g.Groups {
+		if _, ok := groups[sub]; !ok {
+			return &td.GroupServiceError{Kind: td.GroupNotExists, Err: &unknownError{sub}}
+		}
+	}
+	return nil
+}
+
+type unknownError struct {
+	group string
+}
+
+func (u *unknownError) Error() string {
+	return "no group " + u.group
+}
+
+func (s *Service) Group(name string) (group td.Group, ok bool) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	group, ok = s.groups[name]
+	return copyGroup(group), ok
+}
+
+func (s *Service) CreateGroup(group td.Group) (err error) {
+	return s.change(func(groups map[string]td.Group) error {
+		if _, ok := groups[group.Name]; ok {
+			return &td.GroupServiceError{Kind: td.GroupAlreadyExists}
+		}
+		if err := checkNested(groups, group); err != nil {
+			return err
+		}
+		groups[group.Name] = copyGroup(group)
+		return nil
+	})
+}
+
+func (s *Service) UpdateGroup(group td.Group) (err error) {
+	return s.change(func(groups map[string]td.Group) error {
+		if _, ok := groups[group.Name]; !ok {
+			return &td.GroupServiceError{Kind: td.GroupNotExists}
+		}
+		if err := checkNested(groups, group); err != nil {
+			return err
+		}
+		groups[group.Name] = copyGroup(group)
+		return nil
+	})
+}
+
+func (s *Service) DeleteGroup(group td.Group) (err error) {
+	return s.change(func(groups map[string]td.Group) error {
+		if _, ok := groups[group.Name]; !ok {
+			return &td.GroupServiceError{Kind: td.GroupNotExists}
+		}
+		delete(groups, group.Name)
+		for name, g := range groups {
+			if subs := Without(g.Groups, group.Name); len(subs) != len(g.Groups) {
+				g = copyGroup(g)
+				g.Groups = subs
+				groups[name] = g
+			}
+		}
+		return nil
+	})
+}
+
+// Groups lists every group ordered by name.
+func (s *Service) Groups() (groups []td.Group, err error) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return sortedGroups(s.groups), nil
+}
+
+// IsMember reports whether the user name is a member of group, directly or
+// through a nested group.
+func (s *Service) IsMember(name, group string) bool {
+	return s.MemberOf(name)[group]
+}
+
+// MemberOf returns the set of groups the user name belongs to, which the
+// caller must not change.
+func (s *Service) MemberOf(name string) map[string]bool {
+	s.cacheMu.Lock()
+	in, ok := s.cache[name]
+	gen := s.gen
+	s.cacheMu.Unlock()
+	if ok {
+		return in
+	}
+
+	s.rw.RLock()
+	in = make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, g := range s.groups {
+			if in[g.Name] {
+				continue
+			}
+			if Contains(g.Members, name) || containsAny(g.Groups, in) {
+				in[g.Name], changed = true, true
+			}
+		}
+	}
+	s.rw.RUnlock()
+
+	s.cacheMu.Lock()
+	// not cached if the groups changed meanwhile
+	if gen == s.gen {
+		s.cache[name] = in
+	}
+	s.cacheMu.Unlock()
+	return in
+}
+
+// Health checks the storage when it can check itself.
+func (s *Service) Health() error {
+	return td.CheckHealth(s.store)
+}
+
+// Contains reports whether list holds s.
+func Contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list []string, set map[string]bool) bool {
+	for _, v := range list {
+		if set[v] {
+			return true
+		}
+	}
+	return false
+}
+
+// Without returns a copy of list with every s left out.
+func Without(list []string, s string) []string {
+	ret := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != s {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func sortedGroups(groups map[string]td.Group) []td.Group {
+	list := make([]td.Group, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, copyGroup(g))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// copyGroup makes sure callers never share the lists of the stored group.
+func copyGroup(g td.Group) td.Group {
+	g.Owners = append([]string(nil), g.Owners...)
+	g.Members = append([]string(nil), g.Members...)
+	g.Groups = append([]string(nil), g.Groups...)
+	return g
+}
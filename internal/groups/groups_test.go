@@ -0,0 +1,99 @@
+package groups
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func kind(err error) string {
+	if e, ok := err.(*td.GroupServiceError); ok {
+		return e.Kind
+	}
+	return ""
+}
+
+func TestService(t *testing.T) {
+	s, err := NewService(mock.NewStorage())
+	assert.Nil(t, err)
+
+	_, ok := s.Group("dev")
+	assert.False(t, ok)
+	assert.Nil(t, s.CreateGroup(td.Group{Name: "dev", Owners: []string{"sam"}, Members: []string{"tom"}}))
+	assert.Equal(t, td.GroupAlreadyExists, kind(s.CreateGroup(td.Group{Name: "dev"})))
+	g, ok := s.Group("dev")
+	assert.True(t, ok)
+	assert.True(t, g.IsOwner("sam"))
+	assert.False(t, g.IsOwner("tom"))
+	g.Members[0] = "changed"
+	g, _ = s.Group("dev")
+	assert.Equal(t, []string{"tom"}, g.Members, "callers get a copy")
+
+	assert.Equal(t, td.GroupNotExists, kind(s.UpdateGroup(td.Group{Name: "ops"})))
+	assert.Equal(t, td.GroupNotExists, kind(s.CreateGroup(td.Group{Name: "ops", Groups: []string{"qa"}})), "nested groups must exist")
+	assert.Nil(t, s.CreateGroup(td.Group{Name: "ops", Members: []string{"ann"}, Groups: []string{"dev"}}))
+	groups, err := s.Groups()
+	assert.Nil(t, err)
+	if assert.Len(t, groups, 2) {
+		assert.Equal(t, "dev", groups[0].Name)
+		assert.Equal(t, "ops", groups[1].Name)
+	}
+
+	assert.Equal(t, td.GroupNotExists, kind(s.DeleteGroup(td.Group{Name: "qa"})))
+	assert.Nil(t, s.DeleteGroup(td.Group{Name: "dev"}))
+	g, _ = s.Group("ops")
+	assert.Empty(t, g.Groups, "a deleted group is taken out of the others")
+}
+
+func TestService_Nesting(t *testing.T) {
+	s, _ := NewService(mock.NewStorage())
+	assert.Nil(t, s.CreateGroup(td.Group{Name: "a", Members: []string{"sam"}}))
+	assert.Nil(t, s.CreateGroup(td.Group{Name: "b", Members: []string{"tom"}, Groups: []string{"a"}}))
+	assert.Nil(t, s.CreateGroup(td.Group{Name: "c", Groups: []string{"b"}}))
+
+	assert.True(t, s.IsMember("sam", "a"))
+	assert.True(t, s.IsMember("sam", "c"), "members of nested groups are members")
+	assert.False(t, s.IsMember("tom", "a"))
+	assert.True(t, s.IsMember("tom", "c"))
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, s.MemberOf("sam"))
+
+	assert.Equal(t, td.GroupCycle, kind(s.UpdateGroup(td.Group{Name: "a", Members: []string{"sam"}, Groups: []string{"c"}})))
+	assert.Equal(t, td.GroupCycle, kind(s.UpdateGroup(td.Group{Name: "a", Groups: []string{"a"}})))
+	assert.True(t, s.IsMember("sam", "a"), "a failed change changes nothing")
+
+	assert.Nil(t, s.UpdateGroup(td.Group{Name: "b", Members: []string{"tom"}}))
+	assert.False(t, s.IsMember("sam", "c"), "a change drops the cache")
+	assert.True(t, s.IsMember("tom", "c"))
+}
+
+func TestService_Persist(t *testing.T) {
+	store := mock.NewStorage()
+	s, _ := NewService(store)
+	assert.Nil(t, s.CreateGroup(td.Group{Name: "a", Owners: []string{"sam"}, Members: []string{"tom"}}))
+	assert.Nil(t, s.CreateGroup(td.Group{Name: "b", Groups: []string{"a"}}))
+
+	s, err := NewService(store)
+	assert.Nil(t, err)
+	assert.True(t, s.IsMember("tom", "b"))
+	g, _ := s.Group("a")
+	assert.Equal(t, []string{"sam"}, g.Owners)
+
+	_ = store.Put(groupsKey, []byte("{"))
+	_, err = NewService(store)
+	assert.NotNil(t, err)
+}
+
+func TestValidName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"dev":      true,
+		"team.ops": true,
+		"qa-2":     true,
+		"":         false,
+		".hidden":  false,
+		"a/b":      false,
+		"a b":      false,
+	} {
+		assert.Equal(t, valid, ValidName(name), name)
+	}
+}
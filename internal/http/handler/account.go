@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/account"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mail"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	ErrorNoMail       = "mail is not enabled"
+	ErrorInvalidToken = "invalid or expired token"
+	ErrorNoEmail      = "user has no email address"
+	ErrorSendingMail  = "error sending mail"
+	ErrorResettingKey = "error resetting key"
+)
+
+// Account lets users verify their email address and reset a forgotten key
+// by the tokens mailed to them:
+//
+//	GET  {prefix}/verify?token=T  verify the address a verify mail went to
+//	POST {prefix}/verify          the same with {"token": "T"}
+//	POST {prefix}/verify/send     mail the user a verify link again
+//	POST {prefix}/reset           mail a reset token, {"name": "sam"}
+//	PUT  {prefix}/reset           set a new key, {"token": "T", "password": "k"}
+//	GET  {prefix}/reset?token=T   a form the link of a reset mail opens
+//	POST {prefix}/reset           the same as PUT with the form fields
+//
+// Asking for a reset is answered alike whether or not a mail is sent, so it
+// does not tell which users exist or have an address.
+type Account struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewAccount(state *thttp.State, prefix string) *Account {
+	return &Account{state: state, prefix: prefix}
+}
+
+type accountRequest struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Key   string `json:"password"`
+}
+
+func (a *Account) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	if a.state.Account == nil {
+		http.Error(res, ErrorNoMail, http.StatusNotFound)
+		return
+	}
+
+	var r accountRequest
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	form := mediaType == "application/x-www-form-urlencoded"
+	if req.Method == http.MethodPost || req.Method == http.MethodPut {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Debug(ErrorParsingBody, tlog.Err(err))
+			http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+			return
+		}
+		if form {
+			values, err := url.ParseQuery(string(body))
+			if err != nil {
+				log.Debug(ErrorParsingBody, tlog.Err(err))
+				http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+				return
+			}
+			r.Token, r.Key = values.Get("token"), values.Get("password")
+		} else if len(body) > 0 {
+			if err = json.Unmarshal(body, &r); err != nil {
+				log.Debug(ErrorParsingJson, tlog.Err(err))
+				http.Error(res, ErrorParsingJson, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	switch p := strings.Trim(strings.TrimPrefix(req.URL.Path, a.prefix), "/"); {
+	case p == "verify" && req.Method == http.MethodGet:
+		a.ServeVerify(res, req, req.URL.Query().Get("token"))
+	case p == "verify" && req.Method == http.MethodPost:
+		a.ServeVerify(res, req, r.Token)
+	case p == "verify/send" && req.Method == http.MethodPost:
+		a.ServeSendVerify(res, req)
+	case p == "reset" && req.Method == http.MethodGet:
+		a.ServeResetForm(res, req, req.URL.Query().Get("token"))
+	case p == "reset" && req.Method == http.MethodPost && form:
+		a.ServeReset(res, req, r.Token, r.Key)
+	case p == "reset" && req.Method == http.MethodPost:
+		a.ServeRequestReset(res, req, r.Name)
+	case p == "reset" && req.Method == http.MethodPut:
+		a.ServeReset(res, req, r.Token, r.Key)
+	case p == "verify" || p == "verify/send" || p == "reset":
+		log.Debug("unsupported method", tlog.String("method", req.Method))
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+// user returns the user token of purpose is for, answering the request
+// itself if there is none.
+func (a *Account) user(res http.ResponseWriter, req *http.Request, token, purpose string) (td.User, bool) {
+	log := tlog.Ctx(req.Context())
+	t, err := a.state.Account.ParseToken(token, purpose)
+	if err != nil {
+		log.Debug(ErrorInvalidToken, tlog.Err(err))
+		http.Error(res, ErrorInvalidToken, http.StatusBadRequest)
+		return td.User{}, false
+	}
+	user, ok := a.state.Users.User(t.Name)
+	if !ok || !t.Matches(user) {
+		log.Debug(ErrorInvalidToken, tlog.String("name", t.Name), tlog.String("reason", "token is used or outdated"))
+		http.Error(res, ErrorInvalidToken, http.StatusBadRequest)
+		return td.User{}, false
+	}
+	return user, true
+}
+
+func (a *Account) ServeVerify(res http.ResponseWriter, req *http.Request, token string) {
+	log := tlog.Ctx(req.Context())
+	user, ok := a.user(res, req, token, account.PurposeVerify)
+	if !ok {
+		return
+	}
+	meta := make(map[string]string, len(user.Meta)+1)
+	for k, v := range user.Meta {
+		meta[k] = v
+	}
+	meta[td.MetaEmailVerified] = "true"
+	user.Meta = meta
+	if err := a.state.Users.UpdateUser(user); err != nil {
+		log.Error(ErrorUpdatingUser, tlog.Err(err))
+		a.state.Record(req, user.Name, audit.ActionEmailVerify, user.Email(), audit.OutcomeFailure, err.Error())
+		http.Error(res, ErrorUpdatingUser, http.StatusInternalServerError)
+		return
+	}
+	log.Info("verify email", tlog.String("name", user.Name))
+	a.state.Record(req, user.Name, audit.ActionEmailVerify, user.Email(), audit.OutcomeSuccess, "")
+	writeJson(res, http.StatusOK, map[string]string{"name": user.Name, "email": user.Email()})
+}
+
+func (a *Account) ServeSendVerify(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := a.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+	if user.Email() == "" {
+		http.Error(res, ErrorNoEmail, http.StatusBadRequest)
+		return
+	}
+	if err = a.state.Account.SendVerify(req.Context(), user); err != nil {
+		log.Error(ErrorSendingMail, tlog.Err(err))
+		http.Error(res, ErrorSendingMail, http.StatusBadGateway)
+		return
+	}
+	res.WriteHeader(http.StatusAccepted)
+}
+
+func (a *Account) ServeRequestReset(res http.ResponseWriter, req *http.Request, name string) {
+	if name == "" {
+		http.Error(res, "name is required", http.StatusBadRequest)
+		return
+	}
+	if user, ok := a.state.Users.User(name); ok && user.IsEmailVerified() && !user.IsDisabled() {
+		a.state.Record(req, name, audit.ActionKeyReset, name, audit.OutcomeSuccess, "reset mail sent")
+		sendMail(req, "reset", func(ctx context.Context) error {
+			return a.state.Account.SendReset(ctx, user)
+		})
+	} else {
+		tlog.Ctx(req.Context()).Debug("no reset mail", tlog.String("name", name))
+	}
+	res.WriteHeader(http.StatusAccepted)
+}
+
+// resetForm asks for a new key, it posts back to the link it was opened by.
+var resetForm = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Reset your TempDesk key</title></head>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.}}">
+<label>New key <input type="password" name="password" autocomplete="new-password" required></label>
+<button>Reset</button>
+</form>
+</body>
+</html>
+`))
+
+func (a *Account) ServeResetForm(res http.ResponseWriter, req *http.Request, token string) {
+	if _, ok := a.user(res, req, token, account.PurposeReset); !ok {
+		return
+	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	if err := resetForm.Execute(res, token); err != nil {
+		tlog.Ctx(req.Context()).Warn("error writing reset form", tlog.Err(err))
+	}
+}
+
+func (a *Account) ServeReset(res http.ResponseWriter, req *http.Request, token, key string) {
+	log := tlog.Ctx(req.Context())
+	user, ok := a.user(res, req, token, account.PurposeReset)
+	if !ok {
+		return
+	}
+	if !checkKey(a.state, res, user.Name, key) {
+		return
+	}
+	user.Key = key
+	if err := a.state.Users.UpdateUser(user); err != nil {
+		log.Error(ErrorResettingKey, tlog.Err(err))
+		a.state.Record(req, user.Name, audit.ActionKeyReset, user.Name, audit.OutcomeFailure, err.Error())
+		http.Error(res, ErrorResettingKey, http.StatusInternalServerError)
+		return
+	}
+	log.Info("reset key", tlog.String("name", user.Name))
+	a.state.Record(req, user.Name, audit.ActionKeyReset, user.Name, audit.OutcomeSuccess, "")
+	if req.Method == http.MethodPost {
+		// answer the form with more than a blank page
+		_, _ = io.WriteString(res, "Your key is reset.\n")
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// sendMail sends a mail in the background, so the response neither waits
+// for the mail server nor tells by its timing whether a mail was sent.
+func sendMail(req *http.Request, what string, send func(ctx context.Context) error) {
+	log := tlog.Ctx(req.Context())
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mail.DefaultTimeout)
+		defer cancel()
+		if err := send(ctx); err != nil {
+			log.Warn(ErrorSendingMail, tlog.String("mail", what), tlog.Err(err))
+		}
+	}()
+}
+
+// keepVerified lets upd keep the verification of the address of the user it
+// updates when the address stays the same, and drops one upd sets itself.
+// It reports whether upd has a new address to verify.
+func keepVerified(state *thttp.State, upd *td.User) bool {
+	old, _ := state.Users.User(upd.Name)
+	verified := old.IsEmailVerified() && strings.EqualFold(old.Email(), upd.Email())
+	if _, ok := upd.Meta[td.MetaEmailVerified]; ok || verified {
+		meta := make(map[string]string, len(upd.Meta)+1)
+		for k, v := range upd.Meta {
+			if k != td.MetaEmailVerified {
+				meta[k] = v
+			}
+		}
+		if verified {
+			meta[td.MetaEmailVerified] = "true"
+		}
+		upd.Meta = meta
+	}
+	return upd.Email() != "" && !strings.EqualFold(old.Email(), upd.Email())
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/account"
+	"github.com/huangjiahua/tempdesk/internal/mail"
+	"github.com/huangjiahua/tempdesk/internal/mail/mailtest"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mailToken = regexp.MustCompile(`token[= ]([A-Za-z0-9_-]+\.[A-Za-z0-9_-]+)`)
+
+// receiveToken waits for a mail to to arrive at s and returns its token.
+func receiveToken(t *testing.T, s *mailtest.Server, to string) string {
+	select {
+	case m := <-s.Messages:
+		assert.Equal(t, []string{to}, m.To)
+		if match := mailToken.FindStringSubmatch(m.Body); match != nil {
+			return match[1]
+		}
+		t.Fatalf("no token in %q", m.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+	return ""
+}
+
+func assertNoMail(t *testing.T, s *mailtest.Server) {
+	select {
+	case m := <-s.Messages:
+		t.Errorf("unexpected mail to %v: %s", m.To, m.Subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAccount(t *testing.T) {
+	smtp := mailtest.NewServer()
+	defer smtp.Close()
+	state, ts := newSignupServer(t)
+	var err error
+	if state.Account, err = account.NewService(mock.NewStorage(), mail.NewSMTP(smtp.Addr, "", ""), "noreply@example.com", "https://example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := signUp(t, ts, `{"name":"sam","password":"sam password","meta":{"email":"sam at example.com"}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "is not an email address")
+	status, _ = signUp(t, ts, `{"name":"sam","password":"sam password","meta":{"email":"sam@example.com"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	token := receiveToken(t, smtp, "sam@example.com")
+
+	// no reset before the address is verified
+	res, err := http.Post(ts.URL+"/account/reset", "application/json", strings.NewReader(`{"name":"sam"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assertNoMail(t, smtp)
+
+	res, err = http.Get(ts.URL + "/account/verify?token=" + url.QueryEscape(token) + "x")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, err = http.Get(ts.URL + "/account/verify?token=" + url.QueryEscape(token))
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode, string(b))
+	assert.JSONEq(t, `{"name":"sam","email":"sam@example.com"}`, string(b))
+	sam, _ := state.Users.User("sam")
+	assert.True(t, sam.IsEmailVerified())
+
+	// an update keeps the verification, unless it changes the address
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/user/", strings.NewReader(`{"name":"sam","password":"sam password","meta":{"email":"sam@example.com","team":"ops"}}`), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	sam, _ = state.Users.User("sam")
+	assert.True(t, sam.IsEmailVerified())
+	assertNoMail(t, smtp)
+
+	for _, name := range []string{"sam", "nobody"} {
+		res, err = http.Post(ts.URL+"/account/reset", "application/json", strings.NewReader(`{"name":"`+name+`"}`))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusAccepted, res.StatusCode, "a reset is answered alike for every name")
+	}
+	token = receiveToken(t, smtp, "sam@example.com")
+	assertNoMail(t, smtp)
+
+	// the link of the mail opens a form posting back to it
+	res, err = http.Get(ts.URL + "/account/reset?token=" + url.QueryEscape(token))
+	assert.Nil(t, err)
+	b, _ = ioutil.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, string(b), `name="token" value="`+token+`"`)
+	res, err = http.Get(ts.URL + "/account/reset?token=x")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, err = http.PostForm(ts.URL+"/account/reset", url.Values{"token": {token}, "password": {"form sam password"}})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_, _ = http.Post(ts.URL+"/account/reset", "application/json", strings.NewReader(`{"name":"sam"}`))
+	token = receiveToken(t, smtp, "sam@example.com")
+
+	reset := func(body string) int {
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/account/reset", strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, reset(`{"token":"`+token+`","password":"short"}`), "the policy applies")
+	assert.Equal(t, http.StatusNoContent, reset(`{"token":"`+token+`","password":"new sam password"}`))
+	assert.Equal(t, http.StatusBadRequest, reset(`{"token":"`+token+`","password":"newer sam password"}`), "a token works once")
+
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/user/", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "the old key is gone")
+	sam.Key = "new sam password"
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/user/", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/user/", strings.NewReader(`{"name":"sam","password":"new sam password","meta":{"email":"sam@example.org","email_verified":"true"}}`), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	sam, _ = state.Users.User("sam")
+	assert.False(t, sam.IsEmailVerified(), "a new address needs verifying")
+	receiveToken(t, smtp, "sam@example.org")
+
+	res, _ = doFile(t, &sam, http.MethodPost, ts.URL+"/account/verify/send", nil, nil)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	token = receiveToken(t, smtp, "sam@example.org")
+	res, _ = doFile(t, &td.User{}, http.MethodPost, ts.URL+"/account/verify", strings.NewReader(`{"token":"`+token+`"}`), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	sam, _ = state.Users.User("sam")
+	assert.True(t, sam.IsEmailVerified())
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"context"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ErrorNotAdmin      = "admin only"
+	ErrorNoAudit       = "audit is not enabled"
+	ErrorReadingAudit  = "error reading audit log"
+	ErrorParsingFilter = "error parsing filter"
+)
+
+// Admin serves the administration endpoints below prefix to admin users:
+//
+//	GET|PUT {prefix}/log/level     read or change the log level
+//	GET     {prefix}/audit         query the audit log by user, action,
+//	                               since, until and limit
+//	GET     {prefix}/audit/verify  check the hash chain of the audit log
+//	GET|POST {prefix}/invites      list or create invite codes
+//	DELETE  {prefix}/invites/{code} revoke an invite code
+//	GET     {prefix}/pending       list the users waiting for approval
+//	POST|DELETE {prefix}/pending/{name} approve or reject a user
+//	DELETE  {prefix}/totp/{name}   remove the second factor of a user
+type Admin struct {
+	state  *thttp.State
+	prefix string
+	mux    *http.ServeMux
+}
+
+func NewAdmin(state *thttp.State, prefix string) *Admin {
+	a := &Admin{state: state, prefix: prefix, mux: http.NewServeMux()}
+	a.mux.Handle(prefix+"/log/level", tlog.LevelHandler())
+	a.mux.HandleFunc(prefix+"/audit", a.ServeAudit)
+	a.mux.HandleFunc(prefix+"/audit/verify", a.ServeAuditVerify)
+	a.mux.HandleFunc(prefix+"/invites", a.ServeInvites)
+	a.mux.HandleFunc(prefix+"/invites/", a.ServeInvites)
+	a.mux.HandleFunc(prefix+"/pending", a.ServePending)
+	a.mux.HandleFunc(prefix+"/pending/", a.ServePending)
+	a.mux.HandleFunc(prefix+"/totp/", a.ServeTOTPReset)
+	return a
+}
+
+func (a *Admin) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	admin, ok := authAdmin(a.state, res, req)
+	if !ok {
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		tlog.Ctx(req.Context()).Info("admin request", tlog.String("method", req.Method))
+	}
+	a.mux.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), adminKey{}, admin)))
+}
+
+type adminKey struct{}
+
+// adminOf returns the admin Admin authenticated req as.
+func adminOf(req *http.Request) td.User {
+	admin, _ := req.Context().Value(adminKey{}).(td.User)
+	return admin
+}
+
+// authAdmin authenticates req and answers 403 unless it comes from an admin.
+func authAdmin(state *thttp.State, res http.ResponseWriter, req *http.Request) (td.User, bool) {
+	log := tlog.Ctx(req.Context())
+	user, err := state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return td.User{}, false
+	}
+	if !user.IsAdmin() {
+		log.Info(ErrorNotAdmin, tlog.String("path", req.URL.Path))
+		http.Error(res, ErrorNotAdmin, http.StatusForbidden)
+		return td.User{}, false
+	}
+	return user, true
+}
+
+func (a *Admin) ServeAudit(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	if a.state.Audit == nil {
+		http.Error(res, ErrorNoAudit, http.StatusNotFound)
+		return
+	}
+
+	q := req.URL.Query()
+	f := audit.Filter{User: q.Get("user"), Action: q.Get("action")}
+	var err error
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(name); v != "" && err == nil {
+			*t, err = time.Parse(time.RFC3339, v)
+		}
+	}
+	if v := q.Get("limit"); v != "" && err == nil {
+		f.Limit, err = strconv.Atoi(v)
+	}
+	if err != nil {
+		log.Debug(ErrorParsingFilter, tlog.Err(err))
+		http.Error(res, ErrorParsingFilter, http.StatusBadRequest)
+		return
+	}
+
+	records, err := a.state.Audit.Query(f)
+	if err != nil {
+		log.Error(ErrorReadingAudit, tlog.Err(err))
+		http.Error(res, ErrorReadingAudit, http.StatusInternalServerError)
+		return
+	}
+	writeJson(res, http.StatusOK, records)
+}
+
+func (a *Admin) ServeAuditVerify(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	if a.state.Audit == nil {
+		http.Error(res, ErrorNoAudit, http.StatusNotFound)
+		return
+	}
+
+	ret := map[string]interface{}{"records": a.state.Audit.Len(), "ok": true}
+	err := a.state.Audit.Verify()
+	if e, ok := err.(*audit.AuditError); ok {
+		log.Error("audit log verification failed", tlog.Err(err))
+		ret["ok"] = false
+		ret["error"] = e.Error()
+		writeJson(res, http.StatusConflict, ret)
+		return
+	}
+	if err != nil {
+		log.Error(ErrorReadingAudit, tlog.Err(err))
+		http.Error(res, ErrorReadingAudit, http.StatusInternalServerError)
+		return
+	}
+	writeJson(res, http.StatusOK, ret)
+}
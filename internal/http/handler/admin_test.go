@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdmin_ServeHTTP_LogLevel(t *testing.T) {
+	state := &thttp.State{
+		Users:  mock.NewUserService(),
+		Files:  mock.NewFileService(),
+		Auther: auth.NewHMACAuther(),
+	}
+	ts := httptest.NewServer(NewAdmin(state, "/admin"))
+	defer ts.Close()
+
+	sam := td.User{Name: "sam", Key: "key"}
+	root := td.User{Name: "root", Key: "key", Meta: map[string]string{td.MetaRole: td.RoleAdmin}}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(root)
+
+	old := tlog.Level()
+	defer func() { _ = tlog.SetLevel(old) }()
+
+	res, _ := doFile(t, &sam, http.MethodGet, ts.URL+"/admin/log/level", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, body := doFile(t, &root, http.MethodPut, ts.URL+"/admin/log/level", strings.NewReader(`{"level":"warn"}`), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode, body)
+	assert.Equal(t, "warn", tlog.Level())
+
+	res, body = doFile(t, &root, http.MethodGet, ts.URL+"/admin/log/level", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `{"level":"warn"}`, body)
+}
+
+func TestAdmin_ServeHTTP_Audit(t *testing.T) {
+	log, _ := audit.NewLog(mock.NewStorage())
+	state, ts := newServer(t, &thttp.State{Audit: log}, []string{"/admin/", "/user/"})
+
+	root := td.User{Name: "root", Key: "key", Meta: map[string]string{td.MetaRole: td.RoleAdmin}}
+	_ = state.Users.CreateUser(root)
+
+	res, err := http.Post(ts.URL+"/user/", "application/json", strings.NewReader(`{"name":"sam","password":"key"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	wrong := td.User{Name: "sam", Key: "guess"}
+	res, _ = doFile(t, &wrong, http.MethodGet, ts.URL+"/user/", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, body := doFile(t, &root, http.MethodGet, ts.URL+"/admin/audit?user=sam", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode, body)
+	var records []audit.Record
+	assert.NoError(t, json.Unmarshal([]byte(body), &records))
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, audit.ActionAuthFail, records[0].Action)
+		assert.Equal(t, audit.OutcomeFailure, records[0].Outcome)
+		assert.Equal(t, "127.0.0.1", records[0].ClientIP)
+		assert.Equal(t, audit.ActionUserCreate, records[1].Action)
+	}
+
+	res, _ = doFile(t, &root, http.MethodGet, ts.URL+"/admin/audit?since=yesterday", nil, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, body = doFile(t, &root, http.MethodGet, ts.URL+"/admin/audit/verify", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `{"ok":true,"records":2}`, body)
+}
@@ -0,0 +1,338 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	ErrorArchiveFormat  = "unknown archive format"
+	ErrorNoArchivePaths = "no paths to archive"
+	ErrorArchivePaths   = "too many paths to archive"
+	ErrorWritingArchive = "error writing archive"
+
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+
+	// MaxArchivePaths bounds the paths a selection may list, directories
+	// count once however many files they hold.
+	MaxArchivePaths = 1000
+)
+
+// Archive streams the files of a directory or of a selection as one zip or
+// gzipped tar archive, chosen by the format parameter:
+//
+//	GET  {prefix}/{dir}/?format=zip  the files below dir
+//	POST {prefix}/?format=tar.gz     the files and directories listed as
+//	                                 {"paths": ["/a.txt", "/docs/"]}
+//
+// The format defaults to zip, which switches to Zip64 when the archive
+// needs it. Entries of a directory are named relative to it, those of a
+// selection by their path. Files below a directory the user may not read
+// are left out, a listed file the user may not read is not found, just like
+// one that does not exist. An entry is modified when the MetaModTime of its
+// file says, else when the file was stored.
+//
+// The archive is written while the files are read, nothing is buffered. An
+// error once it is under way can only truncate it, it is logged.
+type Archive struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewArchive(state *thttp.State, prefix string) *Archive {
+	return &Archive{state: state, prefix: prefix}
+}
+
+type archiveRequest struct {
+	Paths []string `json:"paths"`
+}
+
+// archiveEntry is a file to archive under name.
+type archiveEntry struct {
+	name string
+	info td.FileInfo
+}
+
+func (a *Archive) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := a.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = ArchiveZip
+	}
+	if format != ArchiveZip && format != ArchiveTarGz {
+		http.Error(res, ErrorArchiveFormat, http.StatusBadRequest)
+		return
+	}
+
+	var entries []archiveEntry
+	name := "tempdesk"
+	switch req.Method {
+	case http.MethodGet:
+		dir := path.Clean("/" + strings.TrimPrefix(req.URL.Path, a.prefix))
+		if entries, err = a.dir(dir, strings.TrimSuffix(dir, "/")+"/"); err != nil {
+			log.Debug(ErrorListingFiles, tlog.String("path", dir), tlog.Err(err))
+			writeFileError(res, err, ErrorListingFiles)
+			return
+		}
+		if dir != "/" {
+			name = path.Base(dir)
+		}
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Debug(ErrorParsingBody, tlog.Err(err))
+			http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+			return
+		}
+		var r archiveRequest
+		if err = json.Unmarshal(body, &r); err != nil {
+			log.Debug(ErrorParsingJson, tlog.Err(err))
+			http.Error(res, ErrorParsingJson, http.StatusBadRequest)
+			return
+		}
+		switch {
+		case len(r.Paths) == 0:
+			http.Error(res, ErrorNoArchivePaths, http.StatusBadRequest)
+			return
+		case len(r.Paths) > MaxArchivePaths:
+			http.Error(res, ErrorArchivePaths, http.StatusBadRequest)
+			return
+		}
+		if entries, err = a.selection(r.Paths, user); err != nil {
+			log.Debug(ErrorListingFiles, tlog.Err(err))
+			writeFileError(res, err, ErrorListingFiles)
+			return
+		}
+	default:
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name += "." + format
+	if format == ArchiveZip {
+		res.Header().Set("Content-Type", "application/zip")
+	} else {
+		res.Header().Set("Content-Type", "application/gzip")
+	}
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	res.WriteHeader(http.StatusOK)
+
+	var w archiveWriter
+	if format == ArchiveZip {
+		w = &zipArchive{zip.NewWriter(res)}
+	} else {
+		gz := gzip.NewWriter(res)
+		w = &tarArchive{gz: gz, tar: tar.NewWriter(gz)}
+	}
+	written, skipped := 0, 0
+	for _, e := range entries {
+		ok, err := a.write(w, e, user)
+		if err != nil {
+			log.Warn(ErrorWritingArchive, tlog.String("path", e.info.Path), tlog.Err(err))
+			return
+		}
+		if ok {
+			written++
+		} else {
+			skipped++
+		}
+	}
+	if err = w.Close(); err != nil {
+		log.Warn(ErrorWritingArchive, tlog.Err(err))
+		return
+	}
+	log.Info("archive files",
+		tlog.String("user", user.Name),
+		tlog.String("name", name),
+		tlog.Int("files", written),
+		tlog.Int("skipped", skipped))
+}
+
+// dir lists the files below dir, named by their path after prefix.
+func (a *Archive) dir(dir string, prefix string) ([]archiveEntry, error) {
+	files, err := a.state.Files.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]archiveEntry, 0, len(files))
+	for _, info := range files {
+		entries = append(entries, archiveEntry{name: strings.TrimPrefix(info.Path, prefix), info: info})
+	}
+	return entries, nil
+}
+
+// selection lists the files of paths, expanding those ending in a slash to
+// the files below them. A file listed twice is archived once. It fails if
+// a file does not exist or user may not read it, so the two cannot be told
+// apart.
+func (a *Archive) selection(paths []string, user td.User) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		clean := path.Clean("/" + p)
+		var found []archiveEntry
+		if strings.HasSuffix(p, "/") {
+			list, err := a.dir(clean, "/")
+			if err != nil {
+				return nil, err
+			}
+			found = list
+		} else {
+			info, err := a.stat(clean, user)
+			if err != nil {
+				return nil, err
+			}
+			found = []archiveEntry{{name: strings.TrimPrefix(clean, "/"), info: info}}
+		}
+		for _, e := range found {
+			if !seen[e.info.Path] {
+				seen[e.info.Path] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// stat finds the FileInfo of the file at p by listing its directory. A file
+// user may not read does not exist for stat.
+func (a *Archive) stat(p string, user td.User) (td.FileInfo, error) {
+	notExist := &td.FileServiceError{Kind: td.FileNotExist}
+	files, err := a.state.Files.List(path.Dir(p))
+	if err != nil {
+		return td.FileInfo{}, err
+	}
+	for _, info := range files {
+		if info.Path != p {
+			continue
+		}
+		file, err := a.state.Files.Open(p, os.O_RDONLY, nil)
+		if err != nil {
+			return td.FileInfo{}, err
+		}
+		defer closeFile(file)
+		if !td.Can(file.Perm(), user, td.VerbRead) {
+			return td.FileInfo{}, notExist
+		}
+		return info, nil
+	}
+	return td.FileInfo{}, notExist
+}
+
+// write adds the file of e to w unless user may not read it or it is gone
+// meanwhile, which it reports by false.
+func (a *Archive) write(w archiveWriter, e archiveEntry, user td.User) (bool, error) {
+	file, err := a.state.Files.Open(e.info.Path, os.O_RDONLY, nil)
+	if err != nil {
+		return false, nil
+	}
+	defer closeFile(file)
+	if !td.Can(file.Perm(), user, td.VerbRead) {
+		return false, nil
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err = w.Add(e.name, size, modTime(file, e.info), io.LimitReader(file, size)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// modTime prefers the MetaModTime of file to the time it was stored.
+func modTime(file td.File, info td.FileInfo) time.Time {
+	v, ok := file.FileMeta(td.MetaModTime)
+	if !ok {
+		return info.ModTime
+	}
+	switch t := v.(type) {
+	case time.Time:
+		return t
+	case string:
+		if parsed, err := time.Parse(time.RFC3339, t); err == nil {
+			return parsed
+		}
+	}
+	return info.ModTime
+}
+
+type archiveWriter interface {
+	// Add writes a file of size bytes read from r.
+	Add(name string, size int64, modified time.Time, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (z *zipArchive) Add(name string, size int64, modified time.Time, r io.Reader) error {
+	// the sizes follow the data in a descriptor, zip.Writer makes it and
+	// the central directory Zip64 once they or the offsets need it
+	w, err := z.w.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (z *zipArchive) Close() error {
+	return z.w.Close()
+}
+
+type tarArchive struct {
+	gz  *gzip.Writer
+	tar *tar.Writer
+}
+
+func (t *tarArchive) Add(name string, size int64, modified time.Time, r io.Reader) error {
+	err := t.tar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t.tar, r)
+	return err
+}
+
+func (t *tarArchive) Close() error {
+	if err := t.tar.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/", "/archive/"})
+	sam := td.User{Name: "sam", Key: "key"}
+	tom := td.User{Name: "tom", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(tom)
+	for p, content := range map[string]string{"/docs/a.txt": "aaa", "/docs/sub/b.txt": "bb", "/other.txt": "o"} {
+		res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/file"+p, strings.NewReader(content), nil)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+	res, _ := doFile(t, &tom, http.MethodPut, ts.URL+"/file/docs/tom.txt", strings.NewReader("t"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	mtime := time.Date(2019, 3, 4, 5, 6, 8, 0, time.UTC)
+	f, _ := state.Files.Open("/docs/a.txt", os.O_RDWR, nil)
+	_ = f.WriteFileMeta(td.MetaModTime, mtime)
+	_ = f.Close()
+	f, _ = state.Files.Open("/docs/sub/b.txt", os.O_RDWR, nil)
+	_ = f.WriteMeta(td.MetaModTime, "2018-01-02T03:04:06Z")
+	_ = f.Close()
+
+	res, body := doFile(t, &sam, http.MethodGet, ts.URL+"/archive/docs/", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=docs.zip`, res.Header.Get("Content-Disposition"))
+	zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	files := map[string]string{}
+	for _, zf := range zr.File {
+		r, _ := zf.Open()
+		b, _ := ioutil.ReadAll(r)
+		files[zf.Name] = string(b)
+		if zf.Name == "a.txt" {
+			assert.True(t, mtime.Equal(zf.Modified), "the mtime of the file is kept: %v", zf.Modified)
+		}
+		if zf.Name == "sub/b.txt" {
+			assert.Equal(t, 2018, zf.Modified.Year())
+		}
+	}
+	assert.Equal(t, map[string]string{"a.txt": "aaa", "sub/b.txt": "bb"}, files, "tom's file is left out")
+
+	selection := `{"paths":["/docs/a.txt","/docs/","/other.txt"]}`
+	res, body = doFile(t, &sam, http.MethodPost, ts.URL+"/archive/?format=tar.gz", strings.NewReader(selection), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/gzip", res.Header.Get("Content-Type"))
+	gz, err := gzip.NewReader(strings.NewReader(body))
+	if !assert.Nil(t, err) {
+		return
+	}
+	tr := tar.NewReader(gz)
+	files = map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.Nil(t, err) {
+			return
+		}
+		b, _ := ioutil.ReadAll(tr)
+		files[h.Name] = string(b)
+		if h.Name == "docs/a.txt" {
+			assert.True(t, mtime.Equal(h.ModTime))
+		}
+	}
+	assert.Equal(t, map[string]string{"docs/a.txt": "aaa", "docs/sub/b.txt": "bb", "other.txt": "o"}, files)
+
+	res, missing := doFile(t, &sam, http.MethodPost, ts.URL+"/archive/", strings.NewReader(`{"paths":["/nothing.txt"]}`), nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, body = doFile(t, &sam, http.MethodPost, ts.URL+"/archive/", strings.NewReader(`{"paths":["/docs/tom.txt"]}`), nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "a file sam may not read looks missing")
+	assert.Equal(t, missing, body)
+	res, _ = doFile(t, &sam, http.MethodPost, ts.URL+"/archive/", strings.NewReader(`{"paths":[]}`), nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/archive/docs/?format=rar", nil, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, _ = doPlain(t, http.MethodGet, ts.URL+"/archive/docs/", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestZipArchive_Zip64(t *testing.T) {
+	// more entries than the plain end of central directory can count
+	const entries = 1<<16 + 1
+	var buf bytes.Buffer
+	w := &zipArchive{zip.NewWriter(&buf)}
+	for i := 0; i < entries; i++ {
+		assert.Nil(t, w.Add("f", 0, time.Now(), strings.NewReader("")))
+	}
+	assert.Nil(t, w.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Len(t, zr.File, entries)
+	assert.True(t, bytes.Contains(buf.Bytes(), []byte{0x50, 0x4b, 0x06, 0x06}), "a Zip64 end of central directory")
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"encoding/json"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const (
+	ErrorNoConfig      = "config is not available"
+	ErrorReadingConfig = "error reading config"
+)
+
+// Redacted replaces the values of secret settings in the config dump.
+const Redacted = "[REDACTED]"
+
+// secretWords mark config keys whose values are never shown.
+var secretWords = []string{"secret", "password", "passwd", "token", "key", "credential"}
+
+// Debug serves diagnostics below prefix to admin users:
+//
+//	GET {prefix}/pprof/   the net/http/pprof profiles
+//	GET {prefix}/build    build and runtime information
+//	GET {prefix}/config   the current config, with secrets redacted
+//
+// pprof only finds named profiles when prefix is "/debug".
+type Debug struct {
+	state  *thttp.State
+	prefix string
+	config func() interface{}
+	start  time.Time
+	mux    *http.ServeMux
+}
+
+// NewDebug creates a Debug handler, config returns the current config and
+// may be nil.
+func NewDebug(state *thttp.State, prefix string, config func() interface{}) *Debug {
+	d := &Debug{state: state, prefix: prefix, config: config, start: time.Now(), mux: http.NewServeMux()}
+	d.mux.HandleFunc(prefix+"/pprof/", pprof.Index)
+	d.mux.HandleFunc(prefix+"/pprof/cmdline", pprof.Cmdline)
+	d.mux.HandleFunc(prefix+"/pprof/profile", pprof.Profile)
+	d.mux.HandleFunc(prefix+"/pprof/symbol", pprof.Symbol)
+	d.mux.HandleFunc(prefix+"/pprof/trace", pprof.Trace)
+	d.mux.HandleFunc(prefix+"/build", d.ServeBuild)
+	d.mux.HandleFunc(prefix+"/config", d.ServeConfig)
+	return d
+}
+
+func (d *Debug) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if _, ok := authAdmin(d.state, res, req); !ok {
+		return
+	}
+	d.mux.ServeHTTP(res, req)
+}
+
+func (d *Debug) ServeBuild(res http.ResponseWriter, req *http.Request) {
+	ret := map[string]interface{}{
+		"go":         runtime.Version(),
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+		"cpus":       runtime.NumCPU(),
+		"goroutines": runtime.NumGoroutine(),
+		"started":    d.start,
+		"uptime":     time.Since(d.start).String(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		ret["path"] = info.Path
+		ret["version"] = info.Main.Version
+		deps := make(map[string]string, len(info.Deps))
+		for _, dep := range info.Deps {
+			deps[dep.Path] = dep.Version
+		}
+		ret["deps"] = deps
+	}
+	writeJson(res, http.StatusOK, ret)
+}
+
+func (d *Debug) ServeConfig(res http.ResponseWriter, req *http.Request) {
+	if d.config == nil {
+		http.Error(res, ErrorNoConfig, http.StatusNotFound)
+		return
+	}
+	ret, err := redact(d.config())
+	if err != nil {
+		tlog.Ctx(req.Context()).Error(ErrorReadingConfig, tlog.Err(err))
+		http.Error(res, ErrorReadingConfig, http.StatusInternalServerError)
+		return
+	}
+	writeJson(res, http.StatusOK, ret)
+}
+
+// redact turns config into its JSON form and hides the values of every key
+// that looks like a secret.
+func redact(config interface{}) (interface{}, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return redactValue(v), nil
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if isSecretKey(k) && value != nil && value != "" {
+				v[k] = Redacted
+				continue
+			}
+			v[k] = redactValue(value)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
+
+func isSecretKey(k string) bool {
+	k = strings.ToLower(k)
+	for _, w := range secretWords {
+		if strings.Contains(k, w) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebug_ServeHTTP(t *testing.T) {
+	state := &thttp.State{
+		Users:  mock.NewUserService(),
+		Files:  mock.NewFileService(),
+		Auther: auth.NewHMACAuther(),
+	}
+	config := struct {
+		Addr   string            `json:"addr"`
+		Hooks  map[string]string `json:"hooks"`
+		APIKey string            `json:"api_key"`
+		Empty  string            `json:"password"`
+	}{"127.0.0.1:8080", map[string]string{"url": "http://x", "secret": "s3cret"}, "k", ""}
+	ts := httptest.NewServer(NewDebug(state, "/debug", func() interface{} { return config }))
+	defer ts.Close()
+
+	sam := td.User{Name: "sam", Key: "key"}
+	root := td.User{Name: "root", Key: "key", Meta: map[string]string{td.MetaRole: td.RoleAdmin}}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(root)
+
+	res, _ := doFile(t, &sam, http.MethodGet, ts.URL+"/debug/config", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, body := doFile(t, &root, http.MethodGet, ts.URL+"/debug/config", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `{"addr":"127.0.0.1:8080","hooks":{"url":"http://x","secret":"[REDACTED]"},"api_key":"[REDACTED]","password":""}`, body)
+
+	res, body = doFile(t, &root, http.MethodGet, ts.URL+"/debug/build", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var build map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(body), &build))
+	assert.NotEmpty(t, build["go"])
+
+	res, _ = doFile(t, &root, http.MethodGet, ts.URL+"/debug/pprof/goroutine?debug=1", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
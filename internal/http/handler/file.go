@@ -0,0 +1,990 @@
+package handler
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/pkg/delta"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ErrorOpeningFile   = "error opening file"
+	ErrorWritingFile   = "error writing file"
+	ErrorRemovingFile  = "error removing file"
+	ErrorLockingFile   = "error locking file"
+	ErrorPermission    = "permission denied"
+	ErrorFileLocked    = "file is locked"
+	ErrorLockNotExist  = "lock not exists"
+	ErrorParsingLock   = "error parsing lock request"
+	ErrorNotLockOwner  = "lock is not owned by user"
+	ErrorMissingToken  = "missing lock token"
+	ErrorFileNotExist  = "file not exists"
+	ErrorParsingRange  = "error parsing content range"
+	ErrorListingFiles  = "error listing files"
+	ErrorMovingFile    = "error moving file"
+	ErrorParsingDest   = "error parsing destination"
+	ErrorSameDest      = "destination is the source"
+	ErrorDestExists    = "destination exists"
+	ErrorQuotaExceeded = "quota exceeded"
+	ErrorParsingBlock  = "error parsing block size"
+	ErrorSigningFile   = "error signing file"
+	ErrorApplyingDelta = "error applying delta"
+
+	ErrorRangeNotSatisfiable = "range not satisfiable"
+	ErrorRangeLength         = "body does not fill the content range"
+
+	MethodLock   = "LOCK"
+	MethodUnlock = "UNLOCK"
+	MethodMove   = "MOVE"
+
+	// MaxLockLease bounds the lease a client may ask for in a Timeout header.
+	MaxLockLease = time.Hour
+)
+
+// File serves the files below prefix. Besides GET, PUT and DELETE it
+// understands the LOCK and UNLOCK methods with the Timeout, Lock-Token and If
+// headers as WebDAV defines them, so a WebDAV front end can reuse the locks.
+// A PUT with a Content-Range header replaces part of a file, which resumes
+// an interrupted upload at the size a HEAD request reports or patches the
+// blocks that changed. GET on a path ending in a slash lists the
+// directory, MOVE renames a file to its Destination header. GET with a
+// signature parameter answers the block signature of a file, which a PATCH
+// with a delta in the format of pkg/delta brings up to date.
+type File struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewFile(state *thttp.State, prefix string) *File {
+	return &File{state: state, prefix: prefix}
+}
+
+func (f *File) filePath(req *http.Request) string {
+	return path.Clean("/" + strings.TrimPrefix(req.URL.Path, f.prefix))
+}
+
+// open opens an existing file and checks that user may do verb with it. It
+// writes the error response itself and returns a nil file on failure.
+func (f *File) open(res http.ResponseWriter, req *http.Request, p string, flags int, user td.User, verb td.Verb) td.File {
+	log := tlog.Ctx(req.Context())
+	file, err := f.state.Files.Open(p, flags, nil)
+	if err != nil {
+		log.Debug(ErrorOpeningFile, tlog.String("path", p), tlog.Err(err))
+		writeFileError(res, err, ErrorOpeningFile)
+		return nil
+	}
+	if !td.Can(file.Perm(), user, verb) {
+		log.Debug(ErrorPermission, tlog.String("path", p), tlog.String("user", user.Name), tlog.String("verb", verb.String()))
+		closeFile(file)
+		http.Error(res, ErrorPermission, http.StatusForbidden)
+		return nil
+	}
+	return file
+}
+
+// allowed is open for requests that only need to know that user may do verb
+// with the file at p.
+func (f *File) allowed(res http.ResponseWriter, req *http.Request, p string, user td.User, verb td.Verb) bool {
+	file := f.open(res, req, p, os.O_RDONLY, user, verb)
+	if file == nil {
+		return false
+	}
+	closeFile(file)
+	return true
+}
+
+func (f *File) ServeGetFile(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := f.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	if strings.HasSuffix(req.URL.Path, "/") {
+		f.serveList(res, req, user)
+		return
+	}
+
+	p := f.filePath(req)
+	file := f.open(res, req, p, os.O_RDONLY, user, td.VerbRead)
+	if file == nil {
+		return
+	}
+	defer closeFile(file)
+
+	if _, ok := req.Form["locks"]; ok {
+		locks, err := f.state.Files.Locks(p)
+		if err != nil {
+			log.Debug(ErrorLockingFile, tlog.Err(err))
+			writeFileError(res, err, ErrorLockingFile)
+			return
+		}
+		ret := make([]lockInfo, 0, len(locks))
+		for _, l := range locks {
+			ret = append(ret, newLockInfo(l))
+		}
+		writeJson(res, http.StatusOK, ret)
+		return
+	}
+
+	if _, ok := req.Form["signature"]; ok {
+		f.serveSignature(res, req, file)
+		return
+	}
+
+	http.ServeContent(res, req, path.Base(p), time.Time{}, file)
+}
+
+// serveSignature answers the block signature of file, in blocks of the size
+// the block parameter asks for or one fitting the file.
+func (f *File) serveSignature(res http.ResponseWriter, req *http.Request, file td.File) {
+	log := tlog.Ctx(req.Context())
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		log.Debug(ErrorOpeningFile, tlog.Err(err))
+		writeFileError(res, err, ErrorOpeningFile)
+		return
+	}
+	blockSize := delta.BlockSizeFor(size)
+	if b := req.Form.Get("block"); b != "" {
+		blockSize, err = strconv.Atoi(b)
+		if err != nil || blockSize < delta.MinBlockSize || blockSize > delta.MaxBlockSize {
+			http.Error(res, ErrorParsingBlock, http.StatusBadRequest)
+			return
+		}
+	}
+	sig, err := delta.Sign(io.NewSectionReader(file, 0, size), blockSize)
+	if err != nil {
+		log.Debug(ErrorSigningFile, tlog.Err(err))
+		writeFileError(res, err, ErrorSigningFile)
+		return
+	}
+	writeJson(res, http.StatusOK, sig)
+}
+
+func (f *File) ServePutFile(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := f.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	start, end, total, ranged, err := parseContentRange(req.Header.Get("Content-Range"))
+	if err != nil {
+		log.Debug(ErrorParsingRange, tlog.Err(err))
+		http.Error(res, ErrorParsingRange, http.StatusBadRequest)
+		return
+	}
+
+	p := f.filePath(req)
+	created := false
+	file, err := f.state.Files.Open(p, os.O_RDWR, nil)
+	if err != nil && isFileErrorKind(err, td.FileNotExist) && start == 0 {
+		file, err = f.state.Files.Open(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, nil)
+		created = err == nil
+	}
+	if err != nil && isFileErrorKind(err, td.FileNotExist) && start > 0 {
+		http.Error(res, ErrorRangeNotSatisfiable, http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		log.Debug(ErrorOpeningFile, tlog.String("path", p), tlog.Err(err))
+		writeFileError(res, err, ErrorOpeningFile)
+		return
+	}
+
+	if created {
+		// a new file is private to its creator until it is shared
+		perm := td.Verbs(file.Perm())
+		perm.GrantAllUser(td.VerbNone)
+		perm.GrantUser(user.Name, td.VerbAll)
+		f.state.Record(req, user.Name, audit.ActionPermChange, p, audit.OutcomeSuccess, "private to owner")
+		if err = file.WriteMeta(td.MetaOwner, user.Name); err != nil {
+			log.Warn(ErrorWritingFile, tlog.Err(err))
+		}
+	} else if !td.Can(file.Perm(), user, td.VerbWrite) {
+		closeFile(file)
+		log.Debug(ErrorPermission, tlog.String("path", p), tlog.String("user", user.Name), tlog.String("verb", td.VerbWrite.String()))
+		http.Error(res, ErrorPermission, http.StatusForbidden)
+		return
+	}
+
+	token := lockToken(req)
+	if token != "" && !f.ownsLock(p, token, user) {
+		closeFile(file)
+		http.Error(res, ErrorNotLockOwner, http.StatusLocked)
+		return
+	}
+	file.SetLockToken(token)
+
+	// a ranged put writes bytes start to end and keeps the rest of the file,
+	// which is cut to the total size if it is given, but never grown past
+	// what was written. start may not lie beyond the end of the file.
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		closeFile(file)
+		log.Debug(ErrorOpeningFile, tlog.String("path", p), tlog.Err(err))
+		writeFileError(res, err, ErrorOpeningFile)
+		return
+	}
+	if ranged && start > size {
+		closeFile(file)
+		res.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		http.Error(res, ErrorRangeNotSatisfiable, http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	left, limited := f.quotaLeft(user, p)
+	if limited && req.ContentLength > left {
+		f.rejectOverQuota(res, req, file, p, created)
+		return
+	}
+
+	// the body is spooled first, so a put that breaks the quota or does not
+	// fill its range leaves the file as it was
+	tmp, err := ioutil.TempFile("", "tempdesk-put-")
+	if err != nil {
+		closeFile(file)
+		log.Warn(ErrorWritingFile, tlog.Err(err))
+		http.Error(res, ErrorInternalServer, http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	body := io.Reader(req.Body)
+	if ranged {
+		// one byte more tells a body longer than the range
+		body = io.LimitReader(body, end-start+2)
+	}
+	if limited {
+		body = io.LimitReader(body, left+1)
+	}
+	n, err := io.Copy(tmp, body)
+	if err != nil {
+		log.Debug(ErrorParsingBody, tlog.String("path", p), tlog.Err(err))
+		f.reject(res, req, file, p, created, ErrorParsingBody, http.StatusBadRequest)
+		return
+	}
+	if ranged && n != end-start+1 {
+		f.reject(res, req, file, p, created, ErrorRangeLength, http.StatusBadRequest)
+		return
+	}
+
+	newSize := n
+	if ranged {
+		newSize = end + 1
+		if size > newSize {
+			newSize = size
+		}
+		if total >= 0 && total < newSize {
+			newSize = total
+		}
+	}
+	if limited && newSize > left {
+		f.rejectOverQuota(res, req, file, p, created)
+		return
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err == nil {
+		_, err = file.Seek(start, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(file, tmp)
+	}
+	if err == nil {
+		err = file.Truncate(newSize, nil)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Debug(ErrorWritingFile, tlog.String("path", p), tlog.Err(err))
+		writeFileError(res, err, ErrorWritingFile)
+		return
+	}
+
+	log.Info("put file",
+		tlog.String("user", user.Name),
+		tlog.String("path", p))
+
+	if created {
+		res.WriteHeader(http.StatusCreated)
+	} else {
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ServePatchFile applies a delta to a file. The new version is built from
+// the old one in a temporary file and only replaces it once its hash is
+// the one the delta ends with, so a delta made against another version is
+// refused with 409.
+func (f *File) ServePatchFile(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := f.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	p := f.filePath(req)
+	file := f.open(res, req, p, os.O_RDWR, user, td.VerbWrite)
+	if file == nil {
+		return
+	}
+	defer closeFile(file)
+
+	token := lockToken(req)
+	if token != "" && !f.ownsLock(p, token, user) {
+		http.Error(res, ErrorNotLockOwner, http.StatusLocked)
+		return
+	}
+	file.SetLockToken(token)
+
+	tmp, err := ioutil.TempFile("", "tempdesk-delta-")
+	if err != nil {
+		log.Warn(ErrorApplyingDelta, tlog.Err(err))
+		http.Error(res, ErrorInternalServer, http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		size, err = delta.Apply(tmp, io.NewSectionReader(file, 0, size), req.Body)
+	}
+	if err != nil {
+		log.Debug(ErrorApplyingDelta, tlog.String("path", p), tlog.Err(err))
+		switch {
+		case delta.IsKind(err, delta.Malformed):
+			http.Error(res, err.Error(), http.StatusBadRequest)
+		case delta.IsKind(err, delta.HashMismatch):
+			http.Error(res, err.Error(), http.StatusConflict)
+		default:
+			writeFileError(res, err, ErrorApplyingDelta)
+		}
+		return
+	}
+
+	if left, limited := f.quotaLeft(user, p); limited && size > left {
+		http.Error(res, ErrorQuotaExceeded, http.StatusInsufficientStorage)
+		return
+	}
+
+	// commit in one Truncate, so readers never see a mix of the old and the
+	// new content and a failure leaves the old one. The file keeps its
+	// permission, meta and locks.
+	var patched []byte
+	if _, err = tmp.Seek(0, io.SeekStart); err == nil {
+		patched, err = ioutil.ReadAll(tmp)
+	}
+	if err == nil {
+		err = file.Truncate(0, patched)
+	}
+	if err != nil {
+		log.Debug(ErrorWritingFile, tlog.String("path", p), tlog.Err(err))
+		writeFileError(res, err, ErrorWritingFile)
+		return
+	}
+
+	log.Info("patch file",
+		tlog.String("user", user.Name),
+		tlog.String("path", p),
+		tlog.Int("size", int(size)))
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (f *File) ServeDeleteFile(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := f.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	p := f.filePath(req)
+	if !f.allowed(res, req, p, user, td.VerbDelete) {
+		return
+	}
+
+	if !f.unlocked(res, req, p, user) {
+		return
+	}
+
+	if err = f.state.Files.Remove(p, lockToken(req)); err != nil {
+		log.Debug(ErrorRemovingFile, tlog.String("path", p), tlog.Err(err))
+		writeFileError(res, err, ErrorRemovingFile)
+		return
+	}
+
+	log.Info("remove file",
+		tlog.String("user", user.Name),
+		tlog.String("path", p))
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// ServeLock creates a lock, or refreshes the lock named in the If header when
+// the request has no body, like WebDAV LOCK does.
+func (f *File) ServeLock(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := f.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	p := f.filePath(req)
+	if !f.allowed(res, req, p, user, td.VerbWrite) {
+		return
+	}
+
+	lease, err := parseTimeout(req.Header.Get("Timeout"))
+	if err != nil {
+		log.Debug(ErrorParsingLock, tlog.Err(err))
+		http.Error(res, ErrorParsingLock, http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Debug(ErrorParsingBody, tlog.Err(err))
+		http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+		return
+	}
+
+	var lock td.Lock
+	if token := lockToken(req); len(body) == 0 && token != "" {
+		if !f.ownsLock(p, token, user) {
+			http.Error(res, ErrorNotLockOwner, http.StatusLocked)
+			return
+		}
+		lock, err = f.state.Files.RefreshLock(p, token, lease)
+	} else {
+		var scope td.LockScope
+		scope, err = parseLockScope(body, req.Form.Get("scope"))
+		if err != nil {
+			log.Debug(ErrorParsingLock, tlog.Err(err))
+			http.Error(res, ErrorParsingLock, http.StatusBadRequest)
+			return
+		}
+		lock, err = f.state.Files.Lock(p, user, scope, lease)
+	}
+	if err != nil {
+		log.Debug(ErrorLockingFile, tlog.String("path", p), tlog.Err(err))
+		writeFileError(res, err, ErrorLockingFile)
+		return
+	}
+
+	log.Info("lock file",
+		tlog.String("user", user.Name),
+		tlog.String("path", p),
+		tlog.String("scope", lock.Scope.String()))
+
+	res.Header().Set("Lock-Token", "<"+lock.Token+">")
+	res.Header().Set("Timeout", "Second-"+strconv.Itoa(int(lease/time.Second)))
+	writeJson(res, http.StatusOK, newLockInfo(lock))
+}
+
+func (f *File) ServeUnlock(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := f.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	p := f.filePath(req)
+	token := lockToken(req)
+	if token == "" {
+		http.Error(res, ErrorMissingToken, http.StatusBadRequest)
+		return
+	}
+	if !f.ownsLock(p, token, user) {
+		http.Error(res, ErrorNotLockOwner, http.StatusConflict)
+		return
+	}
+
+	if err = f.state.Files.Unlock(p, token); err != nil {
+		log.Debug(ErrorLockingFile, tlog.String("path", p), tlog.Err(err))
+		writeFileError(res, err, ErrorLockingFile)
+		return
+	}
+
+	log.Info("unlock file",
+		tlog.String("user", user.Name),
+		tlog.String("path", p))
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// quotaLeft returns how many bytes the file at p may hold in the quota of
+// user besides the other files of user, limited is false if user has no
+// quota. A FileService counting the usage of owners answers it without
+// looking at every file.
+func (f *File) quotaLeft(user td.User, p string) (left int64, limited bool) {
+	quota, ok := user.Quota()
+	if !ok {
+		return 0, false
+	}
+	used, err := f.usedBesides(user, p)
+	if err != nil {
+		tlog.Warn("error counting usage for quota", tlog.Err(err))
+		return 0, true
+	}
+	if used >= quota {
+		return 0, true
+	}
+	return quota - used, true
+}
+
+// usedBesides returns the bytes of the files of user but the one at p.
+func (f *File) usedBesides(user td.User, p string) (int64, error) {
+	if r, ok := td.OwnerUsage(f.state.Files); ok {
+		used, err := r.OwnerUsage(user.Name)
+		if err != nil {
+			return 0, err
+		}
+		if file, err := f.state.Files.Open(p, os.O_RDONLY, nil); err == nil {
+			if owner, _ := file.Meta(td.MetaOwner); owner == user.Name {
+				size, _ := file.Seek(0, io.SeekEnd)
+				used -= size
+			}
+			closeFile(file)
+		}
+		return used, nil
+	}
+
+	files, err := f.state.Files.List("/")
+	if err != nil {
+		return 0, err
+	}
+	var used int64
+	for _, info := range files {
+		if info.Path == p {
+			continue
+		}
+		file, err := f.state.Files.Open(info.Path, os.O_RDONLY, nil)
+		if err != nil {
+			continue
+		}
+		if owner, _ := file.Meta(td.MetaOwner); owner == user.Name {
+			used += info.Size
+		}
+		closeFile(file)
+	}
+	return used, nil
+}
+
+// rejectOverQuota answers 507 for a put that does not fit the quota of the
+// user.
+func (f *File) rejectOverQuota(res http.ResponseWriter, req *http.Request, file td.File, p string, created bool) {
+	f.reject(res, req, file, p, created, ErrorQuotaExceeded, http.StatusInsufficientStorage)
+}
+
+// reject closes file and answers a failed put with msg and status. A file
+// created by the put is removed again.
+func (f *File) reject(res http.ResponseWriter, req *http.Request, file td.File, p string, created bool, msg string, status int) {
+	closeFile(file)
+	if created {
+		// a file just created has no locks yet
+		if err := f.state.Files.Remove(p, ""); err != nil {
+			tlog.Ctx(req.Context()).Warn(ErrorRemovingFile, tlog.String("path", p), tlog.Err(err))
+		}
+	}
+	http.Error(res, msg, status)
+}
+
+// ServeMove renames a file to the path in the Destination header, replacing
+// the file there unless the Overwrite header is "F", like WebDAV MOVE.
+func (f *File) ServeMove(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := f.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	src := f.filePath(req)
+	dest, err := f.destination(req)
+	if err != nil {
+		log.Debug(ErrorParsingDest, tlog.Err(err))
+		http.Error(res, ErrorParsingDest, http.StatusBadRequest)
+		return
+	}
+	if dest == src {
+		http.Error(res, ErrorSameDest, http.StatusForbidden)
+		return
+	}
+	if !f.allowed(res, req, src, user, td.VerbDelete) || !f.unlocked(res, req, src, user) {
+		return
+	}
+
+	created := true
+	file, err := f.state.Files.Open(dest, os.O_RDONLY, nil)
+	if err == nil {
+		created = false
+		allowed := td.Can(file.Perm(), user, td.VerbWrite)
+		closeFile(file)
+		switch {
+		case req.Header.Get("Overwrite") == "F":
+			http.Error(res, ErrorDestExists, http.StatusPreconditionFailed)
+			return
+		case !allowed:
+			http.Error(res, ErrorPermission, http.StatusForbidden)
+			return
+		case !f.unlocked(res, req, dest, user):
+			return
+		}
+	} else if !isFileErrorKind(err, td.FileNotExist) {
+		log.Debug(ErrorOpeningFile, tlog.String("path", dest), tlog.Err(err))
+		writeFileError(res, err, ErrorOpeningFile)
+		return
+	}
+
+	if err = f.state.Files.Rename(dest, src, lockToken(req)); err != nil {
+		log.Debug(ErrorMovingFile, tlog.String("path", src), tlog.Err(err))
+		writeFileError(res, err, ErrorMovingFile)
+		return
+	}
+
+	log.Info("move file",
+		tlog.String("user", user.Name),
+		tlog.String("path", src),
+		tlog.String("dest", dest))
+
+	if created {
+		res.WriteHeader(http.StatusCreated)
+	} else {
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// destination reads the file path from the Destination header, which is an
+// absolute URL or path on this server.
+func (f *File) destination(req *http.Request) (string, error) {
+	u, err := url.Parse(req.Header.Get("Destination"))
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" || !strings.HasPrefix(u.Path, f.prefix+"/") {
+		return "", errors.New("destination is not below " + f.prefix)
+	}
+	return path.Clean("/" + strings.TrimPrefix(u.Path, f.prefix)), nil
+}
+
+// unlocked checks that no one but user, presenting the lock token, holds an
+// exclusive lock on the file at p. It answers 423 if someone does.
+func (f *File) unlocked(res http.ResponseWriter, req *http.Request, p string, user td.User) bool {
+	token := lockToken(req)
+	locks, err := f.state.Files.Locks(p)
+	if err != nil {
+		tlog.Ctx(req.Context()).Debug(ErrorLockingFile, tlog.Err(err))
+		writeFileError(res, err, ErrorLockingFile)
+		return false
+	}
+	for _, l := range locks {
+		if l.Scope == td.LockExclusive && (l.Token != token || l.Owner != user.Name) {
+			http.Error(res, ErrorFileLocked, http.StatusLocked)
+			return false
+		}
+	}
+	return true
+}
+
+// serveList lists the files below a directory that user may access. Only
+// the direct children are listed, with subdirectories as entries of their
+// own, unless the recursive parameter is given.
+func (f *File) serveList(res http.ResponseWriter, req *http.Request, user td.User) {
+	log := tlog.Ctx(req.Context())
+	dir := f.filePath(req)
+	files, err := f.state.Files.List(dir)
+	if err != nil {
+		log.Debug(ErrorListingFiles, tlog.String("path", dir), tlog.Err(err))
+		writeFileError(res, err, ErrorListingFiles)
+		return
+	}
+
+	_, recursive := req.Form["recursive"]
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	// a directory is listed once and modified when its newest file was
+	dirs := make(map[string]int)
+	ret := []listEntry{}
+	for _, info := range files {
+		if !f.visible(info.Path, user) {
+			continue
+		}
+		rel := strings.TrimPrefix(info.Path, prefix)
+		if i := strings.IndexByte(rel, '/'); i >= 0 && !recursive {
+			name := rel[:i]
+			j, ok := dirs[name]
+			if !ok {
+				j = len(ret)
+				dirs[name] = j
+				ret = append(ret, listEntry{Name: name, Path: prefix + name, Dir: true})
+			}
+			if info.ModTime.After(ret[j].Modified) {
+				ret[j].Modified = info.ModTime
+			}
+			continue
+		}
+		ret = append(ret, listEntry{Name: rel, Path: info.Path, Size: info.Size, Modified: info.ModTime})
+	}
+	writeJson(res, http.StatusOK, ret)
+}
+
+// visible reports whether user may read the file at p.
+func (f *File) visible(p string, user td.User) bool {
+	file, err := f.state.Files.Open(p, os.O_RDONLY, nil)
+	if err != nil {
+		return false
+	}
+	defer closeFile(file)
+	return td.Can(file.Perm(), user, td.VerbRead)
+}
+
+func (f *File) ownsLock(p string, token string, user td.User) bool {
+	locks, err := f.state.Files.Locks(p)
+	if err != nil {
+		return false
+	}
+	for _, l := range locks {
+		if l.Token == token {
+			return l.Owner == user.Name
+		}
+	}
+	return false
+}
+
+func (f *File) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	err := req.ParseForm()
+	if err != nil {
+		log.Debug("error parsing url", tlog.Err(err))
+		http.Error(res, "Error parsing url arguments or form", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		f.ServeGetFile(res, req)
+	case http.MethodPut:
+		f.ServePutFile(res, req)
+	case http.MethodPatch:
+		f.ServePatchFile(res, req)
+	case http.MethodDelete:
+		f.ServeDeleteFile(res, req)
+	case MethodLock:
+		f.ServeLock(res, req)
+	case MethodUnlock:
+		f.ServeUnlock(res, req)
+	case MethodMove:
+		f.ServeMove(res, req)
+	default:
+		log.Debug("unsupported method", tlog.String("method", req.Method))
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+	}
+}
+
+type listEntry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Dir      bool      `json:"dir,omitempty"`
+}
+
+type lockInfo struct {
+	Token   string    `json:"token"`
+	Path    string    `json:"path"`
+	Owner   string    `json:"owner"`
+	Scope   string    `json:"scope"`
+	Expires time.Time `json:"expires"`
+}
+
+func newLockInfo(l td.Lock) lockInfo {
+	return lockInfo{
+		Token:   l.Token,
+		Path:    l.Path,
+		Owner:   l.Owner,
+		Scope:   l.Scope.String(),
+		Expires: l.Expires,
+	}
+}
+
+// davLockInfo is the part of a WebDAV lockinfo body that is understood.
+type davLockInfo struct {
+	XMLName   xml.Name  `xml:"DAV: lockinfo"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+}
+
+func parseLockScope(body []byte, scope string) (td.LockScope, error) {
+	if len(body) != 0 {
+		var info davLockInfo
+		if err := xml.Unmarshal(body, &info); err != nil {
+			return 0, err
+		}
+		if info.Shared != nil {
+			return td.LockShared, nil
+		}
+		return td.LockExclusive, nil
+	}
+
+	switch scope {
+	case "", "exclusive":
+		return td.LockExclusive, nil
+	case "shared":
+		return td.LockShared, nil
+	}
+	return 0, errors.New("unknown lock scope " + scope)
+}
+
+// parseTimeout reads the first usable entry of a WebDAV Timeout header such
+// as "Second-600, Infinite". Infinite and too long leases get MaxLockLease.
+func parseTimeout(h string) (time.Duration, error) {
+	if h == "" {
+		return td.DefaultLockLease, nil
+	}
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		if t == "Infinite" {
+			return MaxLockLease, nil
+		}
+		if !strings.HasPrefix(t, "Second-") {
+			continue
+		}
+		sec, err := strconv.ParseUint(strings.TrimPrefix(t, "Second-"), 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		lease := time.Duration(sec) * time.Second
+		if lease <= 0 || lease > MaxLockLease {
+			lease = MaxLockLease
+		}
+		return lease, nil
+	}
+	return td.DefaultLockLease, nil
+}
+
+// parseContentRange reads a Content-Range header of a PUT request, such as
+// "bytes 100-199/500" or "bytes 100-199/*". total is -1 if it is not given.
+func parseContentRange(h string) (start, end, total int64, ok bool, err error) {
+	if h == "" {
+		return 0, 0, -1, false, nil
+	}
+	malformed := errors.New("malformed range " + h)
+	if !strings.HasPrefix(h, "bytes ") {
+		return 0, 0, 0, false, errors.New("unknown range unit in " + h)
+	}
+	spec := strings.TrimPrefix(h, "bytes ")
+	total = -1
+	if i := strings.IndexByte(spec, '/'); i >= 0 {
+		if t := spec[i+1:]; t != "*" {
+			if total, err = strconv.ParseInt(t, 10, 64); err != nil {
+				return 0, 0, 0, false, err
+			}
+		}
+		spec = spec[:i]
+	}
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return 0, 0, 0, false, malformed
+	}
+	if start, err = strconv.ParseInt(spec[:i], 10, 64); err != nil {
+		return 0, 0, 0, false, err
+	}
+	if end, err = strconv.ParseInt(spec[i+1:], 10, 64); err != nil {
+		return 0, 0, 0, false, err
+	}
+	if start < 0 || end < start || (total >= 0 && end >= total) {
+		return 0, 0, 0, false, malformed
+	}
+	return start, end, total, true, nil
+}
+
+var codedURL = regexp.MustCompile(`<(opaquelocktoken:[^>]*)>`)
+
+// lockToken takes the lock token from a Lock-Token header or, failing that,
+// from the first token in an If header.
+func lockToken(req *http.Request) string {
+	for _, h := range []string{req.Header.Get("Lock-Token"), req.Header.Get("If")} {
+		if m := codedURL.FindStringSubmatch(h); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+func closeFile(file td.File) {
+	if err := file.Close(); err != nil {
+		tlog.Debug("error closing file", tlog.Err(err))
+	}
+}
+
+func isFileErrorKind(err error, kind string) bool {
+	e, ok := err.(*td.FileServiceError)
+	return ok && e.Kind == kind
+}
+
+func writeFileError(res http.ResponseWriter, err error, msg string) {
+	e, ok := err.(*td.FileServiceError)
+	if !ok {
+		http.Error(res, msg, http.StatusInternalServerError)
+		return
+	}
+	switch e.Kind {
+	case td.FileNotExist:
+		http.Error(res, ErrorFileNotExist, http.StatusNotFound)
+	case td.FileLocked:
+		http.Error(res, ErrorFileLocked, http.StatusLocked)
+	case td.LockNotExist:
+		http.Error(res, ErrorLockNotExist, http.StatusConflict)
+	case td.FileAlreadyExists:
+		http.Error(res, e.Kind, http.StatusConflict)
+	default:
+		http.Error(res, msg, http.StatusBadRequest)
+	}
+}
+
+func writeJson(res http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		tlog.Info(ErrorEncodingJson, tlog.Err(err))
+		http.Error(res, ErrorInternalServer, http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if _, err = res.Write(body); err != nil {
+		tlog.Warn(ErrorWritingResp, tlog.Err(err))
+	}
+}
@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/pkg/delta"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFile_ServeHTTP_PutGetDelete(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/"})
+	sam := td.User{Name: "sam", Key: "key"}
+	tom := td.User{Name: "tom", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(tom)
+
+	res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/file/a.txt", strings.NewReader("hello"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, body := doFile(t, &sam, http.MethodGet, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "hello", body)
+
+	res, _ = doFile(t, &tom, http.MethodGet, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "new file should be private")
+
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/file/a.txt", strings.NewReader("hi"), nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, body = doFile(t, &sam, http.MethodGet, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, "hi", body, "put should replace the content")
+
+	res, _ = doFile(t, &sam, http.MethodDelete, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestFile_ServeHTTP_PutRange(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/"})
+	sam := td.User{Name: "sam", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	url := ts.URL + "/file/a.txt"
+
+	res, _ := doFile(t, &sam, http.MethodPut, url, strings.NewReader("hello"), map[string]string{"Content-Range": "bytes 3-7/11"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, res.StatusCode, "a new file can only start at 0")
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("hellx"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodHead, url, nil, nil)
+	assert.Equal(t, int64(5), res.ContentLength)
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("o world"), map[string]string{"Content-Range": "bytes 4-10/11"})
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, body := doFile(t, &sam, http.MethodGet, url, nil, nil)
+	assert.Equal(t, "hello world", body)
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("W"), map[string]string{"Content-Range": "bytes 6-6/11"})
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, body = doFile(t, &sam, http.MethodGet, url, nil, nil)
+	assert.Equal(t, "hello World", body, "a block with a total keeps the rest of the file")
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("H"), map[string]string{"Content-Range": "bytes 0-0/*"})
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, body = doFile(t, &sam, http.MethodGet, url, nil, nil)
+	assert.Equal(t, "Hello World", body, "a block without a total keeps the rest of the file")
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("!"), map[string]string{"Content-Range": "bytes 11-11/*"})
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, body = doFile(t, &sam, http.MethodGet, url, nil, nil)
+	assert.Equal(t, "Hello World!", body, "and grows it past the end")
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("!"), map[string]string{"Content-Range": "bytes 0-1/1"})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("!"), map[string]string{"Content-Range": "bytes 20-20/21"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, res.StatusCode)
+	assert.Equal(t, "bytes */12", res.Header.Get("Content-Range"))
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("!"), map[string]string{"Content-Range": "lines 1-2"})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader(strings.Repeat("x", 50)), map[string]string{"Content-Range": "bytes 0-199/200"})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "a body shorter than its range")
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("hello"), map[string]string{"Content-Range": "bytes 0-1/2"})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "a body longer than its range")
+	_, body = doFile(t, &sam, http.MethodGet, url, nil, nil)
+	assert.Equal(t, "Hello World!", body, "a rejected block leaves the file as it was")
+
+	b := ts.URL + "/file/b.txt"
+	res, _ = doFile(t, &sam, http.MethodPut, b, strings.NewReader("x"), map[string]string{"Content-Range": "bytes 0-4/10"})
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodHead, b, nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "a rejected block does not create the file")
+	res, _ = doFile(t, &sam, http.MethodPut, b, strings.NewReader("hello"), map[string]string{"Content-Range": "bytes 0-4/10"})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodHead, b, nil, nil)
+	assert.Equal(t, int64(5), res.ContentLength, "the file is not grown past what was written")
+}
+
+func TestFile_ServeHTTP_ListMove(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/"})
+	sam := td.User{Name: "sam", Key: "key"}
+	tom := td.User{Name: "tom", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(tom)
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	state.Files.(*mock.FileService).Now = func() time.Time { return now }
+
+	for _, p := range []string{"/docs/a.txt", "/docs/sub/b.txt", "/other.txt"} {
+		res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/file"+p, strings.NewReader("x"), nil)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+	res, _ := doFile(t, &tom, http.MethodPut, ts.URL+"/file/docs/tom.txt", strings.NewReader("x"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, body := doFile(t, &sam, http.MethodGet, ts.URL+"/file/docs/", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `[{"name":"a.txt","path":"/docs/a.txt","size":1,"modified":"2020-05-01T12:00:00Z"},{"name":"sub","path":"/docs/sub","size":0,"modified":"2020-05-01T12:00:00Z","dir":true}]`, body,
+		"tom's file should not be listed")
+	_, body = doFile(t, &sam, http.MethodGet, ts.URL+"/file/docs/?recursive", nil, nil)
+	assert.JSONEq(t, `[{"name":"a.txt","path":"/docs/a.txt","size":1,"modified":"2020-05-01T12:00:00Z"},{"name":"sub/b.txt","path":"/docs/sub/b.txt","size":1,"modified":"2020-05-01T12:00:00Z"}]`, body)
+
+	move := func(user *td.User, src, dest string, header map[string]string) int {
+		if header == nil {
+			header = map[string]string{}
+		}
+		if _, ok := header["Destination"]; !ok {
+			header["Destination"] = ts.URL + "/file" + dest
+		}
+		res, _ := doFile(t, user, MethodMove, ts.URL+"/file"+src, nil, header)
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusCreated, move(&sam, "/docs/a.txt", "/docs/c.txt", nil))
+	assert.Equal(t, http.StatusForbidden, move(&tom, "/docs/c.txt", "/docs/d.txt", nil))
+	assert.Equal(t, http.StatusForbidden, move(&sam, "/other.txt", "/docs/tom.txt", nil), "cannot replace tom's file")
+	assert.Equal(t, http.StatusPreconditionFailed, move(&sam, "/other.txt", "/docs/c.txt", map[string]string{"Overwrite": "F"}))
+	assert.Equal(t, http.StatusNoContent, move(&sam, "/other.txt", "/docs/c.txt", nil))
+	assert.Equal(t, http.StatusNotFound, move(&sam, "/other.txt", "/docs/e.txt", nil))
+	assert.Equal(t, http.StatusBadRequest, move(&sam, "/docs/c.txt", "", map[string]string{"Destination": "/etc/passwd"}))
+
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/file/docs/a.txt", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestFile_ServeHTTP_Verbs(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/"})
+	sam := td.User{Name: "sam", Key: "key"}
+	tom := td.User{Name: "tom", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(tom)
+
+	res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/file/a.txt", strings.NewReader("x"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	f, _ := state.Files.Open("/a.txt", os.O_RDONLY, nil)
+	td.Verbs(f.Perm()).GrantUser("tom", td.VerbRead)
+	_ = f.Close()
+
+	res, body := doFile(t, &tom, http.MethodGet, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "x", body)
+	res, _ = doFile(t, &tom, http.MethodPut, ts.URL+"/file/a.txt", strings.NewReader("y"), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "reading is not writing")
+	res, _ = doFile(t, &tom, http.MethodDelete, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res, _ = doFile(t, &tom, MethodMove, ts.URL+"/file/a.txt", nil, map[string]string{"Destination": ts.URL + "/file/b.txt"})
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	f, _ = state.Files.Open("/a.txt", os.O_RDONLY, nil)
+	td.Verbs(f.Perm()).GrantUser("tom", td.VerbRead|td.VerbWrite)
+	_ = f.Close()
+	res, _ = doFile(t, &tom, http.MethodPut, ts.URL+"/file/a.txt", strings.NewReader("y"), nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = doFile(t, &tom, http.MethodDelete, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "writing is not deleting")
+	res, _ = doFile(t, &sam, http.MethodDelete, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestFile_ServeHTTP_Quota(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/"})
+	sam := td.User{Name: "sam", Key: "key", Meta: map[string]string{td.MetaQuota: "8"}}
+	_ = state.Users.CreateUser(sam)
+
+	res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/file/a.txt", strings.NewReader("12345"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/file/b.txt", strings.NewReader("12345"), nil)
+	assert.Equal(t, http.StatusInsufficientStorage, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/file/b.txt", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "a rejected new file should be removed")
+
+	// without a Content-Length the quota is found out while writing
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/file/b.txt", io.MultiReader(strings.NewReader("12345")), nil)
+	assert.Equal(t, http.StatusInsufficientStorage, res.StatusCode)
+
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/file/a.txt", strings.NewReader("12345678"), nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "replacing a file should not count it twice")
+
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/file/a.txt", io.MultiReader(strings.NewReader("123456789")), nil)
+	assert.Equal(t, http.StatusInsufficientStorage, res.StatusCode)
+	_, body := doFile(t, &sam, http.MethodGet, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, "12345678", body, "a rejected put keeps the old content")
+
+	res, _ = doFile(t, &sam, http.MethodDelete, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/file/b.txt", strings.NewReader("12345"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "a removed file frees its quota")
+}
+
+func TestFile_ServeHTTP_Delta(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/"})
+	sam := td.User{Name: "sam", Key: "key"}
+	tom := td.User{Name: "tom", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(tom)
+
+	url := ts.URL + "/file/image.bin"
+	b := make([]byte, 16<<10)
+	rand.New(rand.NewSource(1)).Read(b)
+	base := string(b)
+	res, _ := doFile(t, &sam, http.MethodPut, url, strings.NewReader(base), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, body := doFile(t, &sam, http.MethodGet, url+"?signature&block=1024", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var sig delta.Signature
+	assert.Nil(t, json.Unmarshal([]byte(body), &sig))
+	assert.Equal(t, int64(len(base)), sig.Size)
+	assert.Len(t, sig.Blocks, 16)
+	res, _ = doFile(t, &sam, http.MethodGet, url+"?signature&block=5", nil, nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	target := base[:5000] + "changed" + base[5000:]
+	var d bytes.Buffer
+	assert.Nil(t, delta.Diff(sig, strings.NewReader(target), &d))
+	res, _ = doFile(t, &tom, http.MethodPatch, url, bytes.NewReader(d.Bytes()), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodPatch, url, bytes.NewReader(d.Bytes()), nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, body = doFile(t, &sam, http.MethodGet, url, nil, nil)
+	assert.Equal(t, target, body)
+
+	res, _ = doFile(t, &sam, http.MethodPatch, url, bytes.NewReader(d.Bytes()), nil)
+	assert.Equal(t, http.StatusConflict, res.StatusCode, "the delta was made against the old version")
+	_, body = doFile(t, &sam, http.MethodGet, url, nil, nil)
+	assert.Equal(t, target, body, "a refused delta leaves the file alone")
+
+	res, _ = doFile(t, &sam, http.MethodPatch, url, strings.NewReader("garbage"), nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestFile_ServeHTTP_Lock(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/"})
+	sam := td.User{Name: "sam", Key: "key"}
+	tom := td.User{Name: "tom", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(tom)
+
+	url := ts.URL + "/file/shared.txt"
+	res, _ := doFile(t, &sam, http.MethodPut, url, strings.NewReader("v1"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	f, _ := state.Files.Open("/shared.txt", os.O_RDONLY, nil)
+	f.Perm().AllowAllUser()
+
+	lockinfo := `<?xml version="1.0" encoding="utf-8" ?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+	res, body := doFile(t, &tom, MethodLock, url, strings.NewReader(lockinfo), map[string]string{"Timeout": "Second-60"})
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, body) {
+		return
+	}
+	var info lockInfo
+	assert.NoError(t, json.Unmarshal([]byte(body), &info))
+	assert.Equal(t, "tom", info.Owner)
+	assert.Equal(t, "exclusive", info.Scope)
+	assert.Equal(t, "<"+info.Token+">", res.Header.Get("Lock-Token"))
+	assert.Equal(t, "Second-60", res.Header.Get("Timeout"))
+
+	res, _ = doFile(t, &sam, MethodLock, url+"?scope=shared", nil, nil)
+	assert.Equal(t, http.StatusLocked, res.StatusCode)
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("v2"), nil)
+	assert.Equal(t, http.StatusLocked, res.StatusCode, "write without token should be rejected")
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("v2"), map[string]string{"If": "(<" + info.Token + ">)"})
+	assert.Equal(t, http.StatusLocked, res.StatusCode, "token of another user should be rejected")
+	res, _ = doFile(t, &sam, http.MethodDelete, url, nil, nil)
+	assert.Equal(t, http.StatusLocked, res.StatusCode)
+
+	res, _ = doFile(t, &tom, http.MethodPut, url, strings.NewReader("v2"), map[string]string{"If": "(<" + info.Token + ">)"})
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, body = doFile(t, &tom, MethodLock, url, nil, map[string]string{"If": "(<" + info.Token + ">)", "Timeout": "Infinite"})
+	assert.Equal(t, http.StatusOK, res.StatusCode, body)
+	assert.Equal(t, "Second-3600", res.Header.Get("Timeout"), "refresh should be capped")
+
+	res, body = doFile(t, &sam, http.MethodGet, url+"?locks", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var locks []lockInfo
+	assert.NoError(t, json.Unmarshal([]byte(body), &locks))
+	assert.Len(t, locks, 1)
+
+	res, _ = doFile(t, &sam, MethodUnlock, url, nil, map[string]string{"Lock-Token": "<" + info.Token + ">"})
+	assert.Equal(t, http.StatusConflict, res.StatusCode, "only the owner may unlock")
+	res, _ = doFile(t, &tom, MethodUnlock, url, nil, map[string]string{"Lock-Token": "<" + info.Token + ">"})
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, _ = doFile(t, &sam, http.MethodPut, url, strings.NewReader("v3"), nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, body = doFile(t, &tom, http.MethodGet, url, nil, nil)
+	assert.Equal(t, "v3", body)
+}
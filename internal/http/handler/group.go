@@ -0,0 +1,309 @@
+package handler
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	"github.com/huangjiahua/tempdesk/internal/groups"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	ErrorNoGroups       = "groups are not enabled"
+	ErrorGroupNotFound  = "group not found"
+	ErrorGroupExists    = "group already exists"
+	ErrorInvalidGroup   = "invalid group name"
+	ErrorUnknownUser    = "unknown user"
+	ErrorUnknownGroup   = "unknown nested group"
+	ErrorGroupCycle     = "group would be nested in itself"
+	ErrorNotGroupOwner  = "only an owner may change the group"
+	ErrorListingGroups  = "error listing groups"
+	ErrorChangingGroup  = "error changing group"
+	ErrorGroupNameMatch = "name does not match the path"
+)
+
+// Group manages the groups permissions may allow or block:
+//
+//	GET    {prefix}/        the groups the user owns or is a member of,
+//	                        every group for an admin
+//	POST   {prefix}/        create a group owned by the user
+//	GET    {prefix}/{name}  a group, to its owners, members and admins
+//	PUT    {prefix}/{name}  replace the owners, members and nested groups
+//	DELETE {prefix}/{name}  delete a group
+//
+// A group is sent as {"name": "dev", "owners": ["sam"], "members": ["tom"],
+// "groups": ["ops"]}, whose members include the members of the nested
+// groups. Only owners and admins may change a group.
+type Group struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewGroup(state *thttp.State, prefix string) *Group {
+	return &Group{state: state, prefix: prefix}
+}
+
+type groupInfo struct {
+	Name    string   `json:"name"`
+	Owners  []string `json:"owners"`
+	Members []string `json:"members"`
+	Groups  []string `json:"groups"`
+}
+
+func newGroupInfo(g td.Group) groupInfo {
+	info := groupInfo{Name: g.Name, Owners: g.Owners, Members: g.Members, Groups: g.Groups}
+	for _, l := range []*[]string{&info.Owners, &info.Members, &info.Groups} {
+		if *l == nil {
+			*l = []string{}
+		}
+	}
+	return info
+}
+
+func (g *Group) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	if g.state.Groups == nil {
+		http.Error(res, ErrorNoGroups, http.StatusNotFound)
+		return
+	}
+	user, err := g.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	var info groupInfo
+	if req.Method == http.MethodPost || req.Method == http.MethodPut {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Debug(ErrorParsingBody, tlog.Err(err))
+			http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+			return
+		}
+		if err = json.Unmarshal(body, &info); err != nil {
+			log.Debug(ErrorParsingJson, tlog.Err(err))
+			http.Error(res, ErrorParsingJson, http.StatusBadRequest)
+			return
+		}
+	}
+
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, g.prefix), "/")
+	switch {
+	case name == "" && req.Method == http.MethodGet:
+		g.ServeList(res, req, user)
+	case name == "" && req.Method == http.MethodPost:
+		if !user.IsAdmin() && !groups.Contains(info.Owners, user.Name) {
+			info.Owners = append(info.Owners, user.Name)
+		}
+		g.change(res, req, user, audit.ActionGroupCreate, info, g.state.Groups.CreateGroup)
+	case name == "":
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+	default:
+		group, ok := g.state.Groups.Group(name)
+		if !ok {
+			http.Error(res, ErrorGroupNotFound, http.StatusNotFound)
+			return
+		}
+		owner := user.IsAdmin() || group.IsOwner(user.Name)
+		switch req.Method {
+		case http.MethodGet:
+			if !owner && !g.state.Groups.IsMember(user.Name, name) {
+				http.Error(res, ErrorGroupNotFound, http.StatusNotFound)
+				return
+			}
+			writeJson(res, http.StatusOK, newGroupInfo(group))
+		case http.MethodPut, http.MethodDelete:
+			if !owner {
+				http.Error(res, ErrorNotGroupOwner, http.StatusForbidden)
+				return
+			}
+			if req.Method == http.MethodDelete {
+				g.change(res, req, user, audit.ActionGroupDelete, newGroupInfo(group), g.state.Groups.DeleteGroup)
+				return
+			}
+			if info.Name == "" {
+				info.Name = name
+			}
+			if info.Name != name {
+				http.Error(res, ErrorGroupNameMatch, http.StatusBadRequest)
+				return
+			}
+			g.change(res, req, user, audit.ActionGroupUpdate, info, g.state.Groups.UpdateGroup)
+		default:
+			http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (g *Group) ServeList(res http.ResponseWriter, req *http.Request, user td.User) {
+	list, err := g.state.Groups.Groups()
+	if err != nil {
+		tlog.Ctx(req.Context()).Error(ErrorListingGroups, tlog.Err(err))
+		http.Error(res, ErrorListingGroups, http.StatusInternalServerError)
+		return
+	}
+	ret := []groupInfo{}
+	for _, group := range list {
+		if user.IsAdmin() || group.IsOwner(user.Name) || g.state.Groups.IsMember(user.Name, group.Name) {
+			ret = append(ret, newGroupInfo(group))
+		}
+	}
+	writeJson(res, http.StatusOK, ret)
+}
+
+// change checks info and applies it by fn, recording it as action.
+func (g *Group) change(res http.ResponseWriter, req *http.Request, user td.User, action string, info groupInfo, fn func(td.Group) error) {
+	log := tlog.Ctx(req.Context())
+	if !groups.ValidName(info.Name) {
+		http.Error(res, ErrorInvalidGroup, http.StatusBadRequest)
+		return
+	}
+	if action != audit.ActionGroupDelete {
+		for _, name := range append(append([]string{}, info.Owners...), info.Members...) {
+			if _, ok := g.state.Users.User(name); !ok {
+				http.Error(res, ErrorUnknownUser+" "+name, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	err := fn(td.Group{Name: info.Name, Owners: info.Owners, Members: info.Members, Groups: info.Groups})
+	if err != nil {
+		g.state.Record(req, user.Name, action, info.Name, audit.OutcomeFailure, err.Error())
+		e, _ := err.(*td.GroupServiceError)
+		switch {
+		case e != nil && e.Kind == td.GroupAlreadyExists:
+			http.Error(res, ErrorGroupExists, http.StatusConflict)
+		case e != nil && e.Kind == td.GroupNotExists && e.Err != nil:
+			http.Error(res, ErrorUnknownGroup, http.StatusBadRequest)
+		case e != nil && e.Kind == td.GroupNotExists:
+			http.Error(res, ErrorGroupNotFound, http.StatusNotFound)
+		case e != nil && e.Kind == td.GroupCycle:
+			http.Error(res, ErrorGroupCycle, http.StatusBadRequest)
+		default:
+			log.Error(ErrorChangingGroup, tlog.Err(err))
+			http.Error(res, ErrorChangingGroup, http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Info("change group", tlog.String("action", action), tlog.String("group", info.Name))
+	g.state.Record(req, user.Name, action, info.Name, audit.OutcomeSuccess, "")
+	if action == audit.ActionGroupDelete {
+		forgetGroupGrants(g.state, req, info.Name)
+	}
+	switch action {
+	case audit.ActionGroupCreate:
+		group, _ := g.state.Groups.Group(info.Name)
+		writeJson(res, http.StatusCreated, newGroupInfo(group))
+	case audit.ActionGroupUpdate:
+		group, _ := g.state.Groups.Group(info.Name)
+		writeJson(res, http.StatusOK, newGroupInfo(group))
+	default:
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// forgetMember takes a deleted user out of every group, so a new user of the
+// name does not inherit the memberships.
+func forgetMember(state *thttp.State, req *http.Request, name string) {
+	if state.Groups == nil {
+		return
+	}
+	list, err := state.Groups.Groups()
+	if err != nil {
+		tlog.Ctx(req.Context()).Error(ErrorListingGroups, tlog.Err(err))
+		return
+	}
+	for _, group := range list {
+		if !groups.Contains(group.Members, name) && !groups.Contains(group.Owners, name) {
+			continue
+		}
+		group.Members, group.Owners = groups.Without(group.Members, name), groups.Without(group.Owners, name)
+		if err = state.Groups.UpdateGroup(group); err != nil {
+			tlog.Ctx(req.Context()).Error(ErrorChangingGroup, tlog.Err(err), tlog.String("group", group.Name))
+		}
+	}
+}
+
+// forgetUserGrants drops the rules of a deleted user from every file, so a
+// new user of the name does not inherit them.
+func forgetUserGrants(state *thttp.State, req *http.Request, name string) {
+	dropGrants(state, req, func(doc *td.PermissionDocument) bool {
+		_, ok := doc.Users[name]
+		delete(doc.Users, name)
+		return ok
+	})
+}
+
+// forgetGroupGrants drops the rules of a deleted group from every file, so
+// a new group of the name does not inherit them.
+func forgetGroupGrants(state *thttp.State, req *http.Request, name string) {
+	dropGrants(state, req, func(doc *td.PermissionDocument) bool {
+		_, ok := doc.Groups[name]
+		delete(doc.Groups, name)
+		return ok
+	})
+}
+
+// dropGrants changes the document of every file by drop, which reports
+// whether it changed anything. The files are walked in the background, so
+// the request deleting a user or a group does not wait for every file; one
+// walk runs at a time. A document changed meanwhile is read again.
+// Permissions without a document are left alone.
+func dropGrants(state *thttp.State, req *http.Request, drop func(doc *td.PermissionDocument) bool) {
+	log := tlog.Ctx(req.Context())
+	state.Sweeps.Add(1)
+	go func() {
+		defer state.Sweeps.Done()
+		sweepMu.Lock()
+		defer sweepMu.Unlock()
+		sweepGrants(state, log, drop)
+	}()
+}
+
+// sweepMu keeps the walks of dropGrants from piling up on the files.
+var sweepMu sync.Mutex
+
+func sweepGrants(state *thttp.State, log *tlog.Logger, drop func(doc *td.PermissionDocument) bool) {
+	files, err := state.Files.List("/")
+	if err != nil {
+		log.Error(ErrorListingFiles, tlog.Err(err))
+		return
+	}
+	for _, info := range files {
+		file, err := state.Files.Open(info.Path, os.O_RDONLY, nil)
+		if err != nil {
+			continue
+		}
+		perm, ok := file.Perm().(td.DocumentPermission)
+		for attempt := 0; ok && attempt < 3; attempt++ {
+			var old td.PermissionDocument
+			if old, err = perm.Document(); err != nil {
+				break
+			}
+			doc := old.Normalize()
+			if !drop(&doc) {
+				break
+			}
+			if err = perm.SetDocumentIf(old, doc); !isPermErrorKind(err, td.PermissionChanged) {
+				break
+			}
+		}
+		if err != nil {
+			log.Error(ErrorChangingPerm, tlog.String("path", info.Path), tlog.Err(err))
+		}
+		closeFile(file)
+	}
+}
+
+func isPermErrorKind(err error, kind string) bool {
+	e, ok := err.(*td.PermissionError)
+	return ok && e.Kind == kind
+}
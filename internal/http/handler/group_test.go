@@ -0,0 +1,125 @@
+package handler
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/groups"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newGroupServer(t *testing.T) (*thttp.State, *httptest.Server) {
+	gs, err := groups.NewService(mock.NewStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := mock.NewFileService()
+	files.SetGroups(gs)
+	return newServer(t, &thttp.State{Groups: gs, Files: files}, []string{"/group/", "/file/", "/user/"},
+		rootUser, td.User{Name: "sam", Key: "sam key"}, td.User{Name: "tom", Key: "tom key"}, td.User{Name: "ann", Key: "ann key"})
+}
+
+func TestGroup(t *testing.T) {
+	state, ts := newGroupServer(t)
+	root, _ := state.Users.User("root")
+	sam, _ := state.Users.User("sam")
+	tom, _ := state.Users.User("tom")
+	ann, _ := state.Users.User("ann")
+
+	res, _ := doFile(t, &sam, http.MethodPost, ts.URL+"/group/", strings.NewReader(`{"name":"dev","members":["tom","nobody"]}`), nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodPost, ts.URL+"/group/", strings.NewReader(`{"name":"a/b"}`), nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, body := doFile(t, &sam, http.MethodPost, ts.URL+"/group/", strings.NewReader(`{"name":"dev","members":["tom"]}`), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.JSONEq(t, `{"name":"dev","owners":["sam"],"members":["tom"],"groups":[]}`, body)
+	res, _ = doFile(t, &tom, http.MethodPost, ts.URL+"/group/", strings.NewReader(`{"name":"dev"}`), nil)
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	res, _ = doFile(t, &root, http.MethodPost, ts.URL+"/group/", strings.NewReader(`{"name":"all","groups":["dev"]}`), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, body = doFile(t, &tom, http.MethodGet, ts.URL+"/group/", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `[{"name":"all","owners":[],"members":[],"groups":["dev"]},
+		{"name":"dev","owners":["sam"],"members":["tom"],"groups":[]}]`, body, "members of nested groups see them")
+	res, body = doFile(t, &ann, http.MethodGet, ts.URL+"/group/", nil, nil)
+	assert.JSONEq(t, `[]`, body)
+	res, _ = doFile(t, &ann, http.MethodGet, ts.URL+"/group/dev", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, _ = doFile(t, &tom, http.MethodPut, ts.URL+"/group/dev", strings.NewReader(`{"members":["tom","ann"]}`), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "members may not change the group")
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/group/dev", strings.NewReader(`{"owners":["sam"],"groups":["all"]}`), nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "a cycle")
+
+	// a file only the dev group may read
+	f, _ := state.Files.Open("/plan.txt", os.O_CREATE|os.O_RDWR, nil)
+	_, _ = f.Write([]byte("plan"))
+	f.Perm().BlockAllUser()
+	f.Perm().AllowGroup("all")
+	_ = f.Close()
+	res, body = doFile(t, &tom, http.MethodGet, ts.URL+"/file/plan.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "plan", body)
+	res, _ = doFile(t, &ann, http.MethodGet, ts.URL+"/file/plan.txt", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, body = doFile(t, &sam, http.MethodPut, ts.URL+"/group/dev", strings.NewReader(`{"owners":["sam"],"members":["ann"]}`), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `{"name":"dev","owners":["sam"],"members":["ann"],"groups":[]}`, body)
+	res, _ = doFile(t, &ann, http.MethodGet, ts.URL+"/file/plan.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "ann joined the group")
+	res, _ = doFile(t, &tom, http.MethodGet, ts.URL+"/file/plan.txt", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "tom left it")
+
+	res, _ = doFile(t, &ann, http.MethodDelete, ts.URL+"/user/", strings.NewReader(`{"name":"ann"}`), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	g, _ := state.Groups.Group("dev")
+	assert.Empty(t, g.Members, "a deleted user leaves the groups")
+
+	res, _ = doFile(t, &sam, http.MethodDelete, ts.URL+"/group/dev", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/group/dev", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestGroup_ForgetGrants(t *testing.T) {
+	state, ts := newGroupServer(t)
+	sam, _ := state.Users.User("sam")
+	tom, _ := state.Users.User("tom")
+	ann, _ := state.Users.User("ann")
+
+	res, _ := doFile(t, &sam, http.MethodPost, ts.URL+"/group/", strings.NewReader(`{"name":"dev","members":["tom"]}`), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	f, _ := state.Files.Open("/plan.txt", os.O_CREATE|os.O_RDWR, nil)
+	f.Perm().BlockAllUser()
+	f.Perm().AllowGroup("dev")
+	f.Perm().AllowUser("ann")
+	_ = f.Close()
+
+	res, _ = doFile(t, &sam, http.MethodDelete, ts.URL+"/group/dev", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	state.Sweeps.Wait()
+	res, _ = doFile(t, &sam, http.MethodPost, ts.URL+"/group/", strings.NewReader(`{"name":"dev","members":["tom"]}`), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res, _ = doFile(t, &tom, http.MethodGet, ts.URL+"/file/plan.txt", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "a new group does not inherit the grants of a deleted one")
+
+	res, _ = doFile(t, &ann, http.MethodDelete, ts.URL+"/user/", strings.NewReader(`{"name":"ann"}`), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	state.Sweeps.Wait()
+	_ = state.Users.CreateUser(ann)
+	res, _ = doFile(t, &ann, http.MethodGet, ts.URL+"/file/plan.txt", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "a new user does not inherit the grants of a deleted one")
+
+	f, _ = state.Files.Open("/plan.txt", os.O_RDONLY, nil)
+	doc, _ := f.Perm().(td.DocumentPermission).Document()
+	_ = f.Close()
+	assert.Empty(t, doc.Users)
+	assert.Empty(t, doc.Groups)
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"errors"
+	td "github.com/huangjiahua/tempdesk"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"net/http"
+	"time"
+)
+
+// ReadyTimeout bounds how long a readiness check waits for a backend.
+var ReadyTimeout = 5 * time.Second
+
+var errCheckTimeout = errors.New("health check timed out")
+
+// Health serves the liveness and readiness probes. Neither needs
+// authentication.
+type Health struct {
+	state *thttp.State
+}
+
+func NewHealth(state *thttp.State) *Health {
+	return &Health{state: state}
+}
+
+// ServeLive answers as long as the process can serve requests.
+func (h *Health) ServeLive(res http.ResponseWriter, req *http.Request) {
+	writeJson(res, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ServeReady checks every configured backend that is a td.HealthChecker and
+// answers 503 if any of them fails.
+func (h *Health) ServeReady(res http.ResponseWriter, req *http.Request) {
+	backends := map[string]interface{}{
+		"users":   h.state.Users,
+		"files":   h.state.Files,
+		"storage": h.state.Store,
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(backends))
+	for name, backend := range backends {
+		if backend == nil {
+			results <- result{name, nil}
+			continue
+		}
+		go func(name string, backend interface{}) {
+			results <- result{name, td.CheckHealth(backend)}
+		}(name, backend)
+	}
+
+	timeout := time.NewTimer(ReadyTimeout)
+	defer timeout.Stop()
+	checks := make(map[string]string, len(backends))
+	for range backends {
+		select {
+		case r := <-results:
+			checks[r.name] = "ok"
+			if r.err != nil {
+				checks[r.name] = r.err.Error()
+			}
+		case <-timeout.C:
+			for name := range backends {
+				if _, ok := checks[name]; !ok {
+					checks[name] = errCheckTimeout.Error()
+				}
+			}
+		}
+		if len(checks) == len(backends) {
+			break
+		}
+	}
+
+	status := http.StatusOK
+	for name, check := range checks {
+		if check != "ok" {
+			tlog.Ctx(req.Context()).Warn("backend not ready",
+				tlog.String("backend", name),
+				tlog.String("error", check))
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJson(res, status, map[string]interface{}{
+		"ready":  status == http.StatusOK,
+		"checks": checks,
+	})
+}
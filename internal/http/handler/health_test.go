@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"errors"
+	"github.com/huangjiahua/tempdesk/internal/event"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type brokenStorage struct {
+	*mock.Storage
+}
+
+func (brokenStorage) Health() error {
+	return errors.New("disk full")
+}
+
+func TestHealth_ServeReady(t *testing.T) {
+	state := &thttp.State{
+		Users: event.NewUserService(mock.NewUserService(), event.NewBus()),
+		Files: event.NewFileService(mock.NewFileService(), event.NewBus()),
+		Store: mock.NewStorage(),
+	}
+	h := NewHealth(state)
+
+	res := httptest.NewRecorder()
+	h.ServeLive(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = httptest.NewRecorder()
+	h.ServeReady(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"ready":true,"checks":{"users":"ok","files":"ok","storage":"ok"}}`, res.Body.String())
+
+	state.Store = brokenStorage{mock.NewStorage()}
+	res = httptest.NewRecorder()
+	h.ServeReady(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.JSONEq(t, `{"ready":false,"checks":{"users":"ok","files":"ok","storage":"disk full"}}`, res.Body.String())
+}
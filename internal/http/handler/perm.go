@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	ErrorReadingPerm  = "error reading permission"
+	ErrorChangingPerm = "error changing permission"
+	ErrorPermChanged  = "permission changed meanwhile"
+	ErrorNoPermDoc    = "permission has no document"
+	ErrorInvalidPerm  = "invalid permission document"
+	ErrorNoFilesInDir = "no files below the directory"
+)
+
+// Perm reads and replaces the permissions of files as documents in the
+// JSON form of td.PermissionDocument:
+//
+//	GET {prefix}/{path}  the document of a file
+//	PUT {prefix}/{path}  replace the document of a file
+//	GET {prefix}/{dir}/  the documents of the files below dir, by path
+//	PUT {prefix}/{dir}/  give every file below dir the document
+//
+// Both need the change_perm verb. A GET on a directory leaves out the files
+// the user may not change, and its ETag only covers the documents it
+// answers. A PUT on a directory needs the verb on every file below it,
+// which get the document all or none; otherwise it is refused with
+//
+//	{"error": "permission denied", "paths": ["/dir/a"], "hidden": 1}
+//
+// naming the files in the way the user may read, and counting the others.
+// Responses carry an ETag of the documents. A PUT with an If-Match header
+// only succeeds while it still matches, up to the moment each document is
+// replaced, so two clients editing a permission do not silently overwrite
+// each other.
+type Perm struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewPerm(state *thttp.State, prefix string) *Perm {
+	return &Perm{state: state, prefix: prefix}
+}
+
+// permBlocked answers a PUT on a directory with files the user may not
+// change.
+type permBlocked struct {
+	Error  string   `json:"error"`
+	Paths  []string `json:"paths"`
+	Hidden int      `json:"hidden"`
+}
+
+// permTarget is an open file whose permission a request reads or replaces.
+type permTarget struct {
+	path string
+	file td.File
+	perm td.DocumentPermission
+	doc  td.PermissionDocument
+}
+
+func (p *Perm) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := p.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodPut {
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var doc td.PermissionDocument
+	if req.Method == http.MethodPut {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Debug(ErrorParsingBody, tlog.Err(err))
+			http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+			return
+		}
+		if doc, err = td.ParsePermissionDocument(body); err != nil {
+			log.Debug(ErrorInvalidPerm, tlog.Err(err))
+			writePermError(res, err, ErrorInvalidPerm)
+			return
+		}
+	}
+
+	p.serve(res, req, user, doc)
+}
+
+func (p *Perm) serve(res http.ResponseWriter, req *http.Request, user td.User, doc td.PermissionDocument) {
+	log := tlog.Ctx(req.Context())
+	target := path.Clean("/" + strings.TrimPrefix(req.URL.Path, p.prefix))
+	dir := strings.HasSuffix(req.URL.Path, "/")
+
+	paths := []string{target}
+	if dir {
+		files, err := p.state.Files.List(target)
+		if err != nil {
+			log.Debug(ErrorListingFiles, tlog.String("path", target), tlog.Err(err))
+			writeFileError(res, err, ErrorListingFiles)
+			return
+		}
+		paths = paths[:0]
+		for _, info := range files {
+			paths = append(paths, info.Path)
+		}
+	}
+
+	// a GET on a directory skips the files user may not change, a PUT
+	// changes all of them or none
+	var targets []permTarget
+	blocked := permBlocked{Error: ErrorPermission, Paths: []string{}}
+	defer func() {
+		for _, t := range targets {
+			closeFile(t.file)
+		}
+	}()
+	for _, fp := range paths {
+		file, err := p.state.Files.Open(fp, os.O_RDONLY, nil)
+		if err != nil {
+			log.Debug(ErrorOpeningFile, tlog.String("path", fp), tlog.Err(err))
+			writeFileError(res, err, ErrorOpeningFile)
+			return
+		}
+		if !td.Can(file.Perm(), user, td.VerbChangePerm) {
+			readable := td.Can(file.Perm(), user, td.VerbRead)
+			closeFile(file)
+			if dir && req.Method == http.MethodGet {
+				continue
+			}
+			log.Debug(ErrorPermission, tlog.String("path", fp), tlog.String("user", user.Name), tlog.String("verb", td.VerbChangePerm.String()))
+			if !dir {
+				http.Error(res, ErrorPermission, http.StatusForbidden)
+				return
+			}
+			if readable {
+				blocked.Paths = append(blocked.Paths, fp)
+			} else {
+				blocked.Hidden++
+			}
+			continue
+		}
+		targets = append(targets, permTarget{path: fp, file: file})
+		t := &targets[len(targets)-1]
+		perm, ok := file.Perm().(td.DocumentPermission)
+		if ok {
+			t.perm = perm
+			t.doc, err = perm.Document()
+		} else {
+			err = &td.PermissionError{Kind: td.PermissionNotDocumented}
+		}
+		if err != nil {
+			log.Debug(ErrorReadingPerm, tlog.String("path", fp), tlog.Err(err))
+			writePermError(res, err, ErrorReadingPerm)
+			return
+		}
+	}
+	if len(blocked.Paths) > 0 || blocked.Hidden > 0 {
+		writeJson(res, http.StatusForbidden, blocked)
+		return
+	}
+	if dir && req.Method == http.MethodPut && len(targets) == 0 {
+		http.Error(res, ErrorNoFilesInDir, http.StatusNotFound)
+		return
+	}
+
+	if req.Method == http.MethodPut {
+		match := req.Header.Get("If-Match")
+		if match != "" && !matchETag(match, permETag(targets, dir)) {
+			http.Error(res, ErrorPermChanged, http.StatusPreconditionFailed)
+			return
+		}
+		if err := p.setDocuments(targets, doc, match != ""); err != nil {
+			p.state.Record(req, user.Name, audit.ActionPermChange, target, audit.OutcomeFailure, err.Error())
+			log.Error(ErrorChangingPerm, tlog.String("path", target), tlog.Err(err))
+			writePermError(res, err, ErrorChangingPerm)
+			return
+		}
+		for i := range targets {
+			t := &targets[i]
+			p.state.Record(req, user.Name, audit.ActionPermChange, t.path, audit.OutcomeSuccess, "document")
+			log.Info("change permission", tlog.String("user", user.Name), tlog.String("path", t.path))
+			var err error
+			if t.doc, err = t.perm.Document(); err != nil {
+				log.Error(ErrorReadingPerm, tlog.String("path", t.path), tlog.Err(err))
+				writePermError(res, err, ErrorReadingPerm)
+				return
+			}
+		}
+	}
+
+	res.Header().Set("ETag", permETag(targets, dir))
+	if !dir {
+		writeJson(res, http.StatusOK, targets[0].doc)
+		return
+	}
+	writeJson(res, http.StatusOK, permDocs(targets))
+}
+
+// setDocuments gives every target doc or, if one fails, none. While
+// matched, a target whose document is no longer the one read fails with
+// PermissionChanged.
+func (p *Perm) setDocuments(targets []permTarget, doc td.PermissionDocument, matched bool) error {
+	for i, t := range targets {
+		var err error
+		if matched {
+			err = t.perm.SetDocumentIf(t.doc, doc)
+		} else {
+			err = t.perm.SetDocument(doc)
+		}
+		if err == nil {
+			continue
+		}
+		for _, done := range targets[:i] {
+			// a document changed again since is left alone
+			_ = done.perm.SetDocumentIf(doc, done.doc)
+		}
+		return err
+	}
+	return nil
+}
+
+func permDocs(targets []permTarget) map[string]td.PermissionDocument {
+	docs := make(map[string]td.PermissionDocument, len(targets))
+	for _, t := range targets {
+		docs[t.path] = t.doc
+	}
+	return docs
+}
+
+// permETag is a strong entity tag of the documents answered for targets.
+func permETag(targets []permTarget, dir bool) string {
+	var v interface{} = permDocs(targets)
+	if !dir {
+		v = targets[0].doc
+	}
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// matchETag reports whether an If-Match header matches etag by the strong
+// comparison, which never matches a weak tag.
+func matchETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writePermError(res http.ResponseWriter, err error, msg string) {
+	e, ok := err.(*td.PermissionError)
+	if !ok {
+		http.Error(res, msg, http.StatusInternalServerError)
+		return
+	}
+	switch e.Kind {
+	case td.PermissionNotDocumented:
+		http.Error(res, ErrorNoPermDoc, http.StatusNotImplemented)
+	case td.PermissionChanged:
+		http.Error(res, ErrorPermChanged, http.StatusPreconditionFailed)
+	default:
+		http.Error(res, e.Error(), http.StatusBadRequest)
+	}
+}
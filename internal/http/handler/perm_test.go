@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPerm(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/", "/perm/"})
+	sam := td.User{Name: "sam", Key: "key"}
+	tom := td.User{Name: "tom", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(tom)
+	res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/file/a.txt", strings.NewReader("a"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, body := doFile(t, &sam, http.MethodGet, ts.URL+"/perm/a.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `{"version":1,"all":"none","users":{"sam":"read,write,delete,share,change_perm"},
+		"groups":{},"codes":{},"public":false,"public_codes":[]}`, body)
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	res, _ = doFile(t, &tom, http.MethodGet, ts.URL+"/perm/a.txt", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/perm/b.txt", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	doc := `{"version":1,"all":"none","users":{"sam":"all","tom":"read"}}`
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/perm/a.txt", strings.NewReader(doc), map[string]string{"If-Match": `"stale"`})
+	assert.Equal(t, http.StatusPreconditionFailed, res.StatusCode)
+	res, body = doFile(t, &sam, http.MethodPut, ts.URL+"/perm/a.txt", strings.NewReader(doc), map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `{"version":1,"all":"none","users":{"sam":"read,write,delete,share,change_perm","tom":"read"},
+		"groups":{},"codes":{},"public":false,"public_codes":[]}`, body)
+	assert.NotEqual(t, etag, res.Header.Get("ETag"))
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/perm/a.txt", strings.NewReader(doc), map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, res.StatusCode, "the document changed")
+
+	res, _ = doFile(t, &tom, http.MethodGet, ts.URL+"/file/a.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res, _ = doFile(t, &tom, http.MethodPut, ts.URL+"/perm/a.txt", strings.NewReader(doc), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "reading is not changing the permission")
+
+	for _, bad := range []string{`{"version":2}`, `{"version":1,"users":{"tom":"fly"}}`, `{"version":1,"owner":"tom"}`, `{`} {
+		res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/perm/a.txt", strings.NewReader(bad), nil)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, bad)
+	}
+}
+
+func TestPerm_Dir(t *testing.T) {
+	state, ts := newServer(t, nil, []string{"/file/", "/perm/"})
+	sam := td.User{Name: "sam", Key: "key"}
+	tom := td.User{Name: "tom", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(tom)
+	for _, p := range []string{"/docs/a.txt", "/docs/sub/b.txt"} {
+		res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/file"+p, strings.NewReader("x"), nil)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+	res, _ := doFile(t, &tom, http.MethodPut, ts.URL+"/file/docs/tom.txt", strings.NewReader("x"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, body := doFile(t, &sam, http.MethodGet, ts.URL+"/perm/docs/", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var docs map[string]td.PermissionDocument
+	assert.Nil(t, json.Unmarshal([]byte(body), &docs))
+	assert.Len(t, docs, 2, "tom's file is left out")
+	assert.Contains(t, docs, "/docs/sub/b.txt")
+
+	doc := `{"version":1,"all":"read","users":{"sam":"all"}}`
+	res, body = doFile(t, &sam, http.MethodPut, ts.URL+"/perm/docs/", strings.NewReader(doc), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "sam may not change tom's file")
+	assert.JSONEq(t, `{"error":"permission denied","paths":[],"hidden":1}`, body, "nor learn its name")
+	res, _ = doFile(t, &tom, http.MethodPut, ts.URL+"/perm/docs/tom.txt", strings.NewReader(`{"version":1,"all":"read","users":{"tom":"all"}}`), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res, body = doFile(t, &sam, http.MethodPut, ts.URL+"/perm/docs/", strings.NewReader(doc), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.JSONEq(t, `{"error":"permission denied","paths":["/docs/tom.txt"],"hidden":0}`, body, "a file sam may read is named")
+	res, _ = doFile(t, &tom, http.MethodGet, ts.URL+"/file/docs/a.txt", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "nothing changed")
+
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/perm/docs/sub/", nil, nil)
+	etag := res.Header.Get("ETag")
+	res, body = doFile(t, &sam, http.MethodPut, ts.URL+"/perm/docs/sub/", strings.NewReader(doc), map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, body, `"/docs/sub/b.txt"`)
+	res, _ = doFile(t, &tom, http.MethodGet, ts.URL+"/file/docs/sub/b.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodPut, ts.URL+"/perm/empty/", strings.NewReader(doc), nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestPerm_SetDocuments(t *testing.T) {
+	p := &Perm{}
+	var targets []permTarget
+	for i := 0; i < 2; i++ {
+		perm := mock.NewFilePermission()
+		doc, _ := perm.Document()
+		targets = append(targets, permTarget{perm: perm, doc: doc})
+	}
+	// the second document changes after it was read
+	targets[1].perm.GrantUser("tom", td.VerbRead)
+
+	doc := td.PermissionDocument{Version: td.PermissionVersion, All: td.VerbRead}
+	err := p.setDocuments(targets, doc, true)
+	if assert.IsType(t, &td.PermissionError{}, err) {
+		assert.Equal(t, td.PermissionChanged, err.(*td.PermissionError).Kind)
+	}
+	first, _ := targets[0].perm.Document()
+	assert.True(t, first.Equal(targets[0].doc), "the first document is put back")
+
+	assert.Nil(t, p.setDocuments(targets, doc, false))
+	second, _ := targets[1].perm.Document()
+	assert.True(t, second.Equal(doc))
+}
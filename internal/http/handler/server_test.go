@@ -0,0 +1,92 @@
+package handler
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// routes makes the handlers a test server serves, by the prefix httpserver
+// serves them under.
+var routes = map[string]func(state *thttp.State) http.Handler{
+	"/account/": func(state *thttp.State) http.Handler { return NewAccount(state, "/account") },
+	"/admin/":   func(state *thttp.State) http.Handler { return NewAdmin(state, "/admin") },
+	"/archive/": func(state *thttp.State) http.Handler { return NewArchive(state, "/archive") },
+	"/file/":    func(state *thttp.State) http.Handler { return NewFile(state, "/file") },
+	"/group/":   func(state *thttp.State) http.Handler { return NewGroup(state, "/group") },
+	"/perm/":    func(state *thttp.State) http.Handler { return NewPerm(state, "/perm") },
+	"/session/": func(state *thttp.State) http.Handler { return NewSession(state, "/session") },
+	"/share/":   func(state *thttp.State) http.Handler { return NewShare(state, "/share") },
+	"/totp/":    func(state *thttp.State) http.Handler { return NewTOTP(state, "/totp") },
+	"/user/":    func(state *thttp.State) http.Handler { return NewUser(state) },
+	"/watch/":   func(state *thttp.State) http.Handler { return NewWatch(state, "/watch") },
+}
+
+// newServer serves the handlers under prefixes for state until the test
+// ends. A nil state is an empty one, and mock users and files and an HMAC
+// auther fill in what state leaves nil. users are created in it.
+func newServer(t *testing.T, state *thttp.State, prefixes []string, users ...td.User) (*thttp.State, *httptest.Server) {
+	if state == nil {
+		state = &thttp.State{}
+	}
+	if state.Users == nil {
+		state.Users = mock.NewUserService()
+	}
+	if state.Files == nil {
+		state.Files = mock.NewFileService()
+	}
+	if state.Auther == nil {
+		state.Auther = auth.NewHMACAuther()
+	}
+	for _, u := range users {
+		if err := state.Users.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	for _, prefix := range prefixes {
+		route, ok := routes[prefix]
+		if !ok {
+			t.Fatalf("no handler for %s", prefix)
+		}
+		mux.Handle(prefix, route(state))
+	}
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return state, ts
+}
+
+// rootUser is the admin the servers of some tests start with.
+var rootUser = td.User{Name: "root", Key: "root key", Meta: map[string]string{td.MetaRole: td.RoleAdmin}}
+
+// doFile sends a request signed for user and returns the response and its
+// body.
+func doFile(t *testing.T, user *td.User, method, url string, body io.Reader, header map[string]string) (*http.Response, string) {
+	req, _ := http.NewRequest(method, url, body)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if user != nil {
+		setupHMAC(req, user)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	return res, string(b)
+}
+
+// doPlain sends a request that is not signed and returns the response and
+// its body.
+func doPlain(t *testing.T, method, url string, body io.Reader, header map[string]string) (*http.Response, string) {
+	return doFile(t, nil, method, url, body, header)
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/session"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ErrorNoSessions     = "sessions are not enabled"
+	ErrorSecondFactor   = "second factor required"
+	ErrorCreatingSess   = "error creating session"
+	ErrorNoSession      = "no session"
+	ErrorSessionMissing = "session not found"
+)
+
+// Session logs users in from a browser:
+//
+//	POST   {prefix}/  log in with the name and key in Basic Authorization, and
+//	                  a code in X-TOTP-Code for a user with a second factor
+//	GET    {prefix}/  the session of the request
+//	DELETE {prefix}/  log out
+//
+// A login sets the session cookie and returns the token, which other
+// clients may send as "Authorization: Session TOKEN". A login without the
+// code a user needs is answered with 401 and {"error": "second factor
+// required"}, so the client asks for it.
+type Session struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewSession(state *thttp.State, prefix string) *Session {
+	return &Session{state: state, prefix: prefix}
+}
+
+func (s *Session) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if s.state.Sessions == nil || s.state.Login == nil {
+		http.Error(res, ErrorNoSessions, http.StatusNotFound)
+		return
+	}
+	if p := strings.Trim(strings.TrimPrefix(req.URL.Path, s.prefix), "/"); p != "" {
+		http.NotFound(res, req)
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+		s.ServeLogin(res, req)
+	case http.MethodGet:
+		token, _ := session.Token(req)
+		sess, ok := s.state.Sessions.Get(token)
+		if !ok {
+			http.Error(res, ErrorSessionMissing, http.StatusNotFound)
+			return
+		}
+		writeJson(res, http.StatusOK, sess)
+	case http.MethodDelete:
+		token, _ := session.Token(req)
+		if token == "" {
+			http.Error(res, ErrorNoSession, http.StatusBadRequest)
+			return
+		}
+		s.state.Sessions.Delete(token)
+		http.SetCookie(res, &http.Cookie{Name: session.CookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: req.TLS != nil, SameSite: http.SameSiteStrictMode})
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		tlog.Ctx(req.Context()).Debug("unsupported method", tlog.String("method", req.Method))
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+	}
+}
+
+type loginResponse struct {
+	session.Session
+	Token string `json:"token"`
+}
+
+func (s *Session) ServeLogin(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := s.state.LogIn(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		if e, ok := err.(*auth.AutherError); ok && e.Kind == auth.SecondFactor {
+			writeJson(res, http.StatusUnauthorized, map[string]string{"error": ErrorSecondFactor})
+			return
+		}
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	token, sess, err := s.state.Sessions.Create(user)
+	if err != nil {
+		log.Error(ErrorCreatingSess, tlog.Err(err))
+		http.Error(res, ErrorCreatingSess, http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(res, &http.Cookie{
+		Name:     session.CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  sess.Expires,
+		MaxAge:   int(time.Until(sess.Expires) / time.Second),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	log.Info("log in", tlog.String("name", user.Name))
+	s.state.Record(req, user.Name, audit.ActionLogin, user.Name, audit.OutcomeSuccess, "")
+	writeJson(res, http.StatusOK, loginResponse{Session: sess, Token: token})
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/share"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	ErrorCreatingShare = "error creating share"
+	ErrorRevokingShare = "error revoking share"
+	ErrorNoShares      = "shares are not enabled"
+)
+
+// Share hands out share codes for files:
+//
+//	GET    {prefix}/        list the shares of the user
+//	POST   {prefix}/        share a file, {"path": "/a.txt", "ttl": "24h"}
+//	GET    {prefix}/{code}  download the shared file, anyone may do this
+//	DELETE {prefix}/{code}  revoke a share
+//
+// A download only succeeds while the user who shared the file may still
+// access it.
+type Share struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewShare(state *thttp.State, prefix string) *Share {
+	return &Share{state: state, prefix: prefix}
+}
+
+func (s *Share) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	if s.state.Shares == nil {
+		http.Error(res, ErrorNoShares, http.StatusNotFound)
+		return
+	}
+
+	code := strings.Trim(strings.TrimPrefix(req.URL.Path, s.prefix), "/")
+	if code != "" && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		s.ServeDownload(res, req, code)
+		return
+	}
+
+	user, err := s.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case code == "" && req.Method == http.MethodGet:
+		writeJson(res, http.StatusOK, s.state.Shares.Shares(user.Name))
+	case code == "" && req.Method == http.MethodPost:
+		s.ServeCreate(res, req, user)
+	case code != "" && req.Method == http.MethodDelete:
+		sh, err := s.state.Shares.Share(code)
+		if err == nil {
+			err = s.state.Shares.Revoke(code, user.Name)
+		}
+		if err != nil {
+			log.Debug(ErrorRevokingShare, tlog.Err(err))
+			writeShareError(res, err, ErrorRevokingShare)
+			return
+		}
+		log.Info("revoke share",
+			tlog.String("user", user.Name),
+			tlog.String("path", sh.Path))
+		s.state.Record(req, user.Name, audit.ActionPermChange, sh.Path, audit.OutcomeSuccess, "share revoked")
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		log.Debug("unsupported method", tlog.String("method", req.Method))
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+	}
+}
+
+type shareRequest struct {
+	Path string `json:"path"`
+	TTL  string `json:"ttl"`
+}
+
+func (s *Share) ServeCreate(res http.ResponseWriter, req *http.Request, user td.User) {
+	log := tlog.Ctx(req.Context())
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Debug(ErrorParsingBody, tlog.Err(err))
+		http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+		return
+	}
+	var r shareRequest
+	if err = json.Unmarshal(body, &r); err != nil {
+		log.Debug(ErrorParsingJson, tlog.Err(err))
+		http.Error(res, ErrorParsingJson, http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if r.TTL != "" {
+		if ttl, err = time.ParseDuration(r.TTL); err != nil {
+			log.Debug(ErrorParsingJson, tlog.Err(err))
+			http.Error(res, ErrorParsingJson, http.StatusBadRequest)
+			return
+		}
+	}
+
+	p := path.Clean("/" + r.Path)
+	file, err := s.state.Files.Open(p, os.O_RDONLY, nil)
+	if err != nil {
+		log.Debug(ErrorOpeningFile, tlog.String("path", p), tlog.Err(err))
+		writeFileError(res, err, ErrorOpeningFile)
+		return
+	}
+	allowed := td.Can(file.Perm(), user, td.VerbRead|td.VerbShare)
+	closeFile(file)
+	if !allowed {
+		http.Error(res, ErrorPermission, http.StatusForbidden)
+		return
+	}
+
+	sh, err := s.state.Shares.Create(p, user.Name, ttl)
+	if err != nil {
+		log.Debug(ErrorCreatingShare, tlog.Err(err))
+		s.state.Record(req, user.Name, audit.ActionPermChange, p, audit.OutcomeFailure, err.Error())
+		writeShareError(res, err, ErrorCreatingShare)
+		return
+	}
+
+	log.Info("share file",
+		tlog.String("user", user.Name),
+		tlog.String("path", p),
+		tlog.String("expires", sh.Expires.Format(time.RFC3339)))
+	s.state.Record(req, user.Name, audit.ActionPermChange, p, audit.OutcomeSuccess,
+		"shared by code until "+sh.Expires.Format(time.RFC3339))
+	writeJson(res, http.StatusCreated, sh)
+}
+
+func (s *Share) ServeDownload(res http.ResponseWriter, req *http.Request, code string) {
+	log := tlog.Ctx(req.Context())
+	sh, err := s.state.Shares.Share(code)
+	if err != nil {
+		log.Debug("share not found", tlog.Err(err))
+		writeShareError(res, err, ErrorOpeningFile)
+		return
+	}
+
+	owner, ok := s.state.Users.User(sh.Owner)
+	if !ok {
+		http.Error(res, share.ShareNotExist, http.StatusNotFound)
+		return
+	}
+	file, err := s.state.Files.Open(sh.Path, os.O_RDONLY, nil)
+	if err != nil {
+		log.Debug(ErrorOpeningFile, tlog.String("path", sh.Path), tlog.Err(err))
+		writeFileError(res, err, ErrorOpeningFile)
+		return
+	}
+	defer closeFile(file)
+	// the share ends with the right of its owner to share the file
+	if !td.Can(file.Perm(), owner, td.VerbRead|td.VerbShare) {
+		http.Error(res, share.ShareNotExist, http.StatusNotFound)
+		return
+	}
+
+	name := path.Base(sh.Path)
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(res, req, name, time.Time{}, file)
+}
+
+func writeShareError(res http.ResponseWriter, err error, msg string) {
+	e, ok := err.(*share.ShareError)
+	if !ok {
+		http.Error(res, msg, http.StatusInternalServerError)
+		return
+	}
+	switch e.Kind {
+	case share.ShareNotExist:
+		http.Error(res, e.Error(), http.StatusNotFound)
+	default:
+		http.Error(res, e.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/internal/share"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestShare_ServeHTTP(t *testing.T) {
+	store := mock.NewStorage()
+	log, _ := audit.NewLog(store)
+	shares, _ := share.NewService(store)
+	state, ts := newServer(t, &thttp.State{Audit: log, Shares: shares}, []string{"/file/", "/share/"})
+
+	sam := td.User{Name: "sam", Key: "key"}
+	tom := td.User{Name: "tom", Key: "key"}
+	_ = state.Users.CreateUser(sam)
+	_ = state.Users.CreateUser(tom)
+	doFile(t, &sam, http.MethodPut, ts.URL+"/file/a.txt", strings.NewReader("hello"), nil)
+
+	res, _ := doFile(t, &tom, http.MethodPost, ts.URL+"/share/", strings.NewReader(`{"path":"/a.txt"}`), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "tom may not share sam's file")
+	res, _ = doFile(t, &sam, http.MethodPost, ts.URL+"/share/", strings.NewReader(`{"path":"/a.txt","ttl":"forever"}`), nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, body := doFile(t, &sam, http.MethodPost, ts.URL+"/share/", strings.NewReader(`{"path":"/a.txt","ttl":"1h"}`), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode, body)
+	var sh share.Share
+	assert.NoError(t, json.Unmarshal([]byte(body), &sh))
+
+	res, err := http.Get(ts.URL + "/share/" + sh.Code)
+	if assert.Nil(t, err) {
+		b, _ := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "hello", string(b))
+		assert.Equal(t, `attachment; filename=a.txt`, res.Header.Get("Content-Disposition"))
+	}
+
+	res, _ = doFile(t, &tom, http.MethodDelete, ts.URL+"/share/"+sh.Code, nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodDelete, ts.URL+"/share/"+sh.Code, nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = http.Get(ts.URL + "/share/" + sh.Code)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	records, _ := log.Query(audit.Filter{Action: audit.ActionPermChange})
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, "share revoked", records[0].Detail)
+		assert.Contains(t, records[1].Detail, "shared by code until")
+	}
+}
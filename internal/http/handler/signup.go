@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/signup"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ErrorInvalidSignUp   = "invalid sign up"
+	ErrorSignUpClosed    = "sign up is closed"
+	ErrorInviteRequired  = "invite required"
+	ErrorInvalidInvite   = "invalid invite"
+	ErrorNoSignup        = "sign up control is not enabled"
+	ErrorCreatingInvite  = "error creating invite"
+	ErrorRevokingInvite  = "error revoking invite"
+	ErrorListingUsers    = "error listing users"
+	ErrorUserNotPending  = "user is not pending"
+	ErrorApprovingUser   = "error approving user"
+	ErrorInvalidPassword = "invalid password"
+)
+
+// signupError is the JSON body of a refused sign up.
+type signupError struct {
+	Error    string           `json:"error"`
+	Problems []signup.Problem `json:"problems,omitempty"`
+}
+
+// admit checks whether info may sign up and returns the user to create and
+// the invite code it used, if any. It answers the request itself when the
+// sign up is refused.
+func (u *User) admit(res http.ResponseWriter, req *http.Request, info userSignUpInfo) (td.User, string, bool) {
+	log := tlog.Ctx(req.Context())
+	user := td.User{Name: info.Name, Key: info.Key, Meta: info.Meta}
+	s := u.state.Signup
+	if s == nil {
+		return user, "", true
+	}
+	refuse := func(status int, body signupError) (td.User, string, bool) {
+		log.Debug(body.Error, tlog.String("name", info.Name))
+		u.state.Record(req, info.Name, audit.ActionUserCreate, info.Name, audit.OutcomeFailure, body.Error)
+		writeJson(res, status, body)
+		return td.User{}, "", false
+	}
+
+	mode := s.Mode()
+	if mode == signup.ModeClosed {
+		return refuse(http.StatusForbidden, signupError{Error: ErrorSignUpClosed})
+	}
+	if problems := s.Policy().Check(info.Name, info.Key, info.Meta); len(problems) > 0 {
+		return refuse(http.StatusBadRequest, signupError{Error: ErrorInvalidSignUp, Problems: problems})
+	}
+
+	switch mode {
+	case signup.ModeInvite:
+		if info.Invite == "" {
+			return refuse(http.StatusForbidden, signupError{Error: ErrorInviteRequired})
+		}
+		if _, err := s.Use(info.Invite); err != nil {
+			if signup.IsKind(err, signup.InviteNotExist) || signup.IsKind(err, signup.InviteUsedUp) {
+				return refuse(http.StatusForbidden, signupError{Error: ErrorInvalidInvite})
+			}
+			log.Error(ErrorCreatingUser, tlog.Err(err))
+			http.Error(res, ErrorInternalServer, http.StatusInternalServerError)
+			return td.User{}, "", false
+		}
+		return user, info.Invite, true
+	case signup.ModeApproval:
+		meta := make(map[string]string, len(user.Meta)+1)
+		for k, v := range user.Meta {
+			meta[k] = v
+		}
+		meta[td.MetaPending] = "true"
+		user.Meta = meta
+	}
+	return user, "", true
+}
+
+// checkKey answers the request with the problems of key for the user name
+// unless the policy allows it.
+func checkKey(state *thttp.State, res http.ResponseWriter, name, key string) bool {
+	if state.Signup == nil {
+		return true
+	}
+	if problems := state.Signup.Policy().CheckKey(name, key); len(problems) > 0 {
+		writeJson(res, http.StatusBadRequest, signupError{Error: ErrorInvalidPassword, Problems: problems})
+		return false
+	}
+	return true
+}
+
+type inviteRequest struct {
+	Uses int    `json:"uses"`
+	TTL  string `json:"ttl"`
+}
+
+// ServeInvites lists the invites on GET and creates one on POST with
+// {"uses": 1, "ttl": "72h"}, where uses is 0 for any number of sign ups.
+// DELETE {prefix}/invites/{code} revokes an invite.
+func (a *Admin) ServeInvites(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	s := a.state.Signup
+	if s == nil {
+		http.Error(res, ErrorNoSignup, http.StatusNotFound)
+		return
+	}
+	admin := adminOf(req)
+	code := strings.Trim(strings.TrimPrefix(req.URL.Path, a.prefix+"/invites"), "/")
+
+	switch {
+	case code == "" && req.Method == http.MethodGet:
+		writeJson(res, http.StatusOK, s.Invites())
+	case code == "" && req.Method == http.MethodPost:
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Debug(ErrorParsingBody, tlog.Err(err))
+			http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+			return
+		}
+		r := inviteRequest{Uses: 1}
+		var ttl time.Duration
+		if len(body) > 0 {
+			err = json.Unmarshal(body, &r)
+		}
+		if err == nil && r.TTL != "" {
+			ttl, err = time.ParseDuration(r.TTL)
+		}
+		if err != nil {
+			log.Debug(ErrorParsingJson, tlog.Err(err))
+			http.Error(res, ErrorParsingJson, http.StatusBadRequest)
+			return
+		}
+		invite, err := s.CreateInvite(admin.Name, r.Uses, ttl)
+		if err != nil {
+			log.Debug(ErrorCreatingInvite, tlog.Err(err))
+			a.state.Record(req, admin.Name, audit.ActionInviteCreate, "", audit.OutcomeFailure, err.Error())
+			if signup.IsKind(err, signup.InvalidInvite) {
+				http.Error(res, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(res, ErrorCreatingInvite, http.StatusInternalServerError)
+			}
+			return
+		}
+		log.Info("create invite", tlog.String("user", admin.Name), tlog.Int("uses", invite.MaxUses))
+		a.state.Record(req, admin.Name, audit.ActionInviteCreate, invite.Code, audit.OutcomeSuccess, "")
+		writeJson(res, http.StatusCreated, invite)
+	case code != "" && req.Method == http.MethodDelete:
+		if err := s.RevokeInvite(code); err != nil {
+			log.Debug(ErrorRevokingInvite, tlog.Err(err))
+			if signup.IsKind(err, signup.InviteNotExist) {
+				http.Error(res, err.Error(), http.StatusNotFound)
+			} else {
+				http.Error(res, ErrorRevokingInvite, http.StatusInternalServerError)
+			}
+			return
+		}
+		log.Info("revoke invite", tlog.String("user", admin.Name))
+		a.state.Record(req, admin.Name, audit.ActionInviteRevoke, code, audit.OutcomeSuccess, "")
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+	}
+}
+
+// ServePending lists the users waiting for approval on GET. POST
+// {prefix}/pending/{name} approves a user and DELETE rejects it, which
+// deletes it.
+func (a *Admin) ServePending(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	admin := adminOf(req)
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, a.prefix+"/pending"), "/")
+
+	if name == "" {
+		if req.Method != http.MethodGet {
+			http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+			return
+		}
+		lister, ok := td.Lister(a.state.Users)
+		if !ok {
+			http.Error(res, ErrorListingUsers, http.StatusNotImplemented)
+			return
+		}
+		users, err := lister.Users()
+		if err != nil {
+			log.Error(ErrorListingUsers, tlog.Err(err))
+			http.Error(res, ErrorListingUsers, http.StatusInternalServerError)
+			return
+		}
+		ret := []map[string]string{}
+		for _, user := range users {
+			if user.IsPending() {
+				ret = append(ret, map[string]string{"name": user.Name})
+			}
+		}
+		writeJson(res, http.StatusOK, ret)
+		return
+	}
+
+	user, ok := a.state.Users.User(name)
+	if !ok || !user.IsPending() {
+		http.Error(res, ErrorUserNotPending, http.StatusNotFound)
+		return
+	}
+	var err error
+	action, detail, msg := audit.ActionUserApprove, "", "approve user"
+	switch req.Method {
+	case http.MethodPost:
+		meta := make(map[string]string, len(user.Meta))
+		for k, v := range user.Meta {
+			if k != td.MetaPending {
+				meta[k] = v
+			}
+		}
+		user.Meta = meta
+		err = a.state.Users.UpdateUser(user)
+	case http.MethodDelete:
+		action, detail, msg = audit.ActionUserDelete, "rejected", "reject user"
+		err = a.state.Users.DeleteUser(user)
+	default:
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Error(ErrorApprovingUser, tlog.Err(err))
+		a.state.Record(req, admin.Name, action, name, audit.OutcomeFailure, err.Error())
+		http.Error(res, ErrorApprovingUser, http.StatusInternalServerError)
+		return
+	}
+	log.Info(msg,
+		tlog.String("exe", admin.Name),
+		tlog.String("target", name))
+	a.state.Record(req, admin.Name, action, name, audit.OutcomeSuccess, detail)
+	res.WriteHeader(http.StatusNoContent)
+}
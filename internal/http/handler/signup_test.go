@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/internal/signup"
+	"github.com/huangjiahua/tempdesk/internal/users"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newSignupServer(t *testing.T) (*thttp.State, *httptest.Server) {
+	us, err := users.NewService(mock.NewStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := signup.NewService(mock.NewStorage())
+	return newServer(t, &thttp.State{Users: us, Signup: s}, []string{"/admin/", "/user/", "/account/"}, rootUser)
+}
+
+// signUp posts body to sign up and returns the status and the response.
+func signUp(t *testing.T, ts *httptest.Server, body string) (int, string) {
+	res, err := http.Post(ts.URL+"/user/", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	return res.StatusCode, string(b)
+}
+
+func TestUser_ServeAddUser_Modes(t *testing.T) {
+	state, ts := newSignupServer(t)
+
+	status, body := signUp(t, ts, `{"name":"s","password":"short","meta":{"role":"admin"}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"error":"invalid sign up","problems":[
+		{"field":"name","message":"must be 2 to 64 characters long"},
+		{"field":"password","message":"must be at least 8 characters long"},
+		{"field":"meta.role","message":"may only be set by an admin"}]}`, body)
+
+	status, _ = signUp(t, ts, `{"name":"sam","password":"sam password"}`)
+	assert.Equal(t, http.StatusOK, status, "sign up is open")
+
+	sam := td.User{Name: "sam", Key: "sam password"}
+	res, body := doFile(t, &sam, http.MethodPut, ts.URL+"/user/", strings.NewReader(`{"name":"sam","password":"sam"}`), nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Contains(t, body, "must not be the name")
+
+	_ = state.Signup.SetMode(signup.ModeClosed)
+	status, body = signUp(t, ts, `{"name":"tom","password":"tom password"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"error":"sign up is closed"}`, body)
+}
+
+func TestUser_ServeAddUser_Invite(t *testing.T) {
+	state, ts := newSignupServer(t)
+	_ = state.Signup.SetMode(signup.ModeInvite)
+	root, _ := state.Users.User("root")
+
+	status, body := signUp(t, ts, `{"name":"tom","password":"tom password"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"error":"invite required"}`, body)
+
+	sam := td.User{Name: "sam", Key: "sam password"}
+	_ = state.Users.CreateUser(sam)
+	res, _ := doFile(t, &sam, http.MethodPost, ts.URL+"/admin/invites", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "only admins invite")
+
+	res, body = doFile(t, &root, http.MethodPost, ts.URL+"/admin/invites", strings.NewReader(`{"uses":2,"ttl":"1h"}`), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode, body)
+	var invite signup.Invite
+	assert.Nil(t, json.Unmarshal([]byte(body), &invite))
+	assert.Equal(t, "root", invite.Creator)
+	assert.Equal(t, 2, invite.MaxUses)
+
+	status, _ = signUp(t, ts, `{"name":"tom","password":"tom password","invite":"`+invite.Code+`"}`)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = signUp(t, ts, `{"name":"tom","password":"tom password","invite":"`+invite.Code+`"}`)
+	assert.Equal(t, http.StatusBadRequest, status, "tom exists")
+	status, _ = signUp(t, ts, `{"name":"ann","password":"ann password","invite":"`+invite.Code+`"}`)
+	assert.Equal(t, http.StatusOK, status, "the failed sign up gave its use back")
+	status, body = signUp(t, ts, `{"name":"bob","password":"bob password","invite":"`+invite.Code+`"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, `{"error":"invalid invite"}`, body)
+
+	res, body = doFile(t, &root, http.MethodGet, ts.URL+"/admin/invites", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, body, `"uses":2`)
+	res, _ = doFile(t, &root, http.MethodDelete, ts.URL+"/admin/invites/"+invite.Code, nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = doFile(t, &root, http.MethodDelete, ts.URL+"/admin/invites/"+invite.Code, nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestUser_ServeAddUser_Approval(t *testing.T) {
+	state, ts := newSignupServer(t)
+	_ = state.Signup.SetMode(signup.ModeApproval)
+	root, _ := state.Users.User("root")
+
+	status, body := signUp(t, ts, `{"name":"tom","password":"tom password"}`)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.JSONEq(t, `{"name":"tom","pending":true}`, body)
+	status, _ = signUp(t, ts, `{"name":"bob","password":"bob password"}`)
+	assert.Equal(t, http.StatusAccepted, status)
+
+	tom := td.User{Name: "tom", Key: "tom password"}
+	res, _ := doFile(t, &tom, http.MethodGet, ts.URL+"/user/", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "tom is not approved yet")
+
+	res, body = doFile(t, &root, http.MethodGet, ts.URL+"/admin/pending", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `[{"name":"bob"},{"name":"tom"}]`, body)
+
+	res, _ = doFile(t, &root, http.MethodPost, ts.URL+"/admin/pending/tom", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = doFile(t, &tom, http.MethodGet, ts.URL+"/user/", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res, _ = doFile(t, &root, http.MethodPost, ts.URL+"/admin/pending/tom", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "tom is no longer pending")
+
+	res, _ = doFile(t, &root, http.MethodDelete, ts.URL+"/admin/pending/bob", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, ok := state.Users.User("bob")
+	assert.False(t, ok, "a rejected user is deleted")
+}
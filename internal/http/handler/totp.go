@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/huangjiahua/tempdesk/internal/audit"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/totp"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	ErrorNoTOTP        = "totp is not enabled"
+	ErrorNotEnrolled   = "totp not enrolled"
+	ErrorTOTPEnabled   = "totp already enabled"
+	ErrorWrongCode     = "wrong code"
+	ErrorCodeMissing   = "code is required"
+	ErrorEnrollingTOTP = "error enrolling totp"
+	ErrorChangingTOTP  = "error changing totp"
+)
+
+// TOTP lets a user manage their second factor:
+//
+//	GET    {prefix}/          whether it is enabled and the recovery codes left
+//	POST   {prefix}/enroll    a new secret and its otpauth:// URI for a QR code
+//	POST   {prefix}/confirm   enable it by a first code, {"code": "123456"},
+//	                          and get the recovery codes
+//	POST   {prefix}/recovery  new recovery codes, {"code": "123456"}
+//	DELETE {prefix}/          disable it, {"code": "123456"}
+//
+// Recovery codes are only shown once, the server keeps their hashes.
+type TOTP struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewTOTP(state *thttp.State, prefix string) *TOTP {
+	return &TOTP{state: state, prefix: prefix}
+}
+
+type totpRequest struct {
+	Code string `json:"code"`
+}
+
+type totpStatus struct {
+	Enabled      bool `json:"enabled"`
+	RecoveryLeft int  `json:"recovery_left"`
+}
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type totpRecovery struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (t *TOTP) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	if t.state.TOTP == nil {
+		http.Error(res, ErrorNoTOTP, http.StatusNotFound)
+		return
+	}
+	user, err := t.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	var r totpRequest
+	if req.Method == http.MethodPost || req.Method == http.MethodDelete {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Debug(ErrorParsingBody, tlog.Err(err))
+			http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+			return
+		}
+		if len(body) > 0 {
+			if err = json.Unmarshal(body, &r); err != nil {
+				log.Debug(ErrorParsingJson, tlog.Err(err))
+				http.Error(res, ErrorParsingJson, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	s := t.state.TOTP
+	switch p := strings.Trim(strings.TrimPrefix(req.URL.Path, t.prefix), "/"); {
+	case p == "" && req.Method == http.MethodGet:
+		writeJson(res, http.StatusOK, totpStatus{Enabled: s.Enabled(user.Name), RecoveryLeft: s.RecoveryLeft(user.Name)})
+	case p == "enroll" && req.Method == http.MethodPost:
+		secret, uri, err := s.Enroll(user.Name)
+		if err != nil {
+			t.fail(res, req, ErrorEnrollingTOTP, err)
+			return
+		}
+		log.Info("enroll totp", tlog.String("name", user.Name))
+		writeJson(res, http.StatusOK, totpEnrollment{Secret: secret, URI: uri})
+	case p == "confirm" && req.Method == http.MethodPost:
+		if r.Code == "" {
+			http.Error(res, ErrorCodeMissing, http.StatusBadRequest)
+			return
+		}
+		codes, err := s.Confirm(user.Name, r.Code)
+		if err != nil {
+			t.state.Record(req, user.Name, audit.ActionTOTPEnable, user.Name, audit.OutcomeFailure, err.Error())
+			t.fail(res, req, ErrorChangingTOTP, err)
+			return
+		}
+		log.Info("enable totp", tlog.String("name", user.Name))
+		t.state.Record(req, user.Name, audit.ActionTOTPEnable, user.Name, audit.OutcomeSuccess, "")
+		writeJson(res, http.StatusOK, totpRecovery{RecoveryCodes: codes})
+	case p == "recovery" && req.Method == http.MethodPost:
+		if r.Code == "" {
+			http.Error(res, ErrorCodeMissing, http.StatusBadRequest)
+			return
+		}
+		codes, err := s.RenewRecovery(user.Name, r.Code)
+		if err != nil {
+			t.fail(res, req, ErrorChangingTOTP, err)
+			return
+		}
+		log.Info("renew totp recovery codes", tlog.String("name", user.Name))
+		writeJson(res, http.StatusOK, totpRecovery{RecoveryCodes: codes})
+	case p == "" && req.Method == http.MethodDelete:
+		if r.Code == "" {
+			http.Error(res, ErrorCodeMissing, http.StatusBadRequest)
+			return
+		}
+		if err = s.Verify(user.Name, r.Code); err == nil {
+			err = s.Disable(user.Name)
+		}
+		if err != nil {
+			t.state.Record(req, user.Name, audit.ActionTOTPDisable, user.Name, audit.OutcomeFailure, err.Error())
+			t.fail(res, req, ErrorChangingTOTP, err)
+			return
+		}
+		log.Info("disable totp", tlog.String("name", user.Name))
+		t.state.Record(req, user.Name, audit.ActionTOTPDisable, user.Name, audit.OutcomeSuccess, "")
+		res.WriteHeader(http.StatusNoContent)
+	case p == "" || p == "enroll" || p == "confirm" || p == "recovery":
+		log.Debug("unsupported method", tlog.String("method", req.Method))
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+// fail answers a request whose change of the second factor failed with err.
+func (t *TOTP) fail(res http.ResponseWriter, req *http.Request, msg string, err error) {
+	switch {
+	case totp.IsKind(err, totp.NotEnrolled):
+		http.Error(res, ErrorNotEnrolled, http.StatusNotFound)
+	case totp.IsKind(err, totp.AlreadyEnabled):
+		http.Error(res, ErrorTOTPEnabled, http.StatusConflict)
+	case totp.IsKind(err, totp.WrongCode):
+		http.Error(res, ErrorWrongCode, http.StatusForbidden)
+	default:
+		tlog.Ctx(req.Context()).Error(msg, tlog.Err(err))
+		http.Error(res, msg, http.StatusInternalServerError)
+	}
+}
+
+// ServeTOTPReset removes the second factor of the user
+// {prefix}/totp/{name} on DELETE, for a user who lost it.
+func (a *Admin) ServeTOTPReset(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	if a.state.TOTP == nil {
+		http.Error(res, ErrorNoTOTP, http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodDelete {
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := adminOf(req)
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, a.prefix+"/totp"), "/")
+	if err := a.state.TOTP.Disable(name); err != nil {
+		if totp.IsKind(err, totp.NotEnrolled) {
+			http.Error(res, ErrorNotEnrolled, http.StatusNotFound)
+			return
+		}
+		log.Error(ErrorChangingTOTP, tlog.Err(err))
+		a.state.Record(req, admin.Name, audit.ActionTOTPReset, name, audit.OutcomeFailure, err.Error())
+		http.Error(res, ErrorChangingTOTP, http.StatusInternalServerError)
+		return
+	}
+	log.Info("reset totp",
+		tlog.String("exe", admin.Name),
+		tlog.String("target", name))
+	a.state.Record(req, admin.Name, audit.ActionTOTPReset, name, audit.OutcomeSuccess, "")
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// forgetTOTP removes the second factor of a deleted user, so a new user of
+// the name does not inherit it.
+func forgetTOTP(state *thttp.State, req *http.Request, name string) {
+	if state.TOTP == nil {
+		return
+	}
+	if err := state.TOTP.Disable(name); err != nil && !totp.IsKind(err, totp.NotEnrolled) {
+		tlog.Ctx(req.Context()).Error(ErrorChangingTOTP, tlog.Err(err), tlog.String("name", name))
+	}
+}
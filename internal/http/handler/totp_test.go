@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/internal/session"
+	"github.com/huangjiahua/tempdesk/internal/totp"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTOTPServer(t *testing.T) (*thttp.State, *httptest.Server, *time.Time) {
+	totps, _ := totp.NewService(mock.NewStorage())
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	totps.Now = func() time.Time { return now }
+	guard := totp.NewGuard(totps, []string{totp.ScopeHMAC})
+	sessions := session.NewStore(session.DefaultTTL)
+	state, ts := newServer(t, &thttp.State{
+		Auther:   auth.Chain{guard.Auther(auth.NewHMACAuther(), totp.ScopeHMAC), sessions.Auther()},
+		Login:    guard.Auther(auth.NewPasswordAuther(), totp.ScopePassword),
+		TOTP:     totps,
+		Sessions: sessions,
+	}, []string{"/admin/", "/user/", "/session/", "/totp/"}, rootUser)
+	return state, ts, &now
+}
+
+func basic(name, key string) string {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(name, key)
+	return req.Header.Get("Authorization")
+}
+
+func TestSession(t *testing.T) {
+	_, ts, _ := newTOTPServer(t)
+
+	res, _ := doPlain(t, http.MethodPost, ts.URL+"/session/", nil, map[string]string{"Authorization": basic("root", "wrong")})
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, body := doPlain(t, http.MethodPost, ts.URL+"/session/", nil, map[string]string{"Authorization": basic("root", "root key")})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var login struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(body), &login))
+	assert.Equal(t, "root", login.Name)
+	if assert.Len(t, res.Cookies(), 1) {
+		c := res.Cookies()[0]
+		assert.Equal(t, session.CookieName, c.Name)
+		assert.Equal(t, login.Token, c.Value)
+		assert.True(t, c.HttpOnly)
+	}
+
+	auth := map[string]string{"Authorization": "Session " + login.Token}
+	res, body = doPlain(t, http.MethodGet, ts.URL+"/user/", nil, auth)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "the session authenticates")
+	assert.Contains(t, body, `"root"`)
+	res, _ = doPlain(t, http.MethodGet, ts.URL+"/session/", nil, auth)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, _ = doPlain(t, http.MethodDelete, ts.URL+"/session/", nil, auth)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = doPlain(t, http.MethodGet, ts.URL+"/user/", nil, auth)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "logged out")
+}
+
+func TestTOTP(t *testing.T) {
+	state, ts, now := newTOTPServer(t)
+	sam := td.User{Name: "sam", Key: "sam key"}
+	_ = state.Users.CreateUser(sam)
+	root, _ := state.Users.User("root")
+
+	res, body := doFile(t, &sam, http.MethodGet, ts.URL+"/totp/", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `{"enabled":false,"recovery_left":0}`, body)
+
+	res, body = doFile(t, &sam, http.MethodPost, ts.URL+"/totp/enroll", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var enrollment totpEnrollment
+	assert.Nil(t, json.Unmarshal([]byte(body), &enrollment))
+	assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/TempDesk:sam?"))
+
+	res, _ = doFile(t, &sam, http.MethodPost, ts.URL+"/totp/confirm", strings.NewReader(`{"code":"000000"}`), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	code, _ := totp.Code(enrollment.Secret, *now)
+	res, body = doFile(t, &sam, http.MethodPost, ts.URL+"/totp/confirm", strings.NewReader(`{"code":"`+code+`"}`), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var recovery totpRecovery
+	assert.Nil(t, json.Unmarshal([]byte(body), &recovery))
+	assert.Len(t, recovery.RecoveryCodes, totp.RecoveryCodes)
+
+	login := map[string]string{"Authorization": basic("sam", "sam key")}
+	res, body = doPlain(t, http.MethodPost, ts.URL+"/session/", nil, login)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.JSONEq(t, `{"error":"second factor required"}`, body)
+
+	*now = now.Add(totp.Period)
+	code, _ = totp.Code(enrollment.Secret, *now)
+	login[totp.HeaderCode] = code
+	res, _ = doPlain(t, http.MethodPost, ts.URL+"/session/", nil, login)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res, _ = doPlain(t, http.MethodPost, ts.URL+"/session/", nil, login)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "a code logs in once")
+	login[totp.HeaderCode] = recovery.RecoveryCodes[0]
+	res, _ = doPlain(t, http.MethodPost, ts.URL+"/session/", nil, login)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "a recovery code logs in")
+
+	res, _ = doFile(t, &sam, http.MethodGet, ts.URL+"/user/", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "signed requests skip the code")
+
+	res, _ = doFile(t, &sam, http.MethodDelete, ts.URL+"/admin/totp/sam", nil, nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res, _ = doFile(t, &root, http.MethodDelete, ts.URL+"/admin/totp/sam", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = doFile(t, &root, http.MethodDelete, ts.URL+"/admin/totp/sam", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	delete(login, totp.HeaderCode)
+	res, _ = doPlain(t, http.MethodPost, ts.URL+"/session/", nil, login)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "the admin reset the second factor")
+}
@@ -2,9 +2,12 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/audit"
 	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/signup"
 	tlog "github.com/huangjiahua/tempdesk/pkg/log"
 	"io"
 	"io/ioutil"
@@ -22,6 +25,9 @@ const (
 	ErrorCreatingUser   = "error creating user"
 	ErrorUpdatingUser   = "error updating user"
 	ErrorDeletingUser   = "error deleting user"
+	ErrorInvalidEmail   = "invalid email address"
+	ErrorNotSelf        = "only an admin may change other users"
+	ErrorReservedMeta   = "only an admin may change meta"
 
 	ActionUpdate = "update"
 	ActionDelete = "delete"
@@ -31,10 +37,15 @@ type User struct {
 	state *thttp.State
 }
 
+func NewUser(state *thttp.State) *User {
+	return &User{state: state}
+}
+
 func (u *User) ServeGetUser(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
 	user, err := u.state.AuthUser(req)
 	if err != nil {
-		tlog.Debug(ErrorAuthenticating, tlog.Err(err))
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
 		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
 		return
 	}
@@ -42,43 +53,49 @@ func (u *User) ServeGetUser(res http.ResponseWriter, req *http.Request) {
 	ret := map[string]string{"name": user.Name}
 	body, err := json.Marshal(ret)
 	if err != nil {
-		tlog.Info(ErrorEncodingJson, tlog.Err(err))
+		log.Info(ErrorEncodingJson, tlog.Err(err))
 		http.Error(res, ErrorInternalServer, http.StatusInternalServerError)
 		return
 	}
 	r := bytes.NewReader(body)
 	_, err = io.Copy(res, r)
 	if err != nil {
-		tlog.Warn(ErrorWritingResp, tlog.Err(err))
+		log.Warn(ErrorWritingResp, tlog.Err(err))
 	}
 }
 
 func (u *User) ServeAddUser(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		tlog.Debug(ErrorParsingBody, tlog.Err(err))
+		log.Debug(ErrorParsingBody, tlog.Err(err))
 		http.Error(res, ErrorParsingBody, http.StatusBadRequest)
 		return
 	}
 	if err = req.Body.Close(); err != nil {
-		tlog.Debug(ErrorCloseReader, tlog.Err(err))
+		log.Debug(ErrorCloseReader, tlog.Err(err))
 	}
 
 	info, err := parseUserSignUpInfo(body)
 	if err != nil {
-		tlog.Debug(ErrorParsingJson, tlog.Err(err))
+		log.Debug(ErrorParsingJson, tlog.Err(err))
 		http.Error(res, ErrorParsingJson, http.StatusBadRequest)
 		return
 	}
-	user := td.User{
-		Name: info.Name,
-		Key:  info.Key,
-		Meta: info.Meta,
+	user, invite, ok := u.admit(res, req, info)
+	if !ok {
+		return
 	}
 
 	err = u.state.Users.CreateUser(user)
 	if err != nil {
-		tlog.Debug(ErrorCreatingUser, tlog.Err(err))
+		log.Debug(ErrorCreatingUser, tlog.Err(err))
+		if invite != "" {
+			if err := u.state.Signup.Release(invite); err != nil {
+				log.Error("error releasing invite", tlog.Err(err))
+			}
+		}
+		u.state.Record(req, user.Name, audit.ActionUserCreate, user.Name, audit.OutcomeFailure, err.Error())
 		switch err.(*td.UserServiceError).Kind {
 		case td.NameAlreadyExists:
 			http.Error(res, err.Error(), http.StatusBadRequest)
@@ -88,34 +105,57 @@ func (u *User) ServeAddUser(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	tlog.Info("add new user",
+	log.Info("add new user",
 		tlog.String("name", user.Name))
+	if u.state.Account != nil && user.Email() != "" {
+		sendMail(req, "verify", func(ctx context.Context) error {
+			return u.state.Account.SendVerify(ctx, user)
+		})
+	}
+	detail := ""
+	if user.IsPending() {
+		detail = "pending approval"
+	}
+	u.state.Record(req, user.Name, audit.ActionUserCreate, user.Name, audit.OutcomeSuccess, detail)
 
+	if user.IsPending() {
+		writeJson(res, http.StatusAccepted, map[string]interface{}{"name": user.Name, "pending": true})
+		return
+	}
 	res.WriteHeader(http.StatusOK)
 }
 
 func (u *User) ServeUpdateUser(res http.ResponseWriter, req *http.Request, action string) {
+	log := tlog.Ctx(req.Context())
 	user, err := u.state.AuthUser(req)
 	if err != nil {
-		tlog.Debug(ErrorAuthenticating, tlog.Err(err))
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
 		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
 		return
 	}
 
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		tlog.Debug(ErrorParsingBody, tlog.Err(err))
+		log.Debug(ErrorParsingBody, tlog.Err(err))
 		http.Error(res, ErrorParsingBody, http.StatusBadRequest)
 		return
 	}
 
 	info, err := parseUpdateInfo(body)
 	if err != nil {
-		tlog.Debug(ErrorParsingJson, tlog.Err(err))
+		log.Debug(ErrorParsingJson, tlog.Err(err))
 		http.Error(res, ErrorParsingJson, http.StatusBadRequest)
 		return
 	}
 
+	// users change themselves, admins anyone
+	if info.Name != user.Name && !user.IsAdmin() {
+		log.Debug(ErrorNotSelf, tlog.String("exe", user.Name), tlog.String("target", info.Name))
+		u.state.Record(req, user.Name, auditAction(action), info.Name, audit.OutcomeFailure, ErrorNotSelf)
+		http.Error(res, ErrorNotSelf, http.StatusForbidden)
+		return
+	}
+
 	upd := td.User{
 		Name: info.Name,
 		Key:  info.Key,
@@ -123,35 +163,64 @@ func (u *User) ServeUpdateUser(res http.ResponseWriter, req *http.Request, actio
 	}
 
 	if action == ActionUpdate {
+		if !checkKey(u.state, res, upd.Name, upd.Key) {
+			return
+		}
+		if !user.IsAdmin() {
+			if key, ok := keepReserved(u.state, &upd); !ok {
+				log.Debug(ErrorReservedMeta, tlog.String("exe", user.Name), tlog.String("key", key))
+				u.state.Record(req, user.Name, audit.ActionUserUpdate, info.Name, audit.OutcomeFailure, ErrorReservedMeta+" "+key)
+				http.Error(res, ErrorReservedMeta+" "+key, http.StatusForbidden)
+				return
+			}
+		}
+		if upd.Email() != "" && !signup.ValidEmail(upd.Email()) {
+			http.Error(res, ErrorInvalidEmail, http.StatusBadRequest)
+			return
+		}
+		verify := keepVerified(u.state, &upd)
 		err = u.state.Users.UpdateUser(upd)
 		if err != nil {
-			tlog.Debug(ErrorUpdatingUser, tlog.Err(err))
+			log.Debug(ErrorUpdatingUser, tlog.Err(err))
+			u.state.Record(req, user.Name, audit.ActionUserUpdate, info.Name, audit.OutcomeFailure, err.Error())
 			http.Error(res, ErrorUpdatingUser, http.StatusBadRequest)
 			return
 		}
-		tlog.Info("update user request",
+		log.Info("update user request",
 			tlog.String("exe", user.Name),
 			tlog.String("target", info.Name))
+		u.state.Record(req, user.Name, audit.ActionUserUpdate, info.Name, audit.OutcomeSuccess, "")
+		if verify && u.state.Account != nil {
+			sendMail(req, "verify", func(ctx context.Context) error {
+				return u.state.Account.SendVerify(ctx, upd)
+			})
+		}
 	} else {
 		// delete
 		err = u.state.Users.DeleteUser(upd)
 		if err != nil {
-			tlog.Debug(ErrorDeletingUser, tlog.Err(err))
+			log.Debug(ErrorDeletingUser, tlog.Err(err))
+			u.state.Record(req, user.Name, audit.ActionUserDelete, info.Name, audit.OutcomeFailure, err.Error())
 			http.Error(res, ErrorDeletingUser, http.StatusBadRequest)
 			return
 		}
-		tlog.Info("delete user request",
+		forgetTOTP(u.state, req, info.Name)
+		forgetMember(u.state, req, info.Name)
+		forgetUserGrants(u.state, req, info.Name)
+		log.Info("delete user request",
 			tlog.String("exe", user.Name),
 			tlog.String("target", info.Name))
+		u.state.Record(req, user.Name, audit.ActionUserDelete, info.Name, audit.OutcomeSuccess, "")
 	}
 
 	res.WriteHeader(http.StatusOK)
 }
 
 func (u *User) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
 	err := req.ParseForm()
 	if err != nil {
-		tlog.Debug("error parsing url", tlog.Err(err))
+		log.Debug("error parsing url", tlog.Err(err))
 		http.Error(res, "Error parsing url arguments or form", http.StatusBadRequest)
 		return
 	}
@@ -166,15 +235,46 @@ func (u *User) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	case http.MethodDelete:
 		u.ServeUpdateUser(res, req, ActionDelete)
 	default:
-		tlog.Debug("unsupported method", tlog.String("method", req.Method))
+		log.Debug("unsupported method", tlog.String("method", req.Method))
 		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
 	}
 }
 
+// keepReserved carries the reserved meta of the stored user over to upd,
+// which a user updating themself cannot change. It returns a key upd
+// changes and false if there is one.
+func keepReserved(state *thttp.State, upd *td.User) (string, bool) {
+	old, _ := state.Users.User(upd.Name)
+	meta := make(map[string]string, len(upd.Meta))
+	for k, v := range upd.Meta {
+		if signup.Reserved(k) && v != old.Meta[k] {
+			return k, false
+		}
+		meta[k] = v
+	}
+	for k, v := range old.Meta {
+		if _, ok := meta[k]; !ok && signup.Reserved(k) {
+			meta[k] = v
+		}
+	}
+	upd.Meta = meta
+	return "", true
+}
+
+// auditAction is the audit action of an update or delete request.
+func auditAction(action string) string {
+	if action == ActionUpdate {
+		return audit.ActionUserUpdate
+	}
+	return audit.ActionUserDelete
+}
+
 type userSignUpInfo struct {
 	Name string            `json:"name"`
 	Key  string            `json:"password"`
 	Meta map[string]string `json:"meta,omitempty"`
+	// Invite is the invite code needed to sign up in the invite mode.
+	Invite string `json:"invite,omitempty"`
 }
 
 func parseUserSignUpInfo(data []byte) (userSignUpInfo, error) {
@@ -257,3 +257,68 @@ func TestUser_ServeHTTP_Delete(t *testing.T) {
 
 	assert.Equal(t, http.StatusForbidden, res.StatusCode, "wrong response status")
 }
+
+func TestUser_ServeHTTP_Others(t *testing.T) {
+	h := &User{
+		state: &thttp.State{
+			Users:  mock.NewUserService(),
+			Files:  mock.NewFileService(),
+			Auther: auth.NewHMACAuther(),
+		},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	sam := td.User{Name: "sam", Key: "sam key"}
+	boss := td.User{Name: "boss", Key: "boss key", Meta: map[string]string{td.MetaRole: td.RoleAdmin}}
+	_ = h.state.Users.CreateUser(sam)
+	_ = h.state.Users.CreateUser(boss)
+
+	res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/", bytes.NewReader([]byte(`{"name":"boss","password":"taken over"}`)), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res, _ = doFile(t, &sam, http.MethodDelete, ts.URL+"/", bytes.NewReader([]byte(`{"name":"boss"}`)), nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	u, _ := h.state.Users.User("boss")
+	assert.Equal(t, "boss key", u.Key)
+
+	res, _ = doFile(t, &boss, http.MethodPut, ts.URL+"/", bytes.NewReader([]byte(`{"name":"sam","password":"new sam key"}`)), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "admins change anyone")
+	u, _ = h.state.Users.User("sam")
+	assert.Equal(t, "new sam key", u.Key)
+}
+
+func TestUser_ServeHTTP_ReservedMeta(t *testing.T) {
+	h := &User{
+		state: &thttp.State{
+			Users:  mock.NewUserService(),
+			Files:  mock.NewFileService(),
+			Auther: auth.NewHMACAuther(),
+		},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	sam := td.User{Name: "sam", Key: "sam key", Meta: map[string]string{td.MetaQuota: "100"}}
+	boss := td.User{Name: "boss", Key: "boss key", Meta: map[string]string{td.MetaRole: td.RoleAdmin}}
+	_ = h.state.Users.CreateUser(sam)
+	_ = h.state.Users.CreateUser(boss)
+
+	for _, body := range []string{
+		`{"name":"sam","password":"sam key","meta":{"role":"admin"}}`,
+		`{"name":"sam","password":"sam key","meta":{"quota":"0"}}`,
+		`{"name":"sam","password":"sam key","meta":{"cert_sha256":"ab12"}}`,
+	} {
+		res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/", bytes.NewReader([]byte(body)), nil)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode, body)
+	}
+	u, _ := h.state.Users.User("sam")
+	assert.False(t, u.IsAdmin())
+
+	res, _ := doFile(t, &sam, http.MethodPut, ts.URL+"/", bytes.NewReader([]byte(`{"name":"sam","password":"sam key 2","meta":{"nick":"s"}}`)), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	u, _ = h.state.Users.User("sam")
+	assert.Equal(t, map[string]string{"nick": "s", td.MetaQuota: "100"}, u.Meta, "reserved meta is kept")
+
+	res, _ = doFile(t, &boss, http.MethodPut, ts.URL+"/", bytes.NewReader([]byte(`{"name":"sam","password":"sam key 2","meta":{"quota":"5"}}`)), nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	u, _ = h.state.Users.User("sam")
+	assert.Equal(t, "5", u.Meta[td.MetaQuota])
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/event"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/http/websocket"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	ErrorWatching = "error watching"
+	ErrorNoEvents = "events are not enabled"
+
+	// WatchHeartbeat is how often an idle watch connection is kept alive.
+	WatchHeartbeat = 30 * time.Second
+)
+
+// Watch streams the file events below a path prefix to a subscriber, as
+// Server-Sent Events or, for an upgrade request, over a WebSocket. Only the
+// events of files the subscriber may access are sent.
+type Watch struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewWatch(state *thttp.State, prefix string) *Watch {
+	return &Watch{state: state, prefix: prefix}
+}
+
+func (w *Watch) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	if req.Method != http.MethodGet {
+		log.Debug("unsupported method", tlog.String("method", req.Method))
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := w.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+
+	if w.state.Events == nil {
+		http.Error(res, ErrorNoEvents, http.StatusNotFound)
+		return
+	}
+
+	prefix := path.Clean("/" + strings.TrimPrefix(req.URL.Path, w.prefix))
+	if websocket.IsUpgrade(req) {
+		w.serveWebSocket(res, req, user, prefix)
+	} else {
+		w.serveSSE(res, req, user, prefix)
+	}
+}
+
+func (w *Watch) subscribe(user td.User, prefix string) *event.Subscription {
+	return w.state.Events.Subscribe(prefix, func(e event.Event) bool {
+		return e.Visible(user)
+	})
+}
+
+func (w *Watch) serveSSE(res http.ResponseWriter, req *http.Request, user td.User, prefix string) {
+	log := tlog.Ctx(req.Context())
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		http.Error(res, ErrorInternalServer, http.StatusInternalServerError)
+		return
+	}
+
+	sub := w.subscribe(user, prefix)
+	defer sub.Close()
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	log.Debug("watch started",
+		tlog.String("user", user.Name),
+		tlog.String("prefix", prefix),
+		tlog.String("transport", "sse"))
+
+	heartbeat := time.NewTicker(WatchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(res, ": heartbeat\n\n")
+		case e := <-sub.C:
+			var data []byte
+			data, err = json.Marshal(e)
+			if err == nil {
+				_, err = fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Op, data)
+			}
+		}
+		if err != nil {
+			log.Debug(ErrorWatching, tlog.Err(err))
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (w *Watch) serveWebSocket(res http.ResponseWriter, req *http.Request, user td.User, prefix string) {
+	log := tlog.Ctx(req.Context())
+	sub := w.subscribe(user, prefix)
+	defer sub.Close()
+
+	conn, err := websocket.Upgrade(res, req)
+	if err != nil {
+		log.Debug(ErrorWatching, tlog.Err(err))
+		switch err {
+		case websocket.ErrNotUpgrade:
+			http.Error(res, err.Error(), http.StatusBadRequest)
+		case websocket.ErrBadVersion:
+			res.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(res, err.Error(), http.StatusUpgradeRequired)
+		}
+		return
+	}
+	defer conn.Close()
+
+	log.Debug("watch started",
+		tlog.String("user", user.Name),
+		tlog.String("prefix", prefix),
+		tlog.String("transport", "websocket"))
+
+	// the client is not expected to send anything, reading only serves to
+	// answer pings and notice when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(WatchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-heartbeat.C:
+			err = conn.WriteMessage(websocket.OpPing, nil)
+		case e := <-sub.C:
+			err = conn.WriteJSON(e)
+		}
+		if err != nil {
+			log.Debug(ErrorWatching, tlog.Err(err))
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/event"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/http/websocket"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newWatchServer(t *testing.T) (*thttp.State, *httptest.Server) {
+	bus := event.NewBus()
+	return newServer(t, &thttp.State{
+		Files:  event.NewFileService(mock.NewFileService(), bus),
+		Events: bus,
+	}, []string{"/file/", "/watch/"}, td.User{Name: "sam", Key: "key"}, td.User{Name: "tom", Key: "key"})
+}
+
+// produceEvents makes sam put a private file and then share a file in /docs
+// with tom, so the first event tom may see is the permission change.
+func produceEvents(t *testing.T, state *thttp.State, url string) {
+	sam := td.User{Name: "sam", Key: "key"}
+	doFile(t, &sam, http.MethodPut, url+"/file/docs/private.txt", strings.NewReader("secret"), nil)
+	doFile(t, &sam, http.MethodPut, url+"/file/other/shared.txt", strings.NewReader("hello"), nil)
+	doFile(t, &sam, http.MethodPut, url+"/file/docs/shared.txt", strings.NewReader("hello"), nil)
+
+	f, err := state.Files.Open("/docs/shared.txt", os.O_RDONLY, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Perm().AllowUser("tom")
+	_ = f.Close()
+}
+
+func TestWatch_ServeHTTP_SSE(t *testing.T) {
+	state, ts := newWatchServer(t)
+	tom := td.User{Name: "tom", Key: "key"}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/watch/docs", nil)
+	setupHMAC(req, &tom)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	produceEvents(t, state, ts.URL)
+
+	r := bufio.NewReader(res.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	assert.True(t, strings.HasPrefix(lines[0], "id: "), lines[0])
+	assert.Equal(t, "event: perm", lines[1])
+
+	var e event.Event
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e))
+	assert.Equal(t, "/docs/shared.txt", e.Path)
+}
+
+func TestWatch_ServeHTTP_WebSocket(t *testing.T) {
+	state, ts := newWatchServer(t)
+	tom := td.User{Name: "tom", Key: "key"}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/watch/docs/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	setupHMAC(req, &tom)
+	if err = req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+
+	produceEvents(t, state, ts.URL)
+
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, byte(0x80|websocket.OpText), header[0])
+	n := int(header[1])
+	if n == 126 {
+		var ext [2]byte
+		_, _ = io.ReadFull(r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	var e event.Event
+	assert.NoError(t, json.Unmarshal(payload, &e))
+	assert.Equal(t, event.OpPerm, e.Op)
+	assert.Equal(t, "/docs/shared.txt", e.Path)
+
+	// a masked close frame ends the watch
+	_, _ = conn.Write([]byte{0x80 | websocket.OpClose, 0x80, 0, 0, 0, 0})
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, byte(0x80|websocket.OpClose), header[0])
+}
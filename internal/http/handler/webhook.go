@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/webhook"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	ErrorRegisteringHook = "error registering webhook"
+	ErrorRemovingHook    = "error removing webhook"
+	ErrorReadingHook     = "error reading webhook"
+	ErrorNoWebhooks      = "webhooks are not enabled"
+)
+
+// Webhook manages the webhooks of the authenticated user:
+//
+//	GET    {prefix}/                 list webhooks
+//	POST   {prefix}/                 register a webhook
+//	GET    {prefix}/{id}             show a webhook
+//	DELETE {prefix}/{id}             remove a webhook
+//	GET    {prefix}/{id}/deliveries  show the delivery log
+type Webhook struct {
+	state  *thttp.State
+	prefix string
+}
+
+func NewWebhook(state *thttp.State, prefix string) *Webhook {
+	return &Webhook{state: state, prefix: prefix}
+}
+
+func (w *Webhook) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log := tlog.Ctx(req.Context())
+	user, err := w.state.AuthUser(req)
+	if err != nil {
+		log.Debug(ErrorAuthenticating, tlog.Err(err))
+		http.Error(res, ErrorAuthenticating, http.StatusForbidden)
+		return
+	}
+	if w.state.Webhooks == nil {
+		http.Error(res, ErrorNoWebhooks, http.StatusNotFound)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, w.prefix), "/"), "/")
+	id := parts[0]
+	switch {
+	case id == "" && req.Method == http.MethodGet:
+		writeJson(res, http.StatusOK, w.state.Webhooks.Hooks(user.Name))
+	case id == "" && req.Method == http.MethodPost:
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Debug(ErrorParsingBody, tlog.Err(err))
+			http.Error(res, ErrorParsingBody, http.StatusBadRequest)
+			return
+		}
+		var hook webhook.Webhook
+		if err = json.Unmarshal(body, &hook); err != nil {
+			log.Debug(ErrorParsingJson, tlog.Err(err))
+			http.Error(res, ErrorParsingJson, http.StatusBadRequest)
+			return
+		}
+		hook, err = w.state.Webhooks.Register(user, hook)
+		if err != nil {
+			log.Debug(ErrorRegisteringHook, tlog.Err(err))
+			writeWebhookError(res, err, ErrorRegisteringHook)
+			return
+		}
+		log.Info("register webhook",
+			tlog.String("user", user.Name),
+			tlog.String("id", hook.ID),
+			tlog.String("url", hook.URL))
+		writeJson(res, http.StatusCreated, hook)
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		hook, err := w.state.Webhooks.Hook(user.Name, id)
+		if err != nil {
+			writeWebhookError(res, err, ErrorReadingHook)
+			return
+		}
+		writeJson(res, http.StatusOK, hook)
+	case len(parts) == 1 && req.Method == http.MethodDelete:
+		if err := w.state.Webhooks.Remove(user.Name, id); err != nil {
+			log.Debug(ErrorRemovingHook, tlog.Err(err))
+			writeWebhookError(res, err, ErrorRemovingHook)
+			return
+		}
+		log.Info("remove webhook",
+			tlog.String("user", user.Name),
+			tlog.String("id", id))
+		res.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "deliveries" && req.Method == http.MethodGet:
+		deliveries, err := w.state.Webhooks.Deliveries(user.Name, id)
+		if err != nil {
+			writeWebhookError(res, err, ErrorReadingHook)
+			return
+		}
+		writeJson(res, http.StatusOK, deliveries)
+	default:
+		log.Debug("unsupported method", tlog.String("method", req.Method))
+		http.Error(res, "method not supported", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeWebhookError(res http.ResponseWriter, err error, msg string) {
+	e, ok := err.(*webhook.WebhookError)
+	if !ok {
+		http.Error(res, msg, http.StatusInternalServerError)
+		return
+	}
+	switch e.Kind {
+	case webhook.HookNotExist:
+		http.Error(res, e.Error(), http.StatusNotFound)
+	default:
+		http.Error(res, e.Error(), http.StatusBadRequest)
+	}
+}
@@ -2,16 +2,97 @@ package http
 
 import (
 	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/account"
+	"github.com/huangjiahua/tempdesk/internal/audit"
 	"github.com/huangjiahua/tempdesk/internal/auth"
+	"github.com/huangjiahua/tempdesk/internal/event"
+	"github.com/huangjiahua/tempdesk/internal/session"
+	"github.com/huangjiahua/tempdesk/internal/share"
+	"github.com/huangjiahua/tempdesk/internal/signup"
+	"github.com/huangjiahua/tempdesk/internal/totp"
+	"github.com/huangjiahua/tempdesk/internal/webhook"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"net"
 	"net/http"
+	"sync"
 )
 
 type State struct {
 	Users  td.UserService
+	Groups td.GroupService
 	Files  td.FileService
 	Auther auth.UserAuther
+	Events *event.Bus
+	Store  storage.PutterGetter
+
+	Webhooks *webhook.Service
+	Shares   *share.Service
+	Audit    *audit.Log
+	// Signup controls who may sign up, anyone may if it is nil.
+	Signup *signup.Service
+	// Account mails users to verify their addresses and reset their keys,
+	// nothing is mailed if it is nil.
+	Account *account.Service
+	// TOTP keeps the second factors of users, none may enroll if it is nil.
+	TOTP *totp.Service
+	// Sessions keeps the sessions of users who logged in with Login,
+	// nobody may log in if it or Login is nil.
+	Sessions *session.Store
+	Login    auth.UserAuther
+	// Sweeps counts the walks over every file that run in the background
+	// after a user or a group is deleted, so they can be waited for.
+	Sweeps sync.WaitGroup
 }
 
 func (s *State) AuthUser(req *http.Request) (td.User, error) {
-	return s.Auther.AuthUser(req, s.Users)
+	return s.authWith(req, s.Auther)
+}
+
+// LogIn authenticates a request to start a session by Login.
+func (s *State) LogIn(req *http.Request) (td.User, error) {
+	return s.authWith(req, s.Login)
+}
+
+func (s *State) authWith(req *http.Request, a auth.UserAuther) (td.User, error) {
+	user, err := a.AuthUser(req, s.Users)
+	if err != nil {
+		kind := err.Error()
+		if e, ok := err.(*auth.AutherError); ok {
+			kind = e.Kind
+		}
+		s.Record(req, auth.ClaimedUser(req), audit.ActionAuthFail, req.URL.Path, audit.OutcomeFailure, kind)
+		return user, err
+	}
+	tlog.SetUser(req.Context(), user.Name)
+	return user, nil
+}
+
+// Record appends an audit record about req, if auditing is enabled.
+func (s *State) Record(req *http.Request, actor, action, target, outcome, detail string) {
+	if s.Audit == nil {
+		return
+	}
+	_, err := s.Audit.Append(audit.Record{
+		Actor:    actor,
+		Action:   action,
+		Target:   target,
+		Outcome:  outcome,
+		ClientIP: ClientIP(req),
+		Detail:   detail,
+	})
+	if err != nil {
+		tlog.Ctx(req.Context()).Error("error writing audit record",
+			tlog.String("action", action),
+			tlog.Err(err))
+	}
+}
+
+// ClientIP returns the address of the peer of req without its port.
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
 }
@@ -0,0 +1,229 @@
+// Package websocket implements the server side of RFC 6455, as much as is
+// needed to push messages to a client and to answer its control frames.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	OpContinuation byte = 0x0
+	OpText         byte = 0x1
+	OpBinary       byte = 0x2
+	OpClose        byte = 0x8
+	OpPing         byte = 0x9
+	OpPong         byte = 0xa
+)
+
+// MaxMessageSize bounds the size of a frame read from a client.
+const MaxMessageSize = 1 << 20
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	ErrNotUpgrade = errors.New("tempdesk.internal.http.websocket: not a websocket upgrade request")
+	ErrTooLarge   = errors.New("tempdesk.internal.http.websocket: frame too large")
+	ErrUnmasked   = errors.New("tempdesk.internal.http.websocket: client frame is not masked")
+	ErrBadVersion = errors.New("tempdesk.internal.http.websocket: unsupported websocket version")
+)
+
+// IsUpgrade reports whether req asks for a websocket connection.
+func IsUpgrade(req *http.Request) bool {
+	return headerContains(req.Header, "Connection", "upgrade") &&
+		headerContains(req.Header, "Upgrade", "websocket")
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for key.
+func AcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+type Conn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	wmu sync.Mutex
+}
+
+// Upgrade takes over the connection of req and completes the handshake. On
+// ErrNotUpgrade and ErrBadVersion no response has been written yet.
+func Upgrade(res http.ResponseWriter, req *http.Request) (*Conn, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !IsUpgrade(req) || req.Method != http.MethodGet || key == "" {
+		return nil, ErrNotUpgrade
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, ErrBadVersion
+	}
+
+	hj, ok := res.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("tempdesk.internal.http.websocket: connection cannot be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, rw: rw}, nil
+}
+
+func (c *Conn) WriteMessage(op byte, p []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var header [10]byte
+	header[0] = 0x80 | op
+	n := 2
+	switch {
+	case len(p) < 126:
+		header[1] = byte(len(p))
+	case len(p) <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(len(p)))
+		n = 4
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(p)))
+		n = 10
+	}
+
+	if _, err := c.rw.Write(header[:n]); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(p); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *Conn) WriteText(p []byte) error {
+	return c.WriteMessage(OpText, p)
+}
+
+func (c *Conn) WriteJSON(v interface{}) error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteText(p)
+}
+
+// ReadMessage returns the next data message. Pings are answered and a close
+// frame is echoed, after which io.EOF is returned.
+func (c *Conn) ReadMessage() (op byte, p []byte, err error) {
+	for {
+		fin, fop, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch fop {
+		case OpPing:
+			if err = c.WriteMessage(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			_ = c.WriteMessage(OpClose, payload)
+			return 0, nil, io.EOF
+		case OpContinuation:
+			p = append(p, payload...)
+		default:
+			op, p = fop, payload
+		}
+
+		if len(p) > MaxMessageSize {
+			return 0, nil, ErrTooLarge
+		}
+		if fin {
+			return op, p, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, op byte, p []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.rw, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	op = header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, ErrUnmasked
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > MaxMessageSize {
+		return false, 0, nil, ErrTooLarge
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return
+	}
+	p = make([]byte, length)
+	if _, err = io.ReadFull(c.rw, p); err != nil {
+		return
+	}
+	for i := range p {
+		p[i] ^= mask[i%4]
+	}
+	return
+}
+
+// Close sends a normal closure frame and closes the connection.
+func (c *Conn) Close() error {
+	_ = c.WriteMessage(OpClose, []byte{0x03, 0xe8})
+	return c.conn.Close()
+}
@@ -0,0 +1,93 @@
+package instrument
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"os"
+	"sync"
+)
+
+type FileService struct {
+	td.FileService
+	m       *Metrics
+	backend string
+}
+
+// FileService wraps fs to count the bytes moved and the files open for
+// writing. Its usage is reported when the backend is a td.UsageReporter.
+func (m *Metrics) FileService(fs td.FileService) *FileService {
+	inner := innermostFiles(fs)
+	name := BackendName(inner)
+	if r, ok := inner.(td.UsageReporter); ok {
+		m.mu.Lock()
+		m.backends[name] = r
+		m.mu.Unlock()
+	}
+	return &FileService{FileService: fs, m: m, backend: name}
+}
+
+// Unwrap returns the wrapped FileService.
+func (fs *FileService) Unwrap() td.FileService {
+	return fs.FileService
+}
+
+func (fs *FileService) Open(path string, flags int, perm td.FilePermission) (td.File, error) {
+	file, err := fs.FileService.Open(path, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	writing := flags&(os.O_WRONLY|os.O_RDWR) != 0
+	if writing {
+		fs.m.ActiveUploads.Inc(fs.backend)
+	}
+	return &File{File: file, fs: fs, writing: writing}, nil
+}
+
+type File struct {
+	td.File
+	fs *FileService
+
+	mu      sync.Mutex
+	writing bool
+}
+
+func (f *File) Read(p []byte) (n int, err error) {
+	n, err = f.File.Read(p)
+	f.fs.m.Downloaded.Add(float64(n), f.fs.backend)
+	return
+}
+
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = f.File.ReadAt(p, off)
+	f.fs.m.Downloaded.Add(float64(n), f.fs.backend)
+	return
+}
+
+func (f *File) Write(p []byte) (n int, err error) {
+	n, err = f.File.Write(p)
+	f.fs.m.Uploaded.Add(float64(n), f.fs.backend)
+	return
+}
+
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	n, err = f.File.WriteAt(p, off)
+	f.fs.m.Uploaded.Add(float64(n), f.fs.backend)
+	return
+}
+
+func (f *File) Truncate(pos int64, data []byte) (err error) {
+	err = f.File.Truncate(pos, data)
+	if err == nil {
+		f.fs.m.Uploaded.Add(float64(len(data)), f.fs.backend)
+	}
+	return
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	if f.writing {
+		f.writing = false
+		f.fs.m.ActiveUploads.Dec(f.fs.backend)
+	}
+	f.mu.Unlock()
+	return f.File.Close()
+}
@@ -0,0 +1,103 @@
+package instrument
+
+import (
+	"bufio"
+	"errors"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Auther struct {
+	auth.UserAuther
+	m *Metrics
+}
+
+// Auther wraps a to count failed authentications by AutherError kind.
+func (m *Metrics) Auther(a auth.UserAuther) *Auther {
+	return &Auther{UserAuther: a, m: m}
+}
+
+func (a *Auther) AuthUser(req *http.Request, us td.UserService) (td.User, error) {
+	user, err := a.UserAuther.AuthUser(req, us)
+	if err != nil {
+		kind := "unknown"
+		if e, ok := err.(*auth.AutherError); ok {
+			kind = e.Kind
+		}
+		a.m.AuthFailures.Inc(kind)
+	}
+	return user, err
+}
+
+// methods are the request methods counted apart, any other is counted as
+// "other" so clients cannot add label values.
+var methods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+	http.MethodOptions: true,
+}
+
+func method(req *http.Request) string {
+	if methods[req.Method] {
+		return req.Method
+	}
+	return "other"
+}
+
+// Route counts the requests served by next and observes their latency,
+// labelled with route.
+func (m *Metrics) Route(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		w := &statusWriter{ResponseWriter: res}
+		next.ServeHTTP(w, req)
+
+		status := w.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		code := strconv.Itoa(status)
+		m.Requests.Inc(route, method(req), code)
+		m.Latency.Observe(time.Since(start).Seconds(), route, code)
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("tempdesk.internal.instrument: response writer cannot be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,122 @@
+// Package instrument collects metrics about TempDesk by wrapping the
+// services of a State and the HTTP handlers, so every backend is measured
+// without knowing about it.
+package instrument
+
+import (
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/pkg/metrics"
+	"strings"
+	"sync"
+)
+
+type Metrics struct {
+	Registry *metrics.Registry
+
+	Requests      *metrics.CounterVec
+	Latency       *metrics.HistogramVec
+	Uploaded      *metrics.CounterVec
+	Downloaded    *metrics.CounterVec
+	ActiveUploads *metrics.GaugeVec
+	AuthFailures  *metrics.CounterVec
+	UserOps       *metrics.CounterVec
+
+	mu       sync.Mutex
+	backends map[string]td.UsageReporter
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: metrics.NewRegistry(),
+		Requests: metrics.NewCounterVec("tempdesk_http_requests_total",
+			"Number of HTTP requests.", "route", "method", "status"),
+		Latency: metrics.NewHistogramVec("tempdesk_http_request_duration_seconds",
+			"Latency of HTTP requests.", metrics.DefBuckets, "route", "status"),
+		Uploaded: metrics.NewCounterVec("tempdesk_file_uploaded_bytes_total",
+			"Bytes written to files.", "backend"),
+		Downloaded: metrics.NewCounterVec("tempdesk_file_downloaded_bytes_total",
+			"Bytes read from files.", "backend"),
+		ActiveUploads: metrics.NewGaugeVec("tempdesk_file_active_uploads",
+			"Files currently open for writing.", "backend"),
+		AuthFailures: metrics.NewCounterVec("tempdesk_auth_failures_total",
+			"Failed authentications by error kind.", "kind"),
+		UserOps: metrics.NewCounterVec("tempdesk_user_operations_total",
+			"Operations on the user service by result.", "backend", "op", "result"),
+		backends: make(map[string]td.UsageReporter),
+	}
+
+	for _, metric := range []metrics.Metric{
+		m.Requests, m.Latency, m.Uploaded, m.Downloaded, m.ActiveUploads, m.AuthFailures, m.UserOps,
+	} {
+		m.Registry.Register(metric)
+	}
+	m.Registry.Register(metrics.NewGaugeFunc("tempdesk_files",
+		"Number of stored files.", []string{"backend"}, m.usage(false)))
+	m.Registry.Register(metrics.NewGaugeFunc("tempdesk_storage_bytes",
+		"Bytes used by stored files.", []string{"backend"}, m.usage(true)))
+	return m
+}
+
+// State wraps the services of state, so their use is measured.
+func (m *Metrics) State(state *thttp.State) {
+	state.Files = m.FileService(state.Files)
+	state.Users = m.UserService(state.Users)
+	state.Auther = m.Auther(state.Auther)
+}
+
+func (m *Metrics) usage(bytes bool) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		var ret []metrics.Sample
+		for name, r := range m.backends {
+			files, size, err := r.Usage()
+			if err != nil {
+				continue
+			}
+			v := float64(files)
+			if bytes {
+				v = float64(size)
+			}
+			ret = append(ret, metrics.Sample{LabelValues: []string{name}, Value: v})
+		}
+		return ret
+	}
+}
+
+type fileUnwrapper interface {
+	Unwrap() td.FileService
+}
+
+type userUnwrapper interface {
+	Unwrap() td.UserService
+}
+
+// innermostFiles looks through wrappers like event.FileService for the
+// backend doing the work.
+func innermostFiles(fs td.FileService) td.FileService {
+	for {
+		u, ok := fs.(fileUnwrapper)
+		if !ok {
+			return fs
+		}
+		fs = u.Unwrap()
+	}
+}
+
+func innermostUsers(us td.UserService) td.UserService {
+	for {
+		u, ok := us.(userUnwrapper)
+		if !ok {
+			return us
+		}
+		us = u.Unwrap()
+	}
+}
+
+// BackendName names a backend by its type, like "mock.FileService".
+func BackendName(backend interface{}) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", backend), "*")
+}
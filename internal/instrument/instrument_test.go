@@ -0,0 +1,75 @@
+package instrument
+
+import (
+	"bytes"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"github.com/huangjiahua/tempdesk/internal/event"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMetrics_State(t *testing.T) {
+	m := NewMetrics()
+	state := &thttp.State{
+		Users:  event.NewUserService(mock.NewUserService(), event.NewBus()),
+		Files:  event.NewFileService(mock.NewFileService(), event.NewBus()),
+		Auther: auth.NewHMACAuther(),
+	}
+	m.State(state)
+
+	file, err := state.Files.Open("a.txt", os.O_CREATE|os.O_RDWR, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), m.ActiveUploads.Value("mock.FileService"))
+	_, _ = file.Write([]byte("hello"))
+	assert.Nil(t, file.Close())
+	assert.Nil(t, file.Close())
+	assert.Equal(t, float64(0), m.ActiveUploads.Value("mock.FileService"), "close should count once")
+
+	file, _ = state.Files.Open("a.txt", os.O_RDONLY, nil)
+	b, _ := ioutil.ReadAll(file)
+	_ = file.Close()
+	assert.Equal(t, "hello", string(b))
+	assert.Equal(t, float64(5), m.Uploaded.Value("mock.FileService"))
+	assert.Equal(t, float64(5), m.Downloaded.Value("mock.FileService"))
+
+	_ = state.Users.CreateUser(td.User{Name: "sam"})
+	_ = state.Users.CreateUser(td.User{Name: "sam"})
+	assert.Equal(t, float64(1), m.UserOps.Value("mock.UserService", "create", "ok"))
+	assert.Equal(t, float64(1), m.UserOps.Value("mock.UserService", "create", td.NameAlreadyExists))
+
+	_, err = state.AuthUser(httptest.NewRequest(http.MethodGet, "/file/a.txt", nil))
+	assert.NotNil(t, err)
+	assert.Equal(t, float64(1), m.AuthFailures.Value(auth.WrongFormat))
+
+	var buf bytes.Buffer
+	assert.Nil(t, m.Registry.Write(&buf))
+	assert.Contains(t, buf.String(), `tempdesk_files{backend="mock.FileService"} 1`)
+	assert.Contains(t, buf.String(), `tempdesk_storage_bytes{backend="mock.FileService"} 5`)
+}
+
+func TestMetrics_Route(t *testing.T) {
+	m := NewMetrics()
+	h := m.Route("file", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPut {
+			res.WriteHeader(http.StatusCreated)
+			return
+		}
+		_, _ = res.Write([]byte("ok"))
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/file/a", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/file/a", nil))
+	assert.Equal(t, float64(1), m.Requests.Value("file", http.MethodGet, "200"))
+	assert.Equal(t, float64(1), m.Requests.Value("file", http.MethodPut, "201"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("X-RANDOM-1", "/file/a", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("X-RANDOM-2", "/file/a", nil))
+	assert.Equal(t, float64(2), m.Requests.Value("file", "other", "200"), "unknown methods share a label")
+	assert.Equal(t, uint64(1), m.Latency.Count("file", "201"))
+}
@@ -0,0 +1,57 @@
+package instrument
+
+import td "github.com/huangjiahua/tempdesk"
+
+type UserService struct {
+	td.UserService
+	m       *Metrics
+	backend string
+}
+
+// UserService wraps us to count its operations by result.
+func (m *Metrics) UserService(us td.UserService) *UserService {
+	return &UserService{UserService: us, m: m, backend: BackendName(innermostUsers(us))}
+}
+
+// Unwrap returns the wrapped UserService.
+func (us *UserService) Unwrap() td.UserService {
+	return us.UserService
+}
+
+func (us *UserService) count(op string, err error) {
+	result := "ok"
+	if e, ok := err.(*td.UserServiceError); ok {
+		result = e.Kind
+	} else if err != nil {
+		result = "error"
+	}
+	us.m.UserOps.Inc(us.backend, op, result)
+}
+
+func (us *UserService) User(name string) (td.User, bool) {
+	user, ok := us.UserService.User(name)
+	result := "ok"
+	if !ok {
+		result = td.NameNotExists
+	}
+	us.m.UserOps.Inc(us.backend, "lookup", result)
+	return user, ok
+}
+
+func (us *UserService) CreateUser(user td.User) error {
+	err := us.UserService.CreateUser(user)
+	us.count("create", err)
+	return err
+}
+
+func (us *UserService) UpdateUser(user td.User) error {
+	err := us.UserService.UpdateUser(user)
+	us.count("update", err)
+	return err
+}
+
+func (us *UserService) DeleteUser(user td.User) error {
+	err := us.UserService.DeleteUser(user)
+	us.count("delete", err)
+	return err
+}
@@ -0,0 +1,174 @@
+// Package mail sends the emails of the server. A Transport delivers a
+// Message, SMTP being the one used in production, and Templates render the
+// messages from text templates.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds sending a message when the context has no deadline.
+const DefaultTimeout = 30 * time.Second
+
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	// Body is plain text.
+	Body string
+}
+
+// Bytes formats m as an RFC 5322 message dated now, with a quoted-printable
+// UTF-8 body.
+func (m Message) Bytes(now time.Time) ([]byte, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, fmt.Errorf("from %q: %v", m.From, err)
+	}
+	var to []string
+	for _, t := range m.To {
+		addr, err := mail.ParseAddress(t)
+		if err != nil {
+			return nil, fmt.Errorf("to %q: %v", t, err)
+		}
+		to = append(to, addr.String())
+	}
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+	header("From", from.String())
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", "<"+hex.EncodeToString(id)+"@"+domain+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	body := strings.Replace(m.Body, "\r\n", "\n", -1)
+	if _, err := qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Transport delivers messages.
+type Transport interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// SMTP delivers messages through an SMTP server. It uses STARTTLS whenever
+// the server offers it, and logs in when Username is set, which needs TLS
+// unless the server is on localhost.
+type SMTP struct {
+	// Addr is the host:port of the server.
+	Addr     string
+	Username string
+	Password string
+	// TLSConfig is used for STARTTLS, the default one checks the
+	// certificate for the host of Addr.
+	TLSConfig *tls.Config
+
+	// Now dates the messages, it is replaceable for tests.
+	Now func() time.Time
+}
+
+func NewSMTP(addr, username, password string) *SMTP {
+	return &SMTP{Addr: addr, Username: username, Password: password, Now: time.Now}
+}
+
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	if len(m.To) == 0 {
+		return errors.New("message has no recipient")
+	}
+	data, err := m.Bytes(s.Now())
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err = conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	// after Quit this only closes the closed connection again
+	defer func() { _ = c.Close() }()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := s.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: host}
+		}
+		if err = c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	from, _ := mail.ParseAddress(m.From)
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, t := range m.To {
+		addr, _ := mail.ParseAddress(t)
+		if err = c.Rcpt(addr.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,99 @@
+package mail
+
+import (
+	"context"
+	"github.com/huangjiahua/tempdesk/internal/mail/mailtest"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, s *mailtest.Server) mailtest.Message {
+	select {
+	case m := <-s.Messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return mailtest.Message{}
+	}
+}
+
+func TestSMTP_Send(t *testing.T) {
+	s := mailtest.NewServer()
+	defer s.Close()
+
+	tr := NewSMTP(s.Addr, "tempdesk", "secret")
+	long := strings.Repeat("long line ", 20)
+	err := tr.Send(context.Background(), Message{
+		From:    "TempDesk <noreply@example.com>",
+		To:      []string{"sam@example.com", "Tom <tom@example.com>"},
+		Subject: "Grüße",
+		Body:    "Hello,\n\n" + long + "\n= done\n",
+	})
+	assert.Nil(t, err)
+
+	m := receive(t, s)
+	assert.Equal(t, "noreply@example.com", m.From)
+	assert.Equal(t, []string{"sam@example.com", "tom@example.com"}, m.To)
+	assert.Equal(t, "tempdesk", m.User)
+	assert.Equal(t, "Grüße", m.Subject)
+	assert.Equal(t, "Hello,\n\n"+long+"\n= done\n", m.Body)
+	assert.Equal(t, `"TempDesk" <noreply@example.com>`, m.Header.Get("From"))
+	assert.True(t, strings.HasSuffix(m.Header.Get("Message-ID"), "@example.com>"))
+
+	s.Reject["nobody@example.com"] = true
+	err = tr.Send(context.Background(), Message{From: "noreply@example.com", To: []string{"nobody@example.com"}, Subject: "hi"})
+	assert.NotNil(t, err)
+	err = tr.Send(context.Background(), Message{From: "not an address", To: []string{"sam@example.com"}, Subject: "hi"})
+	assert.NotNil(t, err)
+
+	s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NotNil(t, tr.Send(ctx, Message{From: "noreply@example.com", To: []string{"sam@example.com"}}), "the server is gone")
+}
+
+func TestLoadTemplates(t *testing.T) {
+	data := TemplateData{
+		Name:    "sam",
+		Email:   "sam@example.com",
+		Server:  "https://example.com",
+		URL:     "https://example.com/verify?token=t",
+		Token:   "t",
+		Expires: time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC),
+	}
+	subject, body, err := DefaultTemplates().Render(TemplateVerify, data)
+	assert.Nil(t, err)
+	assert.Equal(t, "Verify your email address for TempDesk", subject)
+	assert.Contains(t, body, "Hello sam,")
+	assert.Contains(t, body, "\nhttps://example.com/verify?token=t\n")
+	assert.Contains(t, body, "2020-01-02 03:04 UTC")
+
+	dir, err := ioutil.TempDir("", "tempdesk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, TemplateReset+TemplateExt), []byte("Subject: Key for {{.Name}}\r\nX-Note: ignored\r\n\r\nrun reset {{.Token}}\r\n"), 0600)
+	ts, err := LoadTemplates(dir)
+	assert.Nil(t, err)
+	subject, body, err = ts.Render(TemplateReset, data)
+	assert.Nil(t, err)
+	assert.Equal(t, "Key for sam", subject)
+	assert.Equal(t, "run reset t\n", body)
+	_, _, err = ts.Render(TemplateVerify, data)
+	assert.Nil(t, err, "the default verify template is used")
+
+	_, _, err = ts.Render(TemplateReset, struct{ Name string }{"sam"})
+	assert.NotNil(t, err, "the template needs .Token")
+
+	for _, text := range []string{"Subject: no body", "no subject\n\nbody", "To: sam@example.com\n\nbody", "Subject: {{.Name\n\nbody"} {
+		_ = ioutil.WriteFile(filepath.Join(dir, TemplateVerify+TemplateExt), []byte(text), 0600)
+		_, err = LoadTemplates(dir)
+		assert.NotNil(t, err, text)
+	}
+}
@@ -0,0 +1,204 @@
+// Package mailtest runs an SMTP server in the process for tests, which keeps
+// the messages it receives instead of delivering them.
+package mailtest
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Message is a message the Server received.
+type Message struct {
+	// From and To are the envelope addresses.
+	From string
+	To   []string
+	// User is the name the client logged in with, if it did.
+	User    string
+	Header  mail.Header
+	Subject string
+	// Body is the decoded body.
+	Body string
+	// Data is the message as it was sent.
+	Data string
+}
+
+// Server speaks enough SMTP for net/smtp. It accepts any login over
+// AUTH PLAIN and refuses recipients in Reject.
+type Server struct {
+	// Addr is the address of the server, like "127.0.0.1:41234".
+	Addr string
+	// Messages receives every message, it is buffered for 100 of them.
+	Messages chan Message
+	// Reject holds addresses whose RCPT TO is refused.
+	Reject map[string]bool
+
+	l     net.Listener
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// NewServer starts a Server on a free port of 127.0.0.1.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("mailtest: failed to listen: " + err.Error())
+	}
+	s := &Server{Addr: l.Addr().String(), Messages: make(chan Message, 100), Reject: map[string]bool{}, l: l, conns: map[net.Conn]bool{}}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops the server, closes the connections and waits for them to
+// end.
+func (s *Server) Close() {
+	_ = s.l.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.session(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) session(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	reply := func(code int, msg string) bool {
+		return c.PrintfLine("%d %s", code, msg) == nil
+	}
+	if !reply(220, "mailtest ESMTP") {
+		return
+	}
+	var m Message
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			if c.PrintfLine("250-mailtest") != nil || !reply(250, "AUTH PLAIN") {
+				return
+			}
+		case "HELO", "NOOP":
+			reply(250, "OK")
+		case "AUTH":
+			fields := strings.Fields(arg)
+			if len(fields) != 2 || !strings.EqualFold(fields[0], "PLAIN") {
+				reply(504, "only AUTH PLAIN with an initial response")
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(fields[1])
+			parts := strings.Split(string(b), "\x00")
+			if err != nil || len(parts) != 3 {
+				reply(501, "malformed credentials")
+				continue
+			}
+			m.User = parts[1]
+			reply(235, "authenticated")
+		case "MAIL":
+			m = Message{User: m.User, From: address(arg)}
+			reply(250, "OK")
+		case "RCPT":
+			to := address(arg)
+			if s.Reject[to] {
+				reply(550, "no such mailbox")
+				continue
+			}
+			m.To = append(m.To, to)
+			reply(250, "OK")
+		case "DATA":
+			if m.From == "" || len(m.To) == 0 {
+				reply(503, "need MAIL and RCPT first")
+				continue
+			}
+			reply(354, "end with .")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m.Data = string(data)
+			if err = m.parse(); err != nil {
+				reply(554, err.Error())
+				continue
+			}
+			s.Messages <- m
+			m = Message{User: m.User}
+			reply(250, "OK")
+		case "RSET":
+			m = Message{User: m.User}
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "not implemented")
+		}
+	}
+}
+
+// address returns the address of a "FROM:<a@b>" or "TO:<a@b>" argument.
+func address(arg string) string {
+	if i := strings.IndexByte(arg, '<'); i >= 0 {
+		arg = arg[i+1:]
+	}
+	if i := strings.IndexByte(arg, '>'); i >= 0 {
+		arg = arg[:i]
+	}
+	return arg
+}
+
+func (m *Message) parse() error {
+	msg, err := mail.ReadMessage(strings.NewReader(m.Data))
+	if err != nil {
+		return err
+	}
+	m.Header = msg.Header
+	if m.Subject, err = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		return err
+	}
+	body := msg.Body
+	if strings.EqualFold(msg.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.Body = strings.Replace(string(b), "\r\n", "\n", -1)
+	return nil
+}
@@ -0,0 +1,140 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// TemplateVerify asks a user to verify their email address.
+	TemplateVerify = "verify"
+	// TemplateReset sends a user a token to reset their key with.
+	TemplateReset = "reset"
+
+	// TemplateExt is the extension of template files.
+	TemplateExt = ".tmpl"
+)
+
+// defaultTemplates are used for the templates a directory does not have.
+// The data of both is a TemplateData.
+var defaultTemplates = map[string]string{
+	TemplateVerify: `Subject: Verify your email address for TempDesk
+
+Hello {{.Name}},
+
+please confirm that {{.Email}} is the email address of your TempDesk
+account by opening this link:
+
+{{.URL}}
+
+The link works until {{.Expires.Format "2006-01-02 15:04 MST"}}. If you did
+not sign up, you can ignore this email.
+`,
+	TemplateReset: `Subject: Reset your TempDesk key
+
+Hello {{.Name}},
+
+someone asked to reset the key of your TempDesk account. To choose a new
+one, open this link:
+
+{{.URL}}
+
+or run
+
+    tempdesk reset -server {{.Server}} -token {{.Token}}
+
+The token works once, until {{.Expires.Format "2006-01-02 15:04 MST"}}. If
+you did not ask for it, you can ignore this email, your key stays the same.
+`,
+}
+
+// TemplateData is what the templates are executed with.
+type TemplateData struct {
+	Name  string
+	Email string
+	// Server is the base URL of the server, like "https://example.com".
+	Server string
+	// URL is the link a message asks to open, to verify the address or to
+	// choose a new key.
+	URL     string
+	Token   string
+	Expires time.Time
+}
+
+// Templates render the messages. A template starts with header lines up to
+// a blank line, of which Subject is used, and the rest is the body.
+type Templates struct {
+	t *template.Template
+}
+
+// DefaultTemplates returns the templates the server comes with.
+func DefaultTemplates() *Templates {
+	t, err := LoadTemplates("")
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// LoadTemplates reads NAME.tmpl files from dir, NAME being TemplateVerify
+// or TemplateReset, and uses the default template for those it lacks. An
+// empty dir uses only the defaults.
+func LoadTemplates(dir string) (*Templates, error) {
+	root := template.New("").Option("missingkey=error")
+	for name, text := range defaultTemplates {
+		if dir != "" {
+			b, err := ioutil.ReadFile(filepath.Join(dir, name+TemplateExt))
+			if err == nil {
+				text = string(b)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		if _, err := root.New(name).Parse(text); err != nil {
+			return nil, err
+		}
+		if _, _, err := split(text); err != nil {
+			return nil, fmt.Errorf("template %s: %v", name, err)
+		}
+	}
+	return &Templates{t: root}, nil
+}
+
+// Render executes the template name with data and returns the subject and
+// body of the message.
+func (t *Templates) Render(name string, data interface{}) (subject, body string, err error) {
+	var buf bytes.Buffer
+	if err = t.t.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", "", err
+	}
+	return split(buf.String())
+}
+
+// split separates the headers of text from the body.
+func split(text string) (subject, body string, err error) {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	i := strings.Index(text, "\n\n")
+	if i < 0 {
+		return "", "", errors.New("no blank line after the headers")
+	}
+	for _, line := range strings.Split(text[:i], "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return "", "", fmt.Errorf("header %q is not Key: Value", line)
+		}
+		if strings.EqualFold(strings.TrimSpace(kv[0]), "subject") {
+			subject = strings.TrimSpace(kv[1])
+		}
+	}
+	if subject == "" {
+		return "", "", errors.New("no Subject header")
+	}
+	return subject, text[i+2:], nil
+}
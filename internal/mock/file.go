@@ -1,21 +1,49 @@
 package mock
 
 import (
+	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"fmt"
 	td "github.com/huangjiahua/tempdesk"
 	"io"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type fileInternal struct {
-	rw   sync.RWMutex
-	meta map[string]interface{}
-	data []byte
+	rw       sync.RWMutex
+	meta     map[string]interface{}
+	data     []byte
+	perm     td.FilePermission
+	modified time.Time
+	// detached is set once the file is removed or replaced, handles still
+	// open may use it but it no longer counts toward any usage.
+	detached bool
+}
+
+// owner returns the td.MetaOwner whose usage counts the file, none once it
+// is detached. rw must be held.
+func (f *fileInternal) owner() string {
+	if f.detached {
+		return ""
+	}
+	owner, _ := f.meta[td.MetaOwner].(string)
+	return owner
 }
 
 type File struct {
-	pos  int64
-	file *fileInternal
+	pos   int64
+	flags int
+	token string
+	// truncate is set while an os.O_TRUNC of Open waits for the token of
+	// the exclusive lock on the file.
+	truncate bool
+	file     *fileInternal
+	fs       *FileService
 }
 
 func (f *File) Read(p []byte) (n int, err error) {
@@ -25,6 +53,11 @@ func (f *File) Read(p []byte) (n int, err error) {
 }
 
 func (f *File) Write(p []byte) (n int, err error) {
+	if f.flags&os.O_APPEND != 0 {
+		f.file.rw.RLock()
+		f.pos = int64(len(f.file.data))
+		f.file.rw.RUnlock()
+	}
 	n, err = f.WriteAt(p, f.pos)
 	f.pos += int64(n)
 	return
@@ -60,7 +93,7 @@ func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
 	}
 
 	f.file.rw.RLock()
-	defer f.file.rw.Unlock()
+	defer f.file.rw.RUnlock()
 
 	if off >= int64(len(f.file.data)) {
 		return 0, io.EOF
@@ -76,20 +109,26 @@ func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
 	if off < 0 {
 		return 0, errors.New("tempdesk.internal.mock.File.WriteAt: negative offset")
 	}
+	if err = f.checkWrite(); err != nil {
+		return 0, err
+	}
 
 	f.file.rw.Lock()
 	defer f.file.rw.Unlock()
 
-	if off+int64(len(p)) >= int64(len(f.file.data)) {
-		f.file.data = append(f.file.data, make([]byte, off+int64(len(p))-int64(len(f.file.data)))...)
+	size := int64(len(f.file.data))
+	if off+int64(len(p)) >= size {
+		f.file.data = append(f.file.data, make([]byte, off+int64(len(p))-size)...)
 	}
 
 	n = copy(f.file.data[off:], p)
+	f.file.modified = f.fs.Now()
+	f.fs.addUsage(f.file.owner(), int64(len(f.file.data))-size)
 	return
 }
 
 func (f *File) Perm() td.FilePermission {
-	panic("implement me")
+	return f.file.perm
 }
 
 func (f *File) Meta(key string) (value string, ok bool) {
@@ -117,14 +156,31 @@ func (f *File) FileMeta(key string) (value interface{}, ok bool) {
 func (f *File) WriteFileMeta(key string, value interface{}) (err error) {
 	f.file.rw.Lock()
 	defer f.file.rw.Unlock()
+	if key == td.MetaOwner && !f.file.detached {
+		size := int64(len(f.file.data))
+		f.fs.addUsage(f.file.owner(), -size)
+		owner, _ := value.(string)
+		f.fs.addUsage(owner, size)
+	}
 	f.file.meta[key] = value
 	return nil
 }
 
 func (f *File) Truncate(pos int64, data []byte) (err error) {
+	if err = f.checkWrite(); err != nil {
+		return err
+	}
+	f.resize(pos, data)
+	return nil
+}
+
+// resize cuts or grows the file to pos and writes data there.
+func (f *File) resize(pos int64, data []byte) {
 	f.file.rw.Lock()
 	defer f.file.rw.Unlock()
 
+	size := int64(len(f.file.data))
+	defer func() { f.fs.addUsage(f.file.owner(), int64(len(f.file.data))-size) }()
 	if int64(len(f.file.data)) != pos+int64(len(data)) {
 		data := make([]byte, pos+int64(len(data)))
 		copy(data[:pos], f.file.data)
@@ -132,13 +188,114 @@ func (f *File) Truncate(pos int64, data []byte) (err error) {
 	}
 
 	copy(f.file.data[pos:], data)
+	f.file.modified = f.fs.Now()
+}
 
+func (f *File) Close() error {
+	return nil
+}
+
+// ModTime returns when the file was last written.
+func (f *File) ModTime() time.Time {
+	f.file.rw.RLock()
+	defer f.file.rw.RUnlock()
+	return f.file.modified
+}
+
+// SetModTime changes when the file was last written, for restoring a file
+// kept elsewhere.
+func (f *File) SetModTime(t time.Time) {
+	f.file.rw.Lock()
+	f.file.modified = t
+	f.file.rw.Unlock()
+}
+
+// SetLockToken also truncates a file opened with os.O_TRUNC while it was
+// locked, once token is the one of the lock.
+func (f *File) SetLockToken(token string) {
+	f.token = token
+	if f.truncate {
+		_ = f.checkWrite()
+	}
+}
+
+// checkWrite checks that f may be written and does a truncation Open left
+// for later.
+func (f *File) checkWrite() error {
+	if f.flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return errors.New("tempdesk.internal.mock.File: file is not opened for writing")
+	}
+	if err := f.fs.checkLock(f.file, f.token); err != nil {
+		return err
+	}
+	if f.truncate {
+		f.truncate = false
+		f.resize(0, nil)
+	}
 	return nil
 }
 
 type FileService struct {
 	rw    sync.RWMutex
-	files map[string]*File
+	files map[string]*fileInternal
+
+	lockRw sync.Mutex
+	locks  map[*fileInternal][]td.Lock
+
+	// Now is the clock used for lock leases, it defaults to time.Now.
+	Now func() time.Time
+
+	groupsRw sync.RWMutex
+	groups   td.GroupResolver
+
+	// usage counts the bytes of the files of every td.MetaOwner.
+	usageMu sync.Mutex
+	usage   map[string]int64
+}
+
+// addUsage counts delta more bytes for owner.
+func (fs *FileService) addUsage(owner string, delta int64) {
+	if owner == "" || delta == 0 {
+		return
+	}
+	fs.usageMu.Lock()
+	defer fs.usageMu.Unlock()
+	if fs.usage[owner] += delta; fs.usage[owner] == 0 {
+		delete(fs.usage, owner)
+	}
+}
+
+// dropUsage stops counting a file that is removed or replaced and detaches
+// it, so writes through handles still open are not counted either.
+func (fs *FileService) dropUsage(file *fileInternal) {
+	file.rw.Lock()
+	defer file.rw.Unlock()
+	fs.addUsage(file.owner(), -int64(len(file.data)))
+	file.detached = true
+}
+
+// OwnerUsage returns the bytes of the files whose td.MetaOwner is owner.
+func (fs *FileService) OwnerUsage(owner string) (bytes int64, err error) {
+	fs.usageMu.Lock()
+	defer fs.usageMu.Unlock()
+	return fs.usage[owner], nil
+}
+
+// SetGroups makes the permissions of the files resolve their group rules
+// by groups.
+func (fs *FileService) SetGroups(groups td.GroupResolver) {
+	fs.groupsRw.Lock()
+	fs.groups = groups
+	fs.groupsRw.Unlock()
+}
+
+// IsMember asks the groups set by SetGroups, no user is a member of any
+// group without them.
+func (fs *FileService) IsMember(name, group string) bool {
+	fs.groupsRw.RLock()
+	groups := fs.groups
+	fs.groupsRw.RUnlock()
+	return groups != nil && groups.IsMember(name, group)
 }
 
 func (fs *FileService) File(path string) (err error) {
@@ -150,53 +307,411 @@ func (fs *FileService) File(path string) (err error) {
 	return nil
 }
 
+// Open supports the os.O_CREATE, os.O_EXCL, os.O_TRUNC and os.O_APPEND flags.
+// A nil perm gives a newly created file a permission allowing every user.
+// A file with an exclusive lock is truncated by the first write or
+// File.SetLockToken that presents the token.
 func (fs *FileService) Open(path string, flags int, perm td.FilePermission) (file td.File, err error) {
-	panic("implement me")
+	fs.rw.Lock()
+	defer fs.rw.Unlock()
+
+	internal, ok := fs.files[path]
+	switch {
+	case ok && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0:
+		return nil, &td.FileServiceError{Kind: td.FileAlreadyExists}
+	case !ok && flags&os.O_CREATE == 0:
+		return nil, &td.FileServiceError{Kind: td.FileNotExist}
+	case !ok:
+		if perm == nil {
+			perm = NewFilePermission()
+		}
+		if p, ok := perm.(*FilePermission); ok {
+			p.setGroups(fs)
+		}
+		internal = &fileInternal{meta: make(map[string]interface{}), perm: perm, modified: fs.Now()}
+		fs.files[path] = internal
+	}
+
+	f := &File{flags: flags, file: internal, fs: fs, truncate: ok && flags&os.O_TRUNC != 0}
+	if f.truncate {
+		// a file locked exclusively is truncated once the token is set, so
+		// the holder of the lock can open it with os.O_TRUNC as well
+		if err = f.checkWrite(); err != nil && !isLocked(err) {
+			return nil, err
+		}
+	}
+	return f, nil
 }
 
-func (fs *FileService) Rename(dest string, src string) (err error) {
+func (fs *FileService) Rename(dest string, src string, token string) (err error) {
 	fs.rw.Lock()
 	defer fs.rw.Unlock()
-	if file, ok := fs.files[src]; ok {
-		fs.files[dest] = file
-		delete(fs.files, src)
-		return nil
+	file, ok := fs.files[src]
+	if !ok {
+		return &td.FileServiceError{Kind: td.FileNotExist}
+	}
+	if err = fs.checkLock(file, token); err != nil {
+		return err
 	}
-	return &td.FileServiceError{Kind: td.FileNotExist}
+	old, replaced := fs.files[dest]
+	if replaced && old != file {
+		if err = fs.checkLock(old, token); err != nil {
+			return err
+		}
+		fs.dropUsage(old)
+		fs.lockRw.Lock()
+		delete(fs.locks, old)
+		fs.lockRw.Unlock()
+	}
+	fs.files[dest] = file
+	delete(fs.files, src)
+	return nil
 }
 
-func (fs *FileService) Remove(path string) (err error) {
+func (fs *FileService) Remove(path string, token string) (err error) {
 	fs.rw.Lock()
 	defer fs.rw.Unlock()
-	if _, ok := fs.files[path]; !ok {
+	file, ok := fs.files[path]
+	if !ok {
 		return &td.FileServiceError{Kind: td.FileNotExist}
 	}
+	if err = fs.checkLock(file, token); err != nil {
+		return err
+	}
 	delete(fs.files, path)
+	fs.dropUsage(file)
+
+	fs.lockRw.Lock()
+	delete(fs.locks, file)
+	fs.lockRw.Unlock()
+	return nil
+}
+
+func (fs *FileService) List(dir string) (files []td.FileInfo, err error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	fs.rw.RLock()
+	defer fs.rw.RUnlock()
+	files = []td.FileInfo{}
+	for p, f := range fs.files {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		f.rw.RLock()
+		files = append(files, td.FileInfo{Path: p, Size: int64(len(f.data)), ModTime: f.modified})
+		f.rw.RUnlock()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+func (fs *FileService) Usage() (files int64, bytes int64, err error) {
+	fs.rw.RLock()
+	defer fs.rw.RUnlock()
+	for _, f := range fs.files {
+		f.rw.RLock()
+		bytes += int64(len(f.data))
+		f.rw.RUnlock()
+	}
+	return int64(len(fs.files)), bytes, nil
+}
+
+// Health reports the FileService as healthy, it lives in memory.
+func (fs *FileService) Health() error {
+	return nil
+}
+
+func (fs *FileService) Lock(path string, owner td.User, scope td.LockScope, lease time.Duration) (lock td.Lock, err error) {
+	file, err := fs.lookup(path)
+	if err != nil {
+		return
+	}
+	if lease <= 0 {
+		lease = td.DefaultLockLease
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return
+	}
+
+	fs.lockRw.Lock()
+	defer fs.lockRw.Unlock()
+	now := fs.expireLocks(file)
+
+	for _, l := range fs.locks[file] {
+		if scope == td.LockExclusive || l.Scope == td.LockExclusive {
+			return td.Lock{}, &td.FileServiceError{Kind: td.FileLocked}
+		}
+	}
+
+	lock = td.Lock{
+		Token:   token,
+		Owner:   owner.Name,
+		Scope:   scope,
+		Expires: now.Add(lease),
+	}
+	fs.locks[file] = append(fs.locks[file], lock)
+	lock.Path = path
+	return
+}
+
+func (fs *FileService) RefreshLock(path string, token string, lease time.Duration) (lock td.Lock, err error) {
+	file, err := fs.lookup(path)
+	if err != nil {
+		return
+	}
+	if lease <= 0 {
+		lease = td.DefaultLockLease
+	}
+
+	fs.lockRw.Lock()
+	defer fs.lockRw.Unlock()
+	now := fs.expireLocks(file)
+
+	for i, l := range fs.locks[file] {
+		if l.Token == token {
+			l.Expires = now.Add(lease)
+			fs.locks[file][i] = l
+			l.Path = path
+			return l, nil
+		}
+	}
+	return td.Lock{}, &td.FileServiceError{Kind: td.LockNotExist}
+}
+
+func (fs *FileService) Unlock(path string, token string) (err error) {
+	file, err := fs.lookup(path)
+	if err != nil {
+		return
+	}
+
+	fs.lockRw.Lock()
+	defer fs.lockRw.Unlock()
+	fs.expireLocks(file)
+
+	locks := fs.locks[file]
+	for i, l := range locks {
+		if l.Token == token {
+			locks = append(locks[:i], locks[i+1:]...)
+			if len(locks) == 0 {
+				delete(fs.locks, file)
+			} else {
+				fs.locks[file] = locks
+			}
+			return nil
+		}
+	}
+	return &td.FileServiceError{Kind: td.LockNotExist}
+}
+
+func (fs *FileService) Locks(path string) (locks []td.Lock, err error) {
+	file, err := fs.lookup(path)
+	if err != nil {
+		return
+	}
+
+	fs.lockRw.Lock()
+	defer fs.lockRw.Unlock()
+	fs.expireLocks(file)
+
+	for _, l := range fs.locks[file] {
+		l.Path = path
+		locks = append(locks, l)
+	}
+	return
+}
+
+func (fs *FileService) lookup(path string) (*fileInternal, error) {
+	fs.rw.RLock()
+	defer fs.rw.RUnlock()
+	file, ok := fs.files[path]
+	if !ok {
+		return nil, &td.FileServiceError{Kind: td.FileNotExist}
+	}
+	return file, nil
+}
+
+func (fs *FileService) checkLock(file *fileInternal, token string) error {
+	fs.lockRw.Lock()
+	defer fs.lockRw.Unlock()
+	fs.expireLocks(file)
+
+	for _, l := range fs.locks[file] {
+		if l.Scope == td.LockExclusive && l.Token != token {
+			return &td.FileServiceError{Kind: td.FileLocked}
+		}
+	}
 	return nil
 }
 
+// expireLocks drops the locks of file whose lease has run out. It is called
+// on each access to the locks of a file, so expired leases never outlive the
+// next lock operation on it. fs.lockRw must be held.
+func (fs *FileService) expireLocks(file *fileInternal) time.Time {
+	now := fs.Now()
+	locks, ok := fs.locks[file]
+	if !ok {
+		return now
+	}
+	alive := locks[:0]
+	for _, l := range locks {
+		if now.Before(l.Expires) {
+			alive = append(alive, l)
+		}
+	}
+	if len(alive) == 0 {
+		delete(fs.locks, file)
+	} else {
+		fs.locks[file] = alive
+	}
+	return now
+}
+
+func isLocked(err error) bool {
+	e, ok := err.(*td.FileServiceError)
+	return ok && e.Kind == td.FileLocked
+}
+
 func NewFileService() *FileService {
-	return &FileService{}
+	return &FileService{
+		files: make(map[string]*fileInternal),
+		locks: make(map[*fileInternal][]td.Lock),
+		usage: make(map[string]int64),
+		Now:   time.Now,
+	}
+}
+
+// newLockToken returns a random token in the opaquelocktoken URI scheme
+// used by WebDAV.
+func newLockToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func NewFilePermission() *FilePermission {
+	return &FilePermission{
+		all:    td.VerbAll,
+		users:  make(map[string]td.Verb),
+		groups: make(map[string]td.Verb),
+		codes:  make(map[string]td.Verb),
+		public: make(map[string]bool),
+	}
 }
 
+// FilePermission is a td.VerbPermission. A new one lets every user do
+// everything.
 type FilePermission struct {
-	isPublic  bool
-	isBlocked bool
-	blocked   map[string]bool
-	allowed   map[string]bool
-	code      map[string]bool
+	rw       sync.RWMutex
+	isPublic bool
+	all      td.Verb
+	users    map[string]td.Verb
+	groups   map[string]td.Verb
+	codes    map[string]td.Verb
+	// public holds the codes that may read while the file is public.
+	public map[string]bool
+	// resolver resolves the group rules, which match nobody while it is nil.
+	resolver td.GroupResolver
+}
+
+// setGroups gives f the groups of a FileService, unless it has some.
+func (f *FilePermission) setGroups(groups td.GroupResolver) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if f.resolver == nil {
+		f.resolver = groups
+	}
 }
 
-func (f *FilePermission) AllowUser(name string) {
-	if !f.isPublic && f.isBlocked {
-		f.allowed[name] = true
+func (f *FilePermission) GrantUser(name string, verbs td.Verb) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	f.users[name] = verbs
+}
+
+func (f *FilePermission) GrantGroup(name string, verbs td.Verb) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	f.groups[name] = verbs
+}
+
+func (f *FilePermission) GrantAllUser(verbs td.Verb) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	f.all = verbs
+	f.users = make(map[string]td.Verb)
+	f.groups = make(map[string]td.Verb)
+}
+
+func (f *FilePermission) GrantCode(code string, verbs td.Verb) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if verbs == td.VerbNone {
+		delete(f.codes, code)
+		return
 	}
+	f.codes[code] = verbs
 }
 
-func (f *FilePermission) BlockUser(name string) {
-	if !f.isPublic && !f.isBlocked {
-		f.blocked[name] = true
+func (f *FilePermission) UserVerbs(user td.User) td.Verb {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+	verbs, ok := f.users[user.Name]
+	if !ok {
+		verbs, ok = f.groupVerbs(user.Name)
+	}
+	if !ok {
+		verbs = f.all
 	}
+	if f.isPublic {
+		verbs |= td.VerbRead
+	}
+	return verbs
+}
+
+// groupVerbs returns the union of the verbs of the groups of the user name
+// and whether any group has a rule for it, the caller holds rw.
+func (f *FilePermission) groupVerbs(name string) (td.Verb, bool) {
+	if f.resolver == nil {
+		return td.VerbNone, false
+	}
+	verbs, found := td.VerbNone, false
+	for g, v := range f.groups {
+		if f.resolver.IsMember(name, g) {
+			verbs, found = verbs|v, true
+		}
+	}
+	return verbs, found
+}
+
+func (f *FilePermission) CodeVerbs(code string) td.Verb {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+	verbs := f.codes[code]
+	if f.isPublic && f.public[code] {
+		verbs |= td.VerbRead
+	}
+	return verbs
+}
+
+func (f *FilePermission) AllowUser(name string) {
+	f.GrantUser(name, td.VerbAll)
+}
+
+func (f *FilePermission) BlockUser(name string) {
+	f.GrantUser(name, td.VerbNone)
+}
+
+func (f *FilePermission) AllowGroup(name string) {
+	f.GrantGroup(name, td.VerbAll)
+}
+
+func (f *FilePermission) BlockGroup(name string) {
+	f.GrantGroup(name, td.VerbNone)
 }
 
 func (f *FilePermission) AllowUserMeta(key, value string) {
@@ -206,44 +721,134 @@ func (f *FilePermission) BlockUserMeta(key, value string) {
 }
 
 func (f *FilePermission) AllowAllUser() {
-	if !f.isPublic {
-		f.isBlocked = false
-		f.blocked = make(map[string]bool)
-	}
+	f.GrantAllUser(td.VerbAll)
 }
 
 func (f *FilePermission) BlockAllUser() {
-	if !f.isPublic {
-		f.isBlocked = true
-		f.allowed = make(map[string]bool)
-	}
+	f.GrantAllUser(td.VerbNone)
 }
 
 func (f *FilePermission) AllowPublic(code string) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
 	f.isPublic = true
-	f.code = make(map[string]bool)
+	f.public = make(map[string]bool)
 }
 
 func (f *FilePermission) AllowCode(code string) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
 	if f.isPublic {
-		f.code[code] = true
+		f.public[code] = true
 	}
 }
 
 func (f *FilePermission) BlockPublic() {
+	f.rw.Lock()
+	defer f.rw.Unlock()
 	f.isPublic = false
 }
 
 func (f *FilePermission) BlockCode(code string) {
-	if f.isPublic {
-		delete(f.code, code)
-	}
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	delete(f.public, code)
+	delete(f.codes, code)
 }
 
+// TestUser reports whether user may read the file.
 func (f *FilePermission) TestUser(user td.User) bool {
-	return f.isPublic || (f.isBlocked && f.allowed[user.Name]) || (!f.isBlocked && !f.blocked[user.Name])
+	return f.UserVerbs(user).Has(td.VerbRead)
 }
 
+// TestCode reports whether code may read the file.
 func (f *FilePermission) TestCode(code string) bool {
-	return f.isPublic && f.code[code]
+	return f.CodeVerbs(code).Has(td.VerbRead)
+}
+
+func (f *FilePermission) Document() (doc td.PermissionDocument, err error) {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+	return f.document(), nil
+}
+
+// document returns the rules of f, the caller holds rw.
+func (f *FilePermission) document() td.PermissionDocument {
+	doc := td.PermissionDocument{
+		Version: td.PermissionVersion,
+		All:     f.all,
+		Users:   f.users,
+		Groups:  f.groups,
+		Codes:   f.codes,
+		Public:  f.isPublic,
+	}
+	if f.isPublic {
+		for code := range f.public {
+			doc.PublicCodes = append(doc.PublicCodes, code)
+		}
+	}
+	return doc.Normalize()
+}
+
+func (f *FilePermission) SetDocument(doc td.PermissionDocument) (err error) {
+	if err = doc.Validate(); err != nil {
+		return err
+	}
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	f.setDocument(doc.Normalize())
+	return nil
+}
+
+func (f *FilePermission) SetDocumentIf(old, doc td.PermissionDocument) (err error) {
+	if err = doc.Validate(); err != nil {
+		return err
+	}
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if !f.document().Equal(old) {
+		return &td.PermissionError{Kind: td.PermissionChanged}
+	}
+	f.setDocument(doc.Normalize())
+	return nil
+}
+
+// Snapshot copies the rules of f, the copy resolves groups like f.
+func (f *FilePermission) Snapshot() td.FilePermission {
+	f.rw.RLock()
+	doc, resolver := f.document(), f.resolver
+	f.rw.RUnlock()
+	c := NewFilePermission()
+	c.setDocument(doc)
+	c.resolver = resolver
+	return c
+}
+
+// setDocument replaces the rules of f by those of doc, the caller holds rw.
+func (f *FilePermission) setDocument(doc td.PermissionDocument) {
+	f.all, f.users, f.groups, f.codes = doc.All, doc.Users, doc.Groups, doc.Codes
+	f.isPublic = doc.Public
+	f.public = make(map[string]bool, len(doc.PublicCodes))
+	for _, code := range doc.PublicCodes {
+		f.public[code] = true
+	}
+}
+
+// MarshalJSON writes the document of f.
+func (f *FilePermission) MarshalJSON() ([]byte, error) {
+	doc, err := f.Document()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON replaces the rules of f by a document written by
+// MarshalJSON, keeping the groups f resolves by.
+func (f *FilePermission) UnmarshalJSON(b []byte) error {
+	doc, err := td.ParsePermissionDocument(b)
+	if err != nil {
+		return err
+	}
+	return f.SetDocument(doc)
 }
@@ -0,0 +1,378 @@
+package mock
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func errIsFileKind(t *testing.T, err error, kind string) {
+	t.Helper()
+	if e, ok := err.(*td.FileServiceError); !ok || e.Kind != kind {
+		t.Errorf("Error is not %v: %v", kind, err)
+	}
+}
+
+func TestFileService_Open(t *testing.T) {
+	fs := NewFileService()
+
+	_, err := fs.Open("/a", os.O_RDONLY, nil)
+	errIsFileKind(t, err, td.FileNotExist)
+
+	f, err := fs.Open("/a", os.O_RDWR|os.O_CREATE|os.O_EXCL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	_, err = fs.Open("/a", os.O_RDWR|os.O_CREATE|os.O_EXCL, nil)
+	errIsFileKind(t, err, td.FileAlreadyExists)
+
+	r, err := fs.Open("/a", os.O_RDONLY, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	_, err = r.Write([]byte("x"))
+	assert.Error(t, err, "read only file should not be writable")
+
+	a, _ := fs.Open("/a", os.O_WRONLY|os.O_APPEND, nil)
+	_, _ = a.Write([]byte(" world"))
+	b, _ = ioutil.ReadAll(openRead(t, fs, "/a"))
+	assert.Equal(t, "hello world", string(b))
+
+	_, _ = fs.Open("/a", os.O_WRONLY|os.O_TRUNC, nil)
+	b, _ = ioutil.ReadAll(openRead(t, fs, "/a"))
+	assert.Equal(t, "", string(b))
+}
+
+func openRead(t *testing.T, fs *FileService, path string) td.File {
+	f, err := fs.Open(path, os.O_RDONLY, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFileService_Lock(t *testing.T) {
+	fs := NewFileService()
+	now := time.Now()
+	fs.Now = func() time.Time { return now }
+
+	sam := td.User{Name: "sam"}
+	tom := td.User{Name: "tom"}
+
+	_, err := fs.Lock("/a", sam, td.LockExclusive, time.Minute)
+	errIsFileKind(t, err, td.FileNotExist)
+
+	f, _ := fs.Open("/a", os.O_RDWR|os.O_CREATE, nil)
+	g, _ := fs.Open("/a", os.O_RDWR, nil)
+
+	shared, err := fs.Lock("/a", sam, td.LockShared, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Lock("/a", tom, td.LockShared, time.Minute)
+	assert.NoError(t, err, "shared locks should coexist")
+	_, err = fs.Lock("/a", tom, td.LockExclusive, time.Minute)
+	errIsFileKind(t, err, td.FileLocked)
+
+	_, err = g.Write([]byte("shared locks are advisory"))
+	assert.NoError(t, err)
+
+	locks, _ := fs.Locks("/a")
+	assert.Len(t, locks, 2)
+	for _, l := range locks {
+		assert.NoError(t, fs.Unlock("/a", l.Token))
+	}
+	errIsFileKind(t, fs.Unlock("/a", shared.Token), td.LockNotExist)
+
+	lock, err := fs.Lock("/a", sam, td.LockExclusive, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sam", lock.Owner)
+	assert.Equal(t, "/a", lock.Path)
+	assert.Equal(t, now.Add(time.Minute), lock.Expires)
+
+	_, err = fs.Lock("/a", tom, td.LockShared, time.Minute)
+	errIsFileKind(t, err, td.FileLocked)
+
+	_, err = g.WriteAt([]byte("x"), 0)
+	errIsFileKind(t, err, td.FileLocked)
+	errIsFileKind(t, g.Truncate(0, nil), td.FileLocked)
+	h, err := fs.Open("/a", os.O_RDWR|os.O_TRUNC, nil)
+	assert.NoError(t, err)
+	_, err = h.Write([]byte("x"))
+	errIsFileKind(t, err, td.FileLocked)
+	size, _ := g.Seek(0, io.SeekEnd)
+	assert.Equal(t, int64(25), size, "a truncation without the token waits")
+
+	f.SetLockToken(lock.Token)
+	_, err = f.WriteAt([]byte("x"), 0)
+	assert.NoError(t, err, "lock holder should be able to write")
+	h, err = fs.Open("/a", os.O_RDWR|os.O_TRUNC, nil)
+	assert.NoError(t, err)
+	h.SetLockToken(lock.Token)
+	size, _ = g.Seek(0, io.SeekEnd)
+	assert.Equal(t, int64(0), size, "the lock holder may truncate")
+
+	// the lock follows the file when it is renamed by its holder
+	errIsFileKind(t, fs.Rename("/b", "/a", ""), td.FileLocked)
+	errIsFileKind(t, fs.Remove("/a", ""), td.FileLocked)
+	assert.NoError(t, fs.Rename("/b", "/a", lock.Token))
+	_, err = g.WriteAt([]byte("x"), 0)
+	errIsFileKind(t, err, td.FileLocked)
+
+	now = now.Add(30 * time.Second)
+	lock, err = fs.RefreshLock("/b", lock.Token, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Minute), lock.Expires)
+
+	now = now.Add(time.Minute)
+	locks, _ = fs.Locks("/b")
+	assert.Empty(t, locks, "expired lock should be released")
+	assert.Empty(t, fs.locks, "expired lock should be cleaned up")
+
+	_, err = g.WriteAt([]byte("x"), 0)
+	assert.NoError(t, err, "expired lock should not block writes")
+	_, err = fs.RefreshLock("/b", lock.Token, time.Minute)
+	errIsFileKind(t, err, td.LockNotExist)
+}
+
+func TestFileService_List(t *testing.T) {
+	fs := NewFileService()
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	fs.Now = func() time.Time { return now }
+	for _, p := range []string{"/b/2.txt", "/a.txt", "/b/1.txt", "/bc.txt"} {
+		f, _ := fs.Open(p, os.O_CREATE|os.O_WRONLY, nil)
+		_, _ = f.Write([]byte(p))
+	}
+
+	files, err := fs.List("/b")
+	assert.Nil(t, err)
+	assert.Equal(t, []td.FileInfo{{Path: "/b/1.txt", Size: 8, ModTime: now}, {Path: "/b/2.txt", Size: 8, ModTime: now}}, files)
+
+	files, _ = fs.List("/")
+	assert.Len(t, files, 4)
+	files, _ = fs.List("/none")
+	assert.Empty(t, files)
+}
+
+// members is a td.GroupResolver of the groups of every user.
+type members map[string][]string
+
+func (m members) IsMember(name, group string) bool {
+	for _, g := range m[name] {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFilePermission_Groups(t *testing.T) {
+	fs := NewFileService()
+	sam, tom := td.User{Name: "sam"}, td.User{Name: "tom"}
+
+	f, err := fs.Open("/a", os.O_CREATE, nil)
+	assert.Nil(t, err)
+	perm := f.Perm()
+	perm.BlockAllUser()
+	perm.AllowGroup("dev")
+	assert.False(t, perm.TestUser(sam), "no groups are set yet")
+
+	fs.SetGroups(members{"sam": {"dev"}})
+	assert.True(t, perm.TestUser(sam))
+	assert.False(t, perm.TestUser(tom))
+
+	perm.AllowAllUser()
+	perm.BlockGroup("dev")
+	assert.False(t, perm.TestUser(sam))
+	assert.True(t, perm.TestUser(tom))
+
+	perm.BlockAllUser()
+	assert.False(t, perm.TestUser(sam), "blocking every user drops the allowed groups")
+	perm.AllowAllUser()
+	assert.True(t, perm.TestUser(sam), "allowing every user drops the blocked groups")
+}
+
+func TestFilePermission_Verbs(t *testing.T) {
+	sam, tom, ann := td.User{Name: "sam"}, td.User{Name: "tom"}, td.User{Name: "ann"}
+	perm := NewFilePermission()
+	perm.setGroups(members{"tom": {"dev"}, "ann": {"dev", "ops"}})
+	assert.Equal(t, td.VerbAll, perm.UserVerbs(sam), "a new file is open to everyone")
+
+	perm.GrantAllUser(td.VerbRead)
+	perm.GrantUser("sam", td.VerbRead|td.VerbWrite)
+	perm.GrantGroup("dev", td.VerbRead|td.VerbDelete)
+	perm.GrantGroup("ops", td.VerbShare)
+	assert.Equal(t, td.VerbRead|td.VerbWrite, perm.UserVerbs(sam))
+	assert.Equal(t, td.VerbRead|td.VerbDelete, perm.UserVerbs(tom))
+	assert.Equal(t, td.VerbRead|td.VerbDelete|td.VerbShare, perm.UserVerbs(ann), "the verbs of all groups")
+	assert.Equal(t, td.VerbRead, perm.UserVerbs(td.User{Name: "bob"}))
+	assert.True(t, perm.TestUser(tom), "TestUser tests reading")
+
+	perm.GrantUser("tom", td.VerbNone)
+	assert.False(t, perm.TestUser(tom), "the rule of the user comes first")
+	perm.AllowPublic("")
+	assert.Equal(t, td.VerbRead, perm.UserVerbs(tom), "everyone reads a public file")
+
+	assert.Equal(t, td.VerbNone, perm.CodeVerbs("abc"))
+	perm.GrantCode("abc", td.VerbRead|td.VerbWrite)
+	assert.True(t, perm.TestCode("abc"))
+	assert.Equal(t, td.VerbRead|td.VerbWrite, perm.CodeVerbs("abc"))
+	perm.BlockCode("abc")
+	assert.False(t, perm.TestCode("abc"))
+}
+
+// legacy hides the verbs of a permission, like one that only knows the
+// old interface.
+type legacy struct {
+	td.FilePermission
+}
+
+func TestVerbs_Adapter(t *testing.T) {
+	sam := td.User{Name: "sam"}
+	perm := td.Verbs(legacy{NewFilePermission()})
+
+	perm.GrantAllUser(td.VerbNone)
+	assert.Equal(t, td.VerbNone, perm.UserVerbs(sam))
+	perm.GrantUser("sam", td.VerbRead)
+	assert.Equal(t, td.VerbAll, perm.UserVerbs(sam), "allowing grants everything")
+	assert.True(t, td.Can(perm, sam, td.VerbDelete))
+
+	native := NewFilePermission()
+	assert.True(t, td.Verbs(native) == td.VerbPermission(native))
+}
+
+func TestParseVerb(t *testing.T) {
+	v, err := td.ParseVerb("read, write")
+	assert.Nil(t, err)
+	assert.Equal(t, td.VerbRead|td.VerbWrite, v)
+	assert.Equal(t, "read,write", v.String())
+	v, _ = td.ParseVerb("all")
+	assert.Equal(t, td.VerbAll, v)
+	assert.Equal(t, "none", td.VerbNone.String())
+	_, err = td.ParseVerb("execute")
+	assert.NotNil(t, err)
+}
+
+func TestFilePermission_Document(t *testing.T) {
+	p := NewFilePermission()
+	p.GrantAllUser(td.VerbNone)
+	p.GrantUser("sam", td.VerbAll)
+	p.GrantUser("tom", td.VerbNone)
+	p.GrantGroup("dev", td.VerbRead|td.VerbWrite)
+	p.GrantCode("x1", td.VerbRead)
+	p.AllowPublic("")
+	p.AllowCode("x2")
+
+	b, err := json.Marshal(p)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"version":1,"all":"none","users":{"sam":"read,write,delete,share,change_perm","tom":"none"},
+		"groups":{"dev":"read,write"},"codes":{"x1":"read"},"public":true,"public_codes":["x2"]}`, string(b))
+
+	q := &FilePermission{}
+	assert.Nil(t, json.Unmarshal(b, q))
+	doc, _ := p.Document()
+	copied, _ := q.Document()
+	assert.Equal(t, doc, copied)
+	assert.True(t, q.TestCode("x2"))
+	assert.Equal(t, td.VerbAll, q.UserVerbs(td.User{Name: "sam"}))
+
+	doc.Users["ann"] = td.VerbWrite
+	assert.Equal(t, td.VerbRead, p.UserVerbs(td.User{Name: "ann"}), "a document is a copy")
+	assert.Nil(t, p.SetDocument(doc))
+	assert.Equal(t, td.VerbRead|td.VerbWrite, p.UserVerbs(td.User{Name: "ann"}), "public files are readable")
+}
+
+func TestFilePermission_SetDocumentIf(t *testing.T) {
+	p := NewFilePermission()
+	old, _ := p.Document()
+	doc := td.PermissionDocument{Version: td.PermissionVersion, Users: map[string]td.Verb{"sam": td.VerbAll}}
+	assert.Nil(t, p.SetDocumentIf(old, doc))
+	assert.Equal(t, td.VerbNone, p.UserVerbs(td.User{Name: "tom"}))
+
+	err := p.SetDocumentIf(old, td.PermissionDocument{Version: td.PermissionVersion, All: td.VerbAll})
+	if assert.IsType(t, &td.PermissionError{}, err) {
+		assert.Equal(t, td.PermissionChanged, err.(*td.PermissionError).Kind)
+	}
+	assert.Equal(t, td.VerbNone, p.UserVerbs(td.User{Name: "tom"}), "nothing changed")
+}
+
+func TestParsePermissionDocument(t *testing.T) {
+	kind := func(err error) string {
+		if e, ok := err.(*td.PermissionError); ok {
+			return e.Kind
+		}
+		return ""
+	}
+	doc, err := td.ParsePermissionDocument([]byte(`{"version":1,"all":"read"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, td.PermissionDocument{Version: 1, All: td.VerbRead, Users: map[string]td.Verb{},
+		Groups: map[string]td.Verb{}, Codes: map[string]td.Verb{}, PublicCodes: []string{}}, doc)
+
+	for body, want := range map[string]string{
+		`{"all":"read"}`:                                  td.PermissionUnsupportedVersion,
+		`{"version":2,"owner":"sam"}`:                     td.PermissionUnsupportedVersion,
+		`{"version":1,"al":"read"}`:                       td.PermissionInvalid,
+		`{"version":1,"users":{"sam":"fly"}}`:             td.PermissionInvalid,
+		`{"version":1,"users":{"":"read"}}`:               td.PermissionInvalid,
+		`{"version":1,"codes":{"x1":"none"}}`:             td.PermissionInvalid,
+		`{"version":1,"public_codes":["x1"]}`:             td.PermissionInvalid,
+		`{"version":1,"public":true,"public_codes":[""]}`: td.PermissionInvalid,
+		`[`: td.PermissionInvalid,
+	} {
+		_, err := td.ParsePermissionDocument([]byte(body))
+		assert.Equal(t, want, kind(err), body)
+	}
+	assert.Equal(t, td.PermissionUnsupportedVersion, kind(NewFilePermission().SetDocument(td.PermissionDocument{})))
+}
+
+func TestFileService_OwnerUsage(t *testing.T) {
+	fs := NewFileService()
+	usage := func(owner string) int64 {
+		n, err := fs.OwnerUsage(owner)
+		assert.Nil(t, err)
+		return n
+	}
+	f, _ := fs.Open("/a", os.O_CREATE|os.O_RDWR, nil)
+	_, _ = f.Write([]byte("12345"))
+	assert.Equal(t, int64(0), usage("sam"), "a file without owner counts for nobody")
+	_ = f.WriteMeta(td.MetaOwner, "sam")
+	assert.Equal(t, int64(5), usage("sam"))
+	_, _ = f.Write([]byte("678"))
+	assert.Equal(t, int64(8), usage("sam"))
+	_ = f.Truncate(2, nil)
+	assert.Equal(t, int64(2), usage("sam"))
+	_ = f.WriteMeta(td.MetaOwner, "tom")
+	assert.Equal(t, int64(0), usage("sam"))
+	assert.Equal(t, int64(2), usage("tom"))
+
+	g, _ := fs.Open("/b", os.O_CREATE|os.O_RDWR, nil)
+	_ = g.WriteMeta(td.MetaOwner, "sam")
+	_, _ = g.Write([]byte("123"))
+	assert.Nil(t, fs.Rename("/a", "/b", ""))
+	assert.Equal(t, int64(0), usage("tom"), "a replaced file is no longer counted")
+	assert.Equal(t, int64(3), usage("sam"))
+	assert.Nil(t, fs.Remove("/a", ""))
+	assert.Equal(t, int64(0), usage("sam"))
+
+	// handles still open after a remove or replace are not counted
+	_, _ = g.Write([]byte("456"))
+	_ = g.Truncate(0, []byte("123456789"))
+	_ = g.WriteMeta(td.MetaOwner, "tom")
+	_, _ = f.Write([]byte("9"))
+	assert.Equal(t, int64(0), usage("sam"))
+	assert.Equal(t, int64(0), usage("tom"))
+}
@@ -0,0 +1,43 @@
+package mock
+
+import (
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"sync"
+)
+
+type Storage struct {
+	rw sync.RWMutex
+	m  map[string]interface{}
+}
+
+func NewStorage() *Storage {
+	return &Storage{m: make(map[string]interface{})}
+}
+
+func (s *Storage) Put(name string, value interface{}) (err error) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.m[name] = value
+	return nil
+}
+
+func (s *Storage) Get(name string) (value interface{}, err error) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	value, ok := s.m[name]
+	if !ok {
+		return nil, &storage.StorageError{Kind: storage.NotFound}
+	}
+	return value, nil
+}
+
+// healthKey is written and read back by Health.
+const healthKey = "health/probe"
+
+func (s *Storage) Health() error {
+	if err := s.Put(healthKey, []byte("ok")); err != nil {
+		return err
+	}
+	_, err := s.Get(healthKey)
+	return err
+}
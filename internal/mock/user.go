@@ -2,44 +2,73 @@ package mock
 
 import (
 	td "github.com/huangjiahua/tempdesk"
+	"sort"
+	"sync"
 )
 
 type UserService struct {
-	M map[string]td.User
+	rw sync.RWMutex
+	m  map[string]td.User
 }
 
 func NewUserService() *UserService {
-	return &UserService{make(map[string]td.User)}
+	return &UserService{m: make(map[string]td.User)}
 }
 
 func (u *UserService) CreateUser(user td.User) (err error) {
-	if _, ok := u.M[user.Name]; ok {
+	u.rw.Lock()
+	defer u.rw.Unlock()
+	if _, ok := u.m[user.Name]; ok {
 		err = &td.UserServiceError{Kind: td.NameAlreadyExists, Err: nil}
 		return
 	}
-	u.M[user.Name] = user
+	u.m[user.Name] = user.Copy()
 	return
 }
 
 func (u *UserService) UpdateUser(user td.User) (err error) {
-	if _, ok := u.M[user.Name]; !ok {
+	u.rw.Lock()
+	defer u.rw.Unlock()
+	if _, ok := u.m[user.Name]; !ok {
 		err = &td.UserServiceError{Kind: td.NameNotExists, Err: nil}
 		return
 	}
-	u.M[user.Name] = user
+	u.m[user.Name] = user.Copy()
 	return
 }
 
 func (u *UserService) DeleteUser(user td.User) (err error) {
-	if _, ok := u.M[user.Name]; !ok {
+	u.rw.Lock()
+	defer u.rw.Unlock()
+	if _, ok := u.m[user.Name]; !ok {
 		err = &td.UserServiceError{Kind: td.NameNotExists, Err: nil}
 		return
 	}
-	delete(u.M, user.Name)
+	delete(u.m, user.Name)
 	return
 }
 
 func (u *UserService) User(name string) (user td.User, ok bool) {
-	user, ok = u.M[name]
+	u.rw.RLock()
+	defer u.rw.RUnlock()
+	user, ok = u.m[name]
+	if ok {
+		user = user.Copy()
+	}
 	return
 }
+
+func (u *UserService) Users() (users []td.User, err error) {
+	u.rw.RLock()
+	defer u.rw.RUnlock()
+	for _, user := range u.m {
+		users = append(users, user.Copy())
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+// Health reports the UserService as healthy, it lives in memory.
+func (u *UserService) Health() error {
+	return nil
+}
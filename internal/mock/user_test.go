@@ -0,0 +1,13 @@
+package mock
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/servicetest"
+	"testing"
+)
+
+func TestUserService(t *testing.T) {
+	servicetest.TestUserService(t, func() td.UserService {
+		return NewUserService()
+	})
+}
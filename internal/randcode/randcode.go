@@ -0,0 +1,25 @@
+// Package randcode makes the random codes handed to people, such as share
+// codes, invite codes and recovery codes.
+package randcode
+
+import (
+	"crypto/rand"
+	"strings"
+)
+
+// Alphabet leaves out characters that are easily confused when a code is
+// read out or typed in, like "l", "1", "o" and "0".
+const Alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// New returns a random code of n characters from Alphabet.
+func New(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, c := range b {
+		sb.WriteByte(Alphabet[int(c)%len(Alphabet)])
+	}
+	return sb.String(), nil
+}
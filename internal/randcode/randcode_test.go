@@ -0,0 +1,18 @@
+package randcode
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	a, err := New(10)
+	assert.Nil(t, err)
+	assert.Len(t, a, 10)
+	for _, r := range a {
+		assert.True(t, strings.ContainsRune(Alphabet, r), "%q is not in the alphabet", r)
+	}
+	b, _ := New(10)
+	assert.NotEqual(t, a, b)
+}
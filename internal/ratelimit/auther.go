@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"net/http"
+)
+
+type Auther struct {
+	auth.UserAuther
+	l *Limiter
+}
+
+// Auther wraps a to count the failed authentications of every user name
+// and client IP toward the lockouts, and to report NoUser as NotAuthed if
+// the policy is Uniform.
+func (l *Limiter) Auther(a auth.UserAuther) *Auther {
+	return &Auther{UserAuther: a, l: l}
+}
+
+func (a *Auther) AuthUser(req *http.Request, us td.UserService) (td.User, error) {
+	log := tlog.Ctx(req.Context())
+	ip := thttp.ClientIP(req)
+	user, err := a.UserAuther.AuthUser(req, us)
+	if err == nil {
+		if err := a.l.Succeed(user.Name, ip); err != nil {
+			log.Error("error resetting lockout", tlog.Err(err))
+		}
+		return user, nil
+	}
+
+	e, ok := err.(*auth.AutherError)
+	if !ok {
+		return user, err
+	}
+	uniform := a.l.Policy().Uniform
+	if uniform && e.Kind == auth.NoUser {
+		err = &auth.AutherError{Kind: auth.NotAuthed, Detail: "Not Authed"}
+	}
+	name := auth.ClaimedUser(req)
+	if name == "" || !(e.Kind == auth.NotAuthed || uniform && e.Kind == auth.NoUser) {
+		return user, err
+	}
+	locked, ferr := a.l.Fail(name, ip)
+	if ferr != nil {
+		log.Error("error counting authentication failure", tlog.Err(ferr))
+	} else if locked > 0 {
+		log.Warn("client locked out of user name", tlog.String("user", name), tlog.String("ip", ip), tlog.Duration("for", locked))
+	}
+	return user, err
+}
@@ -0,0 +1,260 @@
+// Package ratelimit slows down guessing keys. Token buckets limit the
+// requests of every client IP and of every user name they claim, and a
+// client IP whose requests for a user name keep failing authentication is
+// locked out of the name for longer and longer. Failures of a user name
+// from all addresses together lock it out for every client after a larger
+// number, so spreading the guesses over many addresses does not help.
+//
+// The limits of a user name and its lockout for every client are a price:
+// whoever claims a name spends its tokens and failures, and can slow down
+// or lock out its user that way. Keep the per-name limits well above what
+// one client may do.
+package ratelimit
+
+import (
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	tlog "github.com/huangjiahua/tempdesk/pkg/log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrorTooManyRequests is the body of a response to a limited request.
+const ErrorTooManyRequests = "too many requests"
+
+// Rate fills a token bucket, every request takes a token.
+type Rate struct {
+	// PerMinute is how many tokens are added each minute, the requests
+	// are not limited while it is 0.
+	PerMinute int
+	// Burst is how many tokens the bucket holds, PerMinute if 0.
+	Burst int
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return float64(r.PerMinute)
+}
+
+// every returns how long it takes to add one token.
+func (r Rate) every() time.Duration {
+	return time.Minute / time.Duration(r.PerMinute)
+}
+
+// Lockout locks out after After failed authentications in a row, for
+// Duration and then twice as long for each further failure, up to Max,
+// which is at least Duration. The failures are forgotten Max after the last
+// one or the end of the last lockout, and on a successful authentication.
+type Lockout struct {
+	// After is 0 to never lock out.
+	After    int
+	Duration time.Duration
+	Max      time.Duration
+}
+
+// duration returns how long the failures lock out for.
+func (lo Lockout) duration(failures int) time.Duration {
+	if lo.After <= 0 || failures < lo.After {
+		return 0
+	}
+	d, max := lo.Duration, lo.max()
+	for i := lo.After; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (lo Lockout) max() time.Duration {
+	if lo.Max < lo.Duration {
+		return lo.Duration
+	}
+	return lo.Max
+}
+
+type Policy struct {
+	IP   Rate
+	User Rate
+	// Lockout locks a client IP out of a user name it keeps failing for.
+	Lockout Lockout
+	// NameLockout locks every client out of a user name that keeps failing
+	// from any addresses, its After should be well above that of Lockout.
+	NameLockout Lockout
+	// Uniform reports NoUser as NotAuthed and counts it toward a lockout
+	// as well, so neither tells whether a user exists.
+	Uniform bool
+}
+
+// Limiter enforces a Policy with its state in a Store. Middleware rejects
+// the requests over a rate or of a locked out client, Auther counts the
+// failures which lock it out.
+type Limiter struct {
+	Store Store
+	// Now is replaceable for tests.
+	Now func() time.Time
+
+	mu     sync.RWMutex
+	policy Policy
+}
+
+func New(store Store, p Policy) *Limiter {
+	return &Limiter{Store: store, policy: p}
+}
+
+// SetPolicy changes the policy, it is safe to call while requests are
+// served.
+func (l *Limiter) SetPolicy(p Policy) {
+	l.mu.Lock()
+	l.policy = p
+	l.mu.Unlock()
+}
+
+func (l *Limiter) Policy() Policy {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.policy
+}
+
+func (l *Limiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// take takes a token from the bucket key filling at r. It returns how long
+// until there is one if there is none now.
+func (l *Limiter) take(key string, r Rate) (time.Duration, error) {
+	if r.PerMinute <= 0 {
+		return 0, nil
+	}
+	now := l.now()
+	burst, every := r.burst(), r.every()
+	var wait time.Duration
+	_, err := l.Store.Update(key, now, func(e Entry) Entry {
+		tokens := burst
+		if !e.Last.IsZero() {
+			tokens = math.Min(burst, e.Tokens+float64(now.Sub(e.Last))/float64(every))
+		}
+		if tokens < 1 {
+			wait = time.Duration((1 - tokens) * float64(every))
+		} else {
+			tokens--
+		}
+		// a full bucket is the same as none
+		expires := now.Add(time.Duration((burst - tokens) * float64(every)))
+		return Entry{Tokens: tokens, Last: now, Expires: expires}
+	})
+	return wait, err
+}
+
+// Locked returns how much longer the client ip is locked out of name, 0 if
+// it is not.
+func (l *Limiter) Locked(name, ip string) (time.Duration, error) {
+	now := l.now()
+	var wait time.Duration
+	for _, key := range []string{lockKey(name, ip), nameLockKey(name)} {
+		e, err := l.Store.Update(key, now, func(e Entry) Entry { return e })
+		if err != nil {
+			return 0, err
+		}
+		if now.Before(e.Until) && e.Until.Sub(now) > wait {
+			wait = e.Until.Sub(now)
+		}
+	}
+	return wait, nil
+}
+
+// Fail counts a failed authentication of name from the client ip and
+// returns how long ip is locked out of name for now.
+func (l *Limiter) Fail(name, ip string) (time.Duration, error) {
+	p := l.Policy()
+	now := l.now()
+	var wait time.Duration
+	for _, c := range []struct {
+		key string
+		lo  Lockout
+	}{{lockKey(name, ip), p.Lockout}, {nameLockKey(name), p.NameLockout}} {
+		if c.lo.After <= 0 {
+			continue
+		}
+		e, err := l.Store.Update(c.key, now, func(e Entry) Entry {
+			e.Failures++
+			e.Until = now.Add(c.lo.duration(e.Failures))
+			e.Expires = e.Until.Add(c.lo.max())
+			return e
+		})
+		if err != nil {
+			return 0, err
+		}
+		if now.Before(e.Until) && e.Until.Sub(now) > wait {
+			wait = e.Until.Sub(now)
+		}
+	}
+	return wait, nil
+}
+
+// Succeed forgets the failures of name, from the client ip and from all
+// addresses together.
+func (l *Limiter) Succeed(name, ip string) error {
+	for _, key := range []string{lockKey(name, ip), nameLockKey(name)} {
+		if _, err := l.Store.Update(key, l.now(), func(e Entry) Entry { return Entry{} }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func lockKey(name, ip string) string {
+	return "lockout/" + ip + "/" + name
+}
+
+func nameLockKey(name string) string {
+	return "lockout-name/" + name
+}
+
+// Middleware rejects a request with 429 Too Many Requests and a Retry-After
+// header when its client IP is locked out of the user name it claims, or
+// its client IP or user name is over its rate. A request is let through
+// when the store fails, the failure is logged.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		log := tlog.Ctx(req.Context())
+		wait, reason, err := l.check(req)
+		if err != nil {
+			log.Error("error checking rate limit", tlog.Err(err))
+		}
+		if wait <= 0 {
+			next.ServeHTTP(res, req)
+			return
+		}
+		log.Debug("request limited", tlog.String("reason", reason))
+		res.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+		http.Error(res, ErrorTooManyRequests, http.StatusTooManyRequests)
+	})
+}
+
+func (l *Limiter) check(req *http.Request) (time.Duration, string, error) {
+	p := l.Policy()
+	name, ip := auth.ClaimedUser(req), thttp.ClientIP(req)
+	if name != "" {
+		if wait, err := l.Locked(name, ip); wait > 0 || err != nil {
+			return wait, "lockout", err
+		}
+	}
+	if wait, err := l.take("ip/"+ip, p.IP); wait > 0 || err != nil {
+		return wait, "ip", err
+	}
+	if name == "" {
+		return 0, "", nil
+	}
+	wait, err := l.take("user/"+name, p.User)
+	return wait, "user", err
+}
@@ -0,0 +1,231 @@
+package ratelimit
+
+import (
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time { return c.now }
+
+func (c *clock) Add(d time.Duration) { c.now = c.now.Add(d) }
+
+func newLimiter(p Policy) (*Limiter, *clock) {
+	c := &clock{now: time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)}
+	l := New(NewMemoryStore(), p)
+	l.Now = c.Now
+	return l, c
+}
+
+// request claims the user name, if any, from the client IP.
+func request(ip, name string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/file/a.txt", nil)
+	req.RemoteAddr = ip + ":51234"
+	if name != "" {
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		req.Header.Set("Authorization", "HMAC "+name+" xxx")
+	}
+	return req
+}
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestLimiter_Middleware(t *testing.T) {
+	l, c := newLimiter(Policy{
+		IP:   Rate{PerMinute: 60, Burst: 3},
+		User: Rate{PerMinute: 6},
+	})
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve(h, request("10.0.0.1", "")).Code, "request %d", i)
+	}
+	w := serve(h, request("10.0.0.1", ""))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the burst is used up")
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, serve(h, request("10.0.0.2", "")).Code, "other IPs have their own bucket")
+
+	c.Add(time.Second)
+	assert.Equal(t, http.StatusOK, serve(h, request("10.0.0.1", "")).Code, "a token a second")
+	assert.Equal(t, http.StatusTooManyRequests, serve(h, request("10.0.0.1", "")).Code)
+
+	// six a minute for a user name, from whatever IPs
+	for i := 0; i < 6; i++ {
+		ip := fmt.Sprintf("10.0.1.%d", i)
+		assert.Equal(t, http.StatusOK, serve(h, request(ip, "sam")).Code, "request %d", i)
+	}
+	w = serve(h, request("10.0.1.9", "sam"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, serve(h, request("10.0.1.9", "tom")).Code)
+
+	l.SetPolicy(Policy{})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, serve(h, request("10.0.0.1", "sam")).Code, "no limits")
+	}
+}
+
+func TestLimiter_Lockout(t *testing.T) {
+	l, c := newLimiter(Policy{Lockout: Lockout{After: 3, Duration: time.Minute, Max: 5 * time.Minute}})
+
+	locked := func() time.Duration {
+		d, err := l.Locked("sam", "10.0.0.1")
+		assert.Nil(t, err)
+		return d
+	}
+	fail := func() time.Duration {
+		d, err := l.Fail("sam", "10.0.0.1")
+		assert.Nil(t, err)
+		return d
+	}
+
+	assert.Equal(t, time.Duration(0), fail())
+	assert.Equal(t, time.Duration(0), fail())
+	assert.Equal(t, time.Minute, fail())
+	assert.Equal(t, time.Minute, locked())
+	d, err := l.Locked("sam", "10.0.0.2")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), d, "other clients are not locked out")
+	c.Add(time.Minute)
+	assert.Equal(t, time.Duration(0), locked())
+
+	assert.Equal(t, 2*time.Minute, fail(), "each further failure doubles the lockout")
+	c.Add(2 * time.Minute)
+	assert.Equal(t, 4*time.Minute, fail())
+	c.Add(4 * time.Minute)
+	assert.Equal(t, 5*time.Minute, fail(), "up to Max")
+
+	c.Add(5*time.Minute + 5*time.Minute)
+	assert.Equal(t, time.Duration(0), fail(), "failures are forgotten Max after the lockout")
+
+	_ = fail()
+	assert.Nil(t, l.Succeed("sam", "10.0.0.1"))
+	_ = fail()
+	assert.Equal(t, time.Duration(0), fail(), "a success forgets the failures")
+	assert.Equal(t, time.Minute, fail())
+	d, err = l.Locked("tom", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), d)
+}
+
+func TestLimiter_NameLockout(t *testing.T) {
+	l, c := newLimiter(Policy{
+		Lockout:     Lockout{After: 3, Duration: time.Minute, Max: time.Hour},
+		NameLockout: Lockout{After: 5, Duration: time.Minute, Max: time.Hour},
+	})
+
+	for i := 0; i < 4; i++ {
+		d, err := l.Fail("sam", fmt.Sprintf("10.0.0.%d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, time.Duration(0), d)
+	}
+	d, err := l.Fail("sam", "10.0.0.9")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, d, "failures from many IPs add up")
+	d, err = l.Locked("sam", "192.0.2.1")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, d, "every client is locked out")
+	d, err = l.Locked("tom", "192.0.2.1")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), d)
+
+	c.Add(time.Minute)
+	d, err = l.Locked("sam", "192.0.2.1")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), d)
+	assert.Nil(t, l.Succeed("sam", "192.0.2.1"))
+	d, err = l.Fail("sam", "10.0.0.9")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), d, "a success forgets the failures of the name")
+}
+
+func TestAuther(t *testing.T) {
+	l, c := newLimiter(Policy{Lockout: Lockout{After: 2, Duration: time.Minute, Max: time.Hour}})
+	us := mock.NewUserService()
+	_ = us.CreateUser(td.User{Name: "sam", Key: "password"})
+	a := l.Auther(auth.NewHMACAuther())
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := a.AuthUser(req, us); err != nil {
+			http.Error(w, err.(*auth.AutherError).Kind, http.StatusForbidden)
+		}
+	}))
+
+	w := serve(h, request("10.0.0.1", "sam"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), auth.NotAuthed)
+	assert.Equal(t, http.StatusForbidden, serve(h, request("10.0.0.1", "sam")).Code)
+	w = serve(h, request("10.0.0.1", "sam"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "locked out")
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusForbidden, serve(h, request("10.0.0.2", "sam")).Code, "other IPs are not locked out")
+
+	// an unknown user is only locked out when the errors are uniform
+	for i := 0; i < 3; i++ {
+		w = serve(h, request("10.0.0.1", "tom"))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), auth.NoUser)
+	}
+	l.SetPolicy(Policy{Lockout: Lockout{After: 2, Duration: time.Minute, Max: time.Hour}, Uniform: true})
+	for i := 0; i < 2; i++ {
+		w = serve(h, request("10.0.0.1", "bob"))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), auth.NotAuthed, "no sign that bob does not exist")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve(h, request("10.0.0.1", "bob")).Code)
+
+	// the right key resets the failures of sam
+	c.Add(time.Minute)
+	_, err := a.AuthUser(request("192.0.2.1", "sam"), us)
+	assert.NotNil(t, err)
+	c.Add(2 * time.Minute)
+	req := httptest.NewRequest(http.MethodGet, "/file/a.txt", nil)
+	client.Sign(req, "sam", "password", time.Now())
+	_, err = a.AuthUser(req, us)
+	assert.Nil(t, err)
+	d, _ := l.Locked("sam", "192.0.2.1")
+	assert.Equal(t, time.Duration(0), d)
+	_, _ = a.AuthUser(request("192.0.2.1", "sam"), us)
+	d, _ = l.Locked("sam", "192.0.2.1")
+	assert.Equal(t, time.Duration(0), d, "one failure after a success does not lock out")
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	count := func(at time.Time) func(e Entry) Entry {
+		return func(e Entry) Entry { return Entry{Failures: e.Failures + 1, Expires: at.Add(time.Minute)} }
+	}
+	get := func(e Entry) Entry { return e }
+
+	e, err := s.Update("a", now, count(now))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, e.Failures)
+	e, _ = s.Update("a", now, count(now))
+	assert.Equal(t, 2, e.Failures)
+	_, _ = s.Update("b", now.Add(50*time.Second), count(now.Add(50*time.Second)))
+	assert.Equal(t, 2, s.Len())
+
+	e, _ = s.Update("a", now.Add(55*time.Second), get)
+	assert.Equal(t, 2, e.Failures)
+	e, _ = s.Update("a", now.Add(time.Minute), get)
+	assert.Equal(t, Entry{}, e, "an expired entry is gone")
+	assert.Equal(t, 1, s.Len())
+
+	_, _ = s.Update("c", now.Add(3*time.Minute), get)
+	assert.Equal(t, 0, s.Len(), "expired entries are swept")
+}
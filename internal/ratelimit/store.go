@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// SweepInterval is how often a MemoryStore drops its expired entries.
+const SweepInterval = time.Minute
+
+// Entry is what a Limiter keeps under one key. A token bucket uses Tokens
+// and Last, a lockout Failures and Until.
+type Entry struct {
+	Tokens   float64
+	Last     time.Time
+	Failures int
+	Until    time.Time
+	// Expires is when the entry stops mattering, after which a Store may
+	// forget it.
+	Expires time.Time
+}
+
+// Store keeps the entries of a Limiter, in memory or somewhere servers
+// behind one address share.
+type Store interface {
+	// Update calls fn with the entry under key, the zero Entry if there is
+	// none or it expired at now, and keeps what fn returns. A zero Entry
+	// removes the key. Updates of one key must not interleave.
+	Update(key string, now time.Time, fn func(e Entry) Entry) (Entry, error)
+}
+
+// MemoryStore is a Store in memory, for a single server.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+	swept   time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]Entry)}
+}
+
+func (s *MemoryStore) Update(key string, now time.Time, fn func(e Entry) Entry) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) >= SweepInterval {
+		for k, e := range s.entries {
+			if !now.Before(e.Expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.swept = now
+	}
+
+	e, ok := s.entries[key]
+	if ok && !now.Before(e.Expires) {
+		e = Entry{}
+	}
+	e = fn(e)
+	if e == (Entry{}) {
+		delete(s.entries, key)
+	} else {
+		s.entries[key] = e
+	}
+	return e, nil
+}
+
+// Len returns how many entries are kept, expired ones included until they
+// are swept.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
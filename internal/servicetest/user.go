@@ -0,0 +1,208 @@
+// Package servicetest holds conformance suites that every backend of the
+// tempdesk service interfaces is expected to pass.
+package servicetest
+
+import (
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// TestUserService runs the UserService conformance suite. newService must
+// return a fresh, empty service on every call.
+func TestUserService(t *testing.T, newService func() td.UserService) {
+	t.Run("CreateAndLookup", func(t *testing.T) {
+		testUserCreateAndLookup(t, newService())
+	})
+	t.Run("Update", func(t *testing.T) {
+		testUserUpdate(t, newService())
+	})
+	t.Run("Delete", func(t *testing.T) {
+		testUserDelete(t, newService())
+	})
+	t.Run("Meta", func(t *testing.T) {
+		testUserMeta(t, newService())
+	})
+	t.Run("ConcurrentCreate", func(t *testing.T) {
+		testUserConcurrentCreate(t, newService())
+	})
+	t.Run("ConcurrentAccess", func(t *testing.T) {
+		testUserConcurrentAccess(t, newService())
+	})
+}
+
+func errIsUserKind(t *testing.T, err error, kind string) bool {
+	t.Helper()
+	e, ok := err.(*td.UserServiceError)
+	if !ok {
+		t.Errorf("Error is not a *UserServiceError: %#v", err)
+		return false
+	}
+	return assert.Equal(t, kind, e.Kind, "wrong error kind")
+}
+
+func testUserCreateAndLookup(t *testing.T, us td.UserService) {
+	_, ok := us.User("sam")
+	assert.False(t, ok, "empty service should not find a user")
+
+	user := td.User{Name: "sam", Key: "password"}
+	if err := us.CreateUser(user); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	got, ok := us.User("sam")
+	if !assert.True(t, ok, "cannot find created user") {
+		return
+	}
+	assert.Equal(t, "sam", got.Name, "wrong name")
+	assert.Equal(t, "password", got.Key, "wrong key")
+
+	_, ok = us.User("Sam")
+	assert.False(t, ok, "names should be case sensitive")
+
+	err := us.CreateUser(td.User{Name: "sam", Key: "other"})
+	errIsUserKind(t, err, td.NameAlreadyExists)
+
+	got, _ = us.User("sam")
+	assert.Equal(t, "password", got.Key, "failed create should not overwrite user")
+}
+
+func testUserUpdate(t *testing.T, us td.UserService) {
+	err := us.UpdateUser(td.User{Name: "sam", Key: "password"})
+	errIsUserKind(t, err, td.NameNotExists)
+
+	_, ok := us.User("sam")
+	assert.False(t, ok, "failed update should not create user")
+
+	if err = us.CreateUser(td.User{Name: "sam", Key: "password"}); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	if err = us.UpdateUser(td.User{Name: "sam", Key: "new-password"}); err != nil {
+		t.Fatalf("Update user: %v", err)
+	}
+
+	got, _ := us.User("sam")
+	assert.Equal(t, "new-password", got.Key, "update is not visible")
+}
+
+func testUserDelete(t *testing.T, us td.UserService) {
+	err := us.DeleteUser(td.User{Name: "sam"})
+	errIsUserKind(t, err, td.NameNotExists)
+
+	if err = us.CreateUser(td.User{Name: "sam", Key: "password"}); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	if err = us.CreateUser(td.User{Name: "tom", Key: "password"}); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	if err = us.DeleteUser(td.User{Name: "sam"}); err != nil {
+		t.Fatalf("Delete user: %v", err)
+	}
+
+	_, ok := us.User("sam")
+	assert.False(t, ok, "deleted user is still found")
+	_, ok = us.User("tom")
+	assert.True(t, ok, "delete removed the wrong user")
+
+	err = us.DeleteUser(td.User{Name: "sam"})
+	errIsUserKind(t, err, td.NameNotExists)
+
+	if err = us.CreateUser(td.User{Name: "sam", Key: "again"}); err != nil {
+		t.Fatalf("Name should be reusable after delete: %v", err)
+	}
+}
+
+func testUserMeta(t *testing.T, us td.UserService) {
+	meta := map[string]string{"email": "sam@example.com", "empty": "", "unicode": "桌面"}
+	if err := us.CreateUser(td.User{Name: "sam", Key: "password", Meta: meta}); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	got, _ := us.User("sam")
+	assert.Equal(t, meta, got.Meta, "meta does not round trip")
+
+	// neither the caller's map nor a looked up map may alias stored state
+	meta["email"] = "changed@example.com"
+	got.Meta["unicode"] = "changed"
+	again, _ := us.User("sam")
+	assert.Equal(t, "sam@example.com", again.Meta["email"], "stored meta aliases caller's map")
+	assert.Equal(t, "桌面", again.Meta["unicode"], "stored meta aliases returned map")
+
+	upd := map[string]string{"email": "new@example.com"}
+	if err := us.UpdateUser(td.User{Name: "sam", Key: "password", Meta: upd}); err != nil {
+		t.Fatalf("Update user: %v", err)
+	}
+	got, _ = us.User("sam")
+	assert.Equal(t, upd, got.Meta, "update should replace meta")
+
+	if err := us.CreateUser(td.User{Name: "tom", Key: "password"}); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	got, _ = us.User("tom")
+	assert.Empty(t, got.Meta, "user without meta should have empty meta")
+}
+
+func testUserConcurrentCreate(t *testing.T, us td.UserService) {
+	const workers = 32
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- us.CreateUser(td.User{Name: "sam", Key: fmt.Sprintf("key-%d", i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+			continue
+		}
+		errIsUserKind(t, err, td.NameAlreadyExists)
+	}
+	assert.Equal(t, 1, created, "exactly one concurrent create should win")
+
+	_, ok := us.User("sam")
+	assert.True(t, ok, "cannot find concurrently created user")
+}
+
+func testUserConcurrentAccess(t *testing.T, us td.UserService) {
+	const workers = 16
+	const rounds = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("user-%d", i)
+			for r := 0; r < rounds; r++ {
+				user := td.User{Name: name, Key: "key", Meta: map[string]string{"round": fmt.Sprint(r)}}
+				if err := us.CreateUser(user); err != nil {
+					t.Errorf("Create %v: %v", name, err)
+					return
+				}
+				if err := us.UpdateUser(user); err != nil {
+					t.Errorf("Update %v: %v", name, err)
+					return
+				}
+				if _, ok := us.User(name); !ok {
+					t.Errorf("Lookup %v failed", name)
+					return
+				}
+				if err := us.DeleteUser(user); err != nil {
+					t.Errorf("Delete %v: %v", name, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,188 @@
+// Package session keeps the sessions of users who logged in from a browser.
+// A session is found by a random token the browser holds in a cookie, and
+// ends when it expires, the user logs out or the key of the user changes.
+// Sessions are kept in memory, so a restart ends them too.
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CookieName is the cookie holding the token of a session.
+	CookieName = "tempdesk_session"
+
+	DefaultTTL = 12 * time.Hour
+
+	// TokenSize is the number of random bytes of a token.
+	TokenSize = 32
+)
+
+type Session struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// stamp identifies the key of the user when the session started.
+	stamp string
+}
+
+type Store struct {
+	Now func() time.Time
+
+	mu  sync.Mutex
+	ttl time.Duration
+	// sessions are found by the hash of their token, so the map gives
+	// none away.
+	sessions map[string]Session
+}
+
+func NewStore(ttl time.Duration) *Store {
+	return &Store{Now: time.Now, ttl: ttl, sessions: make(map[string]Session)}
+}
+
+// SetTTL changes how long new sessions last, it is safe to call while
+// requests are served.
+func (s *Store) SetTTL(ttl time.Duration) {
+	s.mu.Lock()
+	s.ttl = ttl
+	s.mu.Unlock()
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func stamp(key string) string {
+	sum := sha256.Sum256([]byte("tempdesk session\n" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Create starts a session of user and returns its token.
+func (s *Store) Create(user td.User) (string, Session, error) {
+	b := make([]byte, TokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", Session{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Now()
+	for h, sess := range s.sessions {
+		if !now.Before(sess.Expires) {
+			delete(s.sessions, h)
+		}
+	}
+	sess := Session{Name: user.Name, Created: now.UTC(), Expires: now.Add(s.ttl).UTC(), stamp: stamp(user.Key)}
+	s.sessions[hash(token)] = sess
+	return token, sess, nil
+}
+
+// Get returns the session of token while it lasts.
+func (s *Store) Get(token string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := hash(token)
+	sess, ok := s.sessions[h]
+	if ok && !s.Now().Before(sess.Expires) {
+		delete(s.sessions, h)
+		return Session{}, false
+	}
+	return sess, ok
+}
+
+// Delete ends the session of token.
+func (s *Store) Delete(token string) {
+	s.mu.Lock()
+	delete(s.sessions, hash(token))
+	s.mu.Unlock()
+}
+
+// Len returns the number of sessions, expired ones not yet swept included.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Token returns the session token of req from an "Authorization: Session"
+// header or the session cookie, and whether it came from the cookie.
+func Token(req *http.Request) (token string, cookie bool) {
+	if a := req.Header.Get("Authorization"); a != "" {
+		if strings.HasPrefix(a, "Session ") {
+			return strings.TrimSpace(strings.TrimPrefix(a, "Session ")), false
+		}
+		return "", false
+	}
+	if c, err := req.Cookie(CookieName); err == nil {
+		return c.Value, true
+	}
+	return "", false
+}
+
+// Auther authenticates requests by their session. As a browser sends the
+// cookie with requests other sites make it send, a request changing
+// something with the cookie is refused when its Origin is another site.
+type Auther struct {
+	s *Store
+}
+
+func (s *Store) Auther() *Auther {
+	return &Auther{s: s}
+}
+
+// Presented reports whether req carries a session token.
+func (a *Auther) Presented(req *http.Request) bool {
+	token, _ := Token(req)
+	return token != ""
+}
+
+func (a *Auther) AuthUser(req *http.Request, us td.UserService) (td.User, error) {
+	token, cookie := Token(req)
+	if token == "" {
+		return td.User{}, &auth.AutherError{Kind: auth.WrongFormat, Detail: "Missing Session"}
+	}
+	if cookie && !safeMethod(req.Method) && !sameOrigin(req) {
+		return td.User{}, &auth.AutherError{Kind: auth.NotAuthed, Detail: "Cross Origin Request"}
+	}
+	sess, ok := a.s.Get(token)
+	if !ok {
+		return td.User{}, &auth.AutherError{Kind: auth.Outdated, Detail: "Session Ended"}
+	}
+	user, ok := us.User(sess.Name)
+	if !ok || !hmac.Equal([]byte(stamp(user.Key)), []byte(sess.stamp)) {
+		a.s.Delete(token)
+		return td.User{}, &auth.AutherError{Kind: auth.Outdated, Detail: "Session Ended"}
+	}
+	if err := auth.CheckActive(user); err != nil {
+		return td.User{}, err
+	}
+	return user, nil
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sameOrigin reports whether req has no Origin header or one of its own
+// host.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(time.Hour)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+
+	token, sess, err := s.Create(td.User{Name: "sam", Key: "sam key"})
+	assert.Nil(t, err)
+	assert.Equal(t, "sam", sess.Name)
+	assert.Equal(t, now.Add(time.Hour), sess.Expires)
+	got, ok := s.Get(token)
+	assert.True(t, ok)
+	assert.Equal(t, sess, got)
+	_, ok = s.Get("other")
+	assert.False(t, ok)
+
+	now = now.Add(time.Hour)
+	_, ok = s.Get(token)
+	assert.False(t, ok, "the session expired")
+	assert.Equal(t, 0, s.Len())
+
+	s.SetTTL(time.Minute)
+	old, _, _ := s.Create(td.User{Name: "sam"})
+	now = now.Add(time.Minute)
+	token, _, _ = s.Create(td.User{Name: "tom"})
+	assert.Equal(t, 1, s.Len(), "expired sessions are swept")
+	_, ok = s.Get(old)
+	assert.False(t, ok)
+	s.Delete(token)
+	_, ok = s.Get(token)
+	assert.False(t, ok)
+}
+
+func TestAuther(t *testing.T) {
+	s := NewStore(time.Hour)
+	us := mock.NewUserService()
+	sam := td.User{Name: "sam", Key: "sam key"}
+	_ = us.CreateUser(sam)
+	token, _, _ := s.Create(sam)
+	a := s.Auther()
+
+	kind := func(req *http.Request) string {
+		_, err := a.AuthUser(req, us)
+		if e, ok := err.(*auth.AutherError); ok {
+			return e.Kind
+		}
+		return ""
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/file/", nil)
+	assert.False(t, a.Presented(req))
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+	assert.True(t, a.Presented(req))
+	user, err := a.AuthUser(req, us)
+	assert.Nil(t, err)
+	assert.Equal(t, "sam", user.Name)
+
+	req = httptest.NewRequest(http.MethodPut, "http://example.com/file/a", nil)
+	req.Header.Set("Authorization", "Session "+token)
+	req.Header.Set("Origin", "https://evil.example")
+	assert.Equal(t, "", kind(req), "a header is not sent by other sites")
+	req.Header.Del("Authorization")
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+	assert.Equal(t, auth.NotAuthed, kind(req))
+	req.Header.Set("Origin", "http://example.com")
+	assert.Equal(t, "", kind(req))
+
+	sam.Meta = map[string]string{td.MetaDisabled: "true"}
+	_ = us.UpdateUser(sam)
+	assert.Equal(t, auth.Disabled, kind(req))
+
+	sam.Key, sam.Meta = "new key", nil
+	_ = us.UpdateUser(sam)
+	assert.Equal(t, auth.Outdated, kind(req), "a new key ends the session")
+	assert.Equal(t, 0, s.Len())
+}
@@ -0,0 +1,192 @@
+// Package share keeps share codes: short random codes that let anyone
+// holding one download a file until the code expires or is revoked.
+package share
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/huangjiahua/tempdesk/internal/randcode"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ShareNotExist = "share not exists"
+	InvalidShare  = "invalid share"
+
+	// DefaultTTL is used when a share is created without a TTL.
+	DefaultTTL = 24 * time.Hour
+	// MaxTTL bounds how long a share may live.
+	MaxTTL = 30 * 24 * time.Hour
+
+	// CodeLength is the number of characters in a code.
+	CodeLength = 10
+
+	sharesKey = "share/codes"
+)
+
+type Share struct {
+	Code    string    `json:"code"`
+	Path    string    `json:"path"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+type ShareError struct {
+	Kind string
+	Err  error
+}
+
+func (s *ShareError) Error() string {
+	if s.Err != nil {
+		return s.Kind + ": " + s.Err.Error()
+	}
+	return s.Kind
+}
+
+type Service struct {
+	store storage.PutterGetter
+
+	Now func() time.Time
+
+	mu     sync.Mutex
+	shares map[string]Share
+}
+
+// NewService loads the shares from store.
+func NewService(store storage.PutterGetter) (*Service, error) {
+	s := &Service{store: store, Now: time.Now, shares: make(map[string]Share)}
+	value, err := store.Get(sharesKey)
+	if storage.IsNotFound(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return nil, &ShareError{Kind: "unexpected value stored under " + sharesKey}
+	}
+	if err = json.Unmarshal(b, &s.shares); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save stores shares without the expired ones, the caller holds mu.
+func (s *Service) save(shares map[string]Share) (map[string]Share, error) {
+	now := s.Now()
+	live := make(map[string]Share, len(shares))
+	for code, sh := range shares {
+		if now.Before(sh.Expires) {
+			live[code] = sh
+		}
+	}
+	b, err := json.Marshal(live)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.store.Put(sharesKey, b); err != nil {
+		return nil, err
+	}
+	return live, nil
+}
+
+// Create shares the file at path of owner for ttl, DefaultTTL when ttl is 0.
+func (s *Service) Create(path string, owner string, ttl time.Duration) (Share, error) {
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	if ttl < 0 || ttl > MaxTTL {
+		return Share{}, &ShareError{Kind: InvalidShare, Err: errors.New("ttl must be positive and at most " + MaxTTL.String())}
+	}
+	if path == "" || path == "/" {
+		return Share{}, &ShareError{Kind: InvalidShare, Err: errors.New("no file")}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, err := s.newCode()
+	if err != nil {
+		return Share{}, err
+	}
+	now := s.Now().UTC()
+	sh := Share{Code: code, Path: path, Owner: owner, Created: now, Expires: now.Add(ttl)}
+
+	shares := make(map[string]Share, len(s.shares)+1)
+	for c, old := range s.shares {
+		shares[c] = old
+	}
+	shares[code] = sh
+	if shares, err = s.save(shares); err != nil {
+		return Share{}, err
+	}
+	s.shares = shares
+	return sh, nil
+}
+
+// newCode returns a code that is not in use, the caller holds mu.
+func (s *Service) newCode() (string, error) {
+	for {
+		code, err := randcode.New(CodeLength)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := s.shares[code]; !ok {
+			return code, nil
+		}
+	}
+}
+
+// Share returns the share with code unless it has expired.
+func (s *Service) Share(code string) (Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[strings.ToLower(code)]
+	if !ok || !s.Now().Before(sh.Expires) {
+		return Share{}, &ShareError{Kind: ShareNotExist}
+	}
+	return sh, nil
+}
+
+// Shares lists the live shares of owner, newest first.
+func (s *Service) Shares(owner string) []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Now()
+	ret := []Share{}
+	for _, sh := range s.shares {
+		if sh.Owner == owner && now.Before(sh.Expires) {
+			ret = append(ret, sh)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Created.After(ret[j].Created) })
+	return ret
+}
+
+// Revoke removes the share with code, which only its owner may do.
+func (s *Service) Revoke(code string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code = strings.ToLower(code)
+	sh, ok := s.shares[code]
+	if !ok || sh.Owner != owner {
+		return &ShareError{Kind: ShareNotExist}
+	}
+	shares := make(map[string]Share, len(s.shares))
+	for c, old := range s.shares {
+		if c != code {
+			shares[c] = old
+		}
+	}
+	shares, err := s.save(shares)
+	if err != nil {
+		return err
+	}
+	s.shares = shares
+	return nil
+}
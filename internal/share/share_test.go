@@ -0,0 +1,42 @@
+package share
+
+import (
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestService(t *testing.T) {
+	store := mock.NewStorage()
+	s, err := NewService(store)
+	assert.Nil(t, err)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+
+	_, err = s.Create("/a.txt", "sam", MaxTTL+time.Second)
+	assert.Equal(t, InvalidShare, err.(*ShareError).Kind)
+
+	sh, err := s.Create("/a.txt", "sam", 0)
+	assert.Nil(t, err)
+	assert.Len(t, sh.Code, CodeLength)
+	assert.Equal(t, now.Add(DefaultTTL), sh.Expires)
+	short, _ := s.Create("/b.txt", "sam", time.Minute)
+
+	got, err := s.Share(sh.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, "/a.txt", got.Path)
+
+	// shares survive a restart
+	s, err = NewService(store)
+	assert.Nil(t, err)
+	s.Now = func() time.Time { return now.Add(time.Hour) }
+	assert.Len(t, s.Shares("sam"), 1, "the short share should have expired")
+	_, err = s.Share(short.Code)
+	assert.Equal(t, ShareNotExist, err.(*ShareError).Kind)
+
+	assert.Equal(t, ShareNotExist, s.Revoke(sh.Code, "tom").(*ShareError).Kind, "only the owner may revoke")
+	assert.Nil(t, s.Revoke(sh.Code, "sam"))
+	_, err = s.Share(sh.Code)
+	assert.Equal(t, ShareNotExist, err.(*ShareError).Kind)
+}
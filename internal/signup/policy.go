@@ -0,0 +1,111 @@
+package signup
+
+import (
+	"fmt"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"net/mail"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DefaultNameMin = 2
+	DefaultNameMax = 64
+	DefaultKeyMin  = 8
+	// MaxKeyLength bounds a key whatever the policy says.
+	MaxKeyLength = 1024
+)
+
+// reservedMeta are the User.Meta keys only an admin may set.
+var reservedMeta = []string{td.MetaRole, td.MetaDisabled, td.MetaPending, td.MetaQuota, td.MetaEmailVerified, auth.MetaCertFingerprint}
+
+// Policy tells what names and keys new users may have.
+type Policy struct {
+	NameMin int
+	NameMax int
+	KeyMin  int
+}
+
+func DefaultPolicy() Policy {
+	return Policy{NameMin: DefaultNameMin, NameMax: DefaultNameMax, KeyMin: DefaultKeyMin}
+}
+
+// Problem is one way a sign up breaks the policy, Field is "name", "password"
+// or "meta.KEY" like the fields of the request.
+type Problem struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Check returns every problem of signing up name with key and meta, none if
+// the policy allows it.
+func (p Policy) Check(name, key string, meta map[string]string) []Problem {
+	var problems []Problem
+	bad := func(field, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n := utf8.RuneCountInString(name); n < p.NameMin || (p.NameMax > 0 && n > p.NameMax) {
+		bad("name", "must be %d to %d characters long", p.NameMin, p.NameMax)
+	}
+	for i, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			continue
+		}
+		if i == 0 || !strings.ContainsRune(td.NameSymbols, r) {
+			bad("name", "may only hold letters, digits and %q, and start with a letter or digit", td.NameSymbols)
+			break
+		}
+	}
+
+	problems = append(problems, p.CheckKey(name, key)...)
+
+	var keys []string
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if Reserved(k) {
+			bad("meta."+k, "may only be set by an admin")
+		}
+		if k == td.MetaEmail && !ValidEmail(meta[k]) {
+			bad("meta."+k, "is not an email address")
+		}
+	}
+	return problems
+}
+
+// Reserved reports whether only an admin may set the User.Meta key.
+func Reserved(key string) bool {
+	for _, r := range reservedMeta {
+		if key == r {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidEmail reports whether email is a bare address like "sam@example.com".
+func ValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Name == "" && addr.Address == email
+}
+
+// CheckKey returns the problems of key as the key of the user name.
+func (p Policy) CheckKey(name, key string) []Problem {
+	var problems []Problem
+	switch n := utf8.RuneCountInString(key); {
+	case n < p.KeyMin:
+		problems = append(problems, Problem{"password", fmt.Sprintf("must be at least %d characters long", p.KeyMin)})
+	case len(key) > MaxKeyLength:
+		problems = append(problems, Problem{"password", fmt.Sprintf("must be at most %d bytes long", MaxKeyLength)})
+	}
+	if key != "" && strings.EqualFold(key, name) {
+		problems = append(problems, Problem{"password", "must not be the name"})
+	}
+	return problems
+}
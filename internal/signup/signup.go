@@ -0,0 +1,300 @@
+// Package signup controls who may create an account: anyone, those with an
+// invite code an admin handed out, anyone but only once an admin approves
+// the account, or nobody. It also keeps the invite codes and checks new
+// names and keys against a Policy.
+package signup
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/huangjiahua/tempdesk/internal/randcode"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ModeOpen lets anyone sign up.
+	ModeOpen = "open"
+	// ModeInvite needs an invite code to sign up.
+	ModeInvite = "invite"
+	// ModeApproval lets anyone sign up, but the account is pending until
+	// an admin approves it.
+	ModeApproval = "approval"
+	// ModeClosed lets nobody sign up, admins add users themselves.
+	ModeClosed = "closed"
+
+	InviteNotExist = "invite not exists"
+	InviteUsedUp   = "invite used up"
+	InvalidInvite  = "invalid invite"
+	InvalidMode    = "invalid mode"
+
+	// DefaultInviteTTL is used when an invite is created without a TTL.
+	DefaultInviteTTL = 7 * 24 * time.Hour
+	// MaxInviteTTL bounds how long an invite may live.
+	MaxInviteTTL = 90 * 24 * time.Hour
+
+	// CodeLength is the number of characters in an invite code.
+	CodeLength = 16
+
+	invitesKey = "signup/invites"
+)
+
+// ValidMode reports whether mode is one of the modes.
+func ValidMode(mode string) bool {
+	switch mode {
+	case ModeOpen, ModeInvite, ModeApproval, ModeClosed:
+		return true
+	}
+	return false
+}
+
+// Invite lets MaxUses people sign up in ModeInvite until it expires, any
+// number of people if MaxUses is 0.
+type Invite struct {
+	Code    string    `json:"code"`
+	Creator string    `json:"creator"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	MaxUses int       `json:"max_uses"`
+	Uses    int       `json:"uses"`
+}
+
+// usable reports whether i may be used at now.
+func (i Invite) usable(now time.Time) bool {
+	return now.Before(i.Expires) && (i.MaxUses == 0 || i.Uses < i.MaxUses)
+}
+
+type SignupError struct {
+	Kind string
+	Err  error
+}
+
+func (s *SignupError) Error() string {
+	if s.Err != nil {
+		return s.Kind + ": " + s.Err.Error()
+	}
+	return s.Kind
+}
+
+// IsKind reports whether err is a SignupError of kind.
+func IsKind(err error, kind string) bool {
+	e, ok := err.(*SignupError)
+	return ok && e.Kind == kind
+}
+
+type Service struct {
+	store storage.PutterGetter
+
+	Now func() time.Time
+
+	mu      sync.Mutex
+	mode    string
+	policy  Policy
+	invites map[string]Invite
+}
+
+// NewService loads the invites from store, it starts in ModeOpen with the
+// DefaultPolicy.
+func NewService(store storage.PutterGetter) (*Service, error) {
+	s := &Service{store: store, Now: time.Now, mode: ModeOpen, policy: DefaultPolicy(), invites: make(map[string]Invite)}
+	value, err := store.Get(invitesKey)
+	if storage.IsNotFound(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return nil, &SignupError{Kind: "unexpected value stored under " + invitesKey}
+	}
+	if err = json.Unmarshal(b, &s.invites); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetMode changes the mode, it is safe to call while requests are served.
+func (s *Service) SetMode(mode string) error {
+	if !ValidMode(mode) {
+		return &SignupError{Kind: InvalidMode, Err: errors.New(mode)}
+	}
+	s.mu.Lock()
+	s.mode = mode
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Service) Mode() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mode
+}
+
+// SetPolicy changes the policy, it is safe to call while requests are
+// served.
+func (s *Service) SetPolicy(p Policy) {
+	s.mu.Lock()
+	s.policy = p
+	s.mu.Unlock()
+}
+
+func (s *Service) Policy() Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policy
+}
+
+// save stores invites without the expired ones, the caller holds mu. Used
+// up invites are kept until they expire, for Release and to be listed.
+func (s *Service) save(invites map[string]Invite) (map[string]Invite, error) {
+	now := s.Now()
+	live := make(map[string]Invite, len(invites))
+	for code, i := range invites {
+		if now.Before(i.Expires) {
+			live[code] = i
+		}
+	}
+	b, err := json.Marshal(live)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.store.Put(invitesKey, b); err != nil {
+		return nil, err
+	}
+	return live, nil
+}
+
+// change saves invites changed by fn, the caller holds mu.
+func (s *Service) change(fn func(invites map[string]Invite) error) error {
+	invites := make(map[string]Invite, len(s.invites)+1)
+	for c, i := range s.invites {
+		invites[c] = i
+	}
+	if err := fn(invites); err != nil {
+		return err
+	}
+	invites, err := s.save(invites)
+	if err != nil {
+		return err
+	}
+	s.invites = invites
+	return nil
+}
+
+// CreateInvite creates an invite of creator for maxUses sign ups, any
+// number if 0, within ttl, DefaultInviteTTL when ttl is 0.
+func (s *Service) CreateInvite(creator string, maxUses int, ttl time.Duration) (Invite, error) {
+	if ttl == 0 {
+		ttl = DefaultInviteTTL
+	}
+	if ttl < 0 || ttl > MaxInviteTTL {
+		return Invite{}, &SignupError{Kind: InvalidInvite, Err: errors.New("ttl must be positive and at most " + MaxInviteTTL.String())}
+	}
+	if maxUses < 0 {
+		return Invite{}, &SignupError{Kind: InvalidInvite, Err: errors.New("uses must not be negative")}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, err := s.newCode()
+	if err != nil {
+		return Invite{}, err
+	}
+	now := s.Now().UTC()
+	i := Invite{Code: code, Creator: creator, Created: now, Expires: now.Add(ttl), MaxUses: maxUses}
+	err = s.change(func(invites map[string]Invite) error {
+		invites[code] = i
+		return nil
+	})
+	if err != nil {
+		return Invite{}, err
+	}
+	return i, nil
+}
+
+// newCode returns a code that is not in use, the caller holds mu.
+func (s *Service) newCode() (string, error) {
+	for {
+		code, err := randcode.New(CodeLength)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := s.invites[code]; !ok {
+			return code, nil
+		}
+	}
+}
+
+// Invites lists the invites which have not expired, used up ones too,
+// newest first.
+func (s *Service) Invites() []Invite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Now()
+	ret := []Invite{}
+	for _, i := range s.invites {
+		if now.Before(i.Expires) {
+			ret = append(ret, i)
+		}
+	}
+	sort.Slice(ret, func(a, b int) bool { return ret[a].Created.After(ret[b].Created) })
+	return ret
+}
+
+// RevokeInvite removes the invite with code.
+func (s *Service) RevokeInvite(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code = strings.ToLower(code)
+	return s.change(func(invites map[string]Invite) error {
+		if _, ok := invites[code]; !ok {
+			return &SignupError{Kind: InviteNotExist}
+		}
+		delete(invites, code)
+		return nil
+	})
+}
+
+// Use takes one use of the invite with code, which fails if it has expired
+// or is used up.
+func (s *Service) Use(code string) (Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code = strings.ToLower(code)
+	now := s.Now()
+	var used Invite
+	err := s.change(func(invites map[string]Invite) error {
+		i, ok := invites[code]
+		if !ok || !now.Before(i.Expires) {
+			return &SignupError{Kind: InviteNotExist}
+		}
+		if !i.usable(now) {
+			return &SignupError{Kind: InviteUsedUp}
+		}
+		i.Uses++
+		invites[code] = i
+		used = i
+		return nil
+	})
+	return used, err
+}
+
+// Release gives back a use of the invite with code taken by Use, when the
+// sign up it was taken for failed. An invite revoked meanwhile stays
+// revoked.
+func (s *Service) Release(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code = strings.ToLower(code)
+	return s.change(func(invites map[string]Invite) error {
+		if i, ok := invites[code]; ok && i.Uses > 0 {
+			i.Uses--
+			invites[code] = i
+		}
+		return nil
+	})
+}
@@ -0,0 +1,104 @@
+package signup
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_Invites(t *testing.T) {
+	store := mock.NewStorage()
+	s, err := NewService(store)
+	assert.Nil(t, err)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+
+	_, err = s.CreateInvite("root", 1, MaxInviteTTL+time.Second)
+	assert.True(t, IsKind(err, InvalidInvite))
+	_, err = s.CreateInvite("root", -1, 0)
+	assert.True(t, IsKind(err, InvalidInvite))
+
+	once, err := s.CreateInvite("root", 1, 0)
+	assert.Nil(t, err)
+	assert.Len(t, once.Code, CodeLength)
+	assert.Equal(t, now.Add(DefaultInviteTTL), once.Expires)
+	many, _ := s.CreateInvite("root", 0, time.Hour)
+
+	_, err = s.Use(strings.ToUpper(once.Code))
+	assert.Nil(t, err, "codes are case insensitive")
+	_, err = s.Use(once.Code)
+	assert.True(t, IsKind(err, InviteUsedUp))
+	assert.Nil(t, s.Release(once.Code))
+	used, err := s.Use(once.Code)
+	assert.Nil(t, err, "a released use may be taken again")
+	assert.Equal(t, 1, used.Uses)
+
+	for i := 0; i < 5; i++ {
+		_, err = s.Use(many.Code)
+		assert.Nil(t, err)
+	}
+	_, err = s.Use("nosuchcode")
+	assert.True(t, IsKind(err, InviteNotExist))
+
+	// invites survive a restart
+	s, err = NewService(store)
+	assert.Nil(t, err)
+	s.Now = func() time.Time { return now.Add(2 * time.Hour) }
+	if invites := s.Invites(); assert.Len(t, invites, 1, "the short invite should have expired") {
+		assert.Equal(t, once.Code, invites[0].Code)
+		assert.Equal(t, 1, invites[0].Uses)
+	}
+	_, err = s.Use(many.Code)
+	assert.True(t, IsKind(err, InviteNotExist))
+
+	assert.Nil(t, s.RevokeInvite(once.Code))
+	assert.Nil(t, s.Release(once.Code))
+	assert.Empty(t, s.Invites(), "a revoked invite stays revoked")
+	assert.True(t, IsKind(s.RevokeInvite(once.Code), InviteNotExist))
+}
+
+func TestService_Mode(t *testing.T) {
+	s, _ := NewService(mock.NewStorage())
+	assert.Equal(t, ModeOpen, s.Mode())
+	assert.Nil(t, s.SetMode(ModeApproval))
+	assert.Equal(t, ModeApproval, s.Mode())
+	assert.True(t, IsKind(s.SetMode("members"), InvalidMode))
+	assert.Equal(t, ModeApproval, s.Mode())
+}
+
+func TestPolicy_Check(t *testing.T) {
+	p := DefaultPolicy()
+	assert.Empty(t, p.Check("sam", "correct horse", nil))
+	assert.Empty(t, p.Check("sam.wu@example.com", "correct horse", map[string]string{"team": "ops"}))
+	assert.Empty(t, p.Check("小明", "correct horse", nil))
+
+	fields := func(problems []Problem) []string {
+		var ret []string
+		for _, pr := range problems {
+			ret = append(ret, pr.Field+": "+pr.Message)
+		}
+		return ret
+	}
+	assert.Equal(t, []string{
+		"name: must be 2 to 64 characters long",
+		"password: must be at least 8 characters long",
+	}, fields(p.Check("s", "short", nil)))
+	assert.Equal(t, []string{
+		`name: may only hold letters, digits and "._-@", and start with a letter or digit`,
+		"password: must not be the name",
+	}, fields(p.Check("-sam sam", "-SAM SAM", nil)))
+	assert.Equal(t, []string{
+		"password: must be at most 1024 bytes long",
+		"meta.quota: may only be set by an admin",
+		"meta.role: may only be set by an admin",
+	}, fields(p.Check("sam", strings.Repeat("k", MaxKeyLength+1), map[string]string{td.MetaRole: td.RoleAdmin, td.MetaQuota: "0"})))
+	assert.Equal(t, []string{
+		"meta.email: is not an email address",
+		"meta.email_verified: may only be set by an admin",
+	}, fields(p.Check("sam", "correct horse", map[string]string{td.MetaEmail: "Sam <sam@example.com>", td.MetaEmailVerified: "true"})))
+	assert.Empty(t, p.Check("sam", "correct horse", map[string]string{td.MetaEmail: "sam@example.com"}))
+	assert.Equal(t, []string{"name: must be 2 to 64 characters long"}, fields(p.Check(strings.Repeat("s", 65), "correct horse", nil)))
+}
@@ -0,0 +1,18 @@
+// Package testutil holds helpers shared by the tests of several packages.
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TempDir returns a new directory which is removed when the test ends.
+func TempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tempdesk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
@@ -0,0 +1,98 @@
+package totp
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"net/http"
+	"sync"
+)
+
+const (
+	// ScopeHMAC is the scope of requests signed with the key of a user.
+	ScopeHMAC = "hmac"
+	// ScopeCert is the scope of requests with a client certificate.
+	ScopeCert = "cert"
+	// ScopePassword is the scope of logins with the key, which start a
+	// session.
+	ScopePassword = "password"
+
+	// HeaderCode carries the code of a request that needs one.
+	HeaderCode = "X-TOTP-Code"
+)
+
+// Guard asks users who enrolled for a code, in the scopes it does not skip.
+// Programmatic clients signing every request, whose key or certificate
+// stays on the machine, are usually skipped, while logins with a key a
+// person types are not.
+type Guard struct {
+	s *Service
+
+	mu   sync.Mutex
+	skip map[string]bool
+}
+
+func NewGuard(s *Service, skip []string) *Guard {
+	g := &Guard{s: s}
+	g.SetSkip(skip)
+	return g
+}
+
+// SetSkip changes the scopes that need no code, it is safe to call while
+// requests are served.
+func (g *Guard) SetSkip(scopes []string) {
+	skip := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		skip[scope] = true
+	}
+	g.mu.Lock()
+	g.skip = skip
+	g.mu.Unlock()
+}
+
+func (g *Guard) skips(scope string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.skip[scope]
+}
+
+type Auther struct {
+	auth.UserAuther
+	g     *Guard
+	scope string
+}
+
+// Auther wraps a, whose requests are of scope, to ask users who enrolled
+// for a code in HeaderCode unless the scope is skipped. A login takes a
+// recovery code too, other requests only a code of the secret.
+func (g *Guard) Auther(a auth.UserAuther, scope string) *Auther {
+	return &Auther{UserAuther: a, g: g, scope: scope}
+}
+
+// Presented asks the wrapped auther, so a Chain picks it like that one.
+func (a *Auther) Presented(req *http.Request) bool {
+	if p, ok := a.UserAuther.(auth.Presenter); ok {
+		return p.Presented(req)
+	}
+	return true
+}
+
+func (a *Auther) AuthUser(req *http.Request, us td.UserService) (td.User, error) {
+	user, err := a.UserAuther.AuthUser(req, us)
+	if err != nil || a.g.skips(a.scope) || !a.g.s.Enabled(user.Name) {
+		return user, err
+	}
+	code := req.Header.Get(HeaderCode)
+	if code == "" {
+		return td.User{}, &auth.AutherError{Kind: auth.SecondFactor, Detail: "TOTP Code Required"}
+	}
+	if a.scope == ScopePassword {
+		err = a.g.s.Verify(user.Name, code)
+	} else if !a.g.s.Valid(user.Name, code) {
+		err = &TOTPError{Kind: WrongCode}
+	}
+	if err != nil {
+		// counted toward a lockout like a wrong key
+		return td.User{}, &auth.AutherError{Kind: auth.NotAuthed, Detail: "Wrong TOTP Code"}
+	}
+	return user, nil
+}
@@ -0,0 +1,293 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/huangjiahua/tempdesk/internal/randcode"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NotEnrolled    = "totp not enrolled"
+	AlreadyEnabled = "totp already enabled"
+	WrongCode      = "wrong code"
+
+	// RecoveryCodes is how many recovery codes a user gets.
+	RecoveryCodes = 10
+
+	enrollmentsKey = "totp/enrollments"
+)
+
+// Enrollment is the second factor of a user. It protects logins once it is
+// Confirmed by a first code, which proves the app got the secret.
+type Enrollment struct {
+	Secret    string    `json:"secret"`
+	Confirmed bool      `json:"confirmed"`
+	Created   time.Time `json:"created"`
+	// Recovery holds the salted hashes of the unused recovery codes.
+	Recovery []string `json:"recovery,omitempty"`
+	// LastStep is the period of the last code a login used, no code of it
+	// or before works again.
+	LastStep int64 `json:"last_step,omitempty"`
+}
+
+type TOTPError struct {
+	Kind string
+	Err  error
+}
+
+func (t *TOTPError) Error() string {
+	if t.Err != nil {
+		return t.Kind + ": " + t.Err.Error()
+	}
+	return t.Kind
+}
+
+// IsKind reports whether err is a TOTPError of kind.
+func IsKind(err error, kind string) bool {
+	e, ok := err.(*TOTPError)
+	return ok && e.Kind == kind
+}
+
+type Service struct {
+	store storage.PutterGetter
+
+	// Issuer names the server in authenticator apps.
+	Issuer string
+	Now    func() time.Time
+
+	mu          sync.Mutex
+	enrollments map[string]Enrollment
+}
+
+// NewService loads the enrollments from store.
+func NewService(store storage.PutterGetter) (*Service, error) {
+	s := &Service{store: store, Issuer: DefaultIssuer, Now: time.Now, enrollments: make(map[string]Enrollment)}
+	value, err := store.Get(enrollmentsKey)
+	if storage.IsNotFound(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return nil, &TOTPError{Kind: "unexpected value stored under " + enrollmentsKey}
+	}
+	if err = json.Unmarshal(b, &s.enrollments); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// change saves the enrollments with the one of name changed by fn, which
+// deletes it by returning ok false. The caller holds mu.
+func (s *Service) change(name string, fn func(e Enrollment, found bool) (Enrollment, bool, error)) error {
+	e, found := s.enrollments[name]
+	e, ok, err := fn(e, found)
+	if err != nil {
+		return err
+	}
+	enrollments := make(map[string]Enrollment, len(s.enrollments)+1)
+	for n, e := range s.enrollments {
+		enrollments[n] = e
+	}
+	if ok {
+		enrollments[name] = e
+	} else {
+		delete(enrollments, name)
+	}
+	b, err := json.Marshal(enrollments)
+	if err != nil {
+		return err
+	}
+	if err = s.store.Put(enrollmentsKey, b); err != nil {
+		return err
+	}
+	s.enrollments = enrollments
+	return nil
+}
+
+// Enroll starts enrolling the user name with a new secret, replacing one
+// that was never confirmed, and returns the secret and its provisioning
+// URI.
+func (s *Service) Enroll(name string) (secret, uri string, err error) {
+	if secret, err = NewSecret(); err != nil {
+		return "", "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.change(name, func(e Enrollment, found bool) (Enrollment, bool, error) {
+		if found && e.Confirmed {
+			return e, true, &TOTPError{Kind: AlreadyEnabled}
+		}
+		return Enrollment{Secret: secret, Created: s.Now().UTC()}, true, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return secret, ProvisioningURI(s.Issuer, name, secret), nil
+}
+
+// Confirm enables the enrollment of name by a code of its secret and
+// returns the recovery codes, which are only kept hashed.
+func (s *Service) Confirm(name, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.change(name, func(e Enrollment, found bool) (Enrollment, bool, error) {
+		if !found {
+			return e, found, &TOTPError{Kind: NotEnrolled}
+		}
+		if e.Confirmed {
+			return e, true, &TOTPError{Kind: AlreadyEnabled}
+		}
+		st, ok := match(e.Secret, code, s.Now())
+		if !ok {
+			return e, true, &TOTPError{Kind: WrongCode}
+		}
+		e.Confirmed, e.Recovery, e.LastStep = true, hashes, st
+		return e, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Enabled reports whether name has confirmed a second factor.
+func (s *Service) Enabled(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enrollments[name].Confirmed
+}
+
+// RecoveryLeft returns how many recovery codes of name are unused.
+func (s *Service) RecoveryLeft(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.enrollments[name].Recovery)
+}
+
+// Verify checks a code of name at a login. It takes a code of the secret,
+// but none of a period a login used before, or an unused recovery code,
+// which is then used up.
+func (s *Service) Verify(name, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.change(name, func(e Enrollment, found bool) (Enrollment, bool, error) {
+		if !found || !e.Confirmed {
+			return e, found, &TOTPError{Kind: NotEnrolled}
+		}
+		if st, ok := match(e.Secret, code, s.Now()); ok && st > e.LastStep {
+			e.LastStep = st
+			return e, true, nil
+		}
+		for i, h := range e.Recovery {
+			if recoveryMatches(h, code) {
+				e.Recovery = append(e.Recovery[:i:i], e.Recovery[i+1:]...)
+				return e, true, nil
+			}
+		}
+		return e, true, &TOTPError{Kind: WrongCode}
+	})
+}
+
+// Valid reports whether code is a current code of the secret of name. Unlike
+// Verify it may be used again, as it accompanies every request of a client
+// rather than a login.
+func (s *Service) Valid(name, code string) bool {
+	s.mu.Lock()
+	e := s.enrollments[name]
+	s.mu.Unlock()
+	if !e.Confirmed {
+		return false
+	}
+	_, ok := match(e.Secret, code, s.Now())
+	return ok
+}
+
+// RenewRecovery replaces the recovery codes of name, once a login code
+// proves it is still the user.
+func (s *Service) RenewRecovery(name, code string) ([]string, error) {
+	if err := s.Verify(name, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.change(name, func(e Enrollment, found bool) (Enrollment, bool, error) {
+		if !found {
+			return e, found, &TOTPError{Kind: NotEnrolled}
+		}
+		e.Recovery = hashes
+		return e, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable removes the second factor of name, like when an admin resets it
+// for a user who lost it.
+func (s *Service) Disable(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.change(name, func(e Enrollment, found bool) (Enrollment, bool, error) {
+		if !found {
+			return e, false, &TOTPError{Kind: NotEnrolled}
+		}
+		return e, false, nil
+	})
+}
+
+// newRecoveryCodes returns RecoveryCodes codes like "abcde-fghjk" and their
+// hashes.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < RecoveryCodes; i++ {
+		var code string
+		if code, err = randcode.New(10); err != nil {
+			return nil, nil, err
+		}
+		code = code[:5] + "-" + code[5:]
+		salt := make([]byte, 8)
+		if _, err = rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hex.EncodeToString(salt)+"$"+hashRecovery(salt, code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecovery hashes code with salt, ignoring case and dashes.
+func hashRecovery(salt []byte, code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256(append(append([]byte{}, salt...), code...))
+	return hex.EncodeToString(sum[:])
+}
+
+func recoveryMatches(hash, code string) bool {
+	parts := strings.SplitN(hash, "$", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(hashRecovery(salt, code)), []byte(parts[1]))
+}
@@ -0,0 +1,159 @@
+package totp
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret "12345678901234567890" of RFC 6238.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// the last six digits of the eight digit codes of RFC 6238
+	for unix, code := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		got, err := Code(rfcSecret, time.Unix(unix, 0))
+		assert.Nil(t, err)
+		assert.Equal(t, code, got, "at %d", unix)
+	}
+
+	now := time.Unix(1111111109, 0)
+	_, ok := match(rfcSecret, "081804", now.Add(Period))
+	assert.True(t, ok, "a code may be late by a period")
+	_, ok = match(rfcSecret, "081804", now.Add(2*Period))
+	assert.False(t, ok)
+	_, ok = match(rfcSecret, "81804", now)
+	assert.False(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	secret, err := NewSecret()
+	assert.Nil(t, err)
+	assert.Len(t, secret, 32)
+
+	u, err := url.Parse(ProvisioningURI("TempDesk", "sam", secret))
+	assert.Nil(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/TempDesk:sam", u.Path)
+	assert.Equal(t, secret, u.Query().Get("secret"))
+	assert.Equal(t, "TempDesk", u.Query().Get("issuer"))
+	assert.Equal(t, "6", u.Query().Get("digits"))
+}
+
+func TestService(t *testing.T) {
+	store := mock.NewStorage()
+	s, err := NewService(store)
+	assert.Nil(t, err)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+
+	_, err = s.Confirm("sam", "000000")
+	assert.True(t, IsKind(err, NotEnrolled))
+	secret, uri, err := s.Enroll("sam")
+	assert.Nil(t, err)
+	assert.Contains(t, uri, "secret="+secret)
+	assert.False(t, s.Enabled("sam"), "not before it is confirmed")
+
+	code, _ := Code(secret, now)
+	_, err = s.Confirm("sam", "000000")
+	assert.True(t, IsKind(err, WrongCode))
+	recovery, err := s.Confirm("sam", code)
+	assert.Nil(t, err)
+	assert.Len(t, recovery, RecoveryCodes)
+	assert.True(t, s.Enabled("sam"))
+	_, _, err = s.Enroll("sam")
+	assert.True(t, IsKind(err, AlreadyEnabled))
+
+	assert.True(t, s.Valid("sam", code))
+	assert.True(t, IsKind(s.Verify("sam", code), WrongCode), "the code of the confirmation is used")
+	now = now.Add(Period)
+	code, _ = Code(secret, now)
+	assert.Nil(t, s.Verify("sam", code))
+	assert.True(t, IsKind(s.Verify("sam", code), WrongCode), "a code is only used once")
+
+	assert.Nil(t, s.Verify("sam", recovery[0]))
+	assert.True(t, IsKind(s.Verify("sam", recovery[0]), WrongCode))
+	assert.Equal(t, RecoveryCodes-1, s.RecoveryLeft("sam"))
+
+	loaded, err := NewService(store)
+	assert.Nil(t, err)
+	loaded.Now = s.Now
+	assert.True(t, loaded.Enabled("sam"))
+	assert.Nil(t, loaded.Verify("sam", recovery[1]), "codes are stored")
+	assert.Nil(t, s.Verify("sam", "  "+recovery[2][:5]+recovery[2][6:]), "dashes and spaces are ignored")
+
+	now = now.Add(Period)
+	code, _ = Code(secret, now)
+	renewed, err := s.RenewRecovery("sam", code)
+	assert.Nil(t, err)
+	assert.Len(t, renewed, RecoveryCodes)
+	assert.True(t, IsKind(s.Verify("sam", recovery[3]), WrongCode))
+
+	assert.Nil(t, s.Disable("sam"))
+	assert.False(t, s.Enabled("sam"))
+	assert.True(t, IsKind(s.Disable("sam"), NotEnrolled))
+}
+
+// autherKind returns the kind of an *auth.AutherError, "" for others.
+func autherKind(err error) string {
+	if e, ok := err.(*auth.AutherError); ok {
+		return e.Kind
+	}
+	return ""
+}
+
+func TestGuard(t *testing.T) {
+	s, _ := NewService(mock.NewStorage())
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+	us := mock.NewUserService()
+	_ = us.CreateUser(td.User{Name: "sam", Key: "sam key"})
+	secret, _, _ := s.Enroll("sam")
+	code, _ := Code(secret, now)
+	_, _ = s.Confirm("sam", code)
+	now = now.Add(Period)
+	code, _ = Code(secret, now)
+
+	g := NewGuard(s, []string{ScopeHMAC})
+	login := g.Auther(auth.NewPasswordAuther(), ScopePassword)
+	signed := g.Auther(auth.NewPasswordAuther(), ScopeHMAC)
+
+	req := httptest.NewRequest("POST", "/session/", nil)
+	req.SetBasicAuth("sam", "sam key")
+	assert.True(t, login.Presented(req))
+	_, err := login.AuthUser(req, us)
+	assert.Equal(t, auth.SecondFactor, autherKind(err))
+	user, err := signed.AuthUser(req, us)
+	assert.Nil(t, err, "the scope is skipped")
+	assert.Equal(t, "sam", user.Name)
+
+	req.Header.Set(HeaderCode, "000000")
+	_, err = login.AuthUser(req, us)
+	assert.Equal(t, auth.NotAuthed, autherKind(err))
+	req.Header.Set(HeaderCode, code)
+	_, err = login.AuthUser(req, us)
+	assert.Nil(t, err)
+	_, err = login.AuthUser(req, us)
+	assert.Equal(t, auth.NotAuthed, autherKind(err), "a login code is only used once")
+
+	g.SetSkip(nil)
+	_, err = signed.AuthUser(req, us)
+	assert.Nil(t, err, "other scopes may use a code again")
+
+	req.SetBasicAuth("sam", "wrong")
+	_, err = login.AuthUser(req, us)
+	assert.Equal(t, auth.NotAuthed, autherKind(err))
+}
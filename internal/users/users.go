@@ -0,0 +1,147 @@
+// Package users keeps the users of TempDesk in a storage.PutterGetter, so
+// they survive a restart when the storage does.
+package users
+
+import (
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"sort"
+	"sync"
+)
+
+// usersKey names the JSON document holding every user.
+const usersKey = "users/db"
+
+// Service is a td.UserService and td.UserLister. It reads the storage once
+// when it is created, so two services should not share a storage while
+// both make changes.
+type Service struct {
+	store storage.PutterGetter
+
+	rw    sync.RWMutex
+	users map[string]td.User
+}
+
+// NewService loads the users from store.
+func NewService(store storage.PutterGetter) (*Service, error) {
+	s := &Service{store: store, users: make(map[string]td.User)}
+	value, err := store.Get(usersKey)
+	if storage.IsNotFound(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return nil, &td.UserServiceError{Kind: "unexpected value stored under " + usersKey}
+	}
+	var list []td.User
+	if err = json.Unmarshal(b, &list); err != nil {
+		return nil, &td.UserServiceError{Kind: "error reading users", Err: err}
+	}
+	for _, u := range list {
+		s.users[u.Name] = u
+	}
+	return s, nil
+}
+
+// save stores users in place of the current ones, the caller holds rw.
+func (s *Service) save(users map[string]td.User) error {
+	b, err := json.Marshal(sortedUsers(users))
+	if err != nil {
+		return err
+	}
+	if err = s.store.Put(usersKey, b); err != nil {
+		return err
+	}
+	s.users = users
+	return nil
+}
+
+// change copies the users, lets fn change the copy and saves it.
+func (s *Service) change(fn func(users map[string]td.User) error) error {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	users := make(map[string]td.User, len(s.users)+1)
+	for name, u := range s.users {
+		users[name] = u
+	}
+	if err := fn(users); err != nil {
+		return err
+	}
+	return s.save(users)
+}
+
+func (s *Service) User(name string) (user td.User, ok bool) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	user, ok = s.users[name]
+	return user.Copy(), ok
+}
+
+func (s *Service) CreateUser(user td.User) (err error) {
+	return s.change(func(users map[string]td.User) error {
+		if _, ok := users[user.Name]; ok {
+			return &td.UserServiceError{Kind: td.NameAlreadyExists}
+		}
+		if user.ID == 0 {
+			for _, u := range users {
+				if u.ID >= user.ID {
+					user.ID = u.ID + 1
+				}
+			}
+			if user.ID == 0 {
+				user.ID = 1
+			}
+		}
+		users[user.Name] = user.Copy()
+		return nil
+	})
+}
+
+func (s *Service) UpdateUser(user td.User) (err error) {
+	return s.change(func(users map[string]td.User) error {
+		old, ok := users[user.Name]
+		if !ok {
+			return &td.UserServiceError{Kind: td.NameNotExists}
+		}
+		if user.ID == 0 {
+			user.ID = old.ID
+		}
+		users[user.Name] = user.Copy()
+		return nil
+	})
+}
+
+func (s *Service) DeleteUser(user td.User) (err error) {
+	return s.change(func(users map[string]td.User) error {
+		if _, ok := users[user.Name]; !ok {
+			return &td.UserServiceError{Kind: td.NameNotExists}
+		}
+		delete(users, user.Name)
+		return nil
+	})
+}
+
+// Users lists every user ordered by name.
+func (s *Service) Users() (users []td.User, err error) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return sortedUsers(s.users), nil
+}
+
+// Health checks the storage when it can check itself.
+func (s *Service) Health() error {
+	return td.CheckHealth(s.store)
+}
+
+func sortedUsers(users map[string]td.User) []td.User {
+	list := make([]td.User, 0, len(users))
+	for _, u := range users {
+		list = append(list, u.Copy())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,41 @@
+package users
+
+import (
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/internal/servicetest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestService(t *testing.T) {
+	servicetest.TestUserService(t, func() td.UserService {
+		s, err := NewService(mock.NewStorage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestService_Persist(t *testing.T) {
+	store := mock.NewStorage()
+	s, _ := NewService(store)
+	assert.Nil(t, s.CreateUser(td.User{Name: "tom", Key: "a"}))
+	assert.Nil(t, s.CreateUser(td.User{Name: "sam", Key: "b", Meta: map[string]string{td.MetaRole: td.RoleAdmin}}))
+
+	s, err := NewService(store)
+	assert.Nil(t, err)
+	users, err := s.Users()
+	assert.Nil(t, err)
+	if assert.Len(t, users, 2) {
+		assert.Equal(t, "sam", users[0].Name)
+		assert.Equal(t, 2, users[0].ID)
+		assert.True(t, users[0].IsAdmin())
+		assert.Equal(t, 1, users[1].ID)
+	}
+
+	_ = store.Put(usersKey, []byte("{"))
+	_, err = NewService(store)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,696 @@
+// Package webhook delivers signed notifications about file and user events
+// to URLs registered by users. Deliveries are queued in storage and retried
+// with exponential backoff until they succeed or run out of attempts.
+//
+// Webhooks are only delivered to public addresses, a user may not make the
+// server post to the loopback, private or link-local networks it sits in.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/event"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	EventFileUploaded = "file.uploaded"
+	EventFileDeleted  = "file.deleted"
+	EventFileShared   = "file.shared"
+	EventUserCreated  = "user.created"
+
+	HookNotExist = "webhook not exists"
+	InvalidHook  = "invalid webhook"
+	// AddressNotAllowed is the kind of an error delivering to an address
+	// that is not public.
+	AddressNotAllowed = "webhook address not allowed"
+
+	SignatureHeader = "X-TempDesk-Signature"
+	EventHeader     = "X-TempDesk-Event"
+	DeliveryHeader  = "X-TempDesk-Delivery"
+
+	// MaxAttempts is how often a delivery is tried before it is given up.
+	MaxAttempts = 8
+	// MaxLogSize is how many deliveries are kept in the log of a webhook.
+	MaxLogSize = 100
+
+	hooksKey = "webhook/hooks"
+	queueKey = "webhook/queue"
+	// addedKey numbers the deliveries queued since the queue was last
+	// saved, so queueing does not write the whole queue.
+	addedKey = "webhook/added/"
+	logKey   = "webhook/log/"
+)
+
+var (
+	InitialBackoff = time.Second
+	MaxBackoff     = time.Hour
+	PollInterval   = time.Second
+	// DeliveryTimeout bounds one attempt. A webhook whose delivery fails is
+	// not tried again in the same round, so a dead receiver delays a round
+	// by one attempt at most.
+	DeliveryTimeout = 10 * time.Second
+)
+
+// deniedNets are the networks webhooks may not be delivered to, besides
+// the loopback, link-local, multicast and unspecified addresses.
+var deniedNets = parseNets(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"fc00::/7",
+)
+
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// PublicIP reports whether ip is an address webhooks may be delivered to.
+func PublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range deniedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDial refuses connections to addresses s does not allow. It runs
+// once the host is resolved, so a name pointing inside is refused as well.
+func (s *Service) checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !s.Allowed(ip) {
+		return &WebhookError{Kind: AddressNotAllowed, Err: errors.New(host)}
+	}
+	return nil
+}
+
+// newClient returns a client that only dials the addresses s allows and
+// ignores proxies, as those would dial for it.
+func (s *Service) newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: DeliveryTimeout, Control: s.checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport, Timeout: DeliveryTimeout}
+}
+
+var eventTypes = map[event.Op]string{
+	event.OpWrite:      EventFileUploaded,
+	event.OpRemove:     EventFileDeleted,
+	event.OpPerm:       EventFileShared,
+	event.OpUserCreate: EventUserCreated,
+}
+
+func validEvent(name string) bool {
+	for _, t := range eventTypes {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+type Webhook struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret,omitempty"`
+	Events  []string  `json:"events"`
+	Prefix  string    `json:"prefix"`
+	Created time.Time `json:"created"`
+}
+
+func (h Webhook) wants(name string, e event.Event) bool {
+	found := false
+	for _, ev := range h.Events {
+		found = found || ev == name
+	}
+	if !found {
+		return false
+	}
+	return e.Op == event.OpUserCreate || e.Under(h.Prefix)
+}
+
+// Payload is the JSON body posted to a webhook.
+type Payload struct {
+	Delivery string    `json:"delivery"`
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path,omitempty"`
+	OldPath  string    `json:"old_path,omitempty"`
+	User     string    `json:"user,omitempty"`
+}
+
+type Delivery struct {
+	ID          string          `json:"id"`
+	Hook        string          `json:"hook"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	Status      int             `json:"status,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Delivered   bool            `json:"delivered"`
+	Failed      bool            `json:"failed"`
+	Created     time.Time       `json:"created"`
+	NextAttempt time.Time       `json:"next_attempt,omitempty"`
+}
+
+// savedQueue is the queue as saved under queueKey. Gen tells the deliveries
+// added since, which are saved with the same Gen.
+type savedQueue struct {
+	Gen        int        `json:"gen"`
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+type WebhookError struct {
+	Kind string
+	Err  error
+}
+
+func (w *WebhookError) Error() string {
+	if w.Err != nil {
+		return w.Kind + ": " + w.Err.Error()
+	}
+	return w.Kind
+}
+
+// Sign returns the value of the SignatureHeader for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify is what a receiver uses to check a delivery.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+type Service struct {
+	store storage.PutterGetter
+	users td.UserService
+
+	Client *http.Client
+	Now    func() time.Time
+	// Allowed decides the addresses webhooks may be registered for and
+	// delivered to, PublicIP unless set otherwise.
+	Allowed func(ip net.IP) bool
+
+	mu    sync.Mutex
+	hooks []Webhook
+	queue []Delivery
+	gen   int
+	added int
+
+	running sync.Mutex
+	wake    chan struct{}
+}
+
+// NewService loads the webhooks and the pending deliveries from store.
+func NewService(store storage.PutterGetter, users td.UserService) (*Service, error) {
+	s := &Service{
+		store:   store,
+		users:   users,
+		Now:     time.Now,
+		Allowed: PublicIP,
+		wake:    make(chan struct{}, 1),
+	}
+	s.Client = s.newClient()
+	if err := s.load(hooksKey, &s.hooks); err != nil {
+		return nil, err
+	}
+	if err := s.loadQueue(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadQueue loads the saved queue and the deliveries added since, up to
+// the first one that is missing or older than the queue.
+func (s *Service) loadQueue() error {
+	var saved savedQueue
+	if err := s.load(queueKey, &saved); err != nil {
+		return err
+	}
+	s.queue, s.gen = saved.Deliveries, saved.Gen
+	for ; ; s.added++ {
+		added := savedQueue{Gen: -1}
+		if err := s.load(addedKey+strconv.Itoa(s.added), &added); err != nil {
+			return err
+		}
+		if added.Gen != s.gen {
+			return nil
+		}
+		s.queue = append(s.queue, added.Deliveries...)
+	}
+}
+
+// saveQueue saves the whole queue, which drops the deliveries added before.
+// s.mu must be held.
+func (s *Service) saveQueue(queue []Delivery) error {
+	if err := s.save(queueKey, savedQueue{Gen: s.gen + 1, Deliveries: queue}); err != nil {
+		return err
+	}
+	s.queue, s.gen, s.added = queue, s.gen+1, 0
+	return nil
+}
+
+func (s *Service) load(name string, v interface{}) error {
+	value, err := s.store.Get(name)
+	if storage.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return &WebhookError{Kind: "unexpected value stored under " + name}
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (s *Service) save(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(name, b)
+}
+
+// Register validates hook and stores it for owner. A secret is generated
+// when hook has none.
+func (s *Service) Register(owner td.User, hook Webhook) (Webhook, error) {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, &WebhookError{Kind: InvalidHook, Err: errors.New("url must be an absolute http or https url")}
+	}
+	ip := net.ParseIP(u.Hostname())
+	if u.Hostname() == "localhost" {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip != nil && !s.Allowed(ip) {
+		return Webhook{}, &WebhookError{Kind: InvalidHook, Err: errors.New("url must not point to a private address")}
+	}
+	if len(hook.Events) == 0 {
+		return Webhook{}, &WebhookError{Kind: InvalidHook, Err: errors.New("no events")}
+	}
+	for _, e := range hook.Events {
+		if !validEvent(e) {
+			return Webhook{}, &WebhookError{Kind: InvalidHook, Err: errors.New("unknown event " + e)}
+		}
+	}
+	if hook.Prefix == "" {
+		hook.Prefix = "/"
+	}
+	if hook.Secret == "" {
+		if hook.Secret, err = randomHex(32); err != nil {
+			return Webhook{}, err
+		}
+	}
+	if hook.ID, err = randomHex(8); err != nil {
+		return Webhook{}, err
+	}
+	hook.Owner = owner.Name
+	hook.Created = s.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hooks := append(append([]Webhook(nil), s.hooks...), hook)
+	if err = s.save(hooksKey, hooks); err != nil {
+		return Webhook{}, err
+	}
+	s.hooks = hooks
+	return hook, nil
+}
+
+// Hooks lists the webhooks of owner without their secrets.
+func (s *Service) Hooks(owner string) []Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Webhook{}
+	for _, h := range s.hooks {
+		if h.Owner == owner {
+			h.Secret = ""
+			ret = append(ret, h)
+		}
+	}
+	return ret
+}
+
+// Hook returns the webhook id of owner without its secret.
+func (s *Service) Hook(owner string, id string) (Webhook, error) {
+	for _, h := range s.Hooks(owner) {
+		if h.ID == id {
+			return h, nil
+		}
+	}
+	return Webhook{}, &WebhookError{Kind: HookNotExist}
+}
+
+// Remove deletes the webhook id of owner and drops its pending deliveries.
+func (s *Service) Remove(owner string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hooks := make([]Webhook, 0, len(s.hooks))
+	for _, h := range s.hooks {
+		if h.ID != id || h.Owner != owner {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == len(s.hooks) {
+		return &WebhookError{Kind: HookNotExist}
+	}
+	queue := make([]Delivery, 0, len(s.queue))
+	for _, d := range s.queue {
+		if d.Hook != id {
+			queue = append(queue, d)
+		}
+	}
+
+	if err := s.save(hooksKey, hooks); err != nil {
+		return err
+	}
+	s.hooks = hooks
+	return s.saveQueue(queue)
+}
+
+// Deliveries returns the delivery log of the webhook id of owner, newest
+// first.
+func (s *Service) Deliveries(owner string, id string) ([]Delivery, error) {
+	if _, err := s.Hook(owner, id); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var log []Delivery
+	if err := s.load(logKey+id, &log); err != nil {
+		return nil, err
+	}
+	ret := make([]Delivery, 0, len(log))
+	for i := len(log) - 1; i >= 0; i-- {
+		ret = append(ret, log[i])
+	}
+	return ret, nil
+}
+
+// Enqueue queues a delivery of e for every webhook that wants it and whose
+// owner may see it. Only the new deliveries are saved. A change of a
+// permission is only delivered when it grants something.
+func (s *Service) Enqueue(e event.Event) error {
+	name, ok := eventTypes[e.Op]
+	if !ok || e.Op == event.OpPerm && !e.Granted {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var added []Delivery
+	for _, h := range s.hooks {
+		if !h.wants(name, e) || !s.visible(h.Owner, e) {
+			continue
+		}
+
+		id, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(Payload{
+			Delivery: id,
+			Event:    name,
+			Time:     e.Time,
+			Path:     e.Path,
+			OldPath:  e.OldPath,
+			User:     e.User,
+		})
+		if err != nil {
+			return err
+		}
+		now := s.Now().UTC()
+		added = append(added, Delivery{
+			ID:          id,
+			Hook:        h.ID,
+			Event:       name,
+			Payload:     payload,
+			Created:     now,
+			NextAttempt: now,
+		})
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	if err := s.save(addedKey+strconv.Itoa(s.added), savedQueue{Gen: s.gen, Deliveries: added}); err != nil {
+		return err
+	}
+	s.queue = append(s.queue, added...)
+	s.added++
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// visible tells whether the owner of a webhook may learn about e. Only
+// admins are told about new users.
+func (s *Service) visible(owner string, e event.Event) bool {
+	user, ok := s.users.User(owner)
+	if !ok {
+		return false
+	}
+	if e.Op == event.OpUserCreate {
+		return user.IsAdmin()
+	}
+	return e.Visible(user)
+}
+
+// RunPending attempts every delivery that is due and records the outcome in
+// the delivery log. The deliveries of a webhook stop at its first failure
+// until the next round. The queue is saved whole if anything was added.
+func (s *Service) RunPending() error {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	now := s.Now().UTC()
+	s.mu.Lock()
+	hooks := make(map[string]Webhook, len(s.hooks))
+	for _, h := range s.hooks {
+		hooks[h.ID] = h
+	}
+	var due []Delivery
+	for _, d := range s.queue {
+		if !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	added := s.added
+	s.mu.Unlock()
+
+	if len(due) == 0 && added == 0 {
+		return nil
+	}
+
+	// every webhook gets its deliveries in order, apart from the others
+	byHook := make(map[string][]Delivery)
+	for _, d := range due {
+		if _, ok := hooks[d.Hook]; ok {
+			byHook[d.Hook] = append(byHook[d.Hook], d)
+		}
+	}
+	var (
+		wg     sync.WaitGroup
+		doneMu sync.Mutex
+		done   = make(map[string]Delivery, len(due))
+	)
+	for id, ds := range byHook {
+		wg.Add(1)
+		go func(h Webhook, ds []Delivery) {
+			defer wg.Done()
+			for _, d := range ds {
+				d = s.attempt(h, d, now)
+				doneMu.Lock()
+				done[d.ID] = d
+				doneMu.Unlock()
+				if !d.Delivered {
+					return
+				}
+			}
+		}(hooks[id], ds)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := make([]Delivery, 0, len(s.queue))
+	for _, d := range s.queue {
+		if n, ok := done[d.ID]; ok {
+			d = n
+		}
+		if !d.Delivered && !d.Failed {
+			queue = append(queue, d)
+		}
+	}
+	if err := s.saveQueue(queue); err != nil {
+		return err
+	}
+
+	for _, d := range done {
+		if err := s.log(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) attempt(h Webhook, d Delivery, now time.Time) Delivery {
+	d.Attempts++
+	d.Status = 0
+	d.Error = ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(d.Payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "TempDesk-Webhook")
+		req.Header.Set(EventHeader, d.Event)
+		req.Header.Set(DeliveryHeader, d.ID)
+		req.Header.Set(SignatureHeader, Sign(h.Secret, d.Payload))
+
+		var res *http.Response
+		res, err = s.Client.Do(req)
+		if err == nil {
+			_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+			_ = res.Body.Close()
+			d.Status = res.StatusCode
+		}
+	}
+
+	switch {
+	case err == nil && d.Status >= 200 && d.Status < 300:
+		d.Delivered = true
+		d.NextAttempt = time.Time{}
+		return d
+	case err != nil:
+		d.Error = err.Error()
+	default:
+		d.Error = http.StatusText(d.Status)
+	}
+
+	if d.Attempts >= MaxAttempts {
+		d.Failed = true
+		d.NextAttempt = time.Time{}
+		return d
+	}
+	d.NextAttempt = now.Add(Backoff(d.Attempts))
+	return d
+}
+
+// Backoff returns how long to wait after the given number of failed
+// attempts.
+func Backoff(attempts int) time.Duration {
+	b := InitialBackoff
+	for i := 1; i < attempts && b < MaxBackoff; i++ {
+		b *= 2
+	}
+	if b > MaxBackoff {
+		b = MaxBackoff
+	}
+	return b
+}
+
+// log updates the delivery log of the webhook of d. s.mu must be held.
+func (s *Service) log(d Delivery) error {
+	var log []Delivery
+	if err := s.load(logKey+d.Hook, &log); err != nil {
+		return err
+	}
+	found := false
+	for i := range log {
+		if log[i].ID == d.ID {
+			log[i], found = d, true
+		}
+	}
+	if !found {
+		log = append(log, d)
+	}
+	if len(log) > MaxLogSize {
+		log = log[len(log)-MaxLogSize:]
+	}
+	return s.save(logKey+d.Hook, log)
+}
+
+// Run queues the events published on bus and delivers them until ctx is
+// done. Events are queued while they are published, so none is lost
+// however slow the deliveries are.
+func (s *Service) Run(ctx context.Context, bus *event.Bus, onError func(error)) {
+	remove := bus.Handle(func(e event.Event) {
+		if err := s.Enqueue(e); err != nil {
+			onError(err)
+		}
+	})
+	defer remove()
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		if err := s.RunPending(); err != nil {
+			onError(err)
+		}
+	}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
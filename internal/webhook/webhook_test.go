@@ -0,0 +1,321 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	td "github.com/huangjiahua/tempdesk"
+	"github.com/huangjiahua/tempdesk/internal/event"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	bodies   [][]byte
+	headers  []http.Header
+	received int
+}
+
+func (r *receiver) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received++
+	r.bodies = append(r.bodies, body)
+	r.headers = append(r.headers, req.Header)
+	res.WriteHeader(r.status)
+}
+
+func newService(t *testing.T) (*Service, *mock.Storage, *time.Time) {
+	users := mock.NewUserService()
+	_ = users.CreateUser(td.User{Name: "sam"})
+	_ = users.CreateUser(td.User{Name: "root", Meta: map[string]string{td.MetaRole: td.RoleAdmin}})
+
+	store := mock.NewStorage()
+	s, err := NewService(store, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+	// the receivers of the tests listen on the loopback
+	s.Allowed = allowAll
+	return s, store, &now
+}
+
+func allowAll(net.IP) bool {
+	return true
+}
+
+func TestService_Register(t *testing.T) {
+	s, _, _ := newService(t)
+	sam := td.User{Name: "sam"}
+
+	for _, h := range []Webhook{
+		{URL: "ftp://example.com", Events: []string{EventFileUploaded}},
+		{URL: "/relative", Events: []string{EventFileUploaded}},
+		{URL: "http://example.com"},
+		{URL: "http://example.com", Events: []string{"file.eaten"}},
+	} {
+		_, err := s.Register(sam, h)
+		if e, ok := err.(*WebhookError); !ok || e.Kind != InvalidHook {
+			t.Errorf("%v should be invalid: %v", h, err)
+		}
+	}
+
+	h, err := s.Register(sam, Webhook{URL: "http://example.com", Events: []string{EventFileUploaded}})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, h.ID)
+	assert.NotEmpty(t, h.Secret, "secret should be generated")
+	assert.Equal(t, "/", h.Prefix)
+
+	hooks := s.Hooks("sam")
+	if assert.Len(t, hooks, 1) {
+		assert.Empty(t, hooks[0].Secret, "listing should not reveal secrets")
+	}
+	assert.Empty(t, s.Hooks("tom"))
+
+	s.Allowed = PublicIP
+	for _, u := range []string{"http://127.0.0.1:8080/", "http://localhost/", "http://169.254.169.254/", "http://10.1.2.3/", "http://[::1]/"} {
+		_, err := s.Register(sam, Webhook{URL: u, Events: []string{EventFileUploaded}})
+		assert.Error(t, err, u)
+	}
+
+	assert.Error(t, s.Remove("tom", h.ID), "only the owner may remove a webhook")
+	assert.NoError(t, s.Remove("sam", h.ID))
+	assert.Empty(t, s.Hooks("sam"))
+}
+
+func TestService_Deliver(t *testing.T) {
+	s, store, now := newService(t)
+	r := &receiver{status: http.StatusInternalServerError}
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	sam := td.User{Name: "sam"}
+	hook, err := s.Register(sam, Webhook{URL: ts.URL, Events: []string{EventFileUploaded, EventUserCreated}, Prefix: "/ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _ := s.Register(td.User{Name: "root"}, Webhook{URL: ts.URL, Events: []string{EventUserCreated}})
+
+	hidden := mock.NewFilePermission()
+	hidden.BlockAllUser()
+	assert.NoError(t, s.Enqueue(event.Event{Op: event.OpWrite, Path: "/ci/secret.bin", Perm: hidden}))
+	assert.NoError(t, s.Enqueue(event.Event{Op: event.OpWrite, Path: "/other/a.bin", Perm: mock.NewFilePermission()}))
+	assert.NoError(t, s.Enqueue(event.Event{Op: event.OpRemove, Path: "/ci/a.bin", Perm: mock.NewFilePermission()}))
+	assert.NoError(t, s.Enqueue(event.Event{Op: event.OpUserCreate, User: "tom"}))
+	assert.Len(t, s.queue, 1, "only the admin should hear about new users")
+
+	assert.NoError(t, s.Enqueue(event.Event{Op: event.OpWrite, Path: "/ci/a.bin", Perm: mock.NewFilePermission()}))
+	assert.Len(t, s.queue, 2)
+
+	// the queue survives a restart
+	s, err = NewService(store, s.users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Now = func() time.Time { return *now }
+	s.Allowed = allowAll
+	assert.Len(t, s.queue, 2)
+
+	assert.NoError(t, s.RunPending())
+	assert.Equal(t, 2, r.received)
+	assert.Len(t, s.queue, 2, "failed deliveries should stay queued")
+
+	log, err := s.Deliveries("sam", hook.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, log, 1) {
+		assert.Equal(t, http.StatusInternalServerError, log[0].Status)
+		assert.Equal(t, 1, log[0].Attempts)
+		assert.Equal(t, now.Add(InitialBackoff), log[0].NextAttempt)
+	}
+
+	assert.NoError(t, s.RunPending())
+	assert.Equal(t, 2, r.received, "nothing should be retried before the backoff")
+
+	r.status = http.StatusNoContent
+	*now = now.Add(InitialBackoff)
+	assert.NoError(t, s.RunPending())
+	assert.Equal(t, 4, r.received)
+	assert.Empty(t, s.queue)
+
+	// deliveries added before the queue was last saved are not loaded again
+	assert.NoError(t, s.Enqueue(event.Event{Op: event.OpUserCreate, User: "ann"}))
+	s, err = NewService(store, s.users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, s.queue, 1)
+
+	log, _ = s.Deliveries("sam", hook.ID)
+	if assert.Len(t, log, 1) {
+		assert.True(t, log[0].Delivered)
+		assert.Equal(t, 2, log[0].Attempts)
+		assert.Equal(t, http.StatusNoContent, log[0].Status)
+	}
+	_, err = s.Deliveries("sam", admin.ID)
+	assert.Error(t, err, "other users' logs should not be readable")
+
+	for i, body := range r.bodies {
+		h := r.headers[i]
+		var p Payload
+		assert.NoError(t, json.Unmarshal(body, &p))
+		assert.Equal(t, p.Event, h.Get(EventHeader))
+		assert.Equal(t, p.Delivery, h.Get(DeliveryHeader))
+
+		secret := hook.Secret
+		if p.Event == EventUserCreated {
+			secret = admin.Secret
+			assert.Equal(t, "tom", p.User)
+		} else {
+			assert.Equal(t, "/ci/a.bin", p.Path)
+		}
+		assert.True(t, Verify(secret, body, h.Get(SignatureHeader)), "bad signature")
+		assert.False(t, Verify("wrong", body, h.Get(SignatureHeader)))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, InitialBackoff, Backoff(1))
+	assert.Equal(t, 4*InitialBackoff, Backoff(3))
+	assert.Equal(t, MaxBackoff, Backoff(100))
+}
+
+func TestService_GiveUp(t *testing.T) {
+	s, _, now := newService(t)
+	ts := httptest.NewServer(&receiver{status: http.StatusBadGateway})
+	defer ts.Close()
+
+	hook, _ := s.Register(td.User{Name: "sam"}, Webhook{URL: ts.URL, Events: []string{EventFileDeleted}})
+	_ = s.Enqueue(event.Event{Op: event.OpRemove, Path: "/a", Perm: mock.NewFilePermission()})
+
+	for i := 0; i < MaxAttempts; i++ {
+		assert.NoError(t, s.RunPending())
+		*now = now.Add(MaxBackoff)
+	}
+	assert.Empty(t, s.queue)
+	log, _ := s.Deliveries("sam", hook.ID)
+	if assert.Len(t, log, 1) {
+		assert.True(t, log[0].Failed)
+		assert.Equal(t, MaxAttempts, log[0].Attempts)
+	}
+}
+
+func TestService_Shared(t *testing.T) {
+	s, _, _ := newService(t)
+	_, err := s.Register(td.User{Name: "sam"}, Webhook{URL: "http://example.com", Events: []string{EventFileShared}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s.Enqueue(event.Event{Op: event.OpPerm, Path: "/a", Perm: mock.NewFilePermission()}))
+	assert.Empty(t, s.queue, "a revoke shares nothing")
+	assert.NoError(t, s.Enqueue(event.Event{Op: event.OpPerm, Path: "/a", Perm: mock.NewFilePermission(), Granted: true}))
+	assert.Len(t, s.queue, 1)
+}
+
+func TestPublicIP(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "172.16.5.4", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+		assert.False(t, PublicIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"93.184.216.34", "8.8.8.8", "2606:4700::1111"} {
+		assert.True(t, PublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestService_DialDenied(t *testing.T) {
+	s, _, _ := newService(t)
+	r := &receiver{status: http.StatusNoContent}
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	hook, _ := s.Register(td.User{Name: "sam"}, Webhook{URL: ts.URL, Events: []string{EventFileDeleted}})
+	_ = s.Enqueue(event.Event{Op: event.OpRemove, Path: "/a", Perm: mock.NewFilePermission()})
+	s.Allowed = PublicIP
+	assert.NoError(t, s.RunPending())
+	assert.Equal(t, 0, r.received, "the loopback is not dialed")
+	log, _ := s.Deliveries("sam", hook.ID)
+	if assert.Len(t, log, 1) {
+		assert.Contains(t, log[0].Error, AddressNotAllowed)
+	}
+}
+
+func TestService_SlowHook(t *testing.T) {
+	defer func(d time.Duration) { DeliveryTimeout = d }(DeliveryTimeout)
+	DeliveryTimeout = 50 * time.Millisecond
+
+	s, _, _ := newService(t)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	r := &receiver{status: http.StatusNoContent}
+	fast := httptest.NewServer(r)
+	defer fast.Close()
+
+	sam := td.User{Name: "sam"}
+	slowHook, _ := s.Register(sam, Webhook{URL: slow.URL, Events: []string{EventFileDeleted}})
+	fastHook, _ := s.Register(sam, Webhook{URL: fast.URL, Events: []string{EventFileDeleted}})
+	for i := 0; i < 3; i++ {
+		_ = s.Enqueue(event.Event{Op: event.OpRemove, Path: "/a", Perm: mock.NewFilePermission()})
+	}
+
+	start := time.Now()
+	assert.NoError(t, s.RunPending())
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "attempts time out")
+	assert.Equal(t, 3, r.received)
+	log, _ := s.Deliveries("sam", fastHook.ID)
+	assert.Len(t, log, 3)
+	log, _ = s.Deliveries("sam", slowHook.ID)
+	if assert.Len(t, log, 1, "a webhook is not tried again after a failure in the same round") {
+		assert.False(t, log[0].Delivered)
+		assert.NotEmpty(t, log[0].Error)
+	}
+	assert.Len(t, s.queue, 3)
+}
+
+func TestService_Run(t *testing.T) {
+	s, _, _ := newService(t)
+	s.Client = &http.Client{Transport: roundTripper(func(*http.Request) (*http.Response, error) {
+		return nil, context.DeadlineExceeded
+	})}
+	_, _ = s.Register(td.User{Name: "sam"}, Webhook{URL: "http://example.com", Events: []string{EventFileUploaded}})
+	bus := event.NewBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, bus, func(err error) { t.Error(err) })
+
+	queued := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.queue)
+	}
+	publish := func() {
+		bus.Publish(event.Event{Op: event.OpWrite, Path: "/a", Perm: mock.NewFilePermission()})
+	}
+	for deadline := time.Now().Add(time.Second); queued() == 0 && time.Now().Before(deadline); {
+		publish()
+		time.Sleep(time.Millisecond)
+	}
+	before := queued()
+	for i := 0; i < 2*event.DefaultBuffer; i++ {
+		publish()
+	}
+	assert.Equal(t, before+2*event.DefaultBuffer, queued(), "every event is queued while it is published")
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,201 @@
+package tempdesk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// PermissionVersion is the version of the PermissionDocument schema written
+// by this package. Documents of other versions are refused.
+const PermissionVersion = 1
+
+const (
+	PermissionInvalid = "invalid permission document"
+	// PermissionUnsupportedVersion is the kind of an error reading a
+	// document of a version other than PermissionVersion.
+	PermissionUnsupportedVersion = "unsupported permission document version"
+	// PermissionNotDocumented is the kind of an error reading or replacing
+	// the document of a permission that cannot be one.
+	PermissionNotDocumented = "permission has no document"
+	// PermissionChanged is the kind of an error replacing a document that
+	// is no longer the one expected.
+	PermissionChanged = "permission changed"
+)
+
+// PermissionDocument is the stable JSON form of a VerbPermission, like
+//
+//	{"version": 1, "all": "none", "users": {"sam": "all", "tom": "read"},
+//	 "groups": {"dev": "read,write"}, "codes": {"x1": "read"},
+//	 "public": true, "public_codes": ["x2"]}
+//
+// Verbs are written as Verb.String writes them. A user or group granted
+// "none" is blocked. Codes always grant some verb, as granting none revokes
+// them; public_codes may read the file while it is public.
+type PermissionDocument struct {
+	Version     int             `json:"version"`
+	All         Verb            `json:"all"`
+	Users       map[string]Verb `json:"users"`
+	Groups      map[string]Verb `json:"groups"`
+	Codes       map[string]Verb `json:"codes"`
+	Public      bool            `json:"public"`
+	PublicCodes []string        `json:"public_codes"`
+}
+
+// DocumentPermission is a VerbPermission that can be read and replaced as a
+// whole, which lets a FileService persist it and clients edit it.
+type DocumentPermission interface {
+	VerbPermission
+
+	// Document returns every rule of the permission.
+	Document() (doc PermissionDocument, err error)
+	// SetDocument validates doc and replaces every rule by its rules.
+	SetDocument(doc PermissionDocument) (err error)
+	// SetDocumentIf is SetDocument while the document is still old, else it
+	// fails with PermissionChanged and changes nothing. Comparing and
+	// replacing are one step.
+	SetDocumentIf(old, doc PermissionDocument) (err error)
+}
+
+// PermissionSnapshotter is a FilePermission that can copy itself. Changes
+// to the copy or the original do not show in the other.
+type PermissionSnapshotter interface {
+	Snapshot() FilePermission
+}
+
+// Snapshot returns a copy of p that keeps its current rules, or p itself if
+// it cannot be copied.
+func Snapshot(p FilePermission) FilePermission {
+	if s, ok := p.(PermissionSnapshotter); ok {
+		return s.Snapshot()
+	}
+	return p
+}
+
+type PermissionError struct {
+	Kind string
+	Err  error
+}
+
+func (p *PermissionError) Error() string {
+	if p.Err != nil {
+		return p.Kind + ": " + p.Err.Error()
+	}
+	return p.Kind
+}
+
+// ParsePermissionDocument reads a document from JSON and validates it.
+// Unknown fields are refused, so a misspelt rule is not silently dropped.
+func ParsePermissionDocument(b []byte) (doc PermissionDocument, err error) {
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err = json.Unmarshal(b, &version); err != nil {
+		return doc, &PermissionError{Kind: PermissionInvalid, Err: err}
+	}
+	if version.Version != PermissionVersion {
+		return doc, &PermissionError{Kind: PermissionUnsupportedVersion, Err: fmt.Errorf("version %d", version.Version)}
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&doc); err != nil {
+		return PermissionDocument{}, &PermissionError{Kind: PermissionInvalid, Err: err}
+	}
+	if err = doc.Validate(); err != nil {
+		return PermissionDocument{}, err
+	}
+	return doc.Normalize(), nil
+}
+
+// Validate checks the version, names and verbs of d.
+func (d PermissionDocument) Validate() error {
+	if d.Version != PermissionVersion {
+		return &PermissionError{Kind: PermissionUnsupportedVersion, Err: fmt.Errorf("version %d", d.Version)}
+	}
+	invalid := func(format string, args ...interface{}) error {
+		return &PermissionError{Kind: PermissionInvalid, Err: fmt.Errorf(format, args...)}
+	}
+	if d.All&^VerbAll != 0 {
+		return invalid("unknown verbs for all users")
+	}
+	for _, rules := range []struct {
+		what  string
+		verbs map[string]Verb
+	}{{"user", d.Users}, {"group", d.Groups}, {"code", d.Codes}} {
+		for name, v := range rules.verbs {
+			if name == "" {
+				return invalid("empty %s name", rules.what)
+			}
+			if v&^VerbAll != 0 {
+				return invalid("unknown verbs for %s %s", rules.what, name)
+			}
+			if rules.what == "code" && v == VerbNone {
+				return invalid("code %s grants nothing", name)
+			}
+		}
+	}
+	if len(d.PublicCodes) > 0 && !d.Public {
+		return invalid("public codes of a file that is not public")
+	}
+	for _, code := range d.PublicCodes {
+		if code == "" {
+			return invalid("empty public code")
+		}
+	}
+	return nil
+}
+
+// Normalize returns d with empty rather than nil rules and sorted public
+// codes, so equal documents encode to the same JSON.
+func (d PermissionDocument) Normalize() PermissionDocument {
+	for _, m := range []*map[string]Verb{&d.Users, &d.Groups, &d.Codes} {
+		copied := make(map[string]Verb, len(*m))
+		for name, v := range *m {
+			copied[name] = v
+		}
+		*m = copied
+	}
+	codes := make([]string, 0, len(d.PublicCodes))
+	seen := make(map[string]bool, len(d.PublicCodes))
+	for _, code := range d.PublicCodes {
+		if !seen[code] {
+			seen[code] = true
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	d.PublicCodes = codes
+	return d
+}
+
+// Equal reports whether d and o hold the same rules.
+func (d PermissionDocument) Equal(o PermissionDocument) bool {
+	return reflect.DeepEqual(d.Normalize(), o.Normalize())
+}
+
+// Grants reports whether d grants anything o does not: a verb to all users,
+// a user, group or code, or reading the file publicly or by a public code.
+func (d PermissionDocument) Grants(o PermissionDocument) bool {
+	if d.All&^o.All != 0 || d.Public && !o.Public {
+		return true
+	}
+	for _, rules := range [][2]map[string]Verb{{d.Users, o.Users}, {d.Groups, o.Groups}, {d.Codes, o.Codes}} {
+		for name, v := range rules[0] {
+			if v&^rules[1][name] != 0 {
+				return true
+			}
+		}
+	}
+	public := make(map[string]bool, len(o.PublicCodes))
+	for _, code := range o.PublicCodes {
+		public[code] = true
+	}
+	for _, code := range d.PublicCodes {
+		if !public[code] {
+			return true
+		}
+	}
+	return false
+}
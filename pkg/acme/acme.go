@@ -0,0 +1,310 @@
+// Package acme obtains certificates from a certificate authority speaking
+// ACME (RFC 8555), like Let's Encrypt, proving control of the domains by
+// http-01 challenges.
+//
+// Client covers the requests of the protocol, Manager builds on it to keep
+// a certificate for a server valid: it obtains one on start, renews it
+// before it expires, answers the challenges and hands the certificate to
+// crypto/tls.
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// LetsEncryptURL is the directory of the production Let's Encrypt CA.
+	LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+	DefaultPollInterval = time.Second
+
+	// Problem types the client acts on.
+	ProblemBadNonce = "urn:ietf:params:acme:error:badNonce"
+
+	// Statuses of orders, authorizations and challenges.
+	StatusPending    = "pending"
+	StatusReady      = "ready"
+	StatusProcessing = "processing"
+	StatusValid      = "valid"
+	StatusInvalid    = "invalid"
+
+	contentJOSE = "application/jose+json"
+	contentPEM  = "application/pem-certificate-chain"
+
+	// nonceRetries bounds how often a request refused for a bad nonce is
+	// sent again with a fresh one.
+	nonceRetries = 3
+	// maxResponse bounds the body of a response that is read.
+	maxResponse = 1 << 20
+)
+
+// Problem is an error the CA reports, as RFC 7807 describes it.
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+// IsProblem reports whether err is a *Problem of type typ.
+func IsProblem(err error, typ string) bool {
+	p, ok := err.(*Problem)
+	return ok && p.Type == typ
+}
+
+// Directory lists the URLs of the requests a CA serves.
+type Directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+	RevokeCert string `json:"revokeCert"`
+	KeyChange  string `json:"keyChange"`
+}
+
+type Client struct {
+	// DirectoryURL is where the CA lists its requests, like LetsEncryptURL.
+	DirectoryURL string
+	// Key signs the requests of the account, which the CA knows by it.
+	Key *ecdsa.PrivateKey
+
+	HTTPClient *http.Client
+	// PollInterval is how long to wait before asking again whether an
+	// authorization or order is done, when the CA does not say.
+	PollInterval time.Duration
+
+	mu     sync.Mutex
+	dir    *Directory
+	kid    string
+	nonces []string
+}
+
+// New creates a Client for the account of key at the CA of directoryURL.
+func New(directoryURL string, key *ecdsa.PrivateKey) *Client {
+	return &Client{
+		DirectoryURL: directoryURL,
+		Key:          key,
+		HTTPClient:   http.DefaultClient,
+		PollInterval: DefaultPollInterval,
+	}
+}
+
+// Directory fetches the directory of the CA once and returns it.
+func (c *Client) Directory(ctx context.Context) (*Directory, error) {
+	c.mu.Lock()
+	dir := c.dir
+	c.mu.Unlock()
+	if dir != nil {
+		return dir, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.DirectoryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	dir = &Directory{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(dir); err != nil {
+		return nil, fmt.Errorf("acme: reading directory: %v", err)
+	}
+	if dir.NewNonce == "" || dir.NewAccount == "" || dir.NewOrder == "" {
+		return nil, errors.New("acme: directory lacks newNonce, newAccount or newOrder")
+	}
+	c.mu.Lock()
+	c.dir = dir
+	c.mu.Unlock()
+	return dir, nil
+}
+
+// Register creates the account of the key, or finds it when it exists,
+// agreeing to the terms of service of the CA. email may be empty.
+func (c *Client) Register(ctx context.Context, email string) error {
+	dir, err := c.Directory(ctx)
+	if err != nil {
+		return err
+	}
+	payload := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		payload["contact"] = []string{"mailto:" + email}
+	}
+	resp, err := c.post(ctx, dir.NewAccount, payload, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	kid := resp.Header.Get("Location")
+	if kid == "" {
+		return errors.New("acme: account has no location")
+	}
+	c.mu.Lock()
+	c.kid = kid
+	c.mu.Unlock()
+	return nil
+}
+
+// post sends payload to url signed by the account key and decodes the
+// response into v when v is not nil. A nil payload makes a POST-as-GET. The
+// caller closes the body of the response.
+func (c *Client) post(ctx context.Context, url string, payload interface{}, v interface{}) (*http.Response, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := c.postOnce(ctx, url, body)
+		if IsProblem(err, ProblemBadNonce) && attempt < nonceRetries {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			err = json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(v)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("acme: reading response of %s: %v", url, err)
+			}
+		}
+		return resp, nil
+	}
+}
+
+func (c *Client) postOnce(ctx context.Context, url string, payload []byte) (*http.Response, error) {
+	nonce, err := c.nonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	kid := c.kid
+	if c.dir != nil && url == c.dir.NewAccount {
+		// the account is created or found by its key
+		kid = ""
+	} else if kid == "" {
+		c.mu.Unlock()
+		return nil, errors.New("acme: the account is not registered")
+	}
+	c.mu.Unlock()
+	body, err := sign(c.Key, kid, nonce, url, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentJOSE)
+	req.Header.Set("Accept", contentPEM+", application/json")
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	c.addNonce(resp.Header.Get("Replay-Nonce"))
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// nonce returns a nonce the CA handed out before, or asks for a new one.
+func (c *Client) nonce(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.mu.Unlock()
+		return nonce, nil
+	}
+	c.mu.Unlock()
+
+	dir, err := c.Directory(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodHead, dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: no nonce from " + dir.NewNonce)
+	}
+	return nonce, nil
+}
+
+func (c *Client) addNonce(nonce string) {
+	if nonce == "" {
+		return
+	}
+	c.mu.Lock()
+	c.nonces = append(c.nonces, nonce)
+	c.mu.Unlock()
+}
+
+// responseError turns an error response into a *Problem.
+func responseError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	p := &Problem{}
+	if err := json.Unmarshal(b, p); err != nil || p.Type == "" {
+		p = &Problem{Type: "about:blank", Detail: string(bytes.TrimSpace(b))}
+	}
+	if p.Status == 0 {
+		p.Status = resp.StatusCode
+	}
+	return p
+}
+
+// retryAfter returns how long the CA asks to wait before polling again.
+func (c *Client) retryAfter(resp *http.Response) time.Duration {
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		d := time.Duration(s) * time.Second
+		if d > time.Minute {
+			d = time.Minute
+		}
+		return d
+	}
+	if c.PollInterval > 0 {
+		return c.PollInterval
+	}
+	return DefaultPollInterval
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
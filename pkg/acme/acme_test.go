@@ -0,0 +1,371 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCA is just enough of an ACME server for the client: it checks the
+// signatures and nonces of requests, validates http-01 challenges through
+// validate and issues certificates from its own root.
+type fakeCA struct {
+	t        *testing.T
+	srv      *httptest.Server
+	validate func(token string) string
+	validity time.Duration
+
+	mu       sync.Mutex
+	nonce    int
+	nonces   map[string]bool
+	badNonce bool
+	accounts map[string]*ecdsa.PublicKey
+	authz    map[string]string
+	orders   int
+	domains  []string
+	cert     []byte
+
+	root    *x509.Certificate
+	rootKey *ecdsa.PrivateKey
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	ca := &fakeCA{
+		t:        t,
+		validity: 90 * 24 * time.Hour,
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*ecdsa.PublicKey),
+		authz:    make(map[string]string),
+	}
+	ca.rootKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.rootKey.PublicKey, ca.rootKey)
+	ca.root, _ = x509.ParseCertificate(der)
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *fakeCA) url(p string) string {
+	return ca.srv.URL + p
+}
+
+func (ca *fakeCA) newNonce() string {
+	ca.nonce++
+	n := fmt.Sprintf("nonce-%d", ca.nonce)
+	ca.nonces[n] = true
+	return n
+}
+
+func (ca *fakeCA) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(Problem{Type: typ, Detail: detail, Status: status})
+}
+
+func (ca *fakeCA) serve(w http.ResponseWriter, req *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	w.Header().Set("Replay-Nonce", ca.newNonce())
+
+	switch {
+	case req.URL.Path == "/dir":
+		_ = json.NewEncoder(w).Encode(Directory{
+			NewNonce:   ca.url("/nonce"),
+			NewAccount: ca.url("/account"),
+			NewOrder:   ca.url("/order"),
+		})
+		return
+	case req.URL.Path == "/nonce":
+		return
+	}
+
+	payload, kid, err := ca.verify(req)
+	if p, ok := err.(*Problem); ok {
+		ca.problem(w, http.StatusBadRequest, p.Type, "try again")
+		return
+	}
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "urn:ietf:params:acme:error:malformed", err.Error())
+		return
+	}
+
+	switch p := req.URL.Path; {
+	case p == "/account":
+		w.Header().Set("Location", ca.url("/acct/"+kid))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+	case p == "/order":
+		var o struct{ Identifiers []Identifier }
+		_ = json.Unmarshal(payload, &o)
+		ca.orders++
+		ca.domains = nil
+		var authz []string
+		for _, id := range o.Identifiers {
+			ca.domains = append(ca.domains, id.Value)
+			ca.authz[id.Value] = StatusPending
+			authz = append(authz, ca.url("/authz/"+id.Value))
+		}
+		ca.cert = nil
+		w.Header().Set("Location", ca.url("/orders/1"))
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(Order{Status: StatusPending, Authorizations: authz, Finalize: ca.url("/finalize")})
+	case strings.HasPrefix(p, "/authz/"):
+		d := strings.TrimPrefix(p, "/authz/")
+		_ = json.NewEncoder(w).Encode(Authorization{
+			Status:     ca.authz[d],
+			Identifier: Identifier{Type: "dns", Value: d},
+			Challenges: []Challenge{
+				{Type: "dns-01", URL: ca.url("/chal/dns/" + d), Token: "dns-token"},
+				{Type: ChallengeHTTP01, URL: ca.url("/chal/" + d), Token: "token-" + d},
+			},
+		})
+	case strings.HasPrefix(p, "/chal/"):
+		d := strings.TrimPrefix(p, "/chal/")
+		tp, _ := Thumbprint(ca.accounts[kid])
+		if ca.validate("token-"+d) == "token-"+d+"."+tp {
+			ca.authz[d] = StatusValid
+		} else {
+			ca.authz[d] = StatusInvalid
+		}
+		_, _ = w.Write([]byte(`{}`))
+	case p == "/orders/1":
+		_ = json.NewEncoder(w).Encode(ca.order())
+	case p == "/finalize":
+		var f struct{ CSR string }
+		_ = json.Unmarshal(payload, &f)
+		der, _ := base64.RawURLEncoding.DecodeString(f.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || ca.order().Status != StatusReady {
+			ca.problem(w, http.StatusForbidden, "urn:ietf:params:acme:error:orderNotReady", "not ready")
+			return
+		}
+		assert.Equal(ca.t, ca.domains, csr.DNSNames)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(ca.orders + 1)),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(ca.validity),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		ca.cert, _ = x509.CreateCertificate(rand.Reader, tmpl, ca.root, csr.PublicKey, ca.rootKey)
+		_ = json.NewEncoder(w).Encode(ca.order())
+	case p == "/cert":
+		w.Header().Set("Content-Type", contentPEM)
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert})
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (ca *fakeCA) order() Order {
+	o := Order{Status: StatusReady, Finalize: ca.url("/finalize")}
+	for _, d := range ca.domains {
+		o.Authorizations = append(o.Authorizations, ca.url("/authz/"+d))
+		switch ca.authz[d] {
+		case StatusPending:
+			o.Status = StatusPending
+		case StatusInvalid:
+			o.Status = StatusInvalid
+			return o
+		}
+	}
+	if ca.cert != nil {
+		o.Status, o.Certificate = StatusValid, ca.url("/cert")
+	}
+	return o
+}
+
+// verify checks the JWS of req and returns its payload and account. It
+// refuses the nonce once with a badNonce problem when badNonce is set.
+func (ca *fakeCA) verify(req *http.Request) ([]byte, string, error) {
+	var msg jws
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		return nil, "", err
+	}
+	hb, _ := base64.RawURLEncoding.DecodeString(msg.Protected)
+	var h protected
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return nil, "", err
+	}
+	if h.URL != ca.url(req.URL.Path) {
+		return nil, "", fmt.Errorf("url %q in header", h.URL)
+	}
+	if !ca.nonces[h.Nonce] {
+		return nil, "", fmt.Errorf("unknown nonce %q", h.Nonce)
+	}
+	delete(ca.nonces, h.Nonce)
+	if ca.badNonce {
+		ca.badNonce = false
+		return nil, "", &Problem{Type: ProblemBadNonce}
+	}
+
+	var pub *ecdsa.PublicKey
+	kid := strings.TrimPrefix(h.KID, ca.url("/acct/"))
+	if h.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(h.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(h.JWK.Y)
+		pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		kid, _ = Thumbprint(pub)
+		ca.accounts[kid] = pub
+	} else if pub = ca.accounts[kid]; pub == nil {
+		return nil, "", fmt.Errorf("unknown account %q", h.KID)
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(msg.Signature)
+	sum := sha256.Sum256([]byte(msg.Protected + "." + msg.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, "", fmt.Errorf("bad signature")
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(msg.Payload)
+	if payload == nil {
+		payload = []byte{}
+	}
+	return payload, kid, nil
+}
+
+func TestManager(t *testing.T) {
+	ca := newFakeCA(t)
+	store := mock.NewStorage()
+	m := &Manager{
+		DirectoryURL: ca.url("/dir"),
+		Email:        "admin@example.com",
+		Domains:      []string{"example.com", "www.example.com"},
+		Store:        store,
+	}
+	challenges := m.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	// the CA reaches the manager serving on the domains
+	serving := m
+	ca.validate = func(token string) string {
+		w := httptest.NewRecorder()
+		serving.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com"+ChallengePath+token, nil))
+		return w.Body.String()
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: "www.example.com"}
+	_, err := m.GetCertificate(hello)
+	assert.NotNil(t, err, "no certificate before Renew")
+
+	ctx := context.Background()
+	if err = m.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.GetCertificate(hello)
+	if !assert.Nil(t, err) {
+		return
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: roots})
+	assert.Nil(t, err)
+	assert.Equal(t, cert.Leaf.NotAfter, m.Expiry())
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.com"})
+	assert.NotNil(t, err)
+
+	// the challenges are answered only while they are pending
+	w := httptest.NewRecorder()
+	challenges.ServeHTTP(w, httptest.NewRequest(http.MethodGet, ChallengePath+"token-example.com", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	challenges.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+	assert.Equal(t, http.StatusTeapot, w.Code)
+
+	// a fresh certificate is kept
+	assert.Nil(t, m.Renew(ctx))
+	assert.Equal(t, 1, ca.orders)
+
+	// a restart loads the account and certificate from the store
+	m2 := &Manager{DirectoryURL: m.DirectoryURL, Domains: m.Domains, Store: store}
+	serving = m2
+	cert2, err := m2.GetCertificate(hello)
+	assert.Nil(t, err)
+	assert.Equal(t, cert.Certificate, cert2.Certificate)
+	assert.Nil(t, m2.Renew(ctx))
+	assert.Equal(t, 1, ca.orders)
+
+	// two thirds into its life the certificate is renewed, with the same
+	// account even if a nonce is refused on the way
+	m2.Now = func() time.Time { return time.Now().Add(61 * 24 * time.Hour) }
+	ca.mu.Lock()
+	ca.badNonce = true
+	ca.mu.Unlock()
+	assert.Nil(t, m2.Renew(ctx))
+	assert.Equal(t, 2, ca.orders)
+	assert.Equal(t, 1, len(ca.accounts))
+	cert3, _ := m2.GetCertificate(hello)
+	assert.NotEqual(t, cert.Certificate[0], cert3.Certificate[0])
+}
+
+func TestManager_Invalid(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.validate = func(token string) string { return "wrong" }
+	m := &Manager{DirectoryURL: ca.url("/dir"), Domains: []string{"example.com"}, Store: mock.NewStorage()}
+
+	err := m.Renew(context.Background())
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "example.com")
+	}
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.NotNil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx, time.Hour, func(err error) {
+			errs = append(errs, err)
+			cancel()
+		})
+		close(done)
+	}()
+	<-done
+	assert.Equal(t, 1, len(errs), "Run reports failures and stops with ctx")
+}
+
+func TestThumbprint(t *testing.T) {
+	// the example key of RFC 7638 is RSA, so check against a fixed EC key
+	// hashed by hand instead
+	x, _ := new(big.Int).SetString("f3e4e1c5b8b3a1f2a6d0e5f5cbd4c0f6a0d2b4e1c3f5a7b9d1e3f5a7b9c1d3e5", 16)
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: big.NewInt(1)}
+	tp, err := Thumbprint(key)
+	assert.Nil(t, err)
+	want := sha256.Sum256([]byte(`{"crv":"P-256","kty":"EC","x":"` +
+		base64.RawURLEncoding.EncodeToString(x.Bytes()) + `","y":"` +
+		base64.RawURLEncoding.EncodeToString(append(make([]byte, 31), 1)) + `"}`))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(want[:]), tp)
+
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, err = Thumbprint(&other.PublicKey)
+	assert.NotNil(t, err)
+}
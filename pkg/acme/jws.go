@@ -0,0 +1,100 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+// jwk is the public key of an account as JSON Web Key. Its fields are in
+// the order RFC 7638 hashes them for the thumbprint.
+type jwk struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func publicJWK(pub *ecdsa.PublicKey) (jwk, error) {
+	if pub.Curve != elliptic.P256() {
+		return jwk{}, errors.New("acme: only P-256 account keys are supported")
+	}
+	return jwk{
+		Crv: "P-256",
+		Kty: "EC",
+		X:   b64(pad(pub.X, 32)),
+		Y:   b64(pad(pub.Y, 32)),
+	}, nil
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the public key, which key
+// authorizations end with.
+func Thumbprint(pub *ecdsa.PublicKey) (string, error) {
+	k, err := publicJWK(pub)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return b64(sum[:]), nil
+}
+
+type protected struct {
+	Alg   string `json:"alg"`
+	Nonce string `json:"nonce"`
+	URL   string `json:"url"`
+	JWK   *jwk   `json:"jwk,omitempty"`
+	KID   string `json:"kid,omitempty"`
+}
+
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// sign wraps payload in a flattened JWS signed with ES256 by key, naming
+// the key by kid or, if kid is empty, by the key itself.
+func sign(key *ecdsa.PrivateKey, kid, nonce, url string, payload []byte) ([]byte, error) {
+	h := protected{Alg: "ES256", Nonce: nonce, URL: url, KID: kid}
+	if kid == "" {
+		k, err := publicJWK(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		h.JWK = &k
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	msg := jws{Protected: b64(hb), Payload: b64(payload)}
+	sum := sha256.Sum256([]byte(msg.Protected + "." + msg.Payload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	msg.Signature = b64(append(pad(r, 32), pad(s, 32)...))
+	return json.Marshal(msg)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// pad returns n as a big-endian number of size bytes.
+func pad(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
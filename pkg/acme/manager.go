@@ -0,0 +1,324 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/huangjiahua/tempdesk/pkg/storage"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Names the account key and the certificate are stored under.
+	AccountKeyName  = "acme/account.key"
+	CertificateName = "acme/certificate.pem"
+
+	// DefaultCheckInterval is how often Run checks whether the certificate
+	// is due for renewal.
+	DefaultCheckInterval = 12 * time.Hour
+	// retryBackoff is how long Run waits after the first failure to obtain
+	// a certificate, it doubles up to the check interval.
+	retryBackoff = time.Minute
+)
+
+// Manager keeps a certificate for Domains from the CA of DirectoryURL. It
+// stores the account key and the certificate with its key in Store, so a
+// restart reuses them.
+type Manager struct {
+	DirectoryURL string
+	// Email is the contact of the account, it may be empty.
+	Email   string
+	Domains []string
+	Store   storage.PutterGetter
+
+	HTTPClient *http.Client
+	// Now is used to decide on renewal, it is replaceable for tests.
+	Now func() time.Time
+
+	mu     sync.RWMutex
+	client *Client
+	cert   *tls.Certificate
+	tokens map[string]string
+}
+
+func (m *Manager) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+// GetCertificate hands the certificate to crypto/tls as the
+// tls.Config.GetCertificate callback.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if name := strings.TrimSuffix(strings.ToLower(hello.ServerName), "."); name != "" && !m.hasDomain(name) {
+		return nil, fmt.Errorf("acme: no certificate for %q", hello.ServerName)
+	}
+	m.mu.RLock()
+	cert := m.cert
+	m.mu.RUnlock()
+	if cert == nil {
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+		m.mu.RLock()
+		cert = m.cert
+		m.mu.RUnlock()
+	}
+	if cert == nil {
+		return nil, errors.New("acme: no certificate obtained yet")
+	}
+	return cert, nil
+}
+
+func (m *Manager) hasDomain(name string) bool {
+	for _, d := range m.Domains {
+		if strings.EqualFold(d, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPHandler answers the http-01 challenges of the CA and hands every
+// other request to fallback, which may be nil for a 404.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, ChallengePath) {
+			if fallback == nil {
+				http.NotFound(w, req)
+				return
+			}
+			fallback.ServeHTTP(w, req)
+			return
+		}
+		m.mu.RLock()
+		keyAuth, ok := m.tokens[strings.TrimPrefix(req.URL.Path, ChallengePath)]
+		m.mu.RUnlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(keyAuth))
+	})
+}
+
+func (m *Manager) solve(token, keyAuth string) func() {
+	m.mu.Lock()
+	if m.tokens == nil {
+		m.tokens = make(map[string]string)
+	}
+	m.tokens[token] = keyAuth
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		delete(m.tokens, token)
+		m.mu.Unlock()
+	}
+}
+
+// load reads the stored certificate, if there is one for the domains.
+func (m *Manager) load() error {
+	value, err := m.Store.Get(CertificateName)
+	if storage.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("acme: unexpected value stored under " + CertificateName)
+	}
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return fmt.Errorf("acme: reading %s: %v", CertificateName, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	for _, d := range m.Domains {
+		if cert.Leaf.VerifyHostname(d) != nil {
+			// the domains changed since
+			return nil
+		}
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	return nil
+}
+
+// due reports whether cert is missing or has used up two thirds of its
+// lifetime, when certificate authorities like Let's Encrypt suggest to
+// renew.
+func (m *Manager) due(cert *tls.Certificate) bool {
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	life := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return !m.now().Before(cert.Leaf.NotBefore.Add(life * 2 / 3))
+}
+
+// Expiry returns when the current certificate expires, the zero time while
+// there is none.
+func (m *Manager) Expiry() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil || m.cert.Leaf == nil {
+		return time.Time{}
+	}
+	return m.cert.Leaf.NotAfter
+}
+
+// Renew obtains a new certificate if the current one is missing or due for
+// renewal.
+func (m *Manager) Renew(ctx context.Context) error {
+	m.mu.RLock()
+	cert := m.cert
+	m.mu.RUnlock()
+	if cert == nil {
+		if err := m.load(); err != nil {
+			return err
+		}
+		m.mu.RLock()
+		cert = m.cert
+		m.mu.RUnlock()
+	}
+	if !m.due(cert) {
+		return nil
+	}
+
+	client, err := m.account(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	chain, err := client.Obtain(ctx, m.Domains, key, m.solve)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	next, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return fmt.Errorf("acme: reading the issued certificate: %v", err)
+	}
+	if next.Leaf, err = x509.ParseCertificate(next.Certificate[0]); err != nil {
+		return err
+	}
+	if err = m.Store.Put(CertificateName, b); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cert = &next
+	m.mu.Unlock()
+	return nil
+}
+
+// account returns the client of the stored account, creating the account
+// on first use.
+func (m *Manager) account(ctx context.Context) (*Client, error) {
+	m.mu.RLock()
+	client := m.client
+	m.mu.RUnlock()
+	if client != nil {
+		return client, nil
+	}
+
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client = New(m.DirectoryURL, key)
+	if m.HTTPClient != nil {
+		client.HTTPClient = m.HTTPClient
+	}
+	if err = client.Register(ctx, m.Email); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.client = client
+	m.mu.Unlock()
+	return client, nil
+}
+
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	value, err := m.Store.Get(AccountKeyName)
+	if err == nil {
+		b, ok := value.([]byte)
+		if !ok {
+			return nil, errors.New("acme: unexpected value stored under " + AccountKeyName)
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("acme: no key in " + AccountKeyName)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !storage.IsNotFound(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.Store.Put(AccountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Run renews the certificate until ctx is done: right away, then every
+// interval. A failure is handed to onError and tried again sooner.
+func (m *Manager) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	backoff := retryBackoff
+	for {
+		wait := interval
+		if err := m.Renew(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if onError != nil {
+				onError(err)
+			}
+			if backoff < interval {
+				wait = backoff
+			}
+			backoff *= 2
+		} else {
+			backoff = retryBackoff
+		}
+		if sleep(ctx, wait) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ChallengeHTTP01 is the challenge proving control of a domain by serving
+// the key authorization at ChallengePath + token over plain HTTP.
+const (
+	ChallengeHTTP01 = "http-01"
+	ChallengePath   = "/.well-known/acme-challenge/"
+)
+
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Order asks for a certificate of the identifiers.
+type Order struct {
+	// URL is where the order is polled.
+	URL            string       `json:"-"`
+	Status         string       `json:"status"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *Problem     `json:"error"`
+}
+
+// Authorization tells whether the account controls an identifier and how
+// it can prove it.
+type Authorization struct {
+	Status     string      `json:"status"`
+	Identifier Identifier  `json:"identifier"`
+	Challenges []Challenge `json:"challenges"`
+}
+
+type Challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Status string   `json:"status"`
+	Token  string   `json:"token"`
+	Error  *Problem `json:"error"`
+}
+
+// Solver makes the key authorization of a token available until the
+// returned cleanup is called.
+type Solver func(token, keyAuth string) (cleanup func())
+
+// NewOrder asks for a certificate of the domains.
+func (c *Client) NewOrder(ctx context.Context, domains []string) (*Order, error) {
+	dir, err := c.Directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]Identifier, len(domains))
+	for i, d := range domains {
+		ids[i] = Identifier{Type: "dns", Value: d}
+	}
+	o := &Order{}
+	resp, err := c.post(ctx, dir.NewOrder, map[string]interface{}{"identifiers": ids}, o)
+	if err != nil {
+		return nil, err
+	}
+	if o.URL = resp.Header.Get("Location"); o.URL == "" {
+		return nil, errors.New("acme: order has no location")
+	}
+	return o, nil
+}
+
+// Order fetches the order at url.
+func (c *Client) Order(ctx context.Context, url string) (*Order, error) {
+	o := &Order{}
+	if _, err := c.post(ctx, url, nil, o); err != nil {
+		return nil, err
+	}
+	o.URL = url
+	return o, nil
+}
+
+func (c *Client) Authorization(ctx context.Context, url string) (*Authorization, error) {
+	a := &Authorization{}
+	if _, err := c.post(ctx, url, nil, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// KeyAuthorization returns what answers the challenge of token.
+func (c *Client) KeyAuthorization(token string) (string, error) {
+	tp, err := Thumbprint(&c.Key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return token + "." + tp, nil
+}
+
+// Accept tells the CA that the challenge is ready to be validated.
+func (c *Client) Accept(ctx context.Context, ch Challenge) error {
+	resp, err := c.post(ctx, ch.URL, struct{}{}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Authorize proves control of the identifier of the authorization at url
+// by its http-01 challenge, which solve answers, and waits until the CA has
+// validated it.
+func (c *Client) Authorize(ctx context.Context, url string, solve Solver) error {
+	a, err := c.Authorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if a.Status == StatusValid {
+		return nil
+	}
+	var ch *Challenge
+	for i := range a.Challenges {
+		if a.Challenges[i].Type == ChallengeHTTP01 {
+			ch = &a.Challenges[i]
+		}
+	}
+	if ch == nil {
+		return fmt.Errorf("acme: %s offers no %s challenge", a.Identifier.Value, ChallengeHTTP01)
+	}
+
+	keyAuth, err := c.KeyAuthorization(ch.Token)
+	if err != nil {
+		return err
+	}
+	cleanup := solve(ch.Token, keyAuth)
+	defer cleanup()
+	if err = c.Accept(ctx, *ch); err != nil {
+		return err
+	}
+
+	for {
+		resp, err := c.post(ctx, url, nil, a)
+		if err != nil {
+			return err
+		}
+		switch a.Status {
+		case StatusValid:
+			return nil
+		case StatusPending, StatusProcessing:
+		default:
+			for _, ch := range a.Challenges {
+				if ch.Error != nil {
+					return fmt.Errorf("acme: validating %s: %v", a.Identifier.Value, ch.Error)
+				}
+			}
+			return fmt.Errorf("acme: authorization of %s is %s", a.Identifier.Value, a.Status)
+		}
+		if err = sleep(ctx, c.retryAfter(resp)); err != nil {
+			return err
+		}
+	}
+}
+
+// wait polls the order while its status is one of pending.
+func (c *Client) wait(ctx context.Context, o *Order, pending ...string) (*Order, error) {
+	for oneOf(o.Status, pending) {
+		next := &Order{}
+		resp, err := c.post(ctx, o.URL, nil, next)
+		if err != nil {
+			return nil, err
+		}
+		next.URL = o.URL
+		if next.Status == o.Status {
+			if err = sleep(ctx, c.retryAfter(resp)); err != nil {
+				return nil, err
+			}
+		}
+		o = next
+	}
+	if o.Status == StatusInvalid {
+		if o.Error != nil {
+			return nil, o.Error
+		}
+		return nil, errors.New("acme: order is invalid")
+	}
+	return o, nil
+}
+
+func oneOf(s string, list []string) bool {
+	for _, v := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Finalize sends the certificate signing request of the ready order and
+// waits until the certificate is issued.
+func (c *Client) Finalize(ctx context.Context, o *Order, csr []byte) (*Order, error) {
+	next := &Order{}
+	if _, err := c.post(ctx, o.Finalize, map[string]string{"csr": b64(csr)}, next); err != nil {
+		return nil, err
+	}
+	next.URL = o.URL
+	o, err := c.wait(ctx, next, StatusReady, StatusProcessing)
+	if err != nil {
+		return nil, err
+	}
+	if o.Status != StatusValid || o.Certificate == "" {
+		return nil, fmt.Errorf("acme: order is %s without a certificate", o.Status)
+	}
+	return o, nil
+}
+
+// Certificate downloads the certificate chain at url, leaf first, as DER.
+func (c *Client) Certificate(ctx context.Context, url string) ([][]byte, error) {
+	resp, err := c.post(ctx, url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, err
+	}
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("acme: no certificate in " + resp.Header.Get("Content-Type") + " response")
+	}
+	return chain, nil
+}
+
+// Obtain runs a whole order: it authorizes each domain with solve and
+// returns the chain of a certificate for the domains and key. The account
+// must be registered.
+func (c *Client) Obtain(ctx context.Context, domains []string, key crypto.Signer, solve Solver) ([][]byte, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("acme: no domains")
+	}
+	o, err := c.NewOrder(ctx, domains)
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range o.Authorizations {
+		if err = c.Authorize(ctx, url, solve); err != nil {
+			return nil, err
+		}
+	}
+	if o, err = c.wait(ctx, o, StatusPending); err != nil {
+		return nil, err
+	}
+	if o.Status == StatusReady {
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: domains[0]},
+			DNSNames: domains,
+		}, key)
+		if err != nil {
+			return nil, err
+		}
+		if o, err = c.Finalize(ctx, o, csr); err != nil {
+			return nil, err
+		}
+	} else if o, err = c.wait(ctx, o, StatusProcessing); err != nil {
+		return nil, err
+	}
+	if o.Certificate == "" {
+		return nil, fmt.Errorf("acme: order is %s without a certificate", o.Status)
+	}
+	return c.Certificate(ctx, o.Certificate)
+}
@@ -0,0 +1,79 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestManager_Pebble obtains a certificate from a running pebble, the ACME
+// test server of Let's Encrypt. It is skipped unless TEMPDESK_PEBBLE names
+// the directory, like https://localhost:14000/dir. Pebble must resolve the
+// domain, TEMPDESK_PEBBLE_DOMAIN or example.test, to this machine, for
+// instance through pebble-challtestsrv, and validate http-01 challenges on
+// TEMPDESK_PEBBLE_HTTP_ADDR or :5002. TEMPDESK_PEBBLE_CA is the PEM file of
+// the certificate pebble serves its API with, which is not checked
+// otherwise.
+func TestManager_Pebble(t *testing.T) {
+	dir := os.Getenv("TEMPDESK_PEBBLE")
+	if dir == "" {
+		t.Skip("TEMPDESK_PEBBLE is not set")
+	}
+	domain := getenv("TEMPDESK_PEBBLE_DOMAIN", "example.test")
+	addr := getenv("TEMPDESK_PEBBLE_HTTP_ADDR", ":5002")
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if path := os.Getenv("TEMPDESK_PEBBLE_CA"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+		tlsConfig.RootCAs.AppendCertsFromPEM(b)
+	}
+	m := &Manager{
+		DirectoryURL: dir,
+		Email:        "admin@" + domain,
+		Domains:      []string{domain},
+		Store:        mock.NewStorage(),
+		HTTPClient:   &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: m.HTTPHandler(nil)}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err = m.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cert.Leaf.VerifyHostname(domain); err != nil {
+		t.Error(err)
+	}
+	if !m.Expiry().After(time.Now()) {
+		t.Errorf("Should expire in the future: %v", m.Expiry())
+	}
+}
+
+func getenv(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+const accountPrefix = "/account/"
+
+type accountInfo struct {
+	Name  string `json:"name,omitempty"`
+	Token string `json:"token,omitempty"`
+	Key   string `json:"password,omitempty"`
+}
+
+// VerifyEmail verifies the email address a verify mail with token was sent
+// to, it needs no credentials.
+func (c *Client) VerifyEmail(ctx context.Context, token string) error {
+	body, err := jsonBody(accountInfo{Token: token})
+	if err != nil {
+		return err
+	}
+	return c.doDiscard(ctx, &request{method: http.MethodPost, path: accountPrefix + "verify", body: body, anonymous: true})
+}
+
+// SendVerification asks the server to mail the user a verify link again.
+func (c *Client) SendVerification(ctx context.Context) error {
+	return c.doDiscard(ctx, &request{method: http.MethodPost, path: accountPrefix + "verify/send"})
+}
+
+// RequestReset asks the server to mail the user name a token to reset its
+// key with. The server answers alike whether or not it sends one.
+func (c *Client) RequestReset(ctx context.Context, name string) error {
+	body, err := jsonBody(accountInfo{Name: name})
+	if err != nil {
+		return err
+	}
+	return c.doDiscard(ctx, &request{method: http.MethodPost, path: accountPrefix + "reset", body: body, anonymous: true})
+}
+
+// ResetKey sets key as the key of the user a reset token was mailed to.
+func (c *Client) ResetKey(ctx context.Context, token, key string) error {
+	body, err := jsonBody(accountInfo{Token: token, Key: key})
+	if err != nil {
+		return err
+	}
+	return c.doDiscard(ctx, &request{method: http.MethodPut, path: accountPrefix + "reset", body: body, anonymous: true})
+}
@@ -0,0 +1,211 @@
+// Package client talks to a TempDesk server. It signs every request the way
+// the server's HMACAuther expects, retries server errors with backoff and
+// streams files with progress reports.
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRetries    = 3
+	DefaultBackoff    = 500 * time.Millisecond
+	DefaultMaxBackoff = 10 * time.Second
+
+	userPrefix = "/user/"
+	filePrefix = "/file"
+)
+
+type Client struct {
+	// BaseURL is the address of the server, like "http://localhost:8080".
+	BaseURL string
+	Name    string
+	Key     string
+
+	HTTPClient *http.Client
+	// Retries is how many times a request failing with a 5xx status or a
+	// network error is tried again.
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Now is used to date requests, it is replaceable for tests.
+	Now func() time.Time
+	// TOTPCode returns a current code of the user's second factor, for a
+	// server that asks signed requests for one. It may be nil.
+	TOTPCode func() string
+}
+
+// New creates a Client for the user name with key on the server at baseURL.
+func New(baseURL, name, key string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Name:       name,
+		Key:        key,
+		HTTPClient: http.DefaultClient,
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		Now:        time.Now,
+	}
+}
+
+// Sign sets the Date and Authorization headers of req for the user name with
+// key, dated now.
+func Sign(req *http.Request, name, key string, now time.Time) {
+	d := now.UTC().Format(http.TimeFormat)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(req.Method + "\n" + req.URL.Path + "\n" + name + "\n" + d))
+	digest := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("Date", d)
+	req.Header.Set("Authorization", "HMAC "+name+" "+digest)
+}
+
+// request describes a request that can be built again for every attempt.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	// body returns a fresh body for each attempt, it may be nil.
+	body func() (io.Reader, error)
+	// length is the size of the body when it is known.
+	length int64
+	// anonymous requests are not signed.
+	anonymous bool
+	// once requests are not retried, their body cannot be read again.
+	once bool
+}
+
+func (c *Client) newRequest(ctx context.Context, r *request) (*http.Request, error) {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + r.path
+	if r.query != nil {
+		u.RawQuery = r.query.Encode()
+	}
+
+	var body io.Reader
+	if r.body != nil {
+		if body, err = r.body(); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(r.method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil && r.length > 0 {
+		req.ContentLength = r.length
+	}
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	if !r.anonymous {
+		Sign(req, c.Name, c.Key, c.now())
+		if c.TOTPCode != nil {
+			req.Header.Set("X-TOTP-Code", c.TOTPCode())
+		}
+	}
+	return req, nil
+}
+
+// do sends r, trying it again on network errors and 5xx responses. A
+// response with another error status is turned into a *ClientError, so a
+// returned response always succeeded and its body must be closed.
+func (c *Client) do(ctx context.Context, r *request) (*http.Response, error) {
+	var lastErr error
+	retries := c.Retries
+	if r.once {
+		retries = 0
+	}
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			if err := c.sleep(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := c.newRequest(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.httpClient().Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if res.StatusCode < 400 {
+			return res, nil
+		}
+
+		lastErr = readError(res)
+		if res.StatusCode < 500 {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+// doDiscard is do for requests whose response body does not matter.
+func (c *Client) doDiscard(ctx context.Context, r *request) error {
+	res, err := c.do(ctx, r)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return res.Body.Close()
+}
+
+// backoff returns the delay before the given retry, doubling from Backoff up
+// to MaxBackoff.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.Backoff
+	for i := 1; i < attempt && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if c.MaxBackoff > 0 && d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d
+}
+
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	t := time.NewTimer(c.backoff(attempt))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/http/handler"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newServer serves the user and file handlers, wrapped by wrap if it is not
+// nil, and returns a client signed up as sam.
+func newServer(t *testing.T, wrap func(http.Handler) http.Handler) (*Client, *httptest.Server) {
+	state := &thttp.State{
+		Users:  mock.NewUserService(),
+		Files:  mock.NewFileService(),
+		Auther: auth.NewHMACAuther(),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/user/", handler.NewUser(state))
+	mux.Handle("/file/", handler.NewFile(state, "/file"))
+	var h http.Handler = mux
+	if wrap != nil {
+		h = wrap(mux)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	c := New(ts.URL, "sam", "key")
+	c.Backoff = time.Millisecond
+	if err := c.CreateUser(context.Background(), "sam", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	return c, ts
+}
+
+func TestClient_Users(t *testing.T) {
+	c, ts := newServer(t, nil)
+	ctx := context.Background()
+
+	name, err := c.WhoAmI(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "sam", name)
+
+	err = c.CreateUser(ctx, "sam", "other", nil)
+	assert.True(t, IsKind(err, NameAlreadyExists), "%v", err)
+
+	_, err = New(ts.URL, "sam", "wrong").WhoAmI(ctx)
+	assert.True(t, IsKind(err, NotAuthed), "%v", err)
+	assert.Equal(t, http.StatusForbidden, err.(*ClientError).Status)
+}
+
+func TestClient_UploadDownload(t *testing.T) {
+	c, _ := newServer(t, nil)
+	ctx := context.Background()
+	data := strings.Repeat("tempdesk", 1000)
+
+	var reported int64
+	err := c.Upload(ctx, "/docs/a.txt", strings.NewReader(data), int64(len(data)), func(done, total int64) {
+		assert.Equal(t, int64(len(data)), total)
+		reported = done
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), reported)
+
+	size, err := c.Stat(ctx, "docs/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+
+	var buf bytes.Buffer
+	n, err := c.Download(ctx, "docs/a.txt", &buf, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, buf.String())
+
+	lock, err := c.Lock(ctx, "docs/a.txt", ScopeExclusive, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "sam", lock.Owner)
+	locks, err := c.Locks(ctx, "docs/a.txt")
+	assert.Nil(t, err)
+	assert.Len(t, locks, 1)
+	assert.Nil(t, c.Unlock(ctx, "docs/a.txt", lock.Token))
+
+	assert.Nil(t, c.Remove(ctx, "docs/a.txt"))
+	_, err = c.Download(ctx, "docs/a.txt", &buf, nil)
+	assert.True(t, IsNotFound(err), "%v", err)
+}
+
+func TestClient_Retry(t *testing.T) {
+	var failures int32 = 2
+	c, _ := newServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodPut && atomic.AddInt32(&failures, -1) >= 0 {
+				http.Error(res, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	})
+	ctx := context.Background()
+
+	assert.Nil(t, c.Upload(ctx, "a.txt", strings.NewReader("hello"), 5, nil))
+	var buf bytes.Buffer
+	_, err := c.Download(ctx, "a.txt", &buf, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", buf.String())
+
+	atomic.StoreInt32(&failures, 10)
+	err = c.Upload(ctx, "a.txt", strings.NewReader("hello"), 5, nil)
+	assert.True(t, IsKind(err, ServerError), "%v", err)
+	assert.Equal(t, "try again", err.(*ClientError).Message)
+}
+
+func TestClient_Resume(t *testing.T) {
+	var cut int32 = 1
+	var ranges []string
+	c, _ := newServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if r := req.Header.Get("Content-Range"); r != "" {
+				ranges = append(ranges, r)
+			}
+			if req.Method == http.MethodGet && atomic.AddInt32(&cut, -1) == 0 {
+				// break the first download off half way
+				res.Header().Set("Content-Length", "10")
+				_, _ = res.Write([]byte("01234"))
+				panic(http.ErrAbortHandler)
+			}
+			next.ServeHTTP(res, req)
+		})
+	})
+	ctx := context.Background()
+	data := "0123456789"
+
+	// an upload that stopped after four bytes
+	assert.Nil(t, c.Upload(ctx, "a.txt", strings.NewReader(data[:4]), 4, nil))
+	var reported int64
+	err := c.ResumeUpload(ctx, "a.txt", strings.NewReader(data), 10, func(done, total int64) {
+		reported = done
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bytes 4-9/10"}, ranges, "only the missing bytes should be sent")
+	assert.Equal(t, int64(10), reported)
+
+	var buf bytes.Buffer
+	n, err := c.Download(ctx, "a.txt", &buf, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), n)
+	assert.Equal(t, data, buf.String())
+}
+
+func TestClient_UploadDelta(t *testing.T) {
+	var c *Client
+	var patched, sent, changed int64
+	c, _ = newServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodPatch {
+				atomic.AddInt64(&patched, 1)
+				if atomic.CompareAndSwapInt64(&changed, 1, 2) {
+					// another client changes the file while the delta is made
+					_ = c.Upload(context.Background(), "image.bin", strings.NewReader("other"), 5, nil)
+				}
+				b, _ := ioutil.ReadAll(req.Body)
+				atomic.AddInt64(&sent, int64(len(b)))
+				req.Body = ioutil.NopCloser(bytes.NewReader(b))
+			}
+			next.ServeHTTP(res, req)
+		})
+	})
+	ctx := context.Background()
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	assert.Nil(t, c.UploadDelta(ctx, "image.bin", bytes.NewReader(data), int64(len(data)), nil))
+	assert.Equal(t, int64(0), patched, "a new file is uploaded whole")
+
+	copy(data[100000:], "a small change")
+	assert.Nil(t, c.UploadDelta(ctx, "image.bin", bytes.NewReader(data), int64(len(data)), nil))
+	assert.Equal(t, int64(1), patched)
+	assert.Less(t, sent, int64(16<<10), "only the changed block and the signature matches are sent")
+	var buf bytes.Buffer
+	_, _ = c.Download(ctx, "image.bin", &buf, nil)
+	assert.True(t, bytes.Equal(data, buf.Bytes()))
+
+	changed = 1
+	copy(data[200000:], "another change")
+	assert.Nil(t, c.UploadDelta(ctx, "image.bin", bytes.NewReader(data), int64(len(data)), nil))
+	assert.Equal(t, int64(2), patched)
+	buf.Reset()
+	_, _ = c.Download(ctx, "image.bin", &buf, nil)
+	assert.True(t, bytes.Equal(data, buf.Bytes()), "a refused delta falls back to a whole upload")
+}
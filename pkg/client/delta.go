@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"github.com/huangjiahua/tempdesk/pkg/delta"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Signature returns the block signature of the file at p in blocks of
+// blockSize, or of a size the server picks when blockSize is 0.
+func (c *Client) Signature(ctx context.Context, p string, blockSize int) (delta.Signature, error) {
+	q := url.Values{"signature": {""}}
+	if blockSize > 0 {
+		q.Set("block", strconv.Itoa(blockSize))
+	}
+	var sig delta.Signature
+	err := c.doJson(ctx, &request{method: http.MethodGet, path: filePath(p), query: q}, &sig)
+	return sig, err
+}
+
+// UploadDelta stores the size bytes of r at p like Upload, but only sends
+// what the file already at p lacks. When there is no file at p, or it
+// changed while the delta was made, the whole of r is uploaded instead.
+// The delta is made while it is sent, so it is not retried.
+func (c *Client) UploadDelta(ctx context.Context, p string, r io.ReadSeeker, size int64, progress Progress) error {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	upload := func() error {
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		return c.Upload(ctx, p, r, size, progress)
+	}
+
+	sig, err := c.Signature(ctx, p, 0)
+	if IsNotFound(err) {
+		return upload()
+	}
+	if err != nil {
+		return err
+	}
+
+	// the delta is written into a pipe by a goroutine, which has to stop
+	// reading r before r may be uploaded whole
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	started := false
+	err = c.doDiscard(ctx, &request{
+		method: http.MethodPatch,
+		path:   filePath(p),
+		header: http.Header{"Content-Type": {"application/x-tempdesk-delta"}},
+		body: func() (io.Reader, error) {
+			started = true
+			go func() {
+				defer close(done)
+				_ = pw.CloseWithError(delta.Diff(sig, &progressReader{r: r, total: size, fn: progress}, pw))
+			}()
+			return pr, nil
+		},
+		once: true,
+	})
+	_ = pr.Close()
+	if started {
+		<-done
+	}
+	if IsKind(err, Conflict) {
+		return upload()
+	}
+	return err
+}
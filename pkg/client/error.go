@@ -0,0 +1,87 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Kinds of ClientError, taken from the status and message of a response.
+const (
+	NotAuthed         = "not authed"
+	PermissionDenied  = "permission denied"
+	NotFound          = "not found"
+	Conflict          = "conflict"
+	Locked            = "locked"
+	BadRequest        = "bad request"
+	NameAlreadyExists = "name already exists"
+	RangeNotSatisfied = "range not satisfiable"
+	TooManyRequests   = "too many requests"
+	ServerError       = "server error"
+	UnknownError      = "unknown error"
+)
+
+// maxErrorBody bounds how much of an error response is kept as its message.
+const maxErrorBody = 4 << 10
+
+// ClientError is returned for a response with an error status.
+type ClientError struct {
+	Kind    string
+	Status  int
+	Message string
+}
+
+func (e *ClientError) Error() string {
+	return e.Kind + ": " + e.Message
+}
+
+// IsKind reports whether err is a ClientError of kind.
+func IsKind(err error, kind string) bool {
+	e, ok := err.(*ClientError)
+	return ok && e.Kind == kind
+}
+
+// IsNotFound reports whether err tells that the file or user does not exist.
+func IsNotFound(err error) bool {
+	return IsKind(err, NotFound)
+}
+
+// readError consumes and closes the body of res and describes it as a
+// ClientError.
+func readError(res *http.Response) *ClientError {
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	_ = res.Body.Close()
+	msg := strings.TrimSpace(string(b))
+	if msg == "" {
+		msg = http.StatusText(res.StatusCode)
+	}
+	return &ClientError{Kind: errorKind(res.StatusCode, msg), Status: res.StatusCode, Message: msg}
+}
+
+// errorKind follows the status codes and messages of the server handlers.
+func errorKind(status int, msg string) string {
+	switch {
+	case status == http.StatusForbidden && msg == "error authenticating":
+		return NotAuthed
+	case status == http.StatusForbidden:
+		return PermissionDenied
+	case status == http.StatusNotFound:
+		return NotFound
+	case status == http.StatusConflict:
+		return Conflict
+	case status == http.StatusLocked:
+		return Locked
+	case status == http.StatusRequestedRangeNotSatisfiable:
+		return RangeNotSatisfied
+	case status == http.StatusTooManyRequests:
+		return TooManyRequests
+	case status == http.StatusBadRequest && msg == NameAlreadyExists:
+		return NameAlreadyExists
+	case status == http.StatusBadRequest:
+		return BadRequest
+	case status >= 500:
+		return ServerError
+	}
+	return UnknownError
+}
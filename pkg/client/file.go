@@ -0,0 +1,306 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lock scopes understood by the server.
+const (
+	ScopeShared    = "shared"
+	ScopeExclusive = "exclusive"
+)
+
+var ErrNoResume = errors.New("tempdesk.pkg.client: server ignored the range of a resumed download")
+
+// Progress is called as a transfer advances with the bytes done so far and
+// the total size, or -1 if the total is unknown.
+type Progress func(done, total int64)
+
+type Lock struct {
+	Token   string    `json:"token"`
+	Path    string    `json:"path"`
+	Owner   string    `json:"owner"`
+	Scope   string    `json:"scope"`
+	Expires time.Time `json:"expires"`
+}
+
+func filePath(p string) string {
+	return filePrefix + "/" + strings.TrimLeft(p, "/")
+}
+
+// Stat returns the size of the file at p.
+func (c *Client) Stat(ctx context.Context, p string) (int64, error) {
+	res, err := c.do(ctx, &request{method: http.MethodHead, path: filePath(p)})
+	if err != nil {
+		return 0, err
+	}
+	_ = res.Body.Close()
+	return res.ContentLength, nil
+}
+
+// Upload stores what r holds at p, size is only used to report progress
+// and may be -1. Failed uploads are tried again only when r is an
+// io.Seeker, other readers cannot be read a second time.
+func (c *Client) Upload(ctx context.Context, p string, r io.Reader, size int64, progress Progress) error {
+	seeker, seekable := r.(io.Seeker)
+	var start int64
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+
+	return c.doDiscard(ctx, &request{
+		method: http.MethodPut,
+		path:   filePath(p),
+		body: func() (io.Reader, error) {
+			if seekable {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+			}
+			return &progressReader{r: r, total: size, fn: progress}, nil
+		},
+		length: size,
+		once:   !seekable,
+	})
+}
+
+// ResumeUpload uploads the size bytes of r to p like Upload, but continues
+// where an earlier attempt stopped instead of starting over: the bytes
+// already stored at p are taken to be the start of r. Network errors and
+// server errors are retried from the new end of the file.
+func (c *Client) ResumeUpload(ctx context.Context, p string, r io.ReadSeeker, size int64, progress Progress) error {
+	for attempt := 0; ; attempt++ {
+		offset, err := c.Stat(ctx, p)
+		if IsNotFound(err) {
+			offset, err = 0, nil
+		}
+		if err != nil {
+			return err
+		}
+		if offset > size {
+			offset = 0
+		}
+		if offset == size && size > 0 {
+			return nil
+		}
+		if _, err = r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		req := &request{
+			method: http.MethodPut,
+			path:   filePath(p),
+			body: func() (io.Reader, error) {
+				return &progressReader{r: r, done: offset, total: size, fn: progress}, nil
+			},
+			length: size - offset,
+			once:   true,
+		}
+		if size > 0 {
+			req.header = http.Header{}
+			req.header.Set("Content-Range", "bytes "+strconv.FormatInt(offset, 10)+"-"+
+				strconv.FormatInt(size-1, 10)+"/"+strconv.FormatInt(size, 10))
+		}
+		err = c.doDiscard(ctx, req)
+		if err == nil || !retryable(ctx, err) || attempt >= c.Retries {
+			return err
+		}
+		if err = c.sleep(ctx, attempt+1); err != nil {
+			return err
+		}
+	}
+}
+
+// WriteBlock writes block at offset off of the file at p and keeps the rest
+// of the file, which is resized to total bytes. Uploading only the blocks
+// that changed patches a file the server already holds.
+func (c *Client) WriteBlock(ctx context.Context, p string, off int64, block []byte, total int64) error {
+	if len(block) == 0 {
+		return errors.New("tempdesk.pkg.client: empty block")
+	}
+	req := &request{
+		method: http.MethodPut,
+		path:   filePath(p),
+		header: http.Header{},
+		body: func() (io.Reader, error) {
+			return bytes.NewReader(block), nil
+		},
+		length: int64(len(block)),
+	}
+	req.header.Set("Content-Range", "bytes "+strconv.FormatInt(off, 10)+"-"+
+		strconv.FormatInt(off+int64(len(block))-1, 10)+"/"+strconv.FormatInt(total, 10))
+	return c.doDiscard(ctx, req)
+}
+
+// Download writes the file at p to w and returns the number of bytes
+// written. A transfer broken off by the network is continued with a Range
+// request where it stopped.
+func (c *Client) Download(ctx context.Context, p string, w io.Writer, progress Progress) (int64, error) {
+	var done int64
+	total := int64(-1)
+	for attempt := 0; ; attempt++ {
+		req := &request{method: http.MethodGet, path: filePath(p)}
+		if done > 0 {
+			req.header = http.Header{}
+			req.header.Set("Range", "bytes="+strconv.FormatInt(done, 10)+"-")
+		}
+		res, err := c.do(ctx, req)
+		if err != nil {
+			return done, err
+		}
+		if done > 0 && res.StatusCode != http.StatusPartialContent {
+			_ = res.Body.Close()
+			return done, ErrNoResume
+		}
+		if total < 0 && res.ContentLength >= 0 {
+			total = done + res.ContentLength
+		}
+
+		n, err := io.Copy(w, &progressReader{r: res.Body, done: done, total: total, fn: progress})
+		_ = res.Body.Close()
+		done += n
+		if err == nil || !retryable(ctx, err) || attempt >= c.Retries {
+			return done, err
+		}
+		if err = c.sleep(ctx, attempt+1); err != nil {
+			return done, err
+		}
+	}
+}
+
+func (c *Client) Remove(ctx context.Context, p string) error {
+	return c.doDiscard(ctx, &request{method: http.MethodDelete, path: filePath(p)})
+}
+
+// Lock locks the file at p with scope for lease, the server picks its
+// default lease when lease is 0.
+func (c *Client) Lock(ctx context.Context, p string, scope string, lease time.Duration) (Lock, error) {
+	req := &request{
+		method: "LOCK",
+		path:   filePath(p),
+		query:  url.Values{"scope": {scope}},
+		header: http.Header{},
+	}
+	if lease > 0 {
+		req.header.Set("Timeout", "Second-"+strconv.Itoa(int(lease/time.Second)))
+	}
+	var lock Lock
+	err := c.doJson(ctx, req, &lock)
+	return lock, err
+}
+
+// RefreshLock extends the lease of the lock with token.
+func (c *Client) RefreshLock(ctx context.Context, p string, token string, lease time.Duration) (Lock, error) {
+	req := &request{method: "LOCK", path: filePath(p), header: http.Header{}}
+	req.header.Set("If", "(<"+token+">)")
+	if lease > 0 {
+		req.header.Set("Timeout", "Second-"+strconv.Itoa(int(lease/time.Second)))
+	}
+	var lock Lock
+	err := c.doJson(ctx, req, &lock)
+	return lock, err
+}
+
+func (c *Client) Unlock(ctx context.Context, p string, token string) error {
+	req := &request{method: "UNLOCK", path: filePath(p), header: http.Header{}}
+	req.header.Set("Lock-Token", "<"+token+">")
+	return c.doDiscard(ctx, req)
+}
+
+// Locks lists the locks held on the file at p.
+func (c *Client) Locks(ctx context.Context, p string) ([]Lock, error) {
+	var locks []Lock
+	err := c.doJson(ctx, &request{method: http.MethodGet, path: filePath(p), query: url.Values{"locks": {""}}}, &locks)
+	return locks, err
+}
+
+// doJson is do for requests answered with JSON, which is decoded into v.
+func (c *Client) doJson(ctx context.Context, r *request, v interface{}) error {
+	res, err := c.do(ctx, r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// retryable tells whether a transfer failing with err may be tried again.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if e, ok := err.(*ClientError); ok {
+		return e.Status >= 500
+	}
+	return true
+}
+
+type progressReader struct {
+	r     io.Reader
+	done  int64
+	total int64
+	fn    Progress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		if p.fn != nil {
+			p.fn(p.done, p.total)
+		}
+	}
+	return n, err
+}
+
+type FileInfo struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Dir      bool      `json:"dir,omitempty"`
+}
+
+// List lists the directory dir. Subdirectories are entries of their own
+// unless recursive is set, then every file below dir is listed.
+func (c *Client) List(ctx context.Context, dir string, recursive bool) ([]FileInfo, error) {
+	p := filePath(dir)
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	req := &request{method: http.MethodGet, path: p}
+	if recursive {
+		req.query = url.Values{"recursive": {""}}
+	}
+	var files []FileInfo
+	err := c.doJson(ctx, req, &files)
+	return files, err
+}
+
+// Move renames the file at src to dest. A file at dest is replaced only if
+// overwrite is set.
+func (c *Client) Move(ctx context.Context, src, dest string, overwrite bool) error {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + filePath(dest)
+	req := &request{method: "MOVE", path: filePath(src), header: http.Header{}}
+	req.header.Set("Destination", u.String())
+	if !overwrite {
+		req.header.Set("Overwrite", "F")
+	}
+	return c.doDiscard(ctx, req)
+}
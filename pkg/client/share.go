@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sharePrefix = "/share/"
+
+// Query parameters of a presigned link, as the server's HMACAuther reads
+// them.
+const (
+	presignUser      = "td-user"
+	presignExpires   = "td-expires"
+	presignSignature = "td-signature"
+)
+
+type Share struct {
+	Code    string    `json:"code"`
+	Path    string    `json:"path"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Share creates a share code for the file at p that lives for ttl, or the
+// server default when ttl is 0.
+func (c *Client) Share(ctx context.Context, p string, ttl time.Duration) (Share, error) {
+	info := map[string]string{"path": p}
+	if ttl > 0 {
+		info["ttl"] = ttl.String()
+	}
+	body, err := jsonBody(info)
+	if err != nil {
+		return Share{}, err
+	}
+	var sh Share
+	err = c.doJson(ctx, &request{method: http.MethodPost, path: sharePrefix, body: body}, &sh)
+	return sh, err
+}
+
+// Shares lists the live shares of the user, newest first.
+func (c *Client) Shares(ctx context.Context) ([]Share, error) {
+	var shares []Share
+	err := c.doJson(ctx, &request{method: http.MethodGet, path: sharePrefix}, &shares)
+	return shares, err
+}
+
+func (c *Client) Revoke(ctx context.Context, code string) error {
+	return c.doDiscard(ctx, &request{method: http.MethodDelete, path: sharePrefix + code})
+}
+
+// ShareURL returns the address anyone can download a shared file from.
+func (c *Client) ShareURL(code string) string {
+	return c.BaseURL + sharePrefix + code
+}
+
+// PresignURL returns a link to the file at p that downloads it as the user
+// of c, without further credentials, until ttl passes. It is signed locally
+// with the key of the user, so the server cannot revoke it but changing the
+// key does.
+func (c *Client) PresignURL(p string, ttl time.Duration) (string, error) {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + filePath(p)
+
+	expires := strconv.FormatInt(c.now().Add(ttl).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(c.Key))
+	mac.Write([]byte(http.MethodGet + "\n" + u.Path + "\n" + c.Name + "\n" + expires))
+	u.RawQuery = url.Values{
+		presignUser:      {c.Name},
+		presignExpires:   {expires},
+		presignSignature: {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+	}.Encode()
+	return u.String(), nil
+}
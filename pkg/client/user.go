@@ -0,0 +1,80 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+type userInfo struct {
+	Name   string            `json:"name"`
+	Key    string            `json:"password,omitempty"`
+	Meta   map[string]string `json:"meta,omitempty"`
+	Invite string            `json:"invite,omitempty"`
+}
+
+func jsonBody(v interface{}) (func() (io.Reader, error), error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return func() (io.Reader, error) { return bytes.NewReader(b), nil }, nil
+}
+
+// WhoAmI returns the name the server authenticates the client as.
+func (c *Client) WhoAmI(ctx context.Context) (string, error) {
+	res, err := c.do(ctx, &request{method: http.MethodGet, path: userPrefix})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var info userInfo
+	if err = json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	return info.Name, nil
+}
+
+// CreateUser signs up a new user, it needs no credentials.
+func (c *Client) CreateUser(ctx context.Context, name, key string, meta map[string]string) error {
+	body, err := jsonBody(userInfo{Name: name, Key: key, Meta: meta})
+	if err != nil {
+		return err
+	}
+	return c.doDiscard(ctx, &request{method: http.MethodPost, path: userPrefix, body: body, anonymous: true})
+}
+
+// SignUp signs up a new user with an invite code, which a server only
+// letting invited users sign up needs. pending tells that the user may not
+// log in until an admin approves it.
+func (c *Client) SignUp(ctx context.Context, name, key, invite string) (pending bool, err error) {
+	body, err := jsonBody(userInfo{Name: name, Key: key, Invite: invite})
+	if err != nil {
+		return false, err
+	}
+	res, err := c.do(ctx, &request{method: http.MethodPost, path: userPrefix, body: body, anonymous: true})
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	return res.StatusCode == http.StatusAccepted, nil
+}
+
+// UpdateUser replaces the key and meta of the user name.
+func (c *Client) UpdateUser(ctx context.Context, name, key string, meta map[string]string) error {
+	body, err := jsonBody(userInfo{Name: name, Key: key, Meta: meta})
+	if err != nil {
+		return err
+	}
+	return c.doDiscard(ctx, &request{method: http.MethodPut, path: userPrefix, body: body})
+}
+
+func (c *Client) DeleteUser(ctx context.Context, name string) error {
+	body, err := jsonBody(userInfo{Name: name})
+	if err != nil {
+		return err
+	}
+	return c.doDiscard(ctx, &request{method: http.MethodDelete, path: userPrefix, body: body})
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const watchPrefix = "/watch"
+
+// Event is a change the server reports to a watcher.
+type Event struct {
+	ID      uint64    `json:"id"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	OldPath string    `json:"old_path,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Watch streams the events of the files below prefix to fn until ctx is
+// done, the server closes the stream or fn returns an error, which Watch
+// then returns. A closed stream returns nil.
+func (c *Client) Watch(ctx context.Context, prefix string, fn func(Event) error) error {
+	req := &request{
+		method: http.MethodGet,
+		path:   watchPrefix + "/" + strings.TrimLeft(prefix, "/"),
+		header: http.Header{"Accept": {"text/event-stream"}},
+	}
+	res, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// each event is a block of "field: value" lines ended by a blank line,
+	// lines starting with a colon are comments like the heartbeat
+	var data strings.Builder
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var e Event
+			err := json.Unmarshal([]byte(data.String()), &e)
+			data.Reset()
+			if err != nil {
+				return err
+			}
+			if err = fn(e); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,89 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Apply rebuilds a file from base and the instructions r holds, writing it
+// to dst from offset 0. It returns the size of the file and fails with a
+// HashMismatch unless it has the size and hash the instructions end with,
+// which is what happens when base is not the file the signature was made
+// of.
+func Apply(dst io.WriterAt, base io.ReaderAt, r io.Reader) (int64, error) {
+	in := bufio.NewReader(r)
+	head := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(in, head); err != nil || string(head[:len(magic)]) != magic {
+		return 0, &DeltaError{Malformed, errors.New("bad header")}
+	}
+	bs := int64(binary.BigEndian.Uint32(head[len(magic):]))
+	if bs < MinBlockSize || bs > MaxBlockSize {
+		return 0, &DeltaError{Malformed, errors.New("block size out of range")}
+	}
+
+	h := sha256.New()
+	buf := make([]byte, bs)
+	var off int64
+	write := func(p []byte) error {
+		h.Write(p)
+		_, err := dst.WriteAt(p, off)
+		off += int64(len(p))
+		return err
+	}
+	var args [8 + sha256.Size]byte
+	for {
+		op, err := in.ReadByte()
+		if err != nil {
+			return off, &DeltaError{Malformed, errors.New("missing end")}
+		}
+		switch op {
+		case opCopy:
+			if _, err = io.ReadFull(in, args[:12]); err != nil {
+				return off, &DeltaError{Malformed, err}
+			}
+			first := binary.BigEndian.Uint64(args[:8])
+			count := uint64(binary.BigEndian.Uint32(args[8:12]))
+			for i := first; i < first+count; i++ {
+				n, err := base.ReadAt(buf, int64(i)*bs)
+				if err != nil && !(err == io.EOF && n > 0 && i == first+count-1) {
+					if err == io.EOF {
+						return off, &DeltaError{HashMismatch, errors.New("block beyond base")}
+					}
+					return off, err
+				}
+				if err = write(buf[:n]); err != nil {
+					return off, err
+				}
+			}
+		case opData:
+			if _, err = io.ReadFull(in, args[:4]); err != nil {
+				return off, &DeltaError{Malformed, err}
+			}
+			n := int64(binary.BigEndian.Uint32(args[:4]))
+			if n > MaxLiteral {
+				return off, &DeltaError{Malformed, errors.New("literal too long")}
+			}
+			data := make([]byte, n)
+			if _, err = io.ReadFull(in, data); err != nil {
+				return off, &DeltaError{Malformed, err}
+			}
+			if err = write(data); err != nil {
+				return off, err
+			}
+		case opEnd:
+			if _, err = io.ReadFull(in, args[:]); err != nil {
+				return off, &DeltaError{Malformed, err}
+			}
+			if int64(binary.BigEndian.Uint64(args[:8])) != off || !bytes.Equal(args[8:], h.Sum(nil)) {
+				return off, &DeltaError{Kind: HashMismatch}
+			}
+			return off, nil
+		default:
+			return off, &DeltaError{Malformed, errors.New("unknown instruction")}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package delta transfers a changed file by sending only what the receiver
+// lacks, the way rsync does.
+//
+// The receiver describes the file it holds by a Signature: a rolling and a
+// strong checksum of each block. The sender slides a window over the new
+// file and wherever the window matches a block, it sends an instruction to
+// copy that block instead of its bytes. Apply rebuilds the new file from the
+// old one and the instructions and checks it against the SHA-256 the
+// instructions end with.
+package delta
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+const (
+	Malformed    = "malformed delta"
+	HashMismatch = "hash mismatch"
+
+	// Bounds of the block size, which BlockSizeFor picks between.
+	MinBlockSize = 1 << 10
+	MaxBlockSize = 1 << 20
+
+	// MaxLiteral bounds the bytes of a single literal instruction.
+	MaxLiteral = 1 << 20
+)
+
+type DeltaError struct {
+	Kind string
+	Err  error
+}
+
+func (d *DeltaError) Error() string {
+	if d.Err != nil {
+		return d.Kind + ": " + d.Err.Error()
+	}
+	return d.Kind
+}
+
+// IsKind reports whether err is a *DeltaError of kind.
+func IsKind(err error, kind string) bool {
+	e, ok := err.(*DeltaError)
+	return ok && e.Kind == kind
+}
+
+// Block is the signature of one block of a file. Weak is the rolling
+// checksum, Strong the hex SHA-256.
+type Block struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// Signature describes a file block by block, all blocks but the last are
+// BlockSize long.
+type Signature struct {
+	BlockSize int     `json:"block_size"`
+	Size      int64   `json:"size"`
+	Blocks    []Block `json:"blocks"`
+}
+
+// BlockSizeFor picks a block size near the square root of size, which keeps
+// both the signature and the copy instructions of a file small.
+func BlockSizeFor(size int64) int {
+	bs := MinBlockSize
+	for int64(bs)*int64(bs) < size && bs < MaxBlockSize {
+		bs *= 2
+	}
+	return bs
+}
+
+// Sign computes the signature of what r holds.
+func Sign(r io.Reader, blockSize int) (Signature, error) {
+	if blockSize < MinBlockSize || blockSize > MaxBlockSize {
+		return Signature{}, errors.New("tempdesk.pkg.delta: block size out of range")
+	}
+	sig := Signature{BlockSize: blockSize, Blocks: []Block{}}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			var roll rolling
+			roll.init(buf[:n])
+			sig.Blocks = append(sig.Blocks, Block{Weak: roll.sum(), Strong: strong(buf[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return Signature{}, err
+		}
+	}
+}
+
+func strong(p []byte) string {
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:])
+}
+
+// rolling is the checksum of rsync: a is the sum of the bytes of a window
+// and b the sum of the sums, both modulo 2^16. Moving the window by a byte
+// updates them without a pass over the window.
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rolling) init(p []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(p))
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+}
+
+// roll drops out from the front of the window and appends in.
+func (r *rolling) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
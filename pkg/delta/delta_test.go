@@ -0,0 +1,109 @@
+package delta
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+type buffer struct {
+	data []byte
+}
+
+func (b *buffer) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	return copy(b.data[off:], p), nil
+}
+
+// roundTrip sends target to a receiver holding base and returns the size of
+// the delta.
+func roundTrip(t *testing.T, base, target []byte, blockSize int) int {
+	t.Helper()
+	sig, err := Sign(bytes.NewReader(base), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delta bytes.Buffer
+	if err = Diff(sig, bytes.NewReader(target), &delta); err != nil {
+		t.Fatal(err)
+	}
+	n := delta.Len()
+
+	var out buffer
+	size, err := Apply(&out, bytes.NewReader(base), &delta)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(target)), size)
+	assert.True(t, bytes.Equal(target, out.data), "rebuilt file differs")
+	return n
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	base := make([]byte, 100<<10+123)
+	rnd.Read(base)
+	bs := MinBlockSize
+
+	n := roundTrip(t, base, base, bs)
+	assert.Less(t, n, 100, "an unchanged file is a few copies")
+
+	inserted := append(append(append([]byte{}, base[:50000]...), []byte("a few new bytes")...), base[50000:]...)
+	n = roundTrip(t, base, inserted, bs)
+	assert.Less(t, n, 2*bs+200, "an insert costs about a block")
+
+	removed := append(append([]byte{}, base[:3000]...), base[9000:]...)
+	n = roundTrip(t, base, removed, bs)
+	assert.Less(t, n, 2*bs+200)
+
+	changed := append([]byte{}, base...)
+	changed[len(changed)-1] ^= 0xff
+	roundTrip(t, base, changed, bs)
+
+	roundTrip(t, base, append(append([]byte{}, base...), "appended"...), bs)
+	roundTrip(t, base, nil, bs)
+	roundTrip(t, nil, base, bs)
+	roundTrip(t, []byte("short"), []byte("short"), bs)
+
+	big := make([]byte, 3*MaxLiteral)
+	rnd.Read(big)
+	roundTrip(t, base, big, bs)
+}
+
+func TestApply_Errors(t *testing.T) {
+	base := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	sig, _ := Sign(bytes.NewReader(base), MinBlockSize)
+	var delta bytes.Buffer
+	assert.Nil(t, Diff(sig, bytes.NewReader(base), &delta))
+
+	other := bytes.Repeat([]byte("fedcba9876543210"), 256)
+	_, err := Apply(&buffer{}, bytes.NewReader(other), bytes.NewReader(delta.Bytes()))
+	assert.True(t, IsKind(err, HashMismatch), "a changed base is caught: %v", err)
+
+	_, err = Apply(&buffer{}, bytes.NewReader(base[:100]), bytes.NewReader(delta.Bytes()))
+	assert.True(t, IsKind(err, HashMismatch), "a shorter base is caught: %v", err)
+
+	_, err = Apply(&buffer{}, bytes.NewReader(base), bytes.NewReader(delta.Bytes()[:delta.Len()-1]))
+	assert.True(t, IsKind(err, Malformed), "a cut delta is malformed: %v", err)
+
+	_, err = Apply(&buffer{}, bytes.NewReader(base), bytes.NewReader([]byte("nonsense")))
+	assert.True(t, IsKind(err, Malformed))
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	assert.Equal(t, MinBlockSize, BlockSizeFor(0))
+	assert.Equal(t, 64<<10, BlockSizeFor(2<<30))
+	assert.Equal(t, MaxBlockSize, BlockSizeFor(1<<50))
+}
+
+func TestRolling(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	var r, fresh rolling
+	r.init(data[:16])
+	for i := 1; i+16 <= len(data); i++ {
+		r.roll(data[i-1], data[i+15])
+		fresh.init(data[i : i+16])
+		assert.Equal(t, fresh.sum(), r.sum(), "window at %d", i)
+	}
+}
@@ -0,0 +1,212 @@
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The instructions are encoded as a header of magic and block size and a
+// list of operations, each a kind byte and its big-endian arguments:
+//
+//	'C' first uint64, count uint32   copy count blocks from block first
+//	'D' n uint32, n bytes            write the bytes
+//	'E' size uint64, SHA-256         end, the result has size and hash
+const (
+	magic = "TDD1"
+
+	opCopy = 'C'
+	opData = 'D'
+	opEnd  = 'E'
+
+	readChunk = 64 << 10
+)
+
+type encoder struct {
+	w *bufio.Writer
+	// run is a copy of consecutive blocks not written yet.
+	first, count uint64
+	err          error
+}
+
+func newEncoder(w io.Writer, blockSize int) *encoder {
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.write([]byte(magic))
+	e.uint32(uint32(blockSize))
+	return e
+}
+
+func (e *encoder) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.write(b[:])
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.write(b[:])
+}
+
+func (e *encoder) copy(block int) {
+	if e.count > 0 && e.first+e.count == uint64(block) {
+		e.count++
+		return
+	}
+	e.flush()
+	e.first, e.count = uint64(block), 1
+}
+
+func (e *encoder) flush() {
+	if e.count == 0 {
+		return
+	}
+	e.write([]byte{opCopy})
+	e.uint64(e.first)
+	e.uint32(uint32(e.count))
+	e.count = 0
+}
+
+func (e *encoder) data(p []byte) {
+	if len(p) > 0 {
+		e.flush()
+	}
+	for len(p) > 0 {
+		n := len(p)
+		if n > MaxLiteral {
+			n = MaxLiteral
+		}
+		e.write([]byte{opData})
+		e.uint32(uint32(n))
+		e.write(p[:n])
+		p = p[n:]
+	}
+}
+
+func (e *encoder) end(size int64, sum []byte) error {
+	e.flush()
+	e.write([]byte{opEnd})
+	e.uint64(uint64(size))
+	e.write(sum)
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	return e.err
+}
+
+// Diff writes to w the instructions that turn the file sig describes into
+// what r holds.
+func Diff(sig Signature, r io.Reader, w io.Writer) error {
+	bs := sig.BlockSize
+	if bs < MinBlockSize || bs > MaxBlockSize {
+		return errors.New("tempdesk.pkg.delta: block size out of range")
+	}
+	// only full blocks can match the window, a short last block can only
+	// match the tail of r
+	index := make(map[uint32][]int)
+	last := -1
+	for i, b := range sig.Blocks {
+		if int64(i+1)*int64(bs) <= sig.Size {
+			index[b.Weak] = append(index[b.Weak], i)
+		} else {
+			last = i
+		}
+	}
+
+	h := sha256.New()
+	in := io.TeeReader(r, h)
+	enc := newEncoder(w, bs)
+
+	// buf holds the literal bytes not sent yet from lit and the window
+	// from pos
+	var buf []byte
+	lit, pos := 0, 0
+	var size int64
+	chunk := make([]byte, readChunk)
+	eof := false
+	fill := func() error {
+		for !eof && len(buf)-pos <= bs {
+			buf, pos, lit = buf[lit:], pos-lit, 0
+			n, err := in.Read(chunk)
+			buf = append(buf, chunk[:n]...)
+			size += int64(n)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var roll rolling
+	rolled := false
+	for {
+		if err := fill(); err != nil {
+			return err
+		}
+		if len(buf)-pos < bs {
+			break
+		}
+		window := buf[pos : pos+bs]
+		if !rolled {
+			roll.init(window)
+			rolled = true
+		}
+		if block, ok := match(sig, index[roll.sum()], roll.sum(), window); ok {
+			enc.data(buf[lit:pos])
+			enc.copy(block)
+			pos += bs
+			lit, rolled = pos, false
+			continue
+		}
+		if len(buf)-pos == bs {
+			// the window ends with r
+			break
+		}
+		roll.roll(buf[pos], buf[pos+bs])
+		pos++
+		if pos-lit >= MaxLiteral {
+			enc.data(buf[lit:pos])
+			lit = pos
+		}
+	}
+
+	tail := buf[pos:]
+	if last >= 0 && int64(len(tail)) == sig.Size-int64(last)*int64(bs) {
+		roll.init(tail)
+		if _, ok := match(sig, []int{last}, roll.sum(), tail); ok {
+			enc.data(buf[lit:pos])
+			enc.copy(last)
+			lit = len(buf)
+		}
+	}
+	enc.data(buf[lit:])
+	return enc.end(size, h.Sum(nil))
+}
+
+// match returns the first of the candidate blocks whose checksums are weak
+// and the strong checksum of window.
+func match(sig Signature, candidates []int, weak uint32, window []byte) (int, bool) {
+	s := ""
+	for _, i := range candidates {
+		if sig.Blocks[i].Weak != weak {
+			continue
+		}
+		if s == "" {
+			s = strong(window)
+		}
+		if sig.Blocks[i].Strong == s {
+			return i, true
+		}
+	}
+	return 0, false
+}
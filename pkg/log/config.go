@@ -0,0 +1,135 @@
+package log
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	EncodingJSON    = "json"
+	EncodingConsole = "console"
+
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+)
+
+type Config struct {
+	// Level is one of debug, info, warn and error.
+	Level string
+	// Encoding is EncodingJSON or EncodingConsole.
+	Encoding string
+	// Output is OutputStdout, OutputStderr or the path of a log file.
+	Output string
+	// Sampling limits repeated messages, it is off when nil.
+	Sampling *SamplingConfig
+	// Rotation applies when Output is a file.
+	Rotation RotationConfig
+}
+
+// SamplingConfig logs the first Initial entries with the same message each
+// second and then every Thereafter-th of them.
+type SamplingConfig struct {
+	Initial    int
+	Thereafter int
+}
+
+type RotationConfig struct {
+	// MaxSize is the size in megabytes at which the log file is rotated.
+	MaxSize int
+	// MaxAge is the age at which the log file is rotated.
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files are kept.
+	MaxBackups int
+}
+
+// level is shared by every logger set up by this package, so the level can
+// be changed without replacing the logger.
+var level = zap.NewAtomicLevelAt(zap.DebugLevel)
+
+// output is closed when a new configuration replaces it.
+var output io.Closer
+
+// Setup replaces the logger according to cfg. It is meant to be called once
+// on start up, before logging concurrently.
+func Setup(cfg Config) error {
+	var lvl zapcore.Level
+	if cfg.Level != "" {
+		if err := lvl.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return fmt.Errorf("log level: %v", err)
+		}
+	}
+
+	var encoder zapcore.Encoder
+	switch cfg.Encoding {
+	case "", EncodingJSON:
+		encoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	case EncodingConsole:
+		encoder = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	default:
+		return fmt.Errorf("log encoding: unknown encoding %q", cfg.Encoding)
+	}
+
+	if cfg.Sampling != nil && (cfg.Sampling.Initial <= 0 || cfg.Sampling.Thereafter <= 0) {
+		return fmt.Errorf("log sampling: initial and thereafter must be positive")
+	}
+
+	var ws zapcore.WriteSyncer
+	var closer io.Closer
+	switch cfg.Output {
+	case "", OutputStdout:
+		ws = zapcore.Lock(os.Stdout)
+	case OutputStderr:
+		ws = zapcore.Lock(os.Stderr)
+	default:
+		rc := cfg.Rotation
+		f, err := NewRotatingFile(cfg.Output, int64(rc.MaxSize)<<20, rc.MaxAge, rc.MaxBackups)
+		if err != nil {
+			return fmt.Errorf("log output: %v", err)
+		}
+		ws, closer = f, f
+	}
+
+	core := zapcore.NewCore(encoder, ws, level)
+	if s := cfg.Sampling; s != nil {
+		core = zapcore.NewSampler(core, time.Second, s.Initial, s.Thereafter)
+	}
+
+	level.SetLevel(lvl)
+	old := output
+	logger = zap.New(core,
+		zap.AddCaller(),
+		zap.AddCallerSkip(1),
+		zap.AddStacktrace(zap.ErrorLevel),
+		zap.ErrorOutput(zapcore.Lock(os.Stderr)))
+	output = closer
+
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// SetLevel changes the level of the current logger.
+func SetLevel(l string) error {
+	return level.UnmarshalText([]byte(l))
+}
+
+func Level() string {
+	return level.String()
+}
+
+// LevelHandler reports the level on GET and changes it on PUT, with a JSON
+// body like {"level":"info"}.
+func LevelHandler() http.Handler {
+	return level
+}
+
+// Sync flushes buffered log entries.
+func Sync() error {
+	return logger.Sync()
+}
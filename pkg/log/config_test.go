@@ -0,0 +1,110 @@
+package log
+
+import (
+	"encoding/json"
+	"github.com/huangjiahua/tempdesk/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetup(t *testing.T) {
+	old := logger
+	t.Cleanup(func() {
+		logger = old
+		level.SetLevel(-1)
+		if output != nil {
+			_ = output.Close()
+			output = nil
+		}
+	})
+
+	assert.Error(t, Setup(Config{Level: "loud"}))
+	assert.Error(t, Setup(Config{Encoding: "xml"}))
+	assert.Error(t, Setup(Config{Sampling: &SamplingConfig{}}))
+
+	path := filepath.Join(testutil.TempDir(t), "tempdesk.log")
+	err := Setup(Config{
+		Level:    "info",
+		Encoding: EncodingJSON,
+		Output:   path,
+		Sampling: &SamplingConfig{Initial: 2, Thereafter: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "info", Level())
+
+	Debug("hidden")
+	for i := 0; i < 5; i++ {
+		Info("sampled", Int("i", i))
+	}
+	assert.NoError(t, SetLevel("debug"))
+	Debug("shown")
+	assert.Error(t, SetLevel("loud"))
+	assert.NoError(t, Sync())
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if !assert.Len(t, lines, 3) {
+		return
+	}
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "sampled", entry["msg"])
+	assert.Equal(t, "info", entry["level"])
+	assert.Contains(t, entry["caller"], "config_test.go", "caller should skip the package wrappers")
+	assert.Contains(t, lines[2], `"shown"`)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := testutil.TempDir(t)
+	path := filepath.Join(dir, "app.log")
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	r, err := NewRotatingFile(path, 10, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.now = func() time.Time { return now }
+	r.opened = now
+
+	write := func(s string) {
+		t.Helper()
+		if _, err := r.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+
+	write("12345")
+	write("67890")
+	backups, _ := r.Backups()
+	assert.Empty(t, backups, "file at the size limit should not rotate")
+
+	write("a")
+	backups, _ = r.Backups()
+	assert.Len(t, backups, 1, "file over the size limit should rotate")
+
+	now = now.Add(time.Hour)
+	write("b")
+	backups, _ = r.Backups()
+	assert.Len(t, backups, 2, "file over the age limit should rotate")
+
+	write("123456789")
+	write("c")
+	backups, _ = r.Backups()
+	assert.Len(t, backups, 2, "only max backups should be kept")
+
+	b, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "c", string(b))
+	b, _ = ioutil.ReadFile(backups[1])
+	assert.Equal(t, "b123456789", string(b))
+}
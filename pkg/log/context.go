@@ -0,0 +1,64 @@
+package log
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"sync"
+)
+
+type ctxKey struct{}
+
+// requestLog is the request-scoped state kept in a context.Context.
+type requestLog struct {
+	mu     sync.Mutex
+	logger *zap.Logger
+	user   string
+}
+
+// Logger logs with the fields of the request it was taken from.
+type Logger struct {
+	logger *zap.Logger
+}
+
+// Ctx returns the logger of the request ctx belongs to, or a logger without
+// request fields when ctx does not come from the AccessLog middleware.
+func Ctx(ctx context.Context) *Logger {
+	if rl, ok := ctx.Value(ctxKey{}).(*requestLog); ok {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		return &Logger{rl.logger}
+	}
+	return &Logger{logger}
+}
+
+// SetUser records the authenticated user of the request ctx belongs to, it
+// is added to the access log line and to every later log of the request.
+func SetUser(ctx context.Context, name string) {
+	rl, ok := ctx.Value(ctxKey{}).(*requestLog)
+	if !ok {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.user == name {
+		return
+	}
+	rl.user = name
+	rl.logger = rl.logger.With(zap.String("user", name))
+}
+
+func (l *Logger) Debug(msg string, fields ...zap.Field) {
+	l.logger.Debug(msg, fields...)
+}
+
+func (l *Logger) Error(msg string, fields ...zap.Field) {
+	l.logger.Error(msg, fields...)
+}
+
+func (l *Logger) Warn(msg string, fields ...zap.Field) {
+	l.logger.Warn(msg, fields...)
+}
+
+func (l *Logger) Info(msg string, fields ...zap.Field) {
+	l.logger.Info(msg, fields...)
+}
@@ -0,0 +1,122 @@
+package log
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"time"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds request ids taken over from clients.
+const maxRequestIDLen = 128
+
+// AccessLog logs a line for every request served by next, and gives the
+// request a logger carrying its request id, see Ctx. The request id is taken
+// from the X-Request-ID header when the client sent a sane one, and is
+// echoed in the response.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		res.Header().Set(RequestIDHeader, id)
+
+		rl := &requestLog{logger: logger.With(
+			zap.String("request_id", id),
+			zap.String("method", req.Method),
+			zap.String("path", req.URL.Path),
+		)}
+		req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, rl))
+
+		w := &responseWriter{ResponseWriter: res}
+		next.ServeHTTP(w, req)
+
+		status := w.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		rl.mu.Lock()
+		l, user := rl.logger, rl.user
+		rl.mu.Unlock()
+		if user == "" {
+			l = l.With(zap.String("user", ""))
+		}
+		l.Info("access",
+			zap.Int("status", status),
+			zap.Int64("bytes", w.bytes),
+			zap.Duration("latency", time.Since(start)),
+			zap.String("remote", req.RemoteAddr))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// responseWriter records the status and size of a response. It passes
+// flushing and hijacking through, watch connections depend on both.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("tempdesk.pkg.log: response writer cannot be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
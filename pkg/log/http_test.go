@@ -0,0 +1,82 @@
+package log
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func observe(t *testing.T) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.DebugLevel)
+	old := logger
+	logger = zap.New(core)
+	t.Cleanup(func() { logger = old })
+	return logs
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := observe(t)
+
+	h := AccessLog(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		Ctx(req.Context()).Debug("before auth")
+		SetUser(req.Context(), "sam")
+		Ctx(req.Context()).Info("after auth", String("extra", "x"))
+		res.WriteHeader(http.StatusCreated)
+		_, _ = res.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest(http.MethodPut, "/file/a.txt", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	assert.Equal(t, "abc-123", res.Header().Get(RequestIDHeader))
+
+	entries := logs.AllUntimed()
+	if !assert.Len(t, entries, 3) {
+		return
+	}
+	for _, e := range entries {
+		m := e.ContextMap()
+		assert.Equal(t, "abc-123", m["request_id"], e.Message)
+		assert.Equal(t, "PUT", m["method"], e.Message)
+		assert.Equal(t, "/file/a.txt", m["path"], e.Message)
+	}
+	assert.NotContains(t, entries[0].ContextMap(), "user")
+	assert.Equal(t, "sam", entries[1].ContextMap()["user"])
+	assert.Equal(t, "x", entries[1].ContextMap()["extra"])
+
+	access := entries[2].ContextMap()
+	assert.Equal(t, "access", entries[2].Message)
+	assert.Equal(t, "sam", access["user"])
+	assert.Equal(t, int64(http.StatusCreated), access["status"])
+	assert.Equal(t, int64(5), access["bytes"])
+	assert.Contains(t, access, "latency")
+}
+
+func TestAccessLog_RequestID(t *testing.T) {
+	logs := observe(t)
+	h := AccessLog(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+
+	for _, id := range []string{"", "has space", strings.Repeat("x", maxRequestIDLen+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, id)
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+
+		got := res.Header().Get(RequestIDHeader)
+		assert.Len(t, got, 32, "a fresh id should replace %q", id)
+	}
+
+	access := logs.AllUntimed()[0].ContextMap()
+	assert.Equal(t, int64(http.StatusOK), access["status"])
+	assert.Equal(t, "", access["user"])
+
+	// loggers outside of a request still work
+	Ctx(httptest.NewRequest(http.MethodGet, "/", nil).Context()).Info("plain")
+	assert.Equal(t, "plain", logs.AllUntimed()[3].Message)
+}
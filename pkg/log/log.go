@@ -13,8 +13,12 @@ func init() {
 }
 
 func SetupDev() {
+	cfg := zap.NewDevelopmentConfig()
+	cfg.Level = level
+	level.SetLevel(zap.DebugLevel)
+
 	var err error
-	logger, err = zap.NewDevelopment()
+	logger, err = cfg.Build()
 	if err != nil {
 		log.Fatal(err)
 	}
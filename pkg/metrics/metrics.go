@@ -0,0 +1,356 @@
+// Package metrics keeps counters, gauges and histograms and exposes them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the histogram buckets used for request latencies, in
+// seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric is a family of samples that can be written in the text format.
+type Metric interface {
+	Name() string
+	Write(w io.Writer) error
+}
+
+type Registry struct {
+	mu      sync.RWMutex
+	metrics []Metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds m and returns it, so it can be used in declarations.
+func (r *Registry) Register(m Metric) Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, old := range r.metrics {
+		if old.Name() == m.Name() {
+			panic("tempdesk.pkg.metrics: duplicate metric " + m.Name())
+		}
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// Write writes every registered metric, ordered by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.RLock()
+	metrics := append([]Metric(nil), r.metrics...)
+	r.mu.RUnlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name() < metrics[j].Name() })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		if err := m.Write(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", ContentType)
+	_ = r.Write(res)
+}
+
+// vec holds one value per combination of label values.
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	count       uint64
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{name: name, help: help, typ: typ, labels: labels, values: make(map[string]*series)}
+}
+
+func (v *vec) Name() string {
+	return v.name
+}
+
+// with returns the series of labelValues. v.mu must be held.
+func (v *vec) with(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("tempdesk.pkg.metrics: %v wants %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+// sorted returns the series ordered by label values. v.mu must be held.
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, v.values[k])
+	}
+	return ret
+}
+
+func (v *vec) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.typ)
+	return err
+}
+
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, "counter", labels)}
+}
+
+// Add increases the counter of labelValues by delta, which must not be
+// negative.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("tempdesk.pkg.metrics: counter " + c.name + " cannot decrease")
+	}
+	c.mu.Lock()
+	c.with(labelValues).value += delta
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.with(labelValues).value
+}
+
+func (c *CounterVec) Write(w io.Writer) error {
+	return writeSimple(&c.vec, w)
+}
+
+type GaugeVec struct {
+	vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, "gauge", labels)}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	g.with(labelValues).value = value
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.mu.Lock()
+	g.with(labelValues).value += delta
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.with(labelValues).value
+}
+
+func (g *GaugeVec) Write(w io.Writer) error {
+	return writeSimple(&g.vec, w)
+}
+
+func writeSimple(v *vec, w io.Writer) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	for _, s := range v.sorted() {
+		if err := writeSample(w, v.name, v.labels, s.labelValues, "", "", s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sample is a value reported by a GaugeFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc is a gauge whose samples are taken when it is written.
+type GaugeFunc struct {
+	vec
+	collect func() []Sample
+}
+
+func NewGaugeFunc(name, help string, labels []string, collect func() []Sample) *GaugeFunc {
+	return &GaugeFunc{vec: newVec(name, help, "gauge", labels), collect: collect}
+}
+
+func (g *GaugeFunc) Write(w io.Writer) error {
+	samples := g.collect()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, "\xff") < strings.Join(samples[j].LabelValues, "\xff")
+	})
+	if err := g.writeHeader(w); err != nil {
+		return err
+	}
+	for _, s := range samples {
+		if err := writeSample(w, g.name, g.labels, s.LabelValues, "", "", s.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type HistogramVec struct {
+	vec
+	bounds []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	return &HistogramVec{vec: newVec(name, help, "histogram", labels), bounds: bounds}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.with(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.bounds))
+	}
+	for i, b := range h.bounds {
+		if value <= b {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.with(labelValues).count
+}
+
+func (h *HistogramVec) Write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	for _, s := range h.sorted() {
+		for i, b := range h.bounds {
+			err := writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", formatFloat(b), float64(s.buckets[i]))
+			if err != nil {
+				return err
+			}
+		}
+		if err := writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", "+Inf", float64(s.count)); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_sum", h.labels, s.labelValues, "", "", s.value); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_count", h.labels, s.labelValues, "", "", float64(s.count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, extraLabel, extraValue string, value float64) error {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		sb.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(l + `="` + escapeLabel(values[i]) + `"`)
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(extraLabel + `="` + extraValue + `"`)
+		}
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(value))
+	sb.WriteByte('\n')
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	r := NewRegistry()
+	c := r.Register(NewCounterVec("a_total", "A counter.", "method")).(*CounterVec)
+	g := r.Register(NewGaugeVec("b", "A gauge\nwith two lines.")).(*GaugeVec)
+	h := r.Register(NewHistogramVec("c_seconds", "A histogram.", []float64{1, 0.5}, "route")).(*HistogramVec)
+	r.Register(NewGaugeFunc("d", "A gauge func.", []string{"backend"}, func() []Sample {
+		return []Sample{{LabelValues: []string{`x"y`}, Value: 3}}
+	}))
+
+	c.Inc("GET")
+	c.Add(2, "GET")
+	c.Inc("PUT")
+	g.Set(5)
+	g.Dec()
+	h.Observe(0.2, "file")
+	h.Observe(0.7, "file")
+	h.Observe(3, "file")
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.Write(&buf))
+	assert.Equal(t, `# HELP a_total A counter.
+# TYPE a_total counter
+a_total{method="GET"} 3
+a_total{method="PUT"} 1
+# HELP b A gauge\nwith two lines.
+# TYPE b gauge
+b 4
+# HELP c_seconds A histogram.
+# TYPE c_seconds histogram
+c_seconds_bucket{route="file",le="0.5"} 1
+c_seconds_bucket{route="file",le="1"} 2
+c_seconds_bucket{route="file",le="+Inf"} 3
+c_seconds_sum{route="file"} 3.9
+c_seconds_count{route="file"} 3
+# HELP d A gauge func.
+# TYPE d gauge
+d{backend="x\"y"} 3
+`, buf.String())
+
+	assert.Equal(t, float64(3), c.Value("GET"))
+	assert.Equal(t, uint64(3), h.Count("file"))
+}
+
+func TestRegistry_Register_Duplicate(t *testing.T) {
+	r := NewRegistry()
+	r.Register(NewCounterVec("a_total", "A counter."))
+	assert.Panics(t, func() { r.Register(NewGaugeVec("a_total", "Again.")) })
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Register(NewCounterVec("a_total", "A counter.")).(*CounterVec).Inc()
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, ContentType, res.Header().Get("Content-Type"))
+	assert.Contains(t, res.Body.String(), "a_total 1\n")
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// healthKey is written and read back by Dir.Health.
+const healthKey = "health/probe"
+
+// Dir stores every value in a file below a directory, so it outlives the
+// process. Names are slash separated paths relative to the directory. Only
+// []byte and string values can be stored, Get returns both as []byte.
+type Dir struct {
+	root string
+	rw   sync.RWMutex
+}
+
+// NewDir opens the directory root, creating it if needed.
+func NewDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &Dir{root: root}, nil
+}
+
+// Root returns the directory d stores in.
+func (d *Dir) Root() string {
+	return d.root
+}
+
+func (d *Dir) path(name string) (string, error) {
+	if name == "" || path.Clean(name) != name || path.IsAbs(name) ||
+		name == ".." || strings.HasPrefix(name, "../") {
+		return "", &StorageError{Kind: InvalidName, Err: errors.New(name)}
+	}
+	return filepath.Join(d.root, filepath.FromSlash(name)), nil
+}
+
+// Put replaces the file of name atomically, a crash leaves either the old or
+// the new value.
+func (d *Dir) Put(name string, value interface{}) (err error) {
+	var b []byte
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return &StorageError{Kind: UnsupportedValue}
+	}
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	d.rw.Lock()
+	defer d.rw.Unlock()
+	if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (d *Dir) Get(name string) (value interface{}, err error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	d.rw.RLock()
+	defer d.rw.RUnlock()
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, &StorageError{Kind: NotFound}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Health checks that the directory can be written and read.
+func (d *Dir) Health() error {
+	if err := d.Put(healthKey, []byte("ok")); err != nil {
+		return err
+	}
+	_, err := d.Get(healthKey)
+	return err
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "tempdesk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	d, err := NewDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Get("a/b"); !IsNotFound(err) {
+		t.Errorf("Should not find a/b: %v", err)
+	}
+	if err = d.Put("a/b", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Put("c", "world"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second Dir on the same directory sees the values
+	d, _ = NewDir(root)
+	for name, want := range map[string]string{"a/b": "hello", "c": "world"} {
+		v, err := d.Get(name)
+		if err != nil || string(v.([]byte)) != want {
+			t.Errorf("Get(%v) = %v, %v", name, v, err)
+		}
+	}
+
+	for _, name := range []string{"", "../x", "/etc/passwd", "a/../b", ".."} {
+		if err := d.Put(name, []byte("x")); err == nil || err.(*StorageError).Kind != InvalidName {
+			t.Errorf("Should not put %q: %v", name, err)
+		}
+	}
+	if err := d.Put("n", 42); err == nil || err.(*StorageError).Kind != UnsupportedValue {
+		t.Errorf("Should not put an int: %v", err)
+	}
+	if err := d.Health(); err != nil {
+		t.Errorf("Should be healthy: %v", err)
+	}
+}
@@ -1,6 +1,30 @@
 package storage
 
+const (
+	NotFound         = "not found"
+	InvalidName      = "invalid name"
+	UnsupportedValue = "unsupported value"
+)
+
 type PutterGetter interface {
 	Put(name string, value interface{}) (err error)
 	Get(name string) (value interface{}, err error)
 }
+
+type StorageError struct {
+	Kind string
+	Err  error
+}
+
+func (s *StorageError) Error() string {
+	if s.Err != nil {
+		return s.Kind + ": " + s.Err.Error()
+	}
+	return s.Kind
+}
+
+// IsNotFound reports whether err tells that nothing is stored under a name.
+func IsNotFound(err error) bool {
+	e, ok := err.(*StorageError)
+	return ok && e.Kind == NotFound
+}
@@ -0,0 +1,150 @@
+package syncdir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateFile is the name of the state database Sync keeps in the local
+// folder. It is never synced.
+const StateFile = ".tempdesk-sync.json"
+
+const stateVersion = 1
+
+// entry is what the last sync saw of a file on both sides. The local side is
+// trusted while its size and modification time stay the same, the remote
+// side while its listed size and modification time do.
+type entry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Hash is the SHA-256 of the whole file, Blocks of each BlockSize
+	// block of it.
+	Hash   string   `json:"hash"`
+	Blocks []string `json:"blocks,omitempty"`
+
+	RemoteSize    int64     `json:"remote_size"`
+	RemoteModTime time.Time `json:"remote_mtime"`
+}
+
+type state struct {
+	Version   int               `json:"version"`
+	BlockSize int               `json:"block_size"`
+	Files     map[string]*entry `json:"files"`
+}
+
+// loadState reads the state database of the folder dir, a folder that was
+// never synced has an empty one. Block hashes of another block size are
+// dropped, they cannot be compared.
+func loadState(dir string, blockSize int) (*state, error) {
+	st := &state{Version: stateVersion, BlockSize: blockSize, Files: make(map[string]*entry)}
+	data, err := ioutil.ReadFile(filepath.Join(dir, StateFile))
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("%s: %v", StateFile, err)
+	}
+	if st.Version != stateVersion {
+		return nil, fmt.Errorf("%s: unknown version %d", StateFile, st.Version)
+	}
+	if st.Files == nil {
+		st.Files = make(map[string]*entry)
+	}
+	if st.BlockSize != blockSize {
+		for _, e := range st.Files {
+			e.Blocks = nil
+		}
+		st.BlockSize = blockSize
+	}
+	return st, nil
+}
+
+// save writes the state database to a temporary file first, so a crash
+// leaves the old one in place.
+func (st *state) save(dir string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(dir, StateFile)
+	tmp := p + partSuffix
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, p); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// blockHasher hashes what is written to it as a whole and in blocks.
+type blockHasher struct {
+	size   int
+	whole  hash.Hash
+	block  hash.Hash
+	filled int
+	blocks []string
+}
+
+func newBlockHasher(size int) *blockHasher {
+	return &blockHasher{size: size, whole: sha256.New(), block: sha256.New()}
+}
+
+func (h *blockHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	h.whole.Write(p)
+	for len(p) > 0 {
+		k := h.size - h.filled
+		if k > len(p) {
+			k = len(p)
+		}
+		h.block.Write(p[:k])
+		h.filled += k
+		p = p[k:]
+		if h.filled == h.size {
+			h.endBlock()
+		}
+	}
+	return n, nil
+}
+
+func (h *blockHasher) endBlock() {
+	h.blocks = append(h.blocks, hex.EncodeToString(h.block.Sum(nil)))
+	h.block.Reset()
+	h.filled = 0
+}
+
+// sums returns the hash of everything written and of each block.
+func (h *blockHasher) sums() (string, []string) {
+	if h.filled > 0 {
+		h.endBlock()
+	}
+	return hex.EncodeToString(h.whole.Sum(nil)), h.blocks
+}
+
+// hashFile hashes the file at p in blocks of blockSize.
+func hashFile(p string, blockSize int) (string, []string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	h := newBlockHasher(blockSize)
+	if _, err = io.Copy(h, f); err != nil {
+		return "", nil, err
+	}
+	sum, blocks := h.sums()
+	return sum, blocks, nil
+}
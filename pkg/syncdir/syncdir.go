@@ -0,0 +1,487 @@
+// Package syncdir keeps a local folder and a path on a TempDesk server in
+// sync both ways.
+//
+// Every Sync compares both sides with what the previous one saw, which is
+// kept in a state database in the folder. A file changed on one side is
+// copied to the other, a file changed on both keeps both copies: the local
+// one is renamed with a conflict suffix and uploaded next to the remote
+// one. Files the server already holds are patched by uploading only the
+// blocks that changed.
+package syncdir
+
+import (
+	"context"
+	"fmt"
+	"github.com/huangjiahua/tempdesk/pkg/client"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultBlockSize = 1 << 20
+
+	// partSuffix marks the temporary files of downloads in progress.
+	partSuffix = ".tempdesk-part"
+)
+
+// Actions passed to Syncer.Report.
+const (
+	ActionUpload       = "upload"
+	ActionPatch        = "patch"
+	ActionDownload     = "download"
+	ActionRemoveLocal  = "remove local"
+	ActionRemoveRemote = "remove remote"
+	ActionConflict     = "conflict"
+)
+
+type Syncer struct {
+	Client *client.Client
+	// Local is the folder on disk, Remote the path on the server.
+	Local  string
+	Remote string
+	// BlockSize is the unit of change detection within a file.
+	BlockSize int
+	// Now dates conflict copies, it is replaceable for tests.
+	Now func() time.Time
+	// Report is told about each change Sync makes, it may be nil.
+	Report func(action, name string)
+	// OnError is told why a sync of Watch failed, it may be nil.
+	OnError func(err error)
+}
+
+func New(c *client.Client, local, remote string) *Syncer {
+	return &Syncer{
+		Client:    c,
+		Local:     local,
+		Remote:    "/" + strings.Trim(remote, "/"),
+		BlockSize: DefaultBlockSize,
+		Now:       time.Now,
+	}
+}
+
+// localFile is a file found by a scan of the local folder.
+type localFile struct {
+	size    int64
+	modTime time.Time
+	hash    string
+	blocks  []string
+}
+
+// Sync brings the local folder and the remote path in line once. A file that
+// fails does not stop the others, the first failure is returned.
+func (s *Syncer) Sync(ctx context.Context) error {
+	st, err := loadState(s.Local, s.BlockSize)
+	if err != nil {
+		return err
+	}
+	local, err := s.scan(st)
+	if err != nil {
+		return err
+	}
+	remote, err := s.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for name := range st.Files {
+		if _, ok := local[name]; !ok {
+			if _, ok = remote[name]; !ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	var first error
+	uploaded := make(map[string]bool)
+	for _, name := range names {
+		if ctx.Err() != nil {
+			first = ctx.Err()
+			break
+		}
+		up, err := s.reconcile(ctx, st, name, local[name], remote[name])
+		for _, n := range up {
+			uploaded[n] = true
+		}
+		if err != nil && first == nil {
+			first = fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// the server dates what was uploaded, which the next sync must not
+	// take for a remote change
+	if len(uploaded) > 0 {
+		if remote, err = s.list(ctx); err == nil {
+			for name := range uploaded {
+				if e, info := st.Files[name], remote[name]; e != nil && info != nil {
+					e.RemoteSize, e.RemoteModTime = info.Size, info.Modified
+				}
+			}
+		} else if first == nil {
+			first = err
+		}
+	}
+
+	if err = st.save(s.Local); err != nil && first == nil {
+		first = err
+	}
+	return first
+}
+
+// reconcile syncs the file name, which the previous sync saw as recorded in
+// st, the scan found as l and the listing as r. It returns the names it
+// uploaded.
+func (s *Syncer) reconcile(ctx context.Context, st *state, name string, l *localFile, r *client.FileInfo) ([]string, error) {
+	e := st.Files[name]
+	if e == nil {
+		switch {
+		case r == nil:
+			return []string{name}, s.upload(ctx, st, name, l, nil)
+		case l == nil:
+			return nil, s.download(ctx, st, name, r)
+		default:
+			return s.merge(ctx, st, name, l, r)
+		}
+	}
+
+	localChanged := l == nil || l.hash != e.Hash
+	remoteChanged := r == nil || r.Size != e.RemoteSize || !r.Modified.Equal(e.RemoteModTime)
+	switch {
+	case !localChanged && !remoteChanged:
+		if l.size != e.Size || !l.modTime.Equal(e.ModTime) {
+			// touched but the same
+			e.Size, e.ModTime = l.size, l.modTime
+		}
+		return nil, nil
+	case l == nil && r == nil:
+		delete(st.Files, name)
+		return nil, nil
+	case !remoteChanged && l == nil:
+		if err := s.Client.Remove(ctx, s.remotePath(name)); err != nil && !client.IsNotFound(err) {
+			return nil, err
+		}
+		s.report(ActionRemoveRemote, name)
+		delete(st.Files, name)
+		return nil, nil
+	case !remoteChanged:
+		return []string{name}, s.upload(ctx, st, name, l, e)
+	case !localChanged && r == nil:
+		if err := os.Remove(s.localPath(name)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		s.report(ActionRemoveLocal, name)
+		delete(st.Files, name)
+		return nil, nil
+	case !localChanged || l == nil:
+		return nil, s.download(ctx, st, name, r)
+	case r == nil:
+		// changed here but removed there, the change wins
+		return []string{name}, s.upload(ctx, st, name, l, nil)
+	default:
+		return s.merge(ctx, st, name, l, r)
+	}
+}
+
+// merge handles a file both sides changed. Unless they changed it the same
+// way, the local copy is renamed with a conflict suffix and uploaded, and
+// the remote one takes its place.
+func (s *Syncer) merge(ctx context.Context, st *state, name string, l *localFile, r *client.FileInfo) ([]string, error) {
+	tmp, h, err := s.fetch(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	if sum, _ := h.sums(); sum == l.hash {
+		st.Files[name] = &entry{
+			Size: l.size, ModTime: l.modTime, Hash: l.hash, Blocks: l.blocks,
+			RemoteSize: r.Size, RemoteModTime: r.Modified,
+		}
+		return nil, nil
+	}
+
+	conflict := conflictName(name, s.now())
+	if err = os.Rename(s.localPath(name), s.localPath(conflict)); err != nil {
+		return nil, err
+	}
+	s.report(ActionConflict, conflict)
+	if err = s.place(st, name, tmp, h, r); err != nil {
+		return nil, err
+	}
+	s.report(ActionDownload, name)
+
+	info, err := os.Stat(s.localPath(conflict))
+	if err != nil {
+		return nil, err
+	}
+	c := *l
+	c.modTime = info.ModTime()
+	return []string{conflict}, s.upload(ctx, st, conflict, &c, nil)
+}
+
+// upload sends the local file name to the server. If base describes what
+// the server holds, only the blocks that differ from it are sent.
+func (s *Syncer) upload(ctx context.Context, st *state, name string, l *localFile, base *entry) error {
+	f, err := os.Open(s.localPath(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bs := int64(s.BlockSize)
+	if base == nil || l.size == 0 || int64(len(base.Blocks)) != (base.Size+bs-1)/bs {
+		if err = s.Client.Upload(ctx, s.remotePath(name), f, l.size, nil); err != nil {
+			return err
+		}
+		s.report(ActionUpload, name)
+	} else {
+		if err = s.patch(ctx, name, f, l, base); err != nil {
+			return err
+		}
+		s.report(ActionPatch, name)
+	}
+
+	st.Files[name] = &entry{Size: l.size, ModTime: l.modTime, Hash: l.hash, Blocks: l.blocks}
+	return nil
+}
+
+// patch writes the blocks of f whose hashes differ from base. A file that
+// only shrank still has its last block sent, which cuts it to size.
+func (s *Syncer) patch(ctx context.Context, name string, f *os.File, l *localFile, base *entry) error {
+	bs := int64(s.BlockSize)
+	buf := make([]byte, bs)
+	send := func(i int) error {
+		n, err := f.ReadAt(buf, int64(i)*bs)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return s.Client.WriteBlock(ctx, s.remotePath(name), int64(i)*bs, buf[:n], l.size)
+	}
+
+	sent := false
+	for i, sum := range l.blocks {
+		if i < len(base.Blocks) && base.Blocks[i] == sum {
+			continue
+		}
+		if err := send(i); err != nil {
+			return err
+		}
+		sent = true
+	}
+	if !sent {
+		return send(len(l.blocks) - 1)
+	}
+	return nil
+}
+
+// download fetches the remote file name into the local folder.
+func (s *Syncer) download(ctx context.Context, st *state, name string, r *client.FileInfo) error {
+	tmp, h, err := s.fetch(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err = s.place(st, name, tmp, h, r); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	s.report(ActionDownload, name)
+	return nil
+}
+
+// fetch downloads the remote file name into a temporary file next to where
+// it belongs, hashing it on the way.
+func (s *Syncer) fetch(ctx context.Context, name string) (string, *blockHasher, error) {
+	p := s.localPath(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", nil, err
+	}
+	tmp := filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+partSuffix)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", nil, err
+	}
+	h := newBlockHasher(s.BlockSize)
+	_, err = s.Client.Download(ctx, s.remotePath(name), io.MultiWriter(f, h), nil)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", nil, err
+	}
+	return tmp, h, nil
+}
+
+// place moves the fetched file tmp to name, dated like the remote file r.
+func (s *Syncer) place(st *state, name, tmp string, h *blockHasher, r *client.FileInfo) error {
+	p := s.localPath(name)
+	if !r.Modified.IsZero() {
+		if err := os.Chtimes(tmp, r.Modified, r.Modified); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	sum, blocks := h.sums()
+	st.Files[name] = &entry{
+		Size: info.Size(), ModTime: info.ModTime(), Hash: sum, Blocks: blocks,
+		RemoteSize: r.Size, RemoteModTime: r.Modified,
+	}
+	return nil
+}
+
+// scan walks the local folder. Files whose size and modification time
+// match the state database keep their recorded hashes, the others are
+// hashed again.
+func (s *Syncer) scan(st *state) (map[string]*localFile, error) {
+	files := make(map[string]*localFile)
+	err := filepath.Walk(s.Local, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Name() == StateFile || strings.HasSuffix(info.Name(), partSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Local, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		l := &localFile{size: info.Size(), modTime: info.ModTime()}
+		if e := st.Files[name]; e != nil && e.Size == l.size && e.ModTime.Equal(l.modTime) && e.Blocks != nil {
+			l.hash, l.blocks = e.Hash, e.Blocks
+		} else if l.hash, l.blocks, err = hashFile(p, s.BlockSize); err != nil {
+			return err
+		}
+		files[name] = l
+		return nil
+	})
+	return files, err
+}
+
+// list returns the remote files by their names relative to Remote.
+func (s *Syncer) list(ctx context.Context) (map[string]*client.FileInfo, error) {
+	infos, err := s.Client.List(ctx, s.Remote, true)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*client.FileInfo)
+	for i := range infos {
+		if infos[i].Dir || !validName(infos[i].Name) {
+			continue
+		}
+		files[infos[i].Name] = &infos[i]
+	}
+	return files, nil
+}
+
+// Watch syncs until ctx is done: at once, soon after the server reports a
+// change below Remote, and every interval to pick up local changes. A
+// failed sync is passed to OnError and tried again the next time.
+func (s *Syncer) Watch(ctx context.Context, interval time.Duration) error {
+	changed := make(chan struct{}, 1)
+	go s.watchRemote(ctx, interval, changed)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sync(ctx); err != nil && ctx.Err() == nil {
+			s.fail(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-changed:
+		}
+	}
+}
+
+// watchRemote signals changed for every remote event, reconnecting after
+// interval when the stream breaks.
+func (s *Syncer) watchRemote(ctx context.Context, interval time.Duration, changed chan<- struct{}) {
+	for {
+		err := s.Client.Watch(ctx, s.Remote, func(client.Event) error {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.fail(err)
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Syncer) localPath(name string) string {
+	return filepath.Join(s.Local, filepath.FromSlash(name))
+}
+
+func (s *Syncer) remotePath(name string) string {
+	return path.Join(s.Remote, name)
+}
+
+func (s *Syncer) report(action, name string) {
+	if s.Report != nil {
+		s.Report(action, name)
+	}
+}
+
+func (s *Syncer) fail(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+func (s *Syncer) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+// validName reports whether a remote name stays inside the local folder.
+func validName(name string) bool {
+	return name != "" && path.Clean(name) == name && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../") && name != StateFile
+}
+
+// conflictName returns the name the local copy of a conflicting file is
+// kept under, like "notes (conflict 2020-05-01 120000).txt".
+func conflictName(name string, now time.Time) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" || strings.HasSuffix(base, "/") {
+		base, ext = name, ""
+	}
+	return base + " (conflict " + now.Format("2006-01-02 150405") + ")" + ext
+}
@@ -0,0 +1,198 @@
+package syncdir
+
+import (
+	"bytes"
+	"context"
+	"github.com/huangjiahua/tempdesk/internal/auth"
+	"github.com/huangjiahua/tempdesk/internal/event"
+	thttp "github.com/huangjiahua/tempdesk/internal/http"
+	"github.com/huangjiahua/tempdesk/internal/http/handler"
+	"github.com/huangjiahua/tempdesk/internal/mock"
+	"github.com/huangjiahua/tempdesk/internal/testutil"
+	"github.com/huangjiahua/tempdesk/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newServer serves the user, file and watch handlers, counting the ranged
+// PUT requests in patches, and returns a client signed up as sam.
+func newServer(t *testing.T, patches *int32) *client.Client {
+	bus := event.NewBus()
+	state := &thttp.State{
+		Users:  mock.NewUserService(),
+		Files:  event.NewFileService(mock.NewFileService(), bus),
+		Auther: auth.NewHMACAuther(),
+		Events: bus,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/user/", handler.NewUser(state))
+	mux.Handle("/file/", handler.NewFile(state, "/file"))
+	mux.Handle("/watch/", handler.NewWatch(state, "/watch"))
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPut && req.Header.Get("Content-Range") != "" && patches != nil {
+			atomic.AddInt32(patches, 1)
+		}
+		mux.ServeHTTP(res, req)
+	}))
+	t.Cleanup(ts.Close)
+
+	c := client.New(ts.URL, "sam", "key")
+	c.Backoff = time.Millisecond
+	if err := c.CreateUser(context.Background(), "sam", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, dir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(data)
+}
+
+func remoteFile(t *testing.T, c *client.Client, p string) string {
+	var buf bytes.Buffer
+	if _, err := c.Download(context.Background(), p, &buf, nil); err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return buf.String()
+}
+
+func TestSyncer_Sync(t *testing.T) {
+	c := newServer(t, nil)
+	ctx := context.Background()
+	a, b := New(c, testutil.TempDir(t), "/sync"), New(c, testutil.TempDir(t), "/sync")
+	b.Now = func() time.Time { return time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	writeFile(t, a.Local, "notes.txt", "first")
+	writeFile(t, a.Local, "docs/plan.md", "plan")
+	assert.Nil(t, a.Sync(ctx))
+	assert.Equal(t, "plan", remoteFile(t, c, "/sync/docs/plan.md"))
+	assert.Nil(t, b.Sync(ctx))
+	assert.Equal(t, "first", readFile(t, b.Local, "notes.txt"))
+	assert.Equal(t, "plan", readFile(t, b.Local, "docs/plan.md"))
+
+	var actions []string
+	a.Report = func(action, name string) { actions = append(actions, action+" "+name) }
+	assert.Nil(t, a.Sync(ctx))
+	assert.Empty(t, actions, "nothing changed")
+
+	writeFile(t, b.Local, "notes.txt", "second")
+	assert.Nil(t, b.Sync(ctx))
+	assert.Nil(t, a.Sync(ctx))
+	assert.Equal(t, "second", readFile(t, a.Local, "notes.txt"))
+	assert.Equal(t, []string{"download notes.txt"}, actions)
+
+	actions = nil
+	assert.Nil(t, os.Remove(filepath.Join(a.Local, "docs", "plan.md")))
+	assert.Nil(t, a.Sync(ctx))
+	assert.Equal(t, []string{"remove remote docs/plan.md"}, actions)
+	assert.Nil(t, b.Sync(ctx))
+	_, err := os.Stat(filepath.Join(b.Local, "docs", "plan.md"))
+	assert.True(t, os.IsNotExist(err), "removed on the other side")
+
+	writeFile(t, a.Local, "notes.txt", "from a")
+	writeFile(t, b.Local, "notes.txt", "from b")
+	assert.Nil(t, a.Sync(ctx))
+	assert.Nil(t, b.Sync(ctx))
+	assert.Equal(t, "from a", readFile(t, b.Local, "notes.txt"))
+	assert.Equal(t, "from b", readFile(t, b.Local, "notes (conflict 2020-05-01 120000).txt"))
+	assert.Nil(t, a.Sync(ctx))
+	assert.Equal(t, "from b", readFile(t, a.Local, "notes (conflict 2020-05-01 120000).txt"))
+
+	writeFile(t, a.Local, "same.txt", "same")
+	writeFile(t, b.Local, "same.txt", "same")
+	assert.Nil(t, a.Sync(ctx))
+	actions = nil
+	b.Report = a.Report
+	assert.Nil(t, b.Sync(ctx))
+	assert.Empty(t, actions, "equal files are no conflict")
+}
+
+func TestSyncer_Patch(t *testing.T) {
+	var patches int32
+	c := newServer(t, &patches)
+	ctx := context.Background()
+	s := New(c, testutil.TempDir(t), "/")
+	s.BlockSize = 4
+
+	writeFile(t, s.Local, "blocks", "aaaabbbbccccdddd")
+	assert.Nil(t, s.Sync(ctx))
+	assert.Equal(t, int32(0), patches)
+
+	var actions []string
+	s.Report = func(action, name string) { actions = append(actions, action+" "+name) }
+	writeFile(t, s.Local, "blocks", "aaaaBBBBccccdddd")
+	assert.Nil(t, s.Sync(ctx))
+	assert.Equal(t, int32(1), patches, "only the changed block is sent")
+	assert.Equal(t, []string{"patch blocks"}, actions)
+	assert.Equal(t, "aaaaBBBBccccdddd", remoteFile(t, c, "/blocks"))
+
+	writeFile(t, s.Local, "blocks", "aaaaBBBBcc")
+	assert.Nil(t, s.Sync(ctx))
+	assert.Equal(t, int32(2), patches)
+	assert.Equal(t, "aaaaBBBBcc", remoteFile(t, c, "/blocks"))
+
+	writeFile(t, s.Local, "blocks", "aaaaBBBB")
+	assert.Nil(t, s.Sync(ctx))
+	assert.Equal(t, "aaaaBBBB", remoteFile(t, c, "/blocks"), "a file that only shrank is cut")
+}
+
+func TestSyncer_Watch(t *testing.T) {
+	c := newServer(t, nil)
+	s := New(c, testutil.TempDir(t), "/sync")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Watch(ctx, time.Hour) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// wait for the first sync, then let a remote change bring the next. The
+	// upload is repeated as the event stream may not be subscribed yet.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(s.Local, StateFile)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no first sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for readFile(t, s.Local, "news.txt") != "hello" {
+		if time.Now().After(deadline) {
+			t.Fatal("remote change not synced")
+		}
+		_ = c.Upload(ctx, "/sync/news.txt", strings.NewReader("hello"), 5, nil)
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, "a/b (conflict 2020-05-01 120000).txt", conflictName("a/b.txt", now))
+	assert.Equal(t, "a/.env (conflict 2020-05-01 120000)", conflictName("a/.env", now))
+	assert.Equal(t, "README (conflict 2020-05-01 120000)", conflictName("README", now))
+}
@@ -1,10 +1,37 @@
 package tempdesk
 
+import "strconv"
+
 const (
 	NameAlreadyExists string = "name already exists"
 	NameNotExists     string = "name not exists"
 )
 
+const (
+	// MetaRole is the User.Meta key holding the role of a user.
+	MetaRole  = "role"
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+
+	// MetaDisabled is set to "true" for users who may not log in.
+	MetaDisabled = "disabled"
+	// MetaQuota holds the number of bytes a user may store, no limit if
+	// it is missing.
+	MetaQuota = "quota"
+	// MetaPending is set to "true" for users who signed up and wait for an
+	// admin to approve them, they may not log in until then.
+	MetaPending = "pending"
+	// MetaEmail holds the email address of a user.
+	MetaEmail = "email"
+	// MetaEmailVerified is set to "true" once the user proved to own the
+	// address in MetaEmail.
+	MetaEmailVerified = "email_verified"
+)
+
+// NameSymbols may appear in the name of a user or a group besides letters
+// and digits, though not first.
+const NameSymbols = "._-@"
+
 type User struct {
 	ID   int
 	Name string
@@ -12,6 +39,47 @@ type User struct {
 	Meta map[string]string
 }
 
+// Copy returns u with a Meta map of its own, so a service never shares the
+// map of a stored user with its callers.
+func (u User) Copy() User {
+	if u.Meta == nil {
+		return u
+	}
+	meta := make(map[string]string, len(u.Meta))
+	for k, v := range u.Meta {
+		meta[k] = v
+	}
+	u.Meta = meta
+	return u
+}
+
+func (u User) IsAdmin() bool {
+	return u.Meta[MetaRole] == RoleAdmin
+}
+
+func (u User) IsDisabled() bool {
+	return u.Meta[MetaDisabled] == "true"
+}
+
+func (u User) IsPending() bool {
+	return u.Meta[MetaPending] == "true"
+}
+
+func (u User) Email() string {
+	return u.Meta[MetaEmail]
+}
+
+func (u User) IsEmailVerified() bool {
+	return u.Email() != "" && u.Meta[MetaEmailVerified] == "true"
+}
+
+// Quota returns the number of bytes u may store, ok is false if u has no
+// quota or it cannot be read.
+func (u User) Quota() (quota int64, ok bool) {
+	q, err := strconv.ParseInt(u.Meta[MetaQuota], 10, 64)
+	return q, err == nil && q >= 0
+}
+
 type UserService interface {
 	User(name string) (user User, ok bool)
 	CreateUser(user User) (err error)
@@ -19,6 +87,26 @@ type UserService interface {
 	DeleteUser(user User) (err error)
 }
 
+// UserLister is implemented by a UserService that can list its users.
+type UserLister interface {
+	Users() (users []User, err error)
+}
+
+// Lister looks through wrappers of us, which have an Unwrap method, for a
+// UserService that can list its users.
+func Lister(us UserService) (UserLister, bool) {
+	for {
+		if l, ok := us.(UserLister); ok {
+			return l, true
+		}
+		u, ok := us.(interface{ Unwrap() UserService })
+		if !ok {
+			return nil, false
+		}
+		us = u.Unwrap()
+	}
+}
+
 type UserServiceError struct {
 	Kind string
 	Err  error